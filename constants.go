@@ -25,6 +25,9 @@ const (
 	// to bypass firewall restrictions
 	ComponentReverseTunnel = "reversetunnel"
 
+	// ComponentAuth is auth server SSH tunnel
+	ComponentAuth = "auth"
+
 	// ComponentNode is SSH node (SSH server serving requests)
 	ComponentNode = "node"
 
@@ -39,4 +42,24 @@ const (
 
 	// DebugOutputEnvVar tells tests to use verbose debug output
 	DebugOutputEnvVar = "TELEPORT_DEBUG_TESTS"
+
+	// KeyTTLEnvVar sets the default lifetime of client keys, e.g. "8h"
+	KeyTTLEnvVar = "TELEPORT_KEY_TTL"
+
+	// KeyGracePeriodEnvVar sets how long client keys stay usable after
+	// they expire before they are removed, e.g. "30s"
+	KeyGracePeriodEnvVar = "TELEPORT_KEY_GRACE_PERIOD"
+
+	// KeyStoreEnvVar selects where client keys are stored, "file"
+	// (default) or "keyring"
+	KeyStoreEnvVar = "TELEPORT_KEYSTORE"
+
+	// HostSignersFileEnvVar sets a name of the file in the keys directory
+	// that stores trusted host certificate authorities, so separate client
+	// contexts sharing the directory don't share trust
+	HostSignersFileEnvVar = "TELEPORT_HOST_SIGNERS_FILE"
+
+	// KeyPassphraseEnvVar sets a passphrase that encrypts private keys
+	// of host identities in the data dir
+	KeyPassphraseEnvVar = "TELEPORT_KEY_PASSPHRASE"
 )
@@ -50,6 +50,16 @@ func (e *AlreadyAcquiredError) OrigError() error {
 	return e
 }
 
+// IsAlreadyAcquired returns whether this error indicates that the lock
+// is held by someone else
+func IsAlreadyAcquired(e error) bool {
+	type aa interface {
+		IsAlreadyAcquiredError() bool
+	}
+	_, ok := e.(aa)
+	return ok
+}
+
 // NotFound returns new instance of not found error
 func NotFound(message string) *NotFoundError {
 	return &NotFoundError{
@@ -164,6 +174,20 @@ func IsMissingParameter(e error) bool {
 	return ok
 }
 
+// Code is a machine readable code of an error that lets API consumers
+// tell error categories apart without parsing messages
+type Code string
+
+const (
+	// CodeInvalidListenAddr means that a network address can't be parsed
+	CodeInvalidListenAddr Code = "invalid_listen_addr"
+	// CodeUnsupportedBackend means that a storage backend type is unknown
+	CodeUnsupportedBackend Code = "unsupported_backend"
+	// CodeUnknownConfigKey means that a configuration file has a key
+	// teleport does not know about
+	CodeUnknownConfigKey Code = "unknown_config_key"
+)
+
 // BadParameter returns a new instance of BadParameterError
 func BadParameter(name, message string) *BadParameterError {
 	return &BadParameterError{
@@ -172,12 +196,29 @@ func BadParameter(name, message string) *BadParameterError {
 	}
 }
 
+// BadParameterWithCode returns a new instance of BadParameterError
+// with a machine readable error code
+func BadParameterWithCode(code Code, name, message string) *BadParameterError {
+	return &BadParameterError{
+		Param: name,
+		Err:   message,
+		Code:  code,
+	}
+}
+
 // BadParameterError indicates that something is wrong with passed
 // parameter to API method
 type BadParameterError struct {
 	trace.Traces
 	Param string `json:"param"`
 	Err   string `json:"message"`
+	// Code is an optional machine readable error code
+	Code Code `json:"code,omitempty"`
+}
+
+// ErrorCode returns machine readable error code
+func (b *BadParameterError) ErrorCode() Code {
+	return b.Code
 }
 
 // Error returrns debug friendly message
@@ -204,6 +245,29 @@ func IsBadParameter(e error) bool {
 	return ok
 }
 
+// ErrorCode returns machine readable code of the error or an empty
+// string if the error has none. Errors wrapped with trace.Wrap keep
+// their codes
+func ErrorCode(err error) Code {
+	type coder interface {
+		ErrorCode() Code
+	}
+	for i := 0; i < maxErrorHops && err != nil; i++ {
+		if c, ok := err.(coder); ok {
+			return c.ErrorCode()
+		}
+		wrapper, ok := err.(trace.Error)
+		if !ok || wrapper.OrigError() == err {
+			break
+		}
+		err = wrapper.OrigError()
+	}
+	return ""
+}
+
+// maxErrorHops limits the depth of wrapped errors ErrorCode looks into
+const maxErrorHops = 50
+
 // CompareFailedError indicates that compare failed (e.g wrong password or hash)
 type CompareFailedError struct {
 	trace.Traces
@@ -0,0 +1,75 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package teleport
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/gravitational/trace"
+	. "gopkg.in/check.v1"
+)
+
+func TestErrors(t *testing.T) { TestingT(t) }
+
+type ErrorsSuite struct {
+}
+
+var _ = Suite(&ErrorsSuite{})
+
+func (s *ErrorsSuite) TestErrorCode(c *C) {
+	err := BadParameterWithCode(CodeInvalidListenAddr, "listen_addr", "bad address")
+	c.Assert(ErrorCode(err), Equals, CodeInvalidListenAddr)
+	c.Assert(err.Error(), Equals, "bad parameter 'listen_addr', bad address")
+
+	// code is preserved through wrapping
+	wrapped := trace.Wrap(trace.Wrap(err))
+	c.Assert(ErrorCode(wrapped), Equals, CodeInvalidListenAddr)
+	c.Assert(IsBadParameter(wrapped), Equals, true)
+
+	// and through wrapping by a trace error
+	wrapped = trace.Wrap(&wrapper{err: err})
+	c.Assert(ErrorCode(wrapped), Equals, CodeInvalidListenAddr)
+
+	// and through JSON encoding used by the API
+	data, err2 := json.Marshal(err)
+	c.Assert(err2, IsNil)
+	var decoded BadParameterError
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(ErrorCode(&decoded), Equals, CodeInvalidListenAddr)
+
+	// errors without codes
+	c.Assert(ErrorCode(nil), Equals, Code(""))
+	c.Assert(ErrorCode(BadParameter("name", "msg")), Equals, Code(""))
+	c.Assert(ErrorCode(trace.Wrap(fmt.Errorf("plain"))), Equals, Code(""))
+	c.Assert(ErrorCode(NotFound("missing")), Equals, Code(""))
+}
+
+// wrapper is an error that is not a trace setter, so trace.Wrap
+// puts it inside a trace error
+type wrapper struct {
+	err error
+}
+
+func (w *wrapper) Error() string {
+	return w.err.Error()
+}
+
+func (w *wrapper) OrigError() error {
+	return w.err
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package auth
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -25,6 +26,8 @@ import (
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/httplib"
+	"github.com/gravitational/teleport/lib/metrics"
 	"github.com/gravitational/teleport/lib/recorder"
 	"github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/teleport/lib/utils"
@@ -35,10 +38,13 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// APIWithRoles serves the auth API to authenticated clients, every
+// client gets an API server bound to its role and identity
 type APIWithRoles struct {
 	config    APIConfig
-	listeners map[teleport.Role]*fakeSocket
-	servers   map[teleport.Role]*APIServer
+	roles     map[teleport.Role]bool
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // APIConfig is a configuration file
@@ -52,56 +58,105 @@ type APIConfig struct {
 }
 
 func NewAPIWithRoles(config APIConfig) *APIWithRoles {
-
-	api := APIWithRoles{}
-	api.listeners = make(map[teleport.Role]*fakeSocket)
-	api.servers = make(map[teleport.Role]*APIServer)
-
+	api := APIWithRoles{
+		config: config,
+		roles:  make(map[teleport.Role]bool),
+		closed: make(chan struct{}),
+	}
 	for _, role := range config.Roles {
-		a := AuthWithRoles{
-			authServer:  config.AuthServer,
-			elog:        config.EventLog,
-			sessions:    config.SessionService,
-			recorder:    config.Recorder,
-			permChecker: config.PermissionChecker,
-			role:        role,
-		}
-		api.servers[role] = NewAPIServer(&a)
-		api.listeners[role] = makefakeSocket()
+		api.roles[role] = true
 	}
 	return &api
 }
 
+// Serve blocks until the API is closed, connections are served
+// by HandleNewChannel as they come
 func (api *APIWithRoles) Serve() {
-	wg := sync.WaitGroup{}
-	for role := range api.listeners {
-		wg.Add(1)
-		go func(listener net.Listener, handler http.Handler) {
-			if err := http.Serve(listener, handler); (err != nil) && (err != io.EOF) {
-				log.Errorf(err.Error())
-			}
-		}(api.listeners[role], api.servers[role])
+	<-api.closed
+}
+
+// RoleHandler returns the HTTP handler of the API server for the client
+// authenticated as user with the role, so the API can be served by
+// listeners that authenticate clients on their own instead of the SSH
+// tunnel. Hosts are authenticated as their principal, e.g. "uuid.example.com"
+func (api *APIWithRoles) RoleHandler(role teleport.Role, user string) (http.Handler, error) {
+	if !api.roles[role] {
+		return nil, trace.Wrap(teleport.BadParameter("role", fmt.Sprintf("no API server for role '%v'", role)))
+	}
+	a := NewAuthWithRoles(api.config.AuthServer, api.config.PermissionChecker,
+		api.config.EventLog, api.config.SessionService, role, user, api.config.Recorder)
+	return metrics.InstrumentHandler(metrics.AuthRequests, role.String(), NewAPIServer(a)), nil
+}
+
+// ClientCertHandler returns the HTTP handler that serves every request with
+// the role from the organization of the verified TLS client certificate
+// and the user from its common name, the TLS listener has to require and
+// verify client certificates. Admin and Auth roles are never granted over it
+func (api *APIWithRoles) ClientCertHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, user, err := clientCertIdentity(r)
+		if err != nil {
+			log.Warningf("[AUTH] refused request from %v: %v", r.RemoteAddr, err)
+			httplib.ReplyError(w, err)
+			return
+		}
+		handler, err := api.RoleHandler(role, user)
+		if err != nil {
+			httplib.ReplyError(w, teleport.AccessDenied(err.Error()))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// clientCertIdentity returns the role and the user from the verified TLS
+// client certificate of the request
+func clientCertIdentity(r *http.Request) (teleport.Role, string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", "", teleport.AccessDenied("verified client certificate is required")
 	}
-	wg.Wait()
+	cert := r.TLS.VerifiedChains[0][0]
+	if len(cert.Subject.Organization) != 1 {
+		return "", "", teleport.AccessDenied(fmt.Sprintf(
+			"client certificate '%v' has to have exactly one organization with the role", cert.Subject.CommonName))
+	}
+	role := teleport.Role(cert.Subject.Organization[0])
+	if role == teleport.RoleAdmin || role == teleport.RoleAuth {
+		return "", "", teleport.AccessDenied(fmt.Sprintf(
+			"role '%v' can't be used with client certificates", role))
+	}
+	return role, cert.Subject.CommonName, nil
 }
 
 // HandleNewChannel is called when a new SSH channel (SSH connection) wants to communicate via HTTP API
-// to one of the API servers
-func (api *APIWithRoles) HandleNewChannel(remoteAddr net.Addr, channel ssh.Channel, role teleport.Role) error {
-	// find a listener mapped to the requested role:
-	listener, ok := api.listeners[role]
-	if !ok {
+// of the client authenticated as user with the role
+func (api *APIWithRoles) HandleNewChannel(remoteAddr net.Addr, channel ssh.Channel, role teleport.Role, user string) error {
+	select {
+	case <-api.closed:
 		channel.Close()
-		return trace.Errorf("no such role '%v'", role)
+		return trace.Wrap(teleport.ConnectionProblem("auth API is closed", nil))
+	default:
+	}
+	handler, err := api.RoleHandler(role, user)
+	if err != nil {
+		channel.Close()
+		return trace.Wrap(err)
 	}
 	// create a bridge between the incoming SSH channel to the HTTP-based API server
+	listener := makefakeSocket()
+	defer listener.Close()
+	go func() {
+		if err := http.Serve(listener, handler); (err != nil) && (err != io.EOF) {
+			log.Errorf(err.Error())
+		}
+	}()
 	return listener.CreateBridge(remoteAddr, channel)
 }
 
 func (api *APIWithRoles) Close() {
-	for _, listener := range api.listeners {
-		listener.Close()
-	}
+	api.closeOnce.Do(func() {
+		close(api.closed)
+	})
 }
 
 // Implements a fake "socket" (net.Listener interface) on top of exisitng ssh.Channel
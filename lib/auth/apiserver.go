@@ -17,7 +17,9 @@ limitations under the License.
 package auth
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -65,10 +67,13 @@ func NewAPIServer(a *AuthWithRoles) *APIServer {
 	srv.POST("/v1/authorities/:type", httplib.MakeHandler(srv.upsertCertAuthority))
 	srv.DELETE("/v1/authorities/:type/:domain", httplib.MakeHandler(srv.deleteCertAuthority))
 	srv.GET("/v1/authorities/:type", httplib.MakeHandler(srv.getCertAuthorities))
+	srv.POST("/v1/trusted/authorities", httplib.MakeHandler(srv.addTrustedUserCA))
+	srv.DELETE("/v1/trusted/authorities/:domain", httplib.MakeHandler(srv.removeTrustedUserCA))
 
 	// Generating certificates for user and host authorities
 	srv.POST("/v1/ca/host/certs", httplib.MakeHandler(srv.generateHostCert))
 	srv.POST("/v1/ca/user/certs", httplib.MakeHandler(srv.generateUserCert))
+	srv.POST("/v1/hosts/:host/certs", httplib.MakeHandler(srv.renewHostCert))
 
 	// Operations on users
 	srv.GET("/v1/users", httplib.MakeHandler(srv.getUsers))
@@ -104,12 +109,15 @@ func NewAPIServer(a *AuthWithRoles) *APIServer {
 
 	// Tokens
 	srv.POST("/v1/tokens", httplib.MakeHandler(srv.generateToken))
+	srv.GET("/v1/tokens", httplib.MakeHandler(srv.listTokens))
+	srv.DELETE("/v1/tokens/:token", httplib.MakeHandler(srv.revokeToken))
 	srv.POST("/v1/tokens/register", httplib.MakeHandler(srv.registerUsingToken))
 	srv.POST("/v1/tokens/register/auth", httplib.MakeHandler(srv.registerNewAuthServer))
 
 	// Events
 	srv.POST("/v1/events", httplib.MakeHandler(srv.submitEvents))
 	srv.GET("/v1/events", httplib.MakeHandler(srv.getEvents))
+	srv.GET("/v1/events/stream", httplib.MakeHandler(srv.streamEvents))
 
 	srv.POST("/v1/events/sessions", httplib.MakeHandler(srv.logSessionEvents))
 	srv.GET("/v1/events/sessions", httplib.MakeHandler(srv.getSessionEvents))
@@ -399,6 +407,23 @@ func (s *APIServer) generateHostCert(w http.ResponseWriter, r *http.Request, _ h
 	return string(cert), nil
 }
 
+type renewHostCertReq struct {
+	Key  []byte        `json:"key"`
+	Role teleport.Role `json:"role"`
+}
+
+func (s *APIServer) renewHostCert(w http.ResponseWriter, r *http.Request, p httprouter.Params) (interface{}, error) {
+	var req *renewHostCertReq
+	if err := httplib.ReadJSON(r, &req); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	cert, err := s.a.RenewHostCert(p[0].Value, req.Role, req.Key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return string(cert), nil
+}
+
 type generateUserCertReq struct {
 	Key  []byte        `json:"key"`
 	User string        `json:"user"`
@@ -420,8 +445,9 @@ func (s *APIServer) generateUserCert(w http.ResponseWriter, r *http.Request, _ h
 }
 
 type generateTokenReq struct {
-	Role teleport.Role `json:"role"`
-	TTL  time.Duration `json:"ttl"`
+	Role    teleport.Role `json:"role"`
+	TTL     time.Duration `json:"ttl"`
+	MaxUses int           `json:"max_uses"`
 }
 
 func (s *APIServer) generateToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
@@ -429,13 +455,28 @@ func (s *APIServer) generateToken(w http.ResponseWriter, r *http.Request, _ http
 	if err := httplib.ReadJSON(r, &req); err != nil {
 		return nil, trace.Wrap(err)
 	}
-	token, err := s.a.GenerateToken(req.Role, req.TTL)
+	token, err := s.a.GenerateTokenWithUses(req.Role, req.TTL, req.MaxUses)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 	return string(token), nil
 }
 
+func (s *APIServer) listTokens(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
+	tokens, err := s.a.ListTokens()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return tokens, nil
+}
+
+func (s *APIServer) revokeToken(w http.ResponseWriter, r *http.Request, p httprouter.Params) (interface{}, error) {
+	if err := s.a.RevokeToken(p[0].Value); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return message("token revoked"), nil
+}
+
 type registerUsingTokenReq struct {
 	HostID string        `json:"hostID"`
 	Role   teleport.Role `json:"role"`
@@ -447,13 +488,20 @@ func (s *APIServer) registerUsingToken(w http.ResponseWriter, r *http.Request, _
 	if err := httplib.ReadJSON(r, &req); err != nil {
 		return nil, trace.Wrap(err)
 	}
-	keys, err := s.a.RegisterUsingToken(req.Token, req.HostID, req.Role)
+	keys, err := s.a.RegisterUsingTokenFrom(req.Token, req.HostID, req.Role, remoteAddr(r))
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 	return keys, nil
 }
 
+// remoteAddr returns the address of the client that sent the request,
+// requests coming through the SSH tunnel carry the address of the
+// tunnel client
+func remoteAddr(r *http.Request) net.Addr {
+	return &utils.NetAddr{AddrNetwork: "tcp", Addr: r.RemoteAddr}
+}
+
 type registerNewAuthServerReq struct {
 	Token string `json:"token"`
 }
@@ -463,7 +511,7 @@ func (s *APIServer) registerNewAuthServer(w http.ResponseWriter, r *http.Request
 	if err := httplib.ReadJSON(r, &req); err != nil {
 		return nil, trace.Wrap(err)
 	}
-	err := s.a.RegisterNewAuthServer(req.Token)
+	err := s.a.RegisterNewAuthServerFrom(req.Token, remoteAddr(r))
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -520,6 +568,42 @@ func (s *APIServer) getEvents(w http.ResponseWriter, r *http.Request, _ httprout
 	return events, nil
 }
 
+// streamEvents writes all events logged after the optional "since"
+// timestamp as newline delimited JSON, flushing after every event
+func (s *APIServer) streamEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
+	var since time.Time
+	if val := r.URL.Query().Get("since"); val != "" {
+		if err := since.UnmarshalText([]byte(val)); err != nil {
+			return nil, trace.Wrap(teleport.BadParameter("since", err.Error()))
+		}
+	}
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	written := false
+	err := s.a.IterateEvents(since, func(e lunk.Entry) error {
+		if !written {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			written = true
+		}
+		if err := encoder.Encode(e); err != nil {
+			return trace.Wrap(err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !written {
+			return nil, trace.Wrap(err)
+		}
+		// the response has already started, so the client
+		// will only see a truncated stream
+		log.Errorf("failed to stream events: %v", err)
+	}
+	return nil, nil
+}
+
 func (s *APIServer) getSessionEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
 	f, err := events.FilterFromURL(r.URL.Query())
 	if err != nil {
@@ -640,6 +724,28 @@ func (s *APIServer) deleteCertAuthority(w http.ResponseWriter, r *http.Request,
 	return message(fmt.Sprintf("cert '%v' deleted", id)), nil
 }
 
+type addTrustedUserCAReq struct {
+	CA services.CertAuthority `json:"ca"`
+}
+
+func (s *APIServer) addTrustedUserCA(w http.ResponseWriter, r *http.Request, p httprouter.Params) (interface{}, error) {
+	var req *addTrustedUserCAReq
+	if err := httplib.ReadJSON(r, &req); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := s.a.AddTrustedUserCA(req.CA); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return message("ok"), nil
+}
+
+func (s *APIServer) removeTrustedUserCA(w http.ResponseWriter, r *http.Request, p httprouter.Params) (interface{}, error) {
+	if err := s.a.RemoveTrustedUserCA(p[0].Value); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return message(fmt.Sprintf("trusted authority '%v' removed", p[0].Value)), nil
+}
+
 type createSessionReq struct {
 	Session session.Session `json:"session"`
 }
@@ -18,6 +18,7 @@ package auth
 
 import (
 	"net/http/httptest"
+	"net/url"
 	"path/filepath"
 	"testing"
 	"time"
@@ -33,6 +34,7 @@ import (
 	rtest "github.com/gravitational/teleport/lib/recorder/test"
 	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/session"
+	"github.com/gravitational/teleport/lib/sshutils"
 	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/gokyle/hotp"
@@ -154,6 +156,63 @@ func (s *APISuite) TestGenerateUserCert(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *APISuite) TestTrustedUserCA(c *C) {
+	partner := authority.New()
+	partnerPriv, partnerPub, err := partner.GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	_, userPub, err := partner.GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	certBytes, err := partner.GenerateUserCert(partnerPriv, userPub, "alice", []string{"alice"}, time.Hour)
+	c.Assert(err, IsNil)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	c.Assert(err, IsNil)
+	cert := key.(*ssh.Certificate)
+
+	// checker looks up user authorities on every check, the way nodes do
+	checker := ssh.CertChecker{IsAuthority: func(auth ssh.PublicKey) bool {
+		cas, err := s.clt.GetCertAuthorities(services.UserCA)
+		c.Assert(err, IsNil)
+		for _, ca := range cas {
+			checkers, err := ca.Checkers()
+			c.Assert(err, IsNil)
+			for _, checker := range checkers {
+				if sshutils.KeysEqual(checker, auth) {
+					return true
+				}
+			}
+		}
+		return false
+	}}
+	c.Assert(checker.CheckCert("alice", cert), NotNil)
+
+	ca := services.CertAuthority{
+		Type:         services.UserCA,
+		DomainName:   "partner.example.com",
+		CheckingKeys: [][]byte{partnerPub},
+	}
+	c.Assert(s.clt.AddTrustedUserCA(ca), IsNil)
+	c.Assert(checker.CheckCert("alice", cert), IsNil)
+
+	// domain names are compared case-insensitively
+	c.Assert(s.clt.RemoveTrustedUserCA("Partner.Example.com"), IsNil)
+	c.Assert(checker.CheckCert("alice", cert), NotNil)
+
+	// private keys of remote authorities are not accepted
+	withSigningKeys := ca
+	withSigningKeys.SigningKeys = [][]byte{partnerPriv}
+	c.Assert(s.clt.AddTrustedUserCA(withSigningKeys), NotNil)
+
+	// the local authority can't be replaced
+	local := ca
+	local.DomainName = "LocalHost"
+	c.Assert(s.clt.AddTrustedUserCA(local), NotNil)
+	c.Assert(s.clt.RemoveTrustedUserCA("localhost"), NotNil)
+
+	hostCA := ca
+	hostCA.Type = services.HostCA
+	c.Assert(s.clt.AddTrustedUserCA(hostCA), NotNil)
+}
+
 func (s *APISuite) TestKeysCRUD(c *C) {
 	c.Assert(s.clt.UpsertCertAuthority(
 		*services.NewTestCA(services.UserCA, "localhost"), backend.Forever), IsNil)
@@ -342,6 +401,14 @@ func (s *APISuite) TestEvents(c *C) {
 	suite.EventsCRUD(c)
 }
 
+func (s *APISuite) TestIterateEvents(c *C) {
+	suite := etest.EventSuite{L: s.clt}
+	suite.IterateEvents(c)
+
+	_, err := s.clt.Get(s.clt.Endpoint("events", "stream"), url.Values{"since": []string{"yesterday"}})
+	c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf("%#v", err))
+}
+
 func (s *APISuite) TestSessionEvents(c *C) {
 	suite := etest.EventSuite{L: s.clt}
 	suite.SessionsCRUD(c)
@@ -356,6 +423,20 @@ func (s *APISuite) TestTokens(c *C) {
 	out, err := s.clt.GenerateToken("Node", 0)
 	c.Assert(err, IsNil)
 	c.Assert(len(out), Not(Equals), 0)
+
+	tokens, err := s.clt.ListTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 1)
+	c.Assert(tokens[0].Token, Equals, out)
+	c.Assert(tokens[0].Role, Equals, "Node")
+
+	c.Assert(s.clt.RevokeToken(out), IsNil)
+	tokens, err = s.clt.ListTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 0)
+
+	err = s.clt.RevokeToken(out)
+	c.Assert(teleport.IsNotFound(err), Equals, true)
 }
 
 func (s *APISuite) TestSharedSessions(c *C) {
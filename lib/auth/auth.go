@@ -25,6 +25,7 @@ package auth
 
 import (
 	"fmt"
+	"net"
 
 	"os"
 	"time"
@@ -209,6 +210,12 @@ func (s *AuthServer) CreateWebSession(user string, prevSessionID string) (*Sessi
 }
 
 func (s *AuthServer) GenerateToken(role teleport.Role, ttl time.Duration) (string, error) {
+	return s.GenerateTokenWithUses(role, ttl, 0)
+}
+
+// GenerateTokenWithUses generates provisioning token that can be used to
+// register up to maxUses servers, zero means the token can be used once
+func (s *AuthServer) GenerateTokenWithUses(role teleport.Role, ttl time.Duration, maxUses int) (string, error) {
 	if err := role.Check(); err != nil {
 		return "", trace.Wrap(err)
 	}
@@ -220,7 +227,7 @@ func (s *AuthServer) GenerateToken(role teleport.Role, ttl time.Duration) (strin
 	if err != nil {
 		return "", err
 	}
-	if err := s.ProvisioningService.UpsertToken(token, string(role), ttl); err != nil {
+	if err := s.ProvisioningService.UpsertTokenWithUses(token, string(role), ttl, maxUses); err != nil {
 		return "", err
 	}
 	return outputToken, nil
@@ -261,7 +268,89 @@ func (s *AuthServer) GenerateServerKeys(hostID string, role teleport.Role) (*Pac
 	}, nil
 }
 
+// RenewHostCert signs a new public key of a host that has already joined
+// the cluster, so hosts can rotate their keys without a token
+func (s *AuthServer) RenewHostCert(hostID string, role teleport.Role, pub []byte) ([]byte, error) {
+	if hostID == "" {
+		return nil, trace.Wrap(teleport.BadParameter("hostID", "HostID cannot be empty"))
+	}
+	if err := role.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	fqdn := fmt.Sprintf("%s.%s", hostID, s.DomainName)
+	cert, err := s.GenerateHostCert(pub, fqdn, s.DomainName, role, 0)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	log.Infof("[AUTH] renewed %v certificate of `%v`", role, hostID)
+	return cert, nil
+}
+
+// AddTrustedUserCA starts trusting user certificates signed by the
+// authority of another cluster, the authority is used right away without
+// a restart. Only checking keys are accepted, as the private keys of
+// a remote authority should never leave it
+func (s *AuthServer) AddTrustedUserCA(ca services.CertAuthority) error {
+	if ca.Type != services.UserCA {
+		return trace.Wrap(teleport.BadParameter("type",
+			fmt.Sprintf("expected %v authority, got %v", services.UserCA, ca.Type)))
+	}
+	domainName, err := utils.NormalizeDomainName(ca.DomainName)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ca.DomainName = domainName
+	if err := utils.CheckDomainName(ca.DomainName); err != nil {
+		return trace.Wrap(err)
+	}
+	if ca.DomainName == s.DomainName {
+		return trace.Wrap(teleport.BadParameter("domain_name",
+			fmt.Sprintf("%v is the local authority domain", ca.DomainName)))
+	}
+	if len(ca.SigningKeys) != 0 {
+		return trace.Wrap(teleport.BadParameter("signing_keys",
+			"trusted authorities should have checking keys only"))
+	}
+	if len(ca.CheckingKeys) == 0 {
+		return trace.Wrap(teleport.BadParameter("checking_keys",
+			"trusted authority needs at least one checking key"))
+	}
+	if err := ca.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := s.UpsertCertAuthority(ca, backend.Forever); err != nil {
+		return trace.Wrap(err)
+	}
+	log.Infof("[AUTH] added trusted user authority %v", ca.DomainName)
+	return nil
+}
+
+// RemoveTrustedUserCA stops trusting user certificates of the authority
+// of another cluster added by AddTrustedUserCA
+func (s *AuthServer) RemoveTrustedUserCA(domainName string) error {
+	domainName, err := utils.NormalizeDomainName(domainName)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if domainName == s.DomainName {
+		return trace.Wrap(teleport.BadParameter("domain_name",
+			fmt.Sprintf("%v is the local authority domain", domainName)))
+	}
+	err = s.DeleteCertAuthority(services.CertAuthID{Type: services.UserCA, DomainName: domainName})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	log.Infof("[AUTH] removed trusted user authority %v", domainName)
+	return nil
+}
+
 func (s *AuthServer) RegisterUsingToken(outputToken, hostID string, role teleport.Role) (*PackedKeys, error) {
+	return s.RegisterUsingTokenFrom(outputToken, hostID, role, nil)
+}
+
+// RegisterUsingTokenFrom registers a server that connected from remoteAddr,
+// tokens restricted to some networks are rejected if remoteAddr is nil
+func (s *AuthServer) RegisterUsingTokenFrom(outputToken, hostID string, role teleport.Role, remoteAddr net.Addr) (*PackedKeys, error) {
 	log.Infof("[AUTH] Node `%v` is trying to join", hostID)
 	if hostID == "" {
 		return nil, trace.Wrap(fmt.Errorf("HostID cannot be empty"))
@@ -282,11 +371,18 @@ func (s *AuthServer) RegisterUsingToken(outputToken, hostID string, role telepor
 		return nil, trace.Wrap(
 			teleport.BadParameter("token.Role", "role does not match"))
 	}
+	if err := tok.CheckSource(remoteAddr); err != nil {
+		log.Warningf("[AUTH] Node `%v` cannot join: %v", hostID, err)
+		return nil, trace.Wrap(err)
+	}
+	// the token is used up only once the keys are generated, so a failure
+	// to generate them does not burn it
 	keys, err := s.GenerateServerKeys(hostID, role)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	if err := s.DeleteToken(outputToken); err != nil {
+	if _, err := s.ProvisioningService.UseToken(token); err != nil {
+		log.Warningf("[AUTH] Node `%v` cannot join: token error. %v", hostID, err)
 		return nil, trace.Wrap(err)
 	}
 	utils.Consolef(os.Stdout, "[AUTH] Node `%v` joined the cluster", hostID)
@@ -294,7 +390,12 @@ func (s *AuthServer) RegisterUsingToken(outputToken, hostID string, role telepor
 }
 
 func (s *AuthServer) RegisterNewAuthServer(outputToken string) error {
+	return s.RegisterNewAuthServerFrom(outputToken, nil)
+}
 
+// RegisterNewAuthServerFrom registers an auth server that connected from
+// remoteAddr, see RegisterUsingTokenFrom
+func (s *AuthServer) RegisterNewAuthServerFrom(outputToken string, remoteAddr net.Addr) error {
 	token, _, err := services.SplitTokenRole(outputToken)
 	if err != nil {
 		return trace.Wrap(err)
@@ -309,7 +410,12 @@ func (s *AuthServer) RegisterNewAuthServer(outputToken string) error {
 		return trace.Wrap(teleport.AccessDenied("role does not match"))
 	}
 
-	if err := s.DeleteToken(outputToken); err != nil {
+	if err := tok.CheckSource(remoteAddr); err != nil {
+		log.Warningf("[AUTH] auth server cannot join: %v", err)
+		return trace.Wrap(err)
+	}
+
+	if _, err := s.ProvisioningService.UseToken(token); err != nil {
 		return trace.Wrap(err)
 	}
 
@@ -324,6 +430,32 @@ func (s *AuthServer) DeleteToken(outputToken string) error {
 	return s.ProvisioningService.DeleteToken(token)
 }
 
+// ListTokens returns provisioning tokens that haven't been used or expired
+// yet, every token is returned in the form it was issued to the operator
+func (s *AuthServer) ListTokens() ([]services.ProvisionToken, error) {
+	tokens, err := s.ProvisioningService.GetTokens()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	for i := range tokens {
+		tokens[i].Token, err = services.JoinTokenRole(tokens[i].Token, tokens[i].Role)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	return tokens, nil
+}
+
+// RevokeToken deletes the provisioning token, so it can no longer be used
+// to add servers to the cluster
+func (s *AuthServer) RevokeToken(outputToken string) error {
+	if err := s.DeleteToken(outputToken); err != nil {
+		return trace.Wrap(err)
+	}
+	log.Infof("[AUTH] revoked provisioning token")
+	return nil
+}
+
 func (s *AuthServer) NewWebSession(userName string) (*Session, error) {
 	token, err := utils.CryptoRandomHex(WebSessionTokenLenBytes)
 	if err != nil {
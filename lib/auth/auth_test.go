@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 
 	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth/native"
 	authority "github.com/gravitational/teleport/lib/auth/testauthority"
 	"github.com/gravitational/teleport/lib/backend"
 	"github.com/gravitational/teleport/lib/backend/boltbk"
@@ -107,6 +108,133 @@ func (s *AuthSuite) TestTokensCRUD(c *C) {
 	c.Assert(err, NotNil)
 }
 
+func (s *AuthSuite) TestListRevokeTokens(c *C) {
+	tokens, err := s.a.ListTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 0)
+
+	c.Assert(s.a.UpsertToken("token1", services.TokenRoleNode, 0), IsNil)
+	c.Assert(s.a.UpsertToken("token2", services.TokenRoleAuth, 0), IsNil)
+	tokens, err = s.a.ListTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 2)
+	c.Assert(tokens[0].Token, Equals, "ntoken1")
+	c.Assert(tokens[0].Role, Equals, services.TokenRoleNode)
+	c.Assert(tokens[1].Token, Equals, "atoken2")
+	c.Assert(tokens[1].Role, Equals, services.TokenRoleAuth)
+
+	c.Assert(s.a.RevokeToken("ntoken1"), IsNil)
+	tokens, err = s.a.ListTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 1)
+	c.Assert(tokens[0].Token, Equals, "atoken2")
+
+	// revoked token can't be used to join the cluster
+	_, err = s.a.ValidateToken("ntoken1")
+	c.Assert(err, NotNil)
+}
+
+func (s *AuthSuite) TestTokenSources(c *C) {
+	c.Assert(s.a.UpsertCertAuthority(
+		*services.NewTestCA(services.HostCA, "localhost"), backend.Forever), IsNil)
+
+	networks, err := utils.ParseCIDRs([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+	c.Assert(s.a.UpsertTokenWithSources("token1", string(teleport.RoleNode), 0, 2, networks), IsNil)
+	inside := &utils.NetAddr{AddrNetwork: "tcp", Addr: "10.1.2.3:40000"}
+	outside := &utils.NetAddr{AddrNetwork: "tcp", Addr: "192.168.1.1:40000"}
+
+	// attempts from outside of the networks don't use the token up
+	_, err = s.a.RegisterUsingTokenFrom("ntoken1", "node1", teleport.RoleNode, outside)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true)
+	_, err = s.a.RegisterUsingTokenFrom("ntoken1", "node1", teleport.RoleNode, nil)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true)
+	_, err = s.a.RegisterUsingToken("ntoken1", "node1", teleport.RoleNode)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true)
+	tok, err := s.a.GetToken("token1")
+	c.Assert(err, IsNil)
+	c.Assert(tok.Uses, Equals, 0)
+	c.Assert(tok.AllowedSources, DeepEquals, []string{"10.0.0.0/8"})
+
+	_, err = s.a.RegisterUsingTokenFrom("ntoken1", "node1", teleport.RoleNode, inside)
+	c.Assert(err, IsNil)
+
+	// the same goes for auth servers
+	c.Assert(s.a.UpsertTokenWithSources("token2", string(teleport.RoleAuth), 0, 0, networks), IsNil)
+	c.Assert(teleport.IsAccessDenied(s.a.RegisterNewAuthServerFrom("atoken2", outside)), Equals, true)
+	c.Assert(s.a.RegisterNewAuthServerFrom("atoken2", inside), IsNil)
+
+	// tokens without sources can be used from anywhere
+	tokAny, err := s.a.GenerateToken(teleport.RoleNode, 0)
+	c.Assert(err, IsNil)
+	_, err = s.a.RegisterUsingTokenFrom(tokAny, "node2", teleport.RoleNode, outside)
+	c.Assert(err, IsNil)
+}
+
+func (s *AuthSuite) TestTokenMaxUses(c *C) {
+	// token with count 1 registers a single node
+	tok, err := s.a.GenerateTokenWithUses(teleport.RoleNode, 0, 1)
+	c.Assert(err, IsNil)
+
+	// failure to generate the keys does not use the token up, there is
+	// no host authority to sign the certificate yet
+	_, err = s.a.RegisterUsingToken(tok, "node1", teleport.RoleNode)
+	c.Assert(err, NotNil)
+	tokens, err := s.a.ListTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 1)
+	c.Assert(tokens[0].Uses, Equals, 0)
+
+	c.Assert(s.a.UpsertCertAuthority(
+		*services.NewTestCA(services.HostCA, "localhost"), backend.Forever), IsNil)
+	_, err = s.a.RegisterUsingToken(tok, "node1", teleport.RoleNode)
+	c.Assert(err, IsNil)
+	_, err = s.a.RegisterUsingToken(tok, "node2", teleport.RoleNode)
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+
+	// token with count 3 registers three nodes and is deleted after that
+	tok, err = s.a.GenerateTokenWithUses(teleport.RoleNode, 0, 3)
+	c.Assert(err, IsNil)
+	for i := 1; i <= 3; i++ {
+		_, err = s.a.RegisterUsingToken(tok, "node", teleport.RoleNode)
+		c.Assert(err, IsNil)
+		tokens, err := s.a.ListTokens()
+		c.Assert(err, IsNil)
+		if i < 3 {
+			c.Assert(tokens, HasLen, 1)
+			c.Assert(tokens[0].Uses, Equals, i)
+			c.Assert(tokens[0].MaxUses, Equals, 3)
+		} else {
+			c.Assert(tokens, HasLen, 0)
+		}
+	}
+	_, err = s.a.RegisterUsingToken(tok, "node", teleport.RoleNode)
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+
+	// concurrent registrations can't exceed the count
+	tok, err = s.a.GenerateTokenWithUses(teleport.RoleNode, 0, 2)
+	c.Assert(err, IsNil)
+	token, _, err := services.SplitTokenRole(tok)
+	c.Assert(err, IsNil)
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := s.a.UseToken(token)
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		}
+	}
+	c.Assert(succeeded, Equals, 2)
+
+	_, err = s.a.GenerateTokenWithUses(teleport.RoleNode, 0, -1)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
 func (s *AuthSuite) TestBadTokens(c *C) {
 	// empty
 	_, err := s.a.ValidateToken("")
@@ -124,3 +252,51 @@ func (s *AuthSuite) TestBadTokens(c *C) {
 	_, err = s.a.ValidateToken(tampered)
 	c.Assert(err, NotNil)
 }
+
+func (s *AuthSuite) TestCARotationStatus(c *C) {
+	_, err := s.a.CARotationStatus(services.HostCA)
+	c.Assert(teleport.IsNotFound(err), Equals, true, Commentf("%v", err))
+	_, err = s.a.CARotationStatus("bad")
+	c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf("%v", err))
+
+	ca := services.NewTestCA(services.HostCA, "localhost")
+	c.Assert(s.a.UpsertCertAuthority(*ca, backend.Forever), IsNil)
+
+	status, err := s.a.CARotationStatus(services.HostCA)
+	c.Assert(err, IsNil)
+	c.Assert(status.InProgress, Equals, false)
+	c.Assert(len(status.SigningKeys), Equals, 1)
+	c.Assert(status.CheckingOnlyKeys, DeepEquals, []string{})
+	oldFingerprint := status.SigningKeys[0]
+
+	// rotation in progress: the authority signs with the new key
+	// and still trusts the old one
+	keygen := native.New()
+	defer keygen.Close()
+	priv, pub, err := keygen.GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	ca.SigningKeys = [][]byte{priv}
+	ca.CheckingKeys = [][]byte{pub, ca.CheckingKeys[0]}
+	c.Assert(s.a.UpsertCertAuthority(*ca, backend.Forever), IsNil)
+
+	status, err = s.a.CARotationStatus(services.HostCA)
+	c.Assert(err, IsNil)
+	c.Assert(status.InProgress, Equals, true)
+	c.Assert(status.Type, Equals, services.HostCA)
+	c.Assert(status.DomainName, Equals, "localhost")
+	c.Assert(len(status.SigningKeys), Equals, 1)
+	c.Assert(status.SigningKeys[0], Not(Equals), oldFingerprint)
+	c.Assert(status.CheckingOnlyKeys, DeepEquals, []string{oldFingerprint})
+
+	// the old key is pruned from the overlap set
+	ca.CheckingKeys = ca.CheckingKeys[:1]
+	c.Assert(s.a.UpsertCertAuthority(*ca, backend.Forever), IsNil)
+	status, err = s.a.CARotationStatus(services.HostCA)
+	c.Assert(err, IsNil)
+	c.Assert(status.InProgress, Equals, false)
+	c.Assert(status.CheckingOnlyKeys, DeepEquals, []string{})
+
+	// the user authority is reported separately
+	_, err = s.a.CARotationStatus(services.UserCA)
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package auth
 
 import (
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/gravitational/teleport"
@@ -35,18 +37,22 @@ type AuthWithRoles struct {
 	elog        events.Log
 	sessions    session.Service
 	role        teleport.Role
-	recorder    recorder.Recorder
+	// user is the authenticated client, hosts are authenticated
+	// as their principal, e.g. "uuid.example.com"
+	user     string
+	recorder recorder.Recorder
 }
 
 func NewAuthWithRoles(authServer *AuthServer, permChecker PermissionChecker,
 	elog events.Log, sessions session.Service,
-	role teleport.Role, recorder recorder.Recorder) *AuthWithRoles {
+	role teleport.Role, user string, recorder recorder.Recorder) *AuthWithRoles {
 
 	return &AuthWithRoles{
 		authServer:  authServer,
 		permChecker: permChecker,
 		sessions:    sessions,
 		role:        role,
+		user:        user,
 		recorder:    recorder,
 		elog:        elog,
 	}
@@ -118,6 +124,20 @@ func (a *AuthWithRoles) DeleteCertAuthority(id services.CertAuthID) error {
 		return a.authServer.DeleteCertAuthority(id)
 	}
 }
+
+func (a *AuthWithRoles) AddTrustedUserCA(ca services.CertAuthority) error {
+	if err := a.permChecker.HasPermission(a.role, ActionAddTrustedUserCA); err != nil {
+		return trace.Wrap(err)
+	}
+	return a.authServer.AddTrustedUserCA(ca)
+}
+
+func (a *AuthWithRoles) RemoveTrustedUserCA(domainName string) error {
+	if err := a.permChecker.HasPermission(a.role, ActionRemoveTrustedUserCA); err != nil {
+		return trace.Wrap(err)
+	}
+	return a.authServer.RemoveTrustedUserCA(domainName)
+}
 func (a *AuthWithRoles) GenerateToken(role teleport.Role, ttl time.Duration) (string, error) {
 	if err := a.permChecker.HasPermission(a.role, ActionGenerateToken); err != nil {
 		return "", trace.Wrap(err)
@@ -125,18 +145,49 @@ func (a *AuthWithRoles) GenerateToken(role teleport.Role, ttl time.Duration) (st
 		return a.authServer.GenerateToken(role, ttl)
 	}
 }
+func (a *AuthWithRoles) GenerateTokenWithUses(role teleport.Role, ttl time.Duration, maxUses int) (string, error) {
+	if err := a.permChecker.HasPermission(a.role, ActionGenerateToken); err != nil {
+		return "", trace.Wrap(err)
+	} else {
+		return a.authServer.GenerateTokenWithUses(role, ttl, maxUses)
+	}
+}
+func (a *AuthWithRoles) ListTokens() ([]services.ProvisionToken, error) {
+	if err := a.permChecker.HasPermission(a.role, ActionListTokens); err != nil {
+		return nil, trace.Wrap(err)
+	} else {
+		return a.authServer.ListTokens()
+	}
+}
+func (a *AuthWithRoles) RevokeToken(token string) error {
+	if err := a.permChecker.HasPermission(a.role, ActionRevokeToken); err != nil {
+		return trace.Wrap(err)
+	} else {
+		return a.authServer.RevokeToken(token)
+	}
+}
 func (a *AuthWithRoles) RegisterUsingToken(token, hostID string, role teleport.Role) (*PackedKeys, error) {
+	return a.RegisterUsingTokenFrom(token, hostID, role, nil)
+}
+
+// RegisterUsingTokenFrom registers a server that connected from remoteAddr
+func (a *AuthWithRoles) RegisterUsingTokenFrom(token, hostID string, role teleport.Role, remoteAddr net.Addr) (*PackedKeys, error) {
 	if err := a.permChecker.HasPermission(a.role, ActionRegisterUsingToken); err != nil {
 		return nil, trace.Wrap(err)
 	} else {
-		return a.authServer.RegisterUsingToken(token, hostID, role)
+		return a.authServer.RegisterUsingTokenFrom(token, hostID, role, remoteAddr)
 	}
 }
 func (a *AuthWithRoles) RegisterNewAuthServer(token string) error {
+	return a.RegisterNewAuthServerFrom(token, nil)
+}
+
+// RegisterNewAuthServerFrom registers an auth server that connected from remoteAddr
+func (a *AuthWithRoles) RegisterNewAuthServerFrom(token string, remoteAddr net.Addr) error {
 	if err := a.permChecker.HasPermission(a.role, ActionRegisterNewAuthServer); err != nil {
 		return trace.Wrap(err)
 	} else {
-		return a.authServer.RegisterNewAuthServer(token)
+		return a.authServer.RegisterNewAuthServerFrom(token, remoteAddr)
 	}
 }
 func (a *AuthWithRoles) Log(id lunk.EventID, e lunk.Event) {
@@ -160,6 +211,13 @@ func (a *AuthWithRoles) GetEvents(filter events.Filter) ([]lunk.Entry, error) {
 		return a.elog.GetEvents(filter)
 	}
 }
+func (a *AuthWithRoles) IterateEvents(since time.Time, fn func(lunk.Entry) error) error {
+	if err := a.permChecker.HasPermission(a.role, ActionGetEvents); err != nil {
+		return trace.Wrap(err)
+	} else {
+		return a.elog.IterateEvents(since, fn)
+	}
+}
 func (a *AuthWithRoles) LogSession(sess session.Session) error {
 	if err := a.permChecker.HasPermission(a.role, ActionUpsertSession); err != nil {
 		return trace.Wrap(err)
@@ -331,6 +389,26 @@ func (a *AuthWithRoles) GenerateHostCert(
 		return a.authServer.GenerateHostCert(key, hostname, authDomain, role, ttl)
 	}
 }
+
+// RenewHostCert signs a new host key, hosts can only renew their own
+// certificates of their own role
+func (a *AuthWithRoles) RenewHostCert(hostID string, role teleport.Role, pub []byte) ([]byte, error) {
+	if err := a.permChecker.HasPermission(a.role, ActionRenewHostCert); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if a.role == teleport.RoleAdmin {
+		return a.authServer.RenewHostCert(hostID, role, pub)
+	}
+	if a.role != role {
+		return nil, trace.Wrap(teleport.AccessDenied(
+			fmt.Sprintf("role '%v' can't renew certificates of role '%v'", a.role, role)))
+	}
+	if a.user == "" || a.user != fmt.Sprintf("%v.%v", hostID, a.authServer.DomainName) {
+		return nil, trace.Wrap(teleport.AccessDenied(
+			fmt.Sprintf("host '%v' can't renew certificates of host '%v'", a.user, hostID)))
+	}
+	return a.authServer.RenewHostCert(hostID, role, pub)
+}
 func (a *AuthWithRoles) GenerateUserCert(key []byte, user string, ttl time.Duration) ([]byte, error) {
 	if err := a.permChecker.HasPermission(a.role, ActionGenerateUserCert); err != nil {
 		return nil, trace.Wrap(err)
@@ -0,0 +1,125 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+)
+
+// CachingAccessPoint is an access point that caches cert authorities
+// and nodes returned by the auth server for a TTL, so nodes and proxies
+// polling for them do not load the auth server with repeated reads
+type CachingAccessPoint struct {
+	AccessPoint
+
+	sync.Mutex
+	ttl   time.Duration
+	clock clockwork.Clock
+	cas   map[services.CertAuthType]cachedCAs
+	nodes *cachedNodes
+}
+
+type cachedCAs struct {
+	cas     []*services.CertAuthority
+	expires time.Time
+}
+
+type cachedNodes struct {
+	nodes   []services.Server
+	expires time.Time
+}
+
+// CachingOption is a functional option for CachingAccessPoint
+type CachingOption func(ap *CachingAccessPoint)
+
+// CachingClock sets the clock used to expire cached values (used in tests)
+func CachingClock(clock clockwork.Clock) CachingOption {
+	return func(ap *CachingAccessPoint) {
+		ap.clock = clock
+	}
+}
+
+// NewCachingAccessPoint returns an access point caching the reads
+// of the given access point for ttl
+func NewCachingAccessPoint(ap AccessPoint, ttl time.Duration, opts ...CachingOption) (*CachingAccessPoint, error) {
+	if ttl <= 0 {
+		return nil, trace.Wrap(teleport.BadParameter("auth_cache_ttl",
+			fmt.Sprintf("cache TTL should be positive: %v", ttl)))
+	}
+	c := &CachingAccessPoint{
+		AccessPoint: ap,
+		ttl:         ttl,
+		cas:         make(map[services.CertAuthType]cachedCAs),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.clock == nil {
+		c.clock = clockwork.NewRealClock()
+	}
+	return c, nil
+}
+
+// GetCertAuthorities returns cert authorities of the given type,
+// from the cache if they have been fetched less than TTL ago
+func (c *CachingAccessPoint) GetCertAuthorities(caType services.CertAuthType) ([]*services.CertAuthority, error) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.clock.Now()
+	if cached, ok := c.cas[caType]; ok && now.Before(cached.expires) {
+		return cached.cas, nil
+	}
+	cas, err := c.AccessPoint.GetCertAuthorities(caType)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	c.cas[caType] = cachedCAs{cas: cas, expires: now.Add(c.ttl)}
+	return cas, nil
+}
+
+// GetNodes returns registered nodes, from the cache if they have
+// been fetched less than TTL ago
+func (c *CachingAccessPoint) GetNodes() ([]services.Server, error) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.clock.Now()
+	if c.nodes != nil && now.Before(c.nodes.expires) {
+		return c.nodes.nodes, nil
+	}
+	nodes, err := c.AccessPoint.GetNodes()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	c.nodes = &cachedNodes{nodes: nodes, expires: now.Add(c.ttl)}
+	return nodes, nil
+}
+
+// UpsertNode registers node presence and invalidates cached nodes
+func (c *CachingAccessPoint) UpsertNode(s services.Server, ttl time.Duration) error {
+	c.Lock()
+	c.nodes = nil
+	c.Unlock()
+	return c.AccessPoint.UpsertNode(s, ttl)
+}
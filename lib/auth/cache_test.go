@@ -0,0 +1,95 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/jonboulle/clockwork"
+	. "gopkg.in/check.v1"
+)
+
+type CacheSuite struct {
+}
+
+var _ = Suite(&CacheSuite{})
+
+// countingAccessPoint counts reads that reach the auth server
+type countingAccessPoint struct {
+	AccessPoint
+	caReads   int
+	nodeReads int
+}
+
+func (a *countingAccessPoint) GetCertAuthorities(caType services.CertAuthType) ([]*services.CertAuthority, error) {
+	a.caReads++
+	return []*services.CertAuthority{{Type: caType, DomainName: "example.com"}}, nil
+}
+
+func (a *countingAccessPoint) GetNodes() ([]services.Server, error) {
+	a.nodeReads++
+	return []services.Server{{ID: "node1"}}, nil
+}
+
+func (a *countingAccessPoint) UpsertNode(s services.Server, ttl time.Duration) error {
+	return nil
+}
+
+func (s *CacheSuite) TestCachingAccessPoint(c *C) {
+	backend := &countingAccessPoint{}
+	clock := clockwork.NewFakeClock()
+	ap, err := NewCachingAccessPoint(backend, time.Minute, CachingClock(clock))
+	c.Assert(err, IsNil)
+
+	// within the TTL reads are served from the cache
+	for i := 0; i < 3; i++ {
+		cas, err := ap.GetCertAuthorities(services.HostCA)
+		c.Assert(err, IsNil)
+		c.Assert(cas, HasLen, 1)
+		nodes, err := ap.GetNodes()
+		c.Assert(err, IsNil)
+		c.Assert(nodes, HasLen, 1)
+	}
+	c.Assert(backend.caReads, Equals, 1)
+	c.Assert(backend.nodeReads, Equals, 1)
+
+	// CA types are cached separately
+	_, err = ap.GetCertAuthorities(services.UserCA)
+	c.Assert(err, IsNil)
+	c.Assert(backend.caReads, Equals, 2)
+
+	// after the TTL the auth server is asked again
+	clock.Advance(time.Minute + time.Second)
+	_, err = ap.GetCertAuthorities(services.HostCA)
+	c.Assert(err, IsNil)
+	_, err = ap.GetNodes()
+	c.Assert(err, IsNil)
+	c.Assert(backend.caReads, Equals, 3)
+	c.Assert(backend.nodeReads, Equals, 2)
+
+	// writes invalidate the cache
+	c.Assert(ap.UpsertNode(services.Server{ID: "node2"}, time.Minute), IsNil)
+	_, err = ap.GetNodes()
+	c.Assert(err, IsNil)
+	c.Assert(backend.nodeReads, Equals, 3)
+
+	_, err = NewCachingAccessPoint(backend, 0)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
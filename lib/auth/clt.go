@@ -19,6 +19,7 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"strconv"
 	"time"
@@ -194,6 +195,21 @@ func (c *Client) DeleteCertAuthority(id services.CertAuthID) error {
 	return trace.Wrap(err)
 }
 
+// AddTrustedUserCA makes the auth server trust user certificates signed
+// by the authority of another cluster, the authority should have
+// checking keys only
+func (c *Client) AddTrustedUserCA(ca services.CertAuthority) error {
+	_, err := c.PostJSON(c.Endpoint("trusted", "authorities"),
+		addTrustedUserCAReq{CA: ca})
+	return trace.Wrap(err)
+}
+
+// RemoveTrustedUserCA removes the trusted user authority of another cluster
+func (c *Client) RemoveTrustedUserCA(domainName string) error {
+	_, err := c.Delete(c.Endpoint("trusted", "authorities", domainName))
+	return trace.Wrap(err)
+}
+
 // GenerateToken creates a special provisioning token for a new SSH server
 // that is valid for ttl period seconds.
 //
@@ -215,6 +231,46 @@ func (c *Client) GenerateToken(role teleport.Role, ttl time.Duration) (string, e
 	return token, nil
 }
 
+// GenerateTokenWithUses creates a provisioning token that is valid for ttl
+// period and can be used to register up to maxUses servers
+func (c *Client) GenerateTokenWithUses(role teleport.Role, ttl time.Duration, maxUses int) (string, error) {
+	out, err := c.PostJSON(c.Endpoint("tokens"), generateTokenReq{
+		Role:    role,
+		TTL:     ttl,
+		MaxUses: maxUses,
+	})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	var token string
+	if err := json.Unmarshal(out.Bytes(), &token); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return token, nil
+}
+
+// ListTokens returns provisioning tokens that haven't been used or expired yet
+func (c *Client) ListTokens() ([]services.ProvisionToken, error) {
+	out, err := c.Get(c.Endpoint("tokens"), url.Values{})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var tokens []services.ProvisionToken
+	if err := json.Unmarshal(out.Bytes(), &tokens); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return tokens, nil
+}
+
+// RevokeToken deletes the provisioning token so it can't be used anymore
+func (c *Client) RevokeToken(token string) error {
+	if token == "" {
+		return trace.Wrap(teleport.BadParameter("token", "missing token"))
+	}
+	_, err := c.Delete(c.Endpoint("tokens", token))
+	return trace.Wrap(err)
+}
+
 // RegisterUserToken calls the auth service API to register a new node via registration token
 // which has been previously issued via GenerateToken
 func (c *Client) RegisterUsingToken(token, hostID string, role teleport.Role) (*PackedKeys, error) {
@@ -274,6 +330,38 @@ func (c *Client) GetEvents(filter events.Filter) ([]lunk.Entry, error) {
 	return events, nil
 }
 
+// IterateEvents streams events logged strictly after since from the
+// auth server and calls fn for every event in ascending time order
+func (c *Client) IterateEvents(since time.Time, fn func(lunk.Entry) error) error {
+	vals := url.Values{}
+	if !since.IsZero() {
+		st, err := since.MarshalText()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		vals.Set("since", string(st))
+	}
+	re, err := httplib.ConvertFileResponse(
+		c.Client.GetFile(c.Endpoint("events", "stream"), vals))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer re.Close()
+	decoder := json.NewDecoder(re.Body())
+	for {
+		var e lunk.Entry
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		if err := fn(e); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
+
 // GetSessionEvents returns a list of filtered session events
 func (c *Client) GetSessionEvents(filter events.Filter) ([]session.Session, error) {
 	vals, err := events.FilterToURL(filter)
@@ -576,6 +664,24 @@ func (c *Client) GenerateHostCert(
 	return []byte(cert), nil
 }
 
+// RenewHostCert signs a new public key of the host that has joined the
+// cluster before and returns the certificate
+func (c *Client) RenewHostCert(hostID string, role teleport.Role, pub []byte) ([]byte, error) {
+	out, err := c.PostJSON(c.Endpoint("hosts", hostID, "certs"),
+		renewHostCertReq{
+			Key:  pub,
+			Role: role,
+		})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var cert string
+	if err := json.Unmarshal(out.Bytes(), &cert); err != nil {
+		return nil, err
+	}
+	return []byte(cert), nil
+}
+
 // GenerateUserCert takes the public key in the Open SSH ``authorized_keys``
 // plain text format, signs it using User Certificate Authority signing key and returns the
 // resulting certificate.
@@ -707,7 +813,12 @@ type ClientI interface {
 	UpsertCertAuthority(cert services.CertAuthority, ttl time.Duration) error
 	GetCertAuthorities(caType services.CertAuthType) ([]*services.CertAuthority, error)
 	DeleteCertAuthority(caType services.CertAuthID) error
+	AddTrustedUserCA(ca services.CertAuthority) error
+	RemoveTrustedUserCA(domainName string) error
 	GenerateToken(role teleport.Role, ttl time.Duration) (string, error)
+	GenerateTokenWithUses(role teleport.Role, ttl time.Duration, maxUses int) (string, error)
+	ListTokens() ([]services.ProvisionToken, error)
+	RevokeToken(token string) error
 	RegisterUsingToken(token, hostID string, role teleport.Role) (*PackedKeys, error)
 	RegisterNewAuthServer(token string) error
 	Log(id lunk.EventID, e lunk.Event)
@@ -715,6 +826,7 @@ type ClientI interface {
 	LogSession(sess session.Session) error
 	GetEvents(filter events.Filter) ([]lunk.Entry, error)
 	GetSessionEvents(filter events.Filter) ([]session.Session, error)
+	IterateEvents(since time.Time, fn func(lunk.Entry) error) error
 	GetChunkWriter(id string) (recorder.ChunkWriteCloser, error)
 	GetChunkReader(id string) (recorder.ChunkReadCloser, error)
 	UpsertNode(s services.Server, ttl time.Duration) error
@@ -732,6 +844,7 @@ type ClientI interface {
 	GenerateKeyPair(pass string) ([]byte, []byte, error)
 	GenerateHostCert(key []byte, hostname, authServer string, role teleport.Role, ttl time.Duration) ([]byte, error)
 	GenerateUserCert(key []byte, user string, ttl time.Duration) ([]byte, error)
+	RenewHostCert(hostID string, role teleport.Role, pub []byte) ([]byte, error)
 	GetSignupTokenData(token string) (user string, QRImg []byte, hotpFirstValues []string, e error)
 	CreateUserWithToken(token, password, hotpToken string) (*Session, error)
 }
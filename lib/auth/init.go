@@ -17,15 +17,20 @@ limitations under the License.
 package auth
 
 import (
+	"crypto/rsa"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/backend"
 	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/sshutils"
 	"github.com/gravitational/teleport/lib/utils"
 
 	log "github.com/Sirupsen/logrus"
@@ -33,6 +38,13 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	// HostCAPublicKeyFile is a name of the file with exported host CA public keys
+	HostCAPublicKeyFile = "hostca.pub"
+	// UserCAPublicKeyFile is a name of the file with exported user CA public keys
+	UserCAPublicKeyFile = "userca.pub"
+)
+
 // InitConfig is auth server init config
 type InitConfig struct {
 	Backend   backend.Backend
@@ -55,11 +67,37 @@ type InitConfig struct {
 
 	SecretKey     string
 	AllowedTokens map[string]string
+	// AllowedTokenSources restricts allowed tokens to source networks,
+	// it is keyed by the same tokens as AllowedTokens, tokens that are
+	// not in it can be used from anywhere
+	AllowedTokenSources map[string][]net.IPNet
 
 	// HostCA is an optional host certificate authority keypair
 	HostCA *services.CertAuthority
 	// UserCA is an optional user certificate authority keypair
 	UserCA *services.CertAuthority
+
+	// ExportCAPublicKeysDir is an optional directory where public keys
+	// of host and user certificate authorities are written on first start
+	ExportCAPublicKeysDir string
+
+	// RequireExistingDataDir makes Init fail if the parent of the data
+	// dir does not exist instead of creating the whole path
+	RequireExistingDataDir bool
+
+	// KeyGenAttempts is a number of attempts to generate keys and
+	// certificates on start, transient failures are retried
+	KeyGenAttempts int
+	// KeyGenRetryPeriod is a period between key generation attempts
+	KeyGenRetryPeriod time.Duration
+
+	// KeyPassphrase encrypts private keys of host identities written
+	// to the data dir, keys are stored in plain text if it's empty
+	KeyPassphrase []byte
+
+	// MinKeySize is a minimum size in bits of RSA host keys read from
+	// the data dir, key size is not checked if it's zero
+	MinKeySize int
 }
 
 // Init instantiates and configures an instance of AuthServer
@@ -72,10 +110,22 @@ func Init(cfg InitConfig) (*AuthServer, *Identity, error) {
 		return nil, nil, trace.Wrap(teleport.BadParameter("HostUUID", "host UUID can not be empty"))
 	}
 
-	err := os.MkdirAll(cfg.DataDir, os.ModeDir|0777)
+	domainName, err := utils.NormalizeDomainName(cfg.DomainName)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	cfg.DomainName = domainName
+
+	// validate all tokens before anything gets written to the backend,
+	// so a bad entry does not leave the cluster half-seeded
+	if err := checkAllowedTokens(cfg.AllowedTokens, cfg.AllowedTokenSources); err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+
+	err = utils.EnsureDataDir(cfg.DataDir, cfg.RequireExistingDataDir)
 	if err != nil {
 		log.Errorf(err.Error())
-		return nil, nil, err
+		return nil, nil, trace.Wrap(err)
 	}
 
 	lockService := services.NewLockService(cfg.Backend)
@@ -87,7 +137,36 @@ func Init(cfg InitConfig) (*AuthServer, *Identity, error) {
 
 	// check that user CA and host CA are present and set the certs if needed
 	asrv := NewAuthServer(&cfg)
+	// retry transient key generation failures during bootstrap only,
+	// the original authority is restored once the keys are in place
+	asrv.Authority = newRetryingAuthority(cfg.Authority, cfg.KeyGenAttempts, cfg.KeyGenRetryPeriod)
+
+	// authorities created before the domain name was normalized are
+	// renamed, so they are not mistaken for missing ones
+	if err := normalizeAuthorityNames(asrv, cfg.DomainName); err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	if err := checkDomainName(asrv, cfg.DomainName); err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
 
+	// changes made to the cluster from here on are undone if init fails,
+	// so the next start is a first start again instead of a partial one
+	var rb rollback
+	identity, err := initCluster(&cfg, asrv, &rb)
+	if err != nil {
+		rb.run()
+		return nil, nil, trace.Wrap(err)
+	}
+	asrv.Authority = cfg.Authority
+
+	return asrv, identity, nil
+}
+
+// initCluster creates certificate authorities and seeds tokens on the
+// first start and makes sure the host identity of the auth server exists,
+// every change is registered with rb
+func initCluster(cfg *InitConfig, asrv *AuthServer, rb *rollback) (*Identity, error) {
 	// we determine if it's the first start by checking if the CA's are set
 	var firstStart bool
 
@@ -96,14 +175,14 @@ func Init(cfg InitConfig) (*AuthServer, *Identity, error) {
 	// that can be supplied in configuration
 	if _, err := asrv.GetCertAuthority(services.CertAuthID{DomainName: cfg.DomainName, Type: services.HostCA}, false); err != nil {
 		if !teleport.IsNotFound(err) {
-			return nil, nil, trace.Wrap(err)
+			return nil, trace.Wrap(err)
 		}
 		firstStart = true
 		if cfg.HostCA == nil {
 			log.Infof("FIRST START: Generating host CA on first start")
 			priv, pub, err := asrv.GenerateKeyPair("")
 			if err != nil {
-				return nil, nil, trace.Wrap(err)
+				return nil, trace.Wrap(err)
 			}
 			cfg.HostCA = &services.CertAuthority{
 				DomainName:   cfg.DomainName,
@@ -112,8 +191,8 @@ func Init(cfg InitConfig) (*AuthServer, *Identity, error) {
 				CheckingKeys: [][]byte{pub},
 			}
 		}
-		if err := asrv.CAService.UpsertCertAuthority(*cfg.HostCA, backend.Forever); err != nil {
-			return nil, nil, trace.Wrap(err)
+		if err := upsertAuthority(asrv, *cfg.HostCA, rb); err != nil {
+			return nil, trace.Wrap(err)
 		}
 	}
 
@@ -122,14 +201,14 @@ func Init(cfg InitConfig) (*AuthServer, *Identity, error) {
 	// that can be supplied in configuration
 	if _, err := asrv.GetCertAuthority(services.CertAuthID{DomainName: cfg.DomainName, Type: services.UserCA}, false); err != nil {
 		if !teleport.IsNotFound(err) {
-			return nil, nil, trace.Wrap(err)
+			return nil, trace.Wrap(err)
 		}
 		firstStart = true
 		if cfg.UserCA == nil {
 			log.Infof("FIRST START: Generating user CA on first start")
 			priv, pub, err := asrv.GenerateKeyPair("")
 			if err != nil {
-				return nil, nil, trace.Wrap(err)
+				return nil, trace.Wrap(err)
 			}
 			cfg.UserCA = &services.CertAuthority{
 				DomainName:   cfg.DomainName,
@@ -138,38 +217,233 @@ func Init(cfg InitConfig) (*AuthServer, *Identity, error) {
 				CheckingKeys: [][]byte{pub},
 			}
 		}
-		if err := asrv.CAService.UpsertCertAuthority(*cfg.UserCA, backend.Forever); err != nil {
-			return nil, nil, trace.Wrap(err)
+		if err := upsertAuthority(asrv, *cfg.UserCA, rb); err != nil {
+			return nil, trace.Wrap(err)
 		}
 	}
 	if firstStart {
+		if cfg.ExportCAPublicKeysDir != "" {
+			log.Infof("FIRST START: Exporting CA public keys to %v", cfg.ExportCAPublicKeysDir)
+			for _, name := range []string{HostCAPublicKeyFile, UserCAPublicKeyFile} {
+				if err := rb.addFile(filepath.Join(cfg.ExportCAPublicKeysDir, name)); err != nil {
+					return nil, trace.Wrap(err)
+				}
+			}
+			if err := exportCAPublicKeys(asrv, cfg.DomainName, cfg.ExportCAPublicKeysDir); err != nil {
+				return nil, trace.Wrap(err)
+			}
+		}
 		if len(cfg.AllowedTokens) != 0 {
 			log.Infof("FIRST START: Setting allowed provisioning tokens")
 			for token, domainName := range cfg.AllowedTokens {
 				log.Infof("FIRST START: upsert provisioning token: domainName: %v", domainName)
-				var role string
-				token, role, err = services.SplitTokenRole(token)
+				sources := cfg.AllowedTokenSources[token]
+				token, role, err := services.SplitTokenRole(token)
 				if err != nil {
-					return nil, nil, trace.Wrap(err)
+					return nil, trace.Wrap(err)
 				}
-
-				if err := asrv.UpsertToken(token, role, 600*time.Second); err != nil {
-					return nil, nil, trace.Wrap(err)
+				if err := asrv.UpsertTokenWithSources(token, role, 600*time.Second, 0, sources); err != nil {
+					return nil, trace.Wrap(err)
 				}
+				rb.add(func() error {
+					return ignoreNotFound(asrv.ProvisioningService.DeleteToken(token))
+				})
 			}
 		}
 	}
 
-	identity, err := initKeys(asrv, cfg.DataDir, IdentityID{HostUUID: cfg.HostUUID, Role: teleport.RoleAdmin})
+	id := IdentityID{HostUUID: cfg.HostUUID, Role: teleport.RoleAdmin}
+	kp, cp := keysPath(cfg.DataDir, id)
+	for _, path := range []string{kp, cp} {
+		if err := rb.addFile(path); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	identity, err := initKeys(asrv, cfg.DataDir, id,
+		IdentityPassphrase(cfg.KeyPassphrase), IdentityMinKeySize(cfg.MinKeySize))
 	if err != nil {
-		return nil, nil, err
+		return nil, trace.Wrap(err)
 	}
+	return identity, nil
+}
 
-	return asrv, identity, nil
+// upsertAuthority creates a certificate authority that does not exist yet
+func upsertAuthority(asrv *AuthServer, ca services.CertAuthority, rb *rollback) error {
+	if err := asrv.CAService.UpsertCertAuthority(ca, backend.Forever); err != nil {
+		return trace.Wrap(err)
+	}
+	id := *ca.ID()
+	rb.add(func() error {
+		return ignoreNotFound(asrv.DeleteCertAuthority(id))
+	})
+	return nil
+}
+
+// rollback collects functions undoing changes made to the cluster
+type rollback struct {
+	undo []func() error
+}
+
+// add registers a function undoing the last change
+func (r *rollback) add(fn func() error) {
+	r.undo = append(r.undo, fn)
+}
+
+// addFile registers removal of a file that is about to be written,
+// files that already exist are left alone
+func (r *rollback) addFile(path string) error {
+	exists, err := pathExists(path)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if exists {
+		return nil
+	}
+	r.add(func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return trace.Wrap(err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// run undoes the changes in reverse order, failures are logged and
+// don't stop the rollback
+func (r *rollback) run() {
+	for i := len(r.undo) - 1; i >= 0; i-- {
+		if err := r.undo[i](); err != nil {
+			log.Errorf("[AUTH] failed to roll back init: %v", err)
+		}
+	}
+	r.undo = nil
+}
+
+func ignoreNotFound(err error) error {
+	if teleport.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// checkAllowedTokens makes sure that every allowed token is prefixed
+// with a valid role and that sources are set only for allowed tokens
+func checkAllowedTokens(tokens map[string]string, sources map[string][]net.IPNet) error {
+	keys := make([]string, 0, len(tokens))
+	for token := range tokens {
+		keys = append(keys, token)
+	}
+	sort.Strings(keys)
+	for _, token := range keys {
+		if _, _, err := services.SplitTokenRole(token); err != nil {
+			return trace.Wrap(teleport.BadParameter("allowed_tokens",
+				fmt.Sprintf("invalid allowed token '%v' for '%v': expected token prefixed with role 'n' (node) or 'a' (auth)", token, tokens[token])))
+		}
+	}
+	for token := range sources {
+		if _, ok := tokens[token]; !ok {
+			return trace.Wrap(teleport.BadParameter("allowed_token_sources",
+				"source networks are set for a token that is not allowed"))
+		}
+	}
+	return nil
+}
+
+// checkDomainName rejects invalid domain names of new clusters. Clusters
+// that already have a host authority keep starting with a warning, as
+// their name is part of every certificate they have issued
+func checkDomainName(asrv *AuthServer, domainName string) error {
+	err := utils.CheckDomainName(domainName)
+	if err == nil {
+		return nil
+	}
+	_, caErr := asrv.GetCertAuthority(services.CertAuthID{Type: services.HostCA, DomainName: domainName}, false)
+	if caErr != nil {
+		if teleport.IsNotFound(caErr) {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(caErr)
+	}
+	log.Warningf("[AUTH] %v, consider migrating to a new cluster", err)
+	return nil
+}
+
+// normalizeAuthorityNames renames host and user authorities of the cluster
+// stored under the domain name in a different case to domainName
+func normalizeAuthorityNames(asrv *AuthServer, domainName string) error {
+	for _, caType := range []services.CertAuthType{services.HostCA, services.UserCA} {
+		cas, err := asrv.GetCertAuthorities(caType)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		var found bool
+		var renamed *services.CertAuthority
+		for _, ca := range cas {
+			switch {
+			case ca.DomainName == domainName:
+				found = true
+			case strings.EqualFold(ca.DomainName, domainName):
+				renamed = ca
+			}
+		}
+		if renamed == nil {
+			continue
+		}
+		if found {
+			log.Warningf("[AUTH] ignoring %v authority '%v', using '%v'", caType, renamed.DomainName, domainName)
+			continue
+		}
+		ca, err := asrv.GetCertAuthority(*renamed.ID(), true)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		log.Infof("[AUTH] renaming %v authority '%v' to '%v'", caType, ca.DomainName, domainName)
+		oldID := *ca.ID()
+		ca.DomainName = domainName
+		if err := asrv.UpsertCertAuthority(*ca, backend.Forever); err != nil {
+			return trace.Wrap(err)
+		}
+		if err := asrv.DeleteCertAuthority(oldID); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// exportCAPublicKeys writes public keys of host and user certificate
+// authorities to hostca.pub and userca.pub files in the directory
+func exportCAPublicKeys(asrv *AuthServer, domainName, dir string) error {
+	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		return trace.Wrap(err)
+	}
+	files := map[services.CertAuthType]string{
+		services.HostCA: HostCAPublicKeyFile,
+		services.UserCA: UserCAPublicKeyFile,
+	}
+	for caType, name := range files {
+		ca, err := asrv.GetCertAuthority(services.CertAuthID{DomainName: domainName, Type: caType}, false)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		var data []byte
+		for _, key := range ca.CheckingKeys {
+			data = append(data, key...)
+			if len(key) == 0 || key[len(key)-1] != '\n' {
+				data = append(data, '\n')
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
 }
 
 // initKeys initializes this node's host certificate signed by host authority
-func initKeys(a *AuthServer, dataDir string, id IdentityID) (*Identity, error) {
+func initKeys(a *AuthServer, dataDir string, id IdentityID, opts ...IdentityOption) (*Identity, error) {
+	if err := recoverKeys(dataDir, id); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	kp, cp := keysPath(dataDir, id)
 
 	keyExists, err := pathExists(kp)
@@ -191,32 +465,133 @@ func initKeys(a *AuthServer, dataDir string, id IdentityID) (*Identity, error) {
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
-		if err := writeKeys(dataDir, id, privateKey, cert); err != nil {
+		if err := writeKeys(dataDir, id, privateKey, cert, opts...); err != nil {
 			return nil, trace.Wrap(err)
 		}
 	}
-	i, err := ReadIdentity(dataDir, id)
+	i, err := ReadIdentity(dataDir, id, opts...)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 	return i, nil
 }
 
+// IdentityOption is a functional option for reading and writing identities
+type IdentityOption func(*identityConfig)
+
+type identityConfig struct {
+	passphrase []byte
+	minKeySize int
+}
+
+// IdentityPassphrase encrypts private keys with a passphrase when they are
+// written to disk and decrypts them when read back, empty passphrase
+// leaves keys in plain text
+func IdentityPassphrase(passphrase []byte) IdentityOption {
+	return func(c *identityConfig) {
+		c.passphrase = passphrase
+	}
+}
+
+// IdentityMinKeySize makes ReadIdentity reject RSA host keys smaller
+// than bits, zero turns the check off
+func IdentityMinKeySize(bits int) IdentityOption {
+	return func(c *identityConfig) {
+		c.minKeySize = bits
+	}
+}
+
+func newIdentityConfig(opts []IdentityOption) identityConfig {
+	var c identityConfig
+	for _, o := range opts {
+		o(&c)
+	}
+	return c
+}
+
 // writeKeys saves the key/cert pair for a given domain onto disk. This usually means the
 // domain trusts us (signed our public key)
-func writeKeys(dataDir string, id IdentityID, key []byte, cert []byte) error {
+func writeKeys(dataDir string, id IdentityID, key []byte, cert []byte, opts ...IdentityOption) error {
 	kp, cp := keysPath(dataDir, id)
 	log.Debugf("write key to %v, cert from %v", kp, cp)
 
-	if err := ioutil.WriteFile(kp, key, 0600); err != nil {
-		return err
+	if c := newIdentityConfig(opts); len(c.passphrase) != 0 {
+		var err error
+		key, err = sshutils.EncryptPrivateKey(key, c.passphrase)
+		if err != nil {
+			return trace.Wrap(err)
+		}
 	}
-	if err := ioutil.WriteFile(cp, cert, 0600); err != nil {
-		return err
+
+	// both files are written aside first and the key rename commits the
+	// new identity, recoverKeys finishes the cert rename after a crash,
+	// so the key and the cert on disk always match
+	if err := writeSyncFile(cp+tempKeysSuffix, cert); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := writeSyncFile(kp+tempKeysSuffix, key); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := os.Rename(kp+tempKeysSuffix, kp); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := os.Rename(cp+tempKeysSuffix, cp); err != nil {
+		return trace.Wrap(err)
 	}
 	return nil
 }
 
+// tempKeysSuffix is a suffix of the files the identity is written to
+// before they are renamed over the current key and cert
+const tempKeysSuffix = ".tmp"
+
+// recoverKeys completes or rolls back the identity update interrupted by
+// a crash. The new cert is kept only if the new key has been renamed in
+// place already, otherwise the current identity is left as it is
+func recoverKeys(dataDir string, id IdentityID) error {
+	kp, cp := keysPath(dataDir, id)
+	keyPending, err := pathExists(kp + tempKeysSuffix)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	certPending, err := pathExists(cp + tempKeysSuffix)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if keyPending {
+		log.Warningf("[AUTH] discarding interrupted update of %v identity", id.Role)
+		if err := os.Remove(kp + tempKeysSuffix); err != nil {
+			return trace.Wrap(err)
+		}
+		if certPending {
+			return trace.Wrap(os.Remove(cp + tempKeysSuffix))
+		}
+		return nil
+	}
+	if certPending {
+		log.Warningf("[AUTH] completing interrupted update of %v identity", id.Role)
+		return trace.Wrap(os.Rename(cp+tempKeysSuffix, cp))
+	}
+	return nil
+}
+
+// writeSyncFile writes data to the file and flushes it to disk
+func writeSyncFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return trace.Wrap(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(f.Close())
+}
+
 // Identity is a collection of certificates and signers that represent identity
 type Identity struct {
 	KeyBytes  []byte
@@ -226,6 +601,16 @@ type Identity struct {
 	Cert      *ssh.Certificate
 }
 
+// HasPrincipal returns true if the certificate is valid for principal
+func (i *Identity) HasPrincipal(principal string) bool {
+	for _, p := range i.Cert.ValidPrincipals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
+
 // IdentityID is a combination of role and host UUID
 type IdentityID struct {
 	Role     teleport.Role
@@ -234,13 +619,22 @@ type IdentityID struct {
 
 // ReadIdentity reads, parses and returns the given pub/pri key + cert from the
 // key storage (dataDir).
-func ReadIdentity(dataDir string, id IdentityID) (i *Identity, err error) {
+// Encrypted private keys are decrypted with the IdentityPassphrase option.
+func ReadIdentity(dataDir string, id IdentityID, opts ...IdentityOption) (i *Identity, err error) {
+	if err := recoverKeys(dataDir, id); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	kp, cp := keysPath(dataDir, id)
 	log.Debugf("host identity: [key: %v, cert: %v]", kp, cp)
 
 	i = &Identity{}
 
-	i.KeyBytes, err = utils.ReadPath(kp)
+	keyBytes, err := utils.ReadPath(kp)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	c := newIdentityConfig(opts)
+	i.KeyBytes, err = sshutils.DecryptPrivateKey(keyBytes, c.passphrase)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -266,6 +660,10 @@ func ReadIdentity(dataDir string, id IdentityID) (i *Identity, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse host private key, err: %v", err)
 	}
+	if err := checkKeySize(i.KeyBytes, c.minKeySize); err != nil {
+		return nil, trace.Wrap(teleport.BadParameter("key", fmt.Sprintf(
+			"%v, remove %v and %v to generate a new key", err.Error(), kp, cp)))
+	}
 	// TODO: why NewCertSigner if we already have a signer from ParsePrivateKey?
 	i.KeySigner, err = ssh.NewCertSigner(i.Cert, signer)
 	if err != nil {
@@ -274,8 +672,31 @@ func ReadIdentity(dataDir string, id IdentityID) (i *Identity, err error) {
 	return i, nil
 }
 
+// checkKeySize returns error if keyBytes is an RSA private key smaller
+// than minBits, other key types are not checked
+func checkKeySize(keyBytes []byte, minBits int) error {
+	if minBits <= 0 {
+		return nil
+	}
+	key, err := ssh.ParseRawPrivateKey(keyBytes)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil
+	}
+	if bits := rsaKey.N.BitLen(); bits < minBits {
+		return trace.Errorf("host key is %v bits, minimum allowed size is %v bits", bits, minBits)
+	}
+	return nil
+}
+
 // HaveHostKeys checks either the host keys are in place
 func HaveHostKeys(dataDir string, id IdentityID) (bool, error) {
+	if err := recoverKeys(dataDir, id); err != nil {
+		return false, trace.Wrap(err)
+	}
 	kp, cp := keysPath(dataDir, id)
 
 	exists, err := pathExists(kp)
@@ -0,0 +1,546 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth/native"
+	authority "github.com/gravitational/teleport/lib/auth/testauthority"
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/backend/boltbk"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+	. "gopkg.in/check.v1"
+)
+
+type InitSuite struct {
+	bk  *boltbk.BoltBackend
+	dir string
+}
+
+var _ = Suite(&InitSuite{})
+
+func (s *InitSuite) SetUpSuite(c *C) {
+	utils.InitLoggerForTests()
+}
+
+func (s *InitSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	var err error
+	s.bk, err = boltbk.New(filepath.Join(s.dir, "db"))
+	c.Assert(err, IsNil)
+}
+
+func (s *InitSuite) TearDownTest(c *C) {
+	c.Assert(s.bk.Close(), IsNil)
+}
+
+func (s *InitSuite) initConfig() InitConfig {
+	return InitConfig{
+		Backend:    s.bk,
+		Authority:  authority.New(),
+		DomainName: "localhost",
+		HostUUID:   "00000000-0000-0000-0000-000000000000",
+		DataDir:    filepath.Join(s.dir, "data"),
+	}
+}
+
+func (s *InitSuite) TestExportCAPublicKeys(c *C) {
+	cfg := s.initConfig()
+	cfg.ExportCAPublicKeysDir = filepath.Join(s.dir, "export")
+	_, _, err := Init(cfg)
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{HostCAPublicKeyFile, UserCAPublicKeyFile} {
+		data, err := ioutil.ReadFile(filepath.Join(cfg.ExportCAPublicKeysDir, name))
+		c.Assert(err, IsNil)
+		_, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		c.Assert(err, IsNil, Commentf(name))
+		c.Assert(len(rest), Equals, 0)
+	}
+
+	// keys are exported only on first start
+	cfg = s.initConfig()
+	cfg.ExportCAPublicKeysDir = filepath.Join(s.dir, "export2")
+	_, _, err = Init(cfg)
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadDir(cfg.ExportCAPublicKeysDir)
+	c.Assert(err, NotNil)
+}
+
+func (s *InitSuite) TestRequireExistingDataDir(c *C) {
+	// by default the whole path is created
+	cfg := s.initConfig()
+	cfg.DataDir = filepath.Join(s.dir, "lenient", "var", "lib", "teleport")
+	_, _, err := Init(cfg)
+	c.Assert(err, IsNil)
+	fi, err := os.Stat(cfg.DataDir)
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+
+	// strict mode refuses to create a missing parent
+	cfg = s.initConfig()
+	cfg.RequireExistingDataDir = true
+	cfg.DataDir = filepath.Join(s.dir, "typo", "teleport")
+	_, _, err = Init(cfg)
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+	_, err = os.Stat(filepath.Dir(cfg.DataDir))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// but creates the data dir itself if the parent exists
+	cfg.DataDir = filepath.Join(s.dir, "strict")
+	_, _, err = Init(cfg)
+	c.Assert(err, IsNil)
+	fi, err = os.Stat(cfg.DataDir)
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+}
+
+func (s *InitSuite) TestEncryptedIdentity(c *C) {
+	cfg := s.initConfig()
+	cfg.KeyPassphrase = []byte("secret")
+	_, identity, err := Init(cfg)
+	c.Assert(err, IsNil)
+
+	id := IdentityID{HostUUID: cfg.HostUUID, Role: teleport.RoleAdmin}
+	keyPath, _ := keysPath(cfg.DataDir, id)
+	onDisk, err := ioutil.ReadFile(keyPath)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(onDisk), "ENCRYPTED"), Equals, true)
+
+	i, err := ReadIdentity(cfg.DataDir, id, IdentityPassphrase(cfg.KeyPassphrase))
+	c.Assert(err, IsNil)
+	c.Assert(string(i.KeyBytes), Equals, string(identity.KeyBytes))
+	c.Assert(i.KeySigner.PublicKey().Marshal(), DeepEquals, identity.KeySigner.PublicKey().Marshal())
+
+	_, err = ReadIdentity(cfg.DataDir, id)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+
+	_, err = ReadIdentity(cfg.DataDir, id, IdentityPassphrase([]byte("wrong")))
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+
+	// identities written without a passphrase stay readable
+	plain := IdentityID{HostUUID: cfg.HostUUID, Role: teleport.RoleNode}
+	c.Assert(writeKeys(cfg.DataDir, plain, identity.KeyBytes, identity.CertBytes), IsNil)
+	_, err = ReadIdentity(cfg.DataDir, plain, IdentityPassphrase(cfg.KeyPassphrase))
+	c.Assert(err, IsNil)
+}
+
+func (s *InitSuite) TestMinKeySize(c *C) {
+	a := authority.New()
+	caPriv, _, err := a.GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	writeIdentity := func(bits int) IdentityID {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		c.Assert(err, IsNil)
+		priv := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		pub, err := ssh.NewPublicKey(&key.PublicKey)
+		c.Assert(err, IsNil)
+		cert, err := a.GenerateHostCert(caPriv, ssh.MarshalAuthorizedKey(pub), "host", "example.com", teleport.RoleNode, 0)
+		c.Assert(err, IsNil)
+		id := IdentityID{HostUUID: fmt.Sprintf("host-%v", bits), Role: teleport.RoleNode}
+		c.Assert(writeKeys(s.dir, id, priv, cert), IsNil)
+		return id
+	}
+	weak, strong := writeIdentity(1024), writeIdentity(2048)
+
+	_, err = ReadIdentity(s.dir, weak, IdentityMinKeySize(2048))
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*1024 bits, minimum allowed size is 2048 bits.*")
+
+	_, err = ReadIdentity(s.dir, strong, IdentityMinKeySize(2048))
+	c.Assert(err, IsNil)
+
+	// key size is not checked by default
+	_, err = ReadIdentity(s.dir, weak)
+	c.Assert(err, IsNil)
+}
+
+func (s *InitSuite) TestRegenerateHostKeys(c *C) {
+	cfg := s.initConfig()
+	authServer, _, err := Init(cfg)
+	c.Assert(err, IsNil)
+	id := IdentityID{HostUUID: "node-uuid", Role: teleport.RoleNode}
+	c.Assert(LocalRegister(cfg.DataDir, id, authServer), IsNil)
+	old, err := ReadIdentity(cfg.DataDir, id)
+	c.Assert(err, IsNil)
+
+	// test authority hands out the same key pair every time
+	keygen := native.New()
+	defer keygen.Close()
+	identity, err := RegenerateHostKeys(cfg.DataDir, id, keygen, authServer)
+	c.Assert(err, IsNil)
+	onDisk, err := ReadIdentity(cfg.DataDir, id)
+	c.Assert(err, IsNil)
+	c.Assert(string(onDisk.KeyBytes), Equals, string(identity.KeyBytes))
+	c.Assert(string(onDisk.KeyBytes), Not(Equals), string(old.KeyBytes))
+
+	// the new certificate is signed by the host CA for the same host
+	ca, err := authServer.GetCertAuthority(services.CertAuthID{Type: services.HostCA, DomainName: cfg.DomainName}, false)
+	c.Assert(err, IsNil)
+	checkers, err := ca.Checkers()
+	c.Assert(err, IsNil)
+	checker := ssh.CertChecker{IsAuthority: func(key ssh.PublicKey) bool {
+		for _, checker := range checkers {
+			if string(checker.Marshal()) == string(key.Marshal()) {
+				return true
+			}
+		}
+		return false
+	}}
+	c.Assert(checker.CheckCert("node-uuid.localhost", identity.Cert), IsNil)
+
+	// hosts can't get certificates of other roles
+	_, pub, err := authority.New().GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	node := NewAuthWithRoles(authServer, NewStandardPermissions(), nil, nil, teleport.RoleNode, "node-uuid.localhost", nil)
+	_, err = node.RenewHostCert("node-uuid", teleport.RoleProxy, pub)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true)
+	_, err = node.RenewHostCert("node-uuid", teleport.RoleNode, pub)
+	c.Assert(err, IsNil)
+	user := NewAuthWithRoles(authServer, NewStandardPermissions(), nil, nil, teleport.RoleUser, "alice", nil)
+	_, err = user.RenewHostCert("node-uuid", teleport.RoleUser, pub)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true)
+
+	// nor certificates of other hosts
+	_, err = node.RenewHostCert("other-uuid", teleport.RoleNode, pub)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true)
+	other := NewAuthWithRoles(authServer, NewStandardPermissions(), nil, nil, teleport.RoleNode, "node-uuid.example.com", nil)
+	_, err = other.RenewHostCert("node-uuid", teleport.RoleNode, pub)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true)
+}
+
+func (s *InitSuite) TestInterruptedKeysUpdate(c *C) {
+	a := authority.New()
+	caPriv, _, err := a.GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	keygen := native.New()
+	defer keygen.Close()
+	newKeys := func() ([]byte, []byte) {
+		priv, pub, err := keygen.GenerateKeyPair("")
+		c.Assert(err, IsNil)
+		cert, err := a.GenerateHostCert(caPriv, pub, "host", "example.com", teleport.RoleNode, 0)
+		c.Assert(err, IsNil)
+		return priv, cert
+	}
+	checkIdentity := func(id IdentityID, key []byte) {
+		identity, err := ReadIdentity(s.dir, id)
+		c.Assert(err, IsNil)
+		c.Assert(string(identity.KeyBytes), Equals, string(key))
+		signer, err := ssh.ParsePrivateKey(identity.KeyBytes)
+		c.Assert(err, IsNil)
+		c.Assert(signer.PublicKey().Marshal(), DeepEquals, identity.Cert.Key.Marshal())
+		kp, cp := keysPath(s.dir, id)
+		for _, path := range []string{kp + tempKeysSuffix, cp + tempKeysSuffix} {
+			exists, err := pathExists(path)
+			c.Assert(err, IsNil)
+			c.Assert(exists, Equals, false, Commentf(path))
+		}
+	}
+	id := IdentityID{HostUUID: "host", Role: teleport.RoleNode}
+	oldKey, oldCert := newKeys()
+	c.Assert(writeKeys(s.dir, id, oldKey, oldCert), IsNil)
+	checkIdentity(id, oldKey)
+	kp, cp := keysPath(s.dir, id)
+
+	// crash before the key is renamed keeps the current identity
+	newKey, newCert := newKeys()
+	c.Assert(ioutil.WriteFile(kp+tempKeysSuffix, newKey, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(cp+tempKeysSuffix, newCert, 0600), IsNil)
+	checkIdentity(id, oldKey)
+
+	// crash after the key is renamed completes the update
+	c.Assert(ioutil.WriteFile(kp, newKey, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(cp+tempKeysSuffix, newCert, 0600), IsNil)
+	exists, err := HaveHostKeys(s.dir, id)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+	checkIdentity(id, newKey)
+}
+
+func (s *InitSuite) TestBadAllowedToken(c *C) {
+	cfg := s.initConfig()
+	cfg.AllowedTokens = map[string]string{
+		"ntoken1": "node.example.com",
+		"xtoken2": "bad.example.com",
+		"atoken3": "auth.example.com",
+	}
+	_, _, err := Init(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*xtoken2.*")
+
+	// nothing has been written to the backend
+	_, err = services.NewProvisioningService(s.bk).GetToken("token1")
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+	_, err = services.NewCAService(s.bk).GetCertAuthority(
+		services.CertAuthID{DomainName: cfg.DomainName, Type: services.HostCA}, false)
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+
+	// valid tokens are seeded
+	delete(cfg.AllowedTokens, "xtoken2")
+	_, _, err = Init(cfg)
+	c.Assert(err, IsNil)
+	token, err := services.NewProvisioningService(s.bk).GetToken("token1")
+	c.Assert(err, IsNil)
+	c.Assert(token.Role, Equals, services.TokenRoleNode)
+	token, err = services.NewProvisioningService(s.bk).GetToken("token3")
+	c.Assert(err, IsNil)
+	c.Assert(token.Role, Equals, services.TokenRoleAuth)
+}
+
+func (s *InitSuite) TestAllowedTokenSources(c *C) {
+	networks, err := utils.ParseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+	c.Assert(err, IsNil)
+	cfg := s.initConfig()
+	cfg.AllowedTokens = map[string]string{
+		"ntoken1": "node.example.com",
+		"ntoken2": "node.example.com",
+	}
+	cfg.AllowedTokenSources = map[string][]net.IPNet{"ntoken3": networks}
+	_, _, err = Init(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+
+	cfg.AllowedTokenSources = map[string][]net.IPNet{"ntoken1": networks}
+	_, _, err = Init(cfg)
+	c.Assert(err, IsNil)
+	provisioner := services.NewProvisioningService(s.bk)
+	token, err := provisioner.GetToken("token1")
+	c.Assert(err, IsNil)
+	c.Assert(token.AllowedSources, DeepEquals, []string{"10.0.0.0/8", "fd00::/8"})
+	c.Assert(token.CheckSource(&utils.NetAddr{AddrNetwork: "tcp", Addr: "[fd00::1]:3025"}), IsNil)
+	c.Assert(teleport.IsAccessDenied(token.CheckSource(&utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:3025"})), Equals, true)
+	token, err = provisioner.GetToken("token2")
+	c.Assert(err, IsNil)
+	c.Assert(len(token.AllowedSources), Equals, 0)
+	c.Assert(token.CheckSource(&utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:3025"}), IsNil)
+}
+
+// flakyAuthority fails key and certificate generation the configured
+// number of times before delegating to the real authority
+type flakyAuthority struct {
+	Authority
+	err          error
+	keyFailures  int
+	certFailures int
+	keyCalls     int
+	certCalls    int
+}
+
+func (a *flakyAuthority) GenerateKeyPair(passphrase string) ([]byte, []byte, error) {
+	a.keyCalls++
+	if a.keyCalls <= a.keyFailures {
+		return nil, nil, a.err
+	}
+	return a.Authority.GenerateKeyPair(passphrase)
+}
+
+func (a *flakyAuthority) GenerateHostCert(pkey, key []byte, hostID, authDomain string, role teleport.Role, ttl time.Duration) ([]byte, error) {
+	a.certCalls++
+	if a.certCalls <= a.certFailures {
+		return nil, a.err
+	}
+	return a.Authority.GenerateHostCert(pkey, key, hostID, authDomain, role, ttl)
+}
+
+func (s *InitSuite) TestKeyGenRetries(c *C) {
+	flaky := &flakyAuthority{
+		Authority:    authority.New(),
+		err:          trace.Errorf("not enough entropy"),
+		keyFailures:  2,
+		certFailures: 2,
+	}
+	cfg := s.initConfig()
+	cfg.Authority = flaky
+	cfg.KeyGenAttempts = 3
+	cfg.KeyGenRetryPeriod = time.Millisecond
+	asrv, identity, err := Init(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(identity, NotNil)
+	// host CA, user CA and the host key pair, two failures before the first
+	c.Assert(flaky.keyCalls, Equals, 5)
+	c.Assert(flaky.certCalls, Equals, 3)
+	// retries are only used during bootstrap
+	c.Assert(asrv.Authority, Equals, Authority(flaky))
+}
+
+func (s *InitSuite) TestKeyGenRetriesExhausted(c *C) {
+	flaky := &flakyAuthority{
+		Authority:   authority.New(),
+		err:         trace.Errorf("not enough entropy"),
+		keyFailures: 3,
+	}
+	cfg := s.initConfig()
+	cfg.Authority = flaky
+	cfg.KeyGenAttempts = 3
+	cfg.KeyGenRetryPeriod = time.Millisecond
+	_, _, err := Init(cfg)
+	c.Assert(err, ErrorMatches, ".*not enough entropy.*")
+	c.Assert(flaky.keyCalls, Equals, 3)
+}
+
+func (s *InitSuite) TestKeyGenPermanentError(c *C) {
+	flaky := &flakyAuthority{
+		Authority:   authority.New(),
+		err:         teleport.BadParameter("passphrase", "unsupported passphrase"),
+		keyFailures: 1,
+	}
+	cfg := s.initConfig()
+	cfg.Authority = flaky
+	cfg.KeyGenAttempts = 3
+	cfg.KeyGenRetryPeriod = time.Millisecond
+	_, _, err := Init(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(flaky.keyCalls, Equals, 1)
+}
+
+func (s *InitSuite) TestDomainNameCase(c *C) {
+	// authorities of a cluster started with a mixed case domain name
+	cas := services.NewCAService(s.bk)
+	hostCA := services.NewTestCA(services.HostCA, "LocalHost")
+	userCA := services.NewTestCA(services.UserCA, "LocalHost")
+	c.Assert(cas.UpsertCertAuthority(*hostCA, backend.Forever), IsNil)
+	c.Assert(cas.UpsertCertAuthority(*userCA, backend.Forever), IsNil)
+
+	cfg := s.initConfig()
+	cfg.DomainName = "LOCALHOST."
+	cfg.ExportCAPublicKeysDir = filepath.Join(s.dir, "export")
+	authServer, _, err := Init(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(authServer.DomainName, Equals, "localhost")
+
+	// existing authorities are renamed instead of generating new ones
+	for _, expected := range []*services.CertAuthority{hostCA, userCA} {
+		ca, err := authServer.GetCertAuthority(
+			services.CertAuthID{DomainName: "localhost", Type: expected.Type}, true)
+		c.Assert(err, IsNil)
+		c.Assert(ca.CheckingKeys, DeepEquals, expected.CheckingKeys)
+		c.Assert(ca.SigningKeys, DeepEquals, expected.SigningKeys)
+
+		all, err := authServer.GetCertAuthorities(expected.Type)
+		c.Assert(err, IsNil)
+		c.Assert(all, HasLen, 1)
+	}
+	_, err = os.Stat(cfg.ExportCAPublicKeysDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	cfg.DomainName = "local host"
+	_, _, err = Init(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
+func (s *InitSuite) TestInvalidDomainName(c *C) {
+	// new clusters can not use a domain name that is longer than 253
+	// characters, which the authority storage allowed before
+	label := strings.Repeat("a", 63)
+	cfg := s.initConfig()
+	cfg.DomainName = strings.Join([]string{label, label, label, label}, ".")
+	_, _, err := Init(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+
+	// existing clusters keep starting with the name they were created with
+	cas := services.NewCAService(s.bk)
+	c.Assert(cas.UpsertCertAuthority(*services.NewTestCA(services.HostCA, cfg.DomainName), backend.Forever), IsNil)
+	c.Assert(cas.UpsertCertAuthority(*services.NewTestCA(services.UserCA, cfg.DomainName), backend.Forever), IsNil)
+	authServer, _, err := Init(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(authServer.DomainName, Equals, cfg.DomainName)
+}
+
+func (s *InitSuite) TestRollback(c *C) {
+	// host certificate generation fails after the authorities are
+	// created, the tokens are seeded and the public keys are exported
+	failing := &flakyAuthority{
+		Authority:    authority.New(),
+		err:          teleport.BadParameter("key", "unsupported key"),
+		certFailures: 1,
+	}
+	cfg := s.initConfig()
+	cfg.Authority = failing
+	cfg.AllowedTokens = map[string]string{"ntoken1": "node.example.com"}
+	cfg.ExportCAPublicKeysDir = filepath.Join(s.dir, "export")
+	_, _, err := Init(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(failing.certCalls, Equals, 1)
+
+	// the cluster is back to its pre-init state
+	cas := services.NewCAService(s.bk)
+	for _, caType := range []services.CertAuthType{services.HostCA, services.UserCA} {
+		all, err := cas.GetCertAuthorities(caType)
+		c.Assert(err, IsNil)
+		c.Assert(all, HasLen, 0)
+	}
+	tokens, err := services.NewProvisioningService(s.bk).GetTokens()
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 0)
+	kp, cp := keysPath(cfg.DataDir, IdentityID{HostUUID: cfg.HostUUID, Role: teleport.RoleAdmin})
+	for _, path := range []string{
+		kp, cp,
+		filepath.Join(cfg.ExportCAPublicKeysDir, HostCAPublicKeyFile),
+		filepath.Join(cfg.ExportCAPublicKeysDir, UserCAPublicKeyFile),
+	} {
+		_, err = os.Stat(path)
+		c.Assert(os.IsNotExist(err), Equals, true, Commentf("%v", path))
+	}
+
+	// the next start is a first start
+	cfg.Authority = authority.New()
+	_, _, err = Init(cfg)
+	c.Assert(err, IsNil)
+	_, err = services.NewProvisioningService(s.bk).GetToken("token1")
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(cfg.ExportCAPublicKeysDir, HostCAPublicKeyFile))
+	c.Assert(err, IsNil)
+}
+
+func (s *InitSuite) TestRollbackKeepsExistingState(c *C) {
+	cfg := s.initConfig()
+	_, _, err := Init(cfg)
+	c.Assert(err, IsNil)
+	kp, cp := keysPath(cfg.DataDir, IdentityID{HostUUID: cfg.HostUUID, Role: teleport.RoleAdmin})
+	c.Assert(os.Remove(cp), IsNil)
+
+	// only changes made by the failed init are undone
+	cfg.Authority = &flakyAuthority{
+		Authority:    authority.New(),
+		err:          teleport.BadParameter("key", "unsupported key"),
+		certFailures: 1,
+	}
+	_, _, err = Init(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	for _, caType := range []services.CertAuthType{services.HostCA, services.UserCA} {
+		_, err := services.NewCAService(s.bk).GetCertAuthority(
+			services.CertAuthID{DomainName: cfg.DomainName, Type: caType}, false)
+		c.Assert(err, IsNil)
+	}
+	_, err = os.Stat(kp)
+	c.Assert(err, IsNil)
+}
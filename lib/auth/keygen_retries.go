@@ -0,0 +1,83 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+// retryingAuthority retries transient key and certificate generation
+// failures, like entropy starvation on a freshly booted machine
+type retryingAuthority struct {
+	Authority
+	attempts int
+	period   time.Duration
+}
+
+func newRetryingAuthority(a Authority, attempts int, period time.Duration) *retryingAuthority {
+	if attempts < 1 {
+		attempts = defaults.KeyGenAttempts
+	}
+	if period <= 0 {
+		period = defaults.KeyGenRetryPeriod
+	}
+	return &retryingAuthority{
+		Authority: a,
+		attempts:  attempts,
+		period:    period,
+	}
+}
+
+func (a *retryingAuthority) GenerateKeyPair(passphrase string) (privKey []byte, pubKey []byte, err error) {
+	err = a.retry("generate key pair", func() error {
+		privKey, pubKey, err = a.Authority.GenerateKeyPair(passphrase)
+		return err
+	})
+	return privKey, pubKey, trace.Wrap(err)
+}
+
+func (a *retryingAuthority) GenerateHostCert(pkey, key []byte, hostID, authDomain string, role teleport.Role, ttl time.Duration) (cert []byte, err error) {
+	err = a.retry("generate host certificate", func() error {
+		cert, err = a.Authority.GenerateHostCert(pkey, key, hostID, authDomain, role, ttl)
+		return err
+	})
+	return cert, trace.Wrap(err)
+}
+
+// retry calls fn until it succeeds, returns a permanent error or runs out
+// of attempts. Bad parameter errors are permanent, everything else
+// is considered transient
+func (a *retryingAuthority) retry(op string, fn func() error) error {
+	var err error
+	for i := 1; i <= a.attempts; i++ {
+		err = fn()
+		if err == nil || teleport.IsBadParameter(err) {
+			return err
+		}
+		if i < a.attempts {
+			log.Warningf("[AUTH] failed to %v, attempt %v of %v, retrying in %v: %v", op, i, a.attempts, a.period, err)
+			time.Sleep(a.period)
+		}
+	}
+	return err
+}
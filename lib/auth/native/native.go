@@ -25,6 +25,7 @@ import (
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/sshutils"
 	"github.com/gravitational/teleport/lib/utils"
 
 	log "github.com/Sirupsen/logrus"
@@ -104,6 +105,12 @@ func (n *nauth) GenerateKeyPair(passphrase string) ([]byte, []byte, error) {
 		Bytes:   privDer,
 	}
 	privPem := pem.EncodeToMemory(&privBlock)
+	if passphrase != "" {
+		privPem, err = sshutils.EncryptPrivateKey(privPem, []byte(passphrase))
+		if err != nil {
+			return nil, nil, trace.Wrap(err)
+		}
+	}
 
 	pub, err := ssh.NewPublicKey(&priv.PublicKey)
 	if err != nil {
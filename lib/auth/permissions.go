@@ -75,6 +75,7 @@ func NewStandardPermissions() PermissionChecker {
 		ActionGetChunkWriter:     true,
 		ActionGetSession:         true,
 		ActionGetSessions:        true,
+		ActionRenewHostCert:      true,
 	}
 
 	sp.permissions[teleport.RoleProxy] = map[string]bool{
@@ -92,6 +93,7 @@ func NewStandardPermissions() PermissionChecker {
 		ActionLogEntry:           true,
 		ActionGetSession:         true,
 		ActionGetSessions:        true,
+		ActionRenewHostCert:      true,
 	}
 
 	sp.permissions[teleport.RoleWeb] = map[string]bool{
@@ -170,7 +172,11 @@ const (
 	ActionGetCertAuthorities            = "GetCertAuthorities"
 	ActionGetLocalDomain                = "GetLocalDomain"
 	ActionDeleteCertAuthority           = "DeleteCertAuthority"
+	ActionAddTrustedUserCA              = "AddTrustedUserCA"
+	ActionRemoveTrustedUserCA           = "RemoveTrustedUserCA"
 	ActionGenerateToken                 = "GenerateToken"
+	ActionListTokens                    = "ListTokens"
+	ActionRevokeToken                   = "RevokeToken"
 	ActionRegisterUsingToken            = "RegisterUsingToken"
 	ActionRegisterNewAuthServer         = "RegisterNewAuthServer"
 	ActionLog                           = "Log"
@@ -202,6 +208,7 @@ const (
 	ActionGenerateKeyPair               = "GenerateKeyPair"
 	ActionGenerateHostCert              = "GenerateHostCert"
 	ActionGenerateUserCert              = "GenerateUserCert"
+	ActionRenewHostCert                 = "RenewHostCert"
 	ActionResetHostCertificateAuthority = "ResetHostCertificateAuthority"
 	ActionResetUserCertificateAuthority = "ResetUserCertificateAuthority"
 	ActionGenerateSealKey               = "GenerateSealKey"
@@ -17,27 +17,30 @@ limitations under the License.
 package auth
 
 import (
+	"bytes"
 	"io/ioutil"
 	"strings"
 
+	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
 )
 
 // LocalRegister is used in standalone mode to register roles without
 // connecting to remote clients and provisioning tokens
-func LocalRegister(dataDir string, id IdentityID, authServer *AuthServer) error {
+func LocalRegister(dataDir string, id IdentityID, authServer *AuthServer, opts ...IdentityOption) error {
 	keys, err := authServer.GenerateServerKeys(id.HostUUID, id.Role)
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	return writeKeys(dataDir, id, keys.Key, keys.Cert)
+	return writeKeys(dataDir, id, keys.Key, keys.Cert, opts...)
 }
 
 // Register is used by auth service clients (other services, like proxy or SSH) when a new node
 // joins the cluster
-func Register(dataDir, token string, id IdentityID, servers []utils.NetAddr) error {
+func Register(dataDir, token string, id IdentityID, servers []utils.NetAddr, opts ...TunClientOption) error {
 	tok, err := readToken(token)
 	if err != nil {
 		return trace.Wrap(err)
@@ -50,7 +53,8 @@ func Register(dataDir, token string, id IdentityID, servers []utils.NetAddr) err
 	client, err := NewTunClient(
 		servers,
 		id.HostUUID,
-		method)
+		method,
+		opts...)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -60,7 +64,42 @@ func Register(dataDir, token string, id IdentityID, servers []utils.NetAddr) err
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	return writeKeys(dataDir, id, keys.Key, keys.Cert)
+	return writeKeys(dataDir, id, keys.Key, keys.Cert, client.identityOpts...)
+}
+
+// HostCertRenewer signs new keys of hosts that have joined the cluster,
+// it is implemented by the auth server and by its clients
+type HostCertRenewer interface {
+	RenewHostCert(hostID string, role teleport.Role, pub []byte) ([]byte, error)
+}
+
+// RegenerateHostKeys generates a new host key, has it signed by the auth
+// server and replaces the identity in dataDir with it. The old identity
+// stays on disk until the new certificate is received and checked
+func RegenerateHostKeys(dataDir string, id IdentityID, keygen Authority, renewer HostCertRenewer, opts ...IdentityOption) (*Identity, error) {
+	key, pub, err := keygen.GenerateKeyPair("")
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	certBytes, err := renewer.RenewHostCert(id.HostUUID, id.Role, pub)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	certKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	cert, ok := certKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, trace.Wrap(teleport.BadParameter("cert", "auth server returned a key that is not a host certificate"))
+	}
+	if !bytes.Equal(bytes.TrimSpace(ssh.MarshalAuthorizedKey(cert.Key)), bytes.TrimSpace(pub)) {
+		return nil, trace.Wrap(teleport.BadParameter("cert", "auth server signed a different key"))
+	}
+	if err := writeKeys(dataDir, id, key, certBytes, opts...); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return ReadIdentity(dataDir, id, opts...)
 }
 
 func RegisterNewAuth(domainName, token string, servers []utils.NetAddr) error {
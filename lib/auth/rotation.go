@@ -0,0 +1,93 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// RotationStatus is a state of the key rotation of the local
+// certificate authority
+type RotationStatus struct {
+	// Type is a type of the certificate authority
+	Type services.CertAuthType `json:"type"`
+	// DomainName is a domain name of the certificate authority
+	DomainName string `json:"domain_name"`
+	// SigningKeys are fingerprints of the keys the authority
+	// currently signs certificates with
+	SigningKeys []string `json:"signing_keys"`
+	// CheckingOnlyKeys are fingerprints of the keys that are still
+	// trusted to check certificates, but are no longer used for signing,
+	// this is the overlap set left by a rotation
+	CheckingOnlyKeys []string `json:"checking_only_keys"`
+	// InProgress is true while the overlap set is not empty, i.e.
+	// certificates signed by the previous keys are still accepted
+	InProgress bool `json:"in_progress"`
+}
+
+// CARotationStatus returns the rotation state of the local certificate
+// authority of the given type
+func (a *AuthServer) CARotationStatus(caType services.CertAuthType) (*RotationStatus, error) {
+	if err := caType.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	ca, err := a.GetCertAuthority(services.CertAuthID{
+		Type:       caType,
+		DomainName: a.DomainName,
+	}, true)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return rotationStatus(ca)
+}
+
+// rotationStatus splits checking keys of the authority into the ones
+// that have a matching signing key and the checking-only overlap set
+func rotationStatus(ca *services.CertAuthority) (*RotationStatus, error) {
+	status := &RotationStatus{
+		Type:             ca.Type,
+		DomainName:       ca.DomainName,
+		SigningKeys:      []string{},
+		CheckingOnlyKeys: []string{},
+	}
+	signing := make(map[string]bool, len(ca.SigningKeys))
+	for _, keyBytes := range ca.SigningKeys {
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		fingerprint := utils.Fingerprint(signer.PublicKey())
+		signing[fingerprint] = true
+		status.SigningKeys = append(status.SigningKeys, fingerprint)
+	}
+	for _, keyBytes := range ca.CheckingKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		fingerprint := utils.Fingerprint(key)
+		if !signing[fingerprint] {
+			status.CheckingOnlyKeys = append(status.CheckingOnlyKeys, fingerprint)
+		}
+	}
+	status.InProgress = len(status.CheckingOnlyKeys) != 0
+	return status, nil
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/sshutils"
 
 	"golang.org/x/crypto/ssh"
 	. "gopkg.in/check.v1"
@@ -46,13 +47,24 @@ func (s *AuthSuite) GenerateKeypairEmptyPass(c *C) {
 }
 
 func (s *AuthSuite) GenerateKeypairPass(c *C) {
-	_, pub, err := s.A.GenerateKeyPair("pass1")
+	priv, pub, err := s.A.GenerateKeyPair("pass1")
 	c.Assert(err, IsNil)
 
-	// make sure we can parse the private and public key
-	// TODO(klizhentas) test the private key actually
-	_, _, _, _, err = ssh.ParseAuthorizedKey(pub)
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pub)
+	c.Assert(err, IsNil)
+
+	// private key is encrypted and can be parsed only with the passphrase
+	_, err = ssh.ParsePrivateKey(priv)
+	c.Assert(err, NotNil)
+
+	_, err = sshutils.DecryptPrivateKey(priv, []byte("pass2"))
+	c.Assert(err, NotNil)
+
+	plain, err := sshutils.DecryptPrivateKey(priv, []byte("pass1"))
+	c.Assert(err, IsNil)
+	signer, err := ssh.ParsePrivateKey(plain)
 	c.Assert(err, IsNil)
+	c.Assert(signer.PublicKey().Marshal(), DeepEquals, pubKey.Marshal())
 }
 
 func (s *AuthSuite) GenerateHostCert(c *C) {
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/sshutils"
 	"github.com/gravitational/teleport/lib/utils"
 
 	"golang.org/x/crypto/ssh"
@@ -68,7 +69,14 @@ func (n *nauth) GetNewKeyPairFromPool() ([]byte, []byte, error) {
 	return n.GenerateKeyPair("")
 }
 func (n *nauth) GenerateKeyPair(passphrase string) ([]byte, []byte, error) {
-	return []byte(privPem), []byte(pubBytes), nil
+	if passphrase == "" {
+		return []byte(privPem), []byte(pubBytes), nil
+	}
+	priv, err := sshutils.EncryptPrivateKey([]byte(privPem), []byte(passphrase))
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, []byte(pubBytes), nil
 }
 
 func (n *nauth) GenerateHostCert(pkey, key []byte, hostname, authDomain string, role teleport.Role, ttl time.Duration) ([]byte, error) {
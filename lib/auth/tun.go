@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -54,9 +55,14 @@ type AuthTunnel struct {
 	// to create a tunnel
 	sshServer       *sshutils.Server
 	hostSigner      ssh.Signer
-	hostCertChecker ssh.CertChecker
-	userCertChecker ssh.CertChecker
+	hostCertChecker sshutils.CertChecker
+	userCertChecker sshutils.CertChecker
 	limiter         *limiter.Limiter
+	allowedSources  []net.IPNet
+	clockSkew       time.Duration
+	reusePort       bool
+	logConnections  bool
+	recoverPanics   bool
 }
 
 // ServerOption is the functional argument passed to the server
@@ -70,6 +76,53 @@ func SetLimiter(limiter *limiter.Limiter) ServerOption {
 	}
 }
 
+// SetAllowedSources restricts source IPs of clients that can connect
+// to the auth tunnel server, any source is allowed if networks are empty
+func SetAllowedSources(networks []net.IPNet) ServerOption {
+	return func(s *AuthTunnel) error {
+		s.allowedSources = networks
+		return nil
+	}
+}
+
+// SetReusePort binds the listening socket with SO_REUSEPORT, so another
+// process can listen on the same address
+func SetReusePort(reusePort bool) ServerOption {
+	return func(s *AuthTunnel) error {
+		s.reusePort = reusePort
+		return nil
+	}
+}
+
+// SetConnectionLogging turns on logging of accepted, authenticated and
+// closed connections with the source IP and principal
+func SetConnectionLogging(enabled bool) ServerOption {
+	return func(s *AuthTunnel) error {
+		s.logConnections = enabled
+		return nil
+	}
+}
+
+// SetPanicRecovery turns on recovery from panics in connection and
+// request handlers, a panic closes the channel it happened in
+func SetPanicRecovery(enabled bool) ServerOption {
+	return func(s *AuthTunnel) error {
+		s.recoverPanics = enabled
+		return nil
+	}
+}
+
+// SetClockSkew sets a tolerated clock skew for certificate validity checks
+func SetClockSkew(skew time.Duration) ServerOption {
+	return func(s *AuthTunnel) error {
+		if skew < 0 {
+			return trace.Wrap(teleport.BadParameter("clock_skew", "clock skew can't be negative"))
+		}
+		s.clockSkew = skew
+		return nil
+	}
+}
+
 // NewTunnel creates a new SSH tunnel server which is not started yet
 func NewTunnel(addr utils.NetAddr,
 	hostSigners []ssh.Signer,
@@ -80,6 +133,7 @@ func NewTunnel(addr utils.NetAddr,
 	tunnel = &AuthTunnel{
 		authServer: authServer,
 		apiServer:  apiServer,
+		clockSkew:  defaults.ClockSkew,
 	}
 	tunnel.limiter, err = limiter.NewLimiter(limiter.LimiterConfig{})
 	if err != nil {
@@ -91,6 +145,17 @@ func NewTunnel(addr utils.NetAddr,
 			return nil, err
 		}
 	}
+	serverOpts := []sshutils.ServerOption{
+		sshutils.SetLimiter(tunnel.limiter),
+		sshutils.SetAllowedSources(tunnel.allowedSources),
+		sshutils.SetReusePort(tunnel.reusePort),
+	}
+	if tunnel.logConnections {
+		serverOpts = append(serverOpts, sshutils.SetConnectionLogging(teleport.ComponentAuth))
+	}
+	if tunnel.recoverPanics {
+		serverOpts = append(serverOpts, sshutils.SetPanicRecovery(teleport.ComponentAuth))
+	}
 	// create an SSH server and assign the tunnel to be it's "new SSH channel handler"
 	tunnel.sshServer, err = sshutils.NewServer(
 		addr,
@@ -100,13 +165,19 @@ func NewTunnel(addr utils.NetAddr,
 			Password:  tunnel.passwordAuth,
 			PublicKey: tunnel.keyAuth,
 		},
-		sshutils.SetLimiter(tunnel.limiter),
+		serverOpts...,
 	)
 	if err != nil {
 		return nil, err
 	}
-	tunnel.userCertChecker = ssh.CertChecker{IsAuthority: tunnel.isUserAuthority}
-	tunnel.hostCertChecker = ssh.CertChecker{IsAuthority: tunnel.isHostAuthority}
+	tunnel.userCertChecker = sshutils.CertChecker{
+		CertChecker: ssh.CertChecker{IsAuthority: tunnel.isUserAuthority},
+		ClockSkew:   tunnel.clockSkew,
+	}
+	tunnel.hostCertChecker = sshutils.CertChecker{
+		CertChecker: ssh.CertChecker{IsAuthority: tunnel.isHostAuthority},
+		ClockSkew:   tunnel.clockSkew,
+	}
 	return tunnel, nil
 }
 
@@ -236,6 +307,7 @@ func (s *AuthTunnel) haveExt(sconn *ssh.ServerConn, ext ...string) bool {
 }
 
 func (s *AuthTunnel) handleWebAgentRequest(sconn *ssh.ServerConn, ch ssh.Channel) {
+	defer utils.RecoverPanic(s.recoverPanics, teleport.ComponentAuth, "web agent handler")
 	defer ch.Close()
 
 	if sconn.Permissions.Extensions[ExtRole] != string(teleport.RoleWeb) {
@@ -287,6 +359,7 @@ func (s *AuthTunnel) handleWebAgentRequest(sconn *ssh.ServerConn, ch ssh.Channel
 // handleDirectTCPIPRequest accepts an incoming SSH connection via TCP/IP and forwards
 // it to the local auth server which listens on local UNIX pipe
 func (s *AuthTunnel) handleDirectTCPIPRequest(sconn *ssh.ServerConn, sshChannel ssh.Channel, req *sshutils.DirectTCPIPReq) {
+	defer utils.RecoverPanic(s.recoverPanics, teleport.ComponentAuth, "direct-tcpip handler")
 	defer sconn.Close()
 
 	// retreive the role from thsi connection's permissions (make sure it's a valid role)
@@ -297,8 +370,8 @@ func (s *AuthTunnel) handleDirectTCPIPRequest(sconn *ssh.ServerConn, sshChannel
 	}
 
 	// Forward this new SSH channel to API-with-roles server. It will try to proxy this
-	// connection to the API service mapped to this role:
-	if err := s.apiServer.HandleNewChannel(sconn.RemoteAddr(), sshChannel, role); err != nil {
+	// connection to the API service of the authenticated user with this role:
+	if err := s.apiServer.HandleNewChannel(sconn.RemoteAddr(), sshChannel, role, sconn.User()); err != nil {
 		log.Error(err)
 		return
 	}
@@ -495,6 +568,64 @@ func TunClientStorage(storage utils.AddrStorage) TunClientOption {
 	}
 }
 
+// TunClientHostKey makes the client refuse to talk to auth servers
+// that do not present the pinned host key
+func TunClientHostKey(pin *utils.HostKeyPin) TunClientOption {
+	return func(t *TunClient) {
+		t.hostKeyPin = pin
+	}
+}
+
+// TunClientIdentityOptions sets options of the identity the client
+// writes to the data dir when it registers with a token
+func TunClientIdentityOptions(opts ...IdentityOption) TunClientOption {
+	return func(t *TunClient) {
+		t.identityOpts = opts
+	}
+}
+
+// AuthServerStrategy defines the order in which tunnel client
+// tries auth servers on every connection attempt
+type AuthServerStrategy string
+
+const (
+	// StrategyOrdered tries auth servers in the order they are listed
+	StrategyOrdered AuthServerStrategy = "ordered"
+	// StrategyRandom tries auth servers in random order
+	StrategyRandom AuthServerStrategy = "random"
+	// StrategyRoundRobin starts every attempt with the server
+	// next to the one the previous attempt started with
+	StrategyRoundRobin AuthServerStrategy = "round-robin"
+)
+
+// Check returns error if strategy is not supported
+func (s AuthServerStrategy) Check() error {
+	switch s {
+	case StrategyOrdered, StrategyRandom, StrategyRoundRobin:
+		return nil
+	}
+	return trace.Wrap(teleport.BadParameter("auth_server_strategy",
+		fmt.Sprintf("unsupported strategy: '%v', supported are %v, %v and %v",
+			s, StrategyOrdered, StrategyRandom, StrategyRoundRobin)))
+}
+
+// TunClientStrategy sets the strategy of picking auth servers
+func TunClientStrategy(strategy AuthServerStrategy) TunClientOption {
+	return func(t *TunClient) {
+		t.strategy = strategy
+	}
+}
+
+// TunClientRefreshPeriod sets the period of refreshing the list of
+// auth servers, zero keeps the default
+func TunClientRefreshPeriod(period time.Duration) TunClientOption {
+	return func(t *TunClient) {
+		if period > 0 {
+			t.refreshPeriod = period
+		}
+	}
+}
+
 // TunClient is HTTP client that works over SSH tunnel
 // This is done in order to authenticate various teleport roles
 // using existing SSH certificate infrastructure
@@ -504,11 +635,24 @@ type TunClient struct {
 	user          string
 	authServers   []utils.NetAddr
 	authMethods   []ssh.AuthMethod
+	refreshPeriod time.Duration
 	refreshTicker *time.Ticker
 	closeC        chan struct{}
 	closeOnce     sync.Once
 	tr            *http.Transport
 	addrStorage   utils.AddrStorage
+	strategy      AuthServerStrategy
+	// rand shuffles auth servers for random strategy, it's seeded per
+	// client so processes started together don't pick the same server
+	rand *rand.Rand
+	// attempt counts connection attempts for round-robin strategy
+	attempt int
+	// currentServer is the auth server the last connection was made to
+	currentServer utils.NetAddr
+	// hostKeyPin is the host key auth servers have to present, if set
+	hostKeyPin *utils.HostKeyPin
+	// identityOpts apply to the identity written by Register
+	identityOpts []IdentityOption
 }
 
 // NewTunClient returns an instance of new HTTP client to Auth server API
@@ -521,12 +665,21 @@ func NewTunClient(authServers []utils.NetAddr, user string, authMethods []ssh.Au
 		user:          user,
 		authServers:   authServers,
 		authMethods:   authMethods,
-		refreshTicker: time.NewTicker(defaults.AuthServersRefreshPeriod),
+		refreshPeriod: defaults.AuthServersRefreshPeriod,
 		closeC:        make(chan struct{}),
+		strategy:      StrategyOrdered,
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 	for _, o := range opts {
 		o(tc)
 	}
+	tc.refreshTicker = time.NewTicker(tc.refreshPeriod)
+	if tc.strategy == "" {
+		tc.strategy = StrategyOrdered
+	}
+	if err := tc.strategy.Check(); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	tr := &http.Transport{
 		Dial: tc.Dial,
 	}
@@ -680,31 +833,92 @@ func (c *TunClient) setAuthServers(servers []utils.NetAddr) {
 	c.authServers = servers
 }
 
+// orderAuthServers returns auth servers in the order they should be
+// tried on this connection attempt according to the strategy
+func (c *TunClient) orderAuthServers() []utils.NetAddr {
+	servers := c.getAuthServers()
+	if len(servers) < 2 {
+		return servers
+	}
+	switch c.strategy {
+	case StrategyRandom:
+		c.Lock()
+		for i := range servers {
+			j := c.rand.Intn(i + 1)
+			servers[i], servers[j] = servers[j], servers[i]
+		}
+		c.Unlock()
+	case StrategyRoundRobin:
+		c.Lock()
+		start := c.attempt % len(servers)
+		c.attempt++
+		c.Unlock()
+		servers = append(servers[start:], servers[:start]...)
+	}
+	return servers
+}
+
 func (c *TunClient) getClient() (*ssh.Client, error) {
 	var client *ssh.Client
 	var err error
-	for _, authServer := range c.getAuthServers() {
+	for _, authServer := range c.orderAuthServers() {
 		client, err = c.dialAuthServer(authServer)
 		if err == nil {
+			c.setCurrentAuthServer(authServer)
 			return client, nil
 		}
 	}
 	return nil, trace.Wrap(err)
 }
 
+func (c *TunClient) setCurrentAuthServer(authServer utils.NetAddr) {
+	c.Lock()
+	defer c.Unlock()
+	if c.currentServer != authServer {
+		log.Infof("connected to auth server %v", authServer.Addr)
+	}
+	c.currentServer = authServer
+}
+
+// CurrentAuthServer returns the auth server the client has connected
+// to the last time, it changes when the client fails over to another
+// server. Returns an empty address if the client has not connected yet
+func (c *TunClient) CurrentAuthServer() utils.NetAddr {
+	c.Lock()
+	defer c.Unlock()
+	return c.currentServer
+}
+
 func (c *TunClient) dialAuthServer(authServer utils.NetAddr) (*ssh.Client, error) {
 	config := &ssh.ClientConfig{
 		User: c.user,
 		Auth: c.authMethods,
 	}
+	var hostKeyErr error
+	if c.hostKeyPin != nil {
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = c.hostKeyPin.HostKeyCallback(hostname, remote, key)
+			return hostKeyErr
+		}
+	}
 	client, err := ssh.Dial(authServer.AddrNetwork, authServer.Addr, config)
 	log.Debugf("TunDialer.getClient(%v)", authServer.String())
 	if err != nil {
 		log.Infof("TunDialer could not ssh.Dial: %v", err)
-		if utils.IsHandshakeFailedError(err) {
+		if hostKeyErr != nil {
+			log.Warningf("auth server %v: %v", authServer.Addr, hostKeyErr)
+			return nil, trace.Wrap(hostKeyErr)
+		}
+		if utils.IsAuthenticationFailedError(err) {
 			return nil, teleport.AccessDenied(
 				fmt.Sprintf("access denied to '%v': bad username or credentials", c.user))
 		}
+		// the handshake can fail on a dropped connection or a server
+		// that's overloaded, it's worth trying again unlike bad credentials
+		if utils.IsHandshakeFailedError(err) {
+			return nil, trace.Wrap(teleport.ConnectionProblem(
+				fmt.Sprintf("handshake with auth server %v failed", authServer.Addr), err))
+		}
 		return nil, trace.Wrap(teleport.ConvertSystemError(err))
 	}
 	return client, nil
@@ -17,7 +17,11 @@ limitations under the License.
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"fmt"
+	"net"
+	"net/http/httptest"
 	"path/filepath"
 	"time"
 
@@ -442,6 +446,71 @@ func (s *TunSuite) TestFailover(c *C) {
 	c.Assert(nodes, DeepEquals, []services.Server{node})
 }
 
+func (s *TunSuite) TestCurrentAuthServer(c *C) {
+	backup, err := NewTunnel(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:0"},
+		[]ssh.Signer{s.signer},
+		s.srv, s.a)
+	c.Assert(err, IsNil)
+	c.Assert(backup.Start(), IsNil)
+	defer backup.Close()
+
+	primary := utils.NetAddr{AddrNetwork: "tcp", Addr: s.tsrv.Addr()}
+	secondary := utils.NetAddr{AddrNetwork: "tcp", Addr: backup.Addr()}
+	clt, err := NewTunClient(
+		[]utils.NetAddr{primary, secondary},
+		"localhost", []ssh.AuthMethod{ssh.PublicKeys(s.signer)})
+	c.Assert(err, IsNil)
+	defer clt.Close()
+
+	// not connected yet
+	c.Assert(clt.CurrentAuthServer(), Equals, utils.NetAddr{})
+
+	_, err = clt.GetNodes()
+	c.Assert(err, IsNil)
+	c.Assert(clt.CurrentAuthServer(), Equals, primary)
+
+	// primary goes away, the client fails over to the backup
+	c.Assert(s.tsrv.Close(), IsNil)
+	clt.tr.CloseIdleConnections()
+	_, err = clt.GetNodes()
+	c.Assert(err, IsNil)
+	c.Assert(clt.CurrentAuthServer(), Equals, secondary)
+}
+
+func (s *TunSuite) TestHostKeyPin(c *C) {
+	hostKey := s.signer.PublicKey().(*ssh.Certificate).Key
+	newClient := func(pin string) *TunClient {
+		hostKeyPin, err := utils.ParseHostKeyPin(pin)
+		c.Assert(err, IsNil)
+		clt, err := NewTunClient(
+			[]utils.NetAddr{{AddrNetwork: "tcp", Addr: s.tsrv.Addr()}},
+			"localhost", []ssh.AuthMethod{ssh.PublicKeys(s.signer)},
+			TunClientHostKey(hostKeyPin))
+		c.Assert(err, IsNil)
+		return clt
+	}
+
+	// matching public key and fingerprint
+	for _, pin := range []string{string(ssh.MarshalAuthorizedKey(hostKey)), utils.Fingerprint(hostKey)} {
+		clt := newClient(pin)
+		_, err := clt.GetNodes()
+		c.Assert(err, IsNil)
+		clt.Close()
+	}
+
+	// auth server presenting another key is refused
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	otherPub, err := ssh.NewPublicKey(&otherKey.PublicKey)
+	c.Assert(err, IsNil)
+	clt := newClient(utils.Fingerprint(otherPub))
+	defer clt.Close()
+	_, err = clt.GetNodes()
+	c.Assert(err, NotNil)
+	c.Assert(err, ErrorMatches, ".*does not match the pinned key.*")
+}
+
 func (s *TunSuite) TestSync(c *C) {
 	authServer := services.Server{
 		ID:       "node1",
@@ -471,3 +540,180 @@ func (s *TunSuite) TestSync(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(syncedServers, DeepEquals, expected)
 }
+
+func (s *TunSuite) TestAuthServerStrategies(c *C) {
+	servers := []utils.NetAddr{
+		{AddrNetwork: "tcp", Addr: "127.0.0.1:1"},
+		{AddrNetwork: "tcp", Addr: "127.0.0.1:2"},
+		{AddrNetwork: "tcp", Addr: "127.0.0.1:3"},
+	}
+	newClient := func(strategy AuthServerStrategy) *TunClient {
+		clt, err := NewTunClient(servers, "user", nil, TunClientStrategy(strategy))
+		c.Assert(err, IsNil)
+		return clt
+	}
+
+	// ordered keeps the configured order
+	clt := newClient(StrategyOrdered)
+	defer clt.Close()
+	for i := 0; i < 3; i++ {
+		c.Assert(clt.orderAuthServers(), DeepEquals, servers)
+	}
+
+	// round-robin starts every attempt with the next server
+	clt = newClient(StrategyRoundRobin)
+	defer clt.Close()
+	for i := 0; i < 6; i++ {
+		ordered := clt.orderAuthServers()
+		c.Assert(ordered, HasLen, len(servers))
+		c.Assert(ordered[0], Equals, servers[i%len(servers)])
+	}
+
+	// random distributes first attempts across all servers
+	clt = newClient(StrategyRandom)
+	defer clt.Close()
+	first := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		ordered := clt.orderAuthServers()
+		c.Assert(ordered, HasLen, len(servers))
+		first[ordered[0].Addr]++
+	}
+	for _, server := range servers {
+		c.Assert(first[server.Addr] > 0, Equals, true, Commentf("%v was never tried first", server.Addr))
+	}
+
+	// unknown strategy is rejected
+	_, err := NewTunClient(servers, "user", nil, TunClientStrategy("sometimes"))
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
+func (s *TunSuite) TestRefreshPeriod(c *C) {
+	authServer := services.Server{
+		ID:       "node1",
+		Addr:     "node.example.com:12345",
+		Hostname: "node.example.com",
+	}
+	c.Assert(s.a.UpsertAuthServer(authServer, backend.Forever), IsNil)
+
+	clt, err := NewTunClient(
+		[]utils.NetAddr{
+			{AddrNetwork: "tcp", Addr: s.tsrv.Addr()},
+		}, "localhost", []ssh.AuthMethod{ssh.PublicKeys(s.signer)},
+		TunClientRefreshPeriod(50*time.Millisecond),
+	)
+	c.Assert(err, IsNil)
+	defer clt.Close()
+	c.Assert(clt.refreshPeriod, Equals, 50*time.Millisecond)
+
+	// the list of auth servers is refreshed well before the default period
+	expected := []utils.NetAddr{{Addr: "node.example.com:12345", AddrNetwork: "tcp"}}
+	for i := 0; i < 40; i++ {
+		if len(clt.getAuthServers()) == 1 && clt.getAuthServers()[0] == expected[0] {
+			break
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+	c.Assert(clt.getAuthServers(), DeepEquals, expected)
+
+	// zero keeps the default
+	clt, err = NewTunClient(expected, "user", nil, TunClientRefreshPeriod(0))
+	c.Assert(err, IsNil)
+	defer clt.Close()
+	c.Assert(clt.refreshPeriod, Equals, defaults.AuthServersRefreshPeriod)
+}
+
+func (s *TunSuite) TestRoleHandler(c *C) {
+	handler, err := s.srv.RoleHandler(teleport.RoleNode, "node.localhost")
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	clt, err := NewClient(srv.URL)
+	c.Assert(err, IsNil)
+	domain, err := clt.GetLocalDomain()
+	c.Assert(err, IsNil)
+	c.Assert(domain, Equals, "localhost")
+
+	// requests get permissions of the role
+	_, err = clt.GenerateToken(teleport.RoleNode, time.Minute)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true, Commentf("%#v", err))
+
+	_, err = s.srv.RoleHandler(teleport.Role("Superuser"), "node.localhost")
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
+func (s *TunSuite) TestRenewHostCert(c *C) {
+	newClient := func(hostID string) *TunClient {
+		priv, pub, err := s.a.GenerateKeyPair("")
+		c.Assert(err, IsNil)
+		cert, err := s.a.GenerateHostCert(pub, hostID+".localhost", "localhost", teleport.RoleNode, 0)
+		c.Assert(err, IsNil)
+		signer, err := sshutils.NewSigner(priv, cert)
+		c.Assert(err, IsNil)
+		clt, err := NewTunClient(
+			[]utils.NetAddr{{AddrNetwork: "tcp", Addr: s.tsrv.Addr()}},
+			hostID+".localhost", []ssh.AuthMethod{ssh.PublicKeys(signer)})
+		c.Assert(err, IsNil)
+		return clt
+	}
+	clt := newClient("node-uuid")
+	defer clt.Close()
+
+	_, pub, err := s.a.GenerateKeyPair("")
+	c.Assert(err, IsNil)
+	cert, err := clt.RenewHostCert("node-uuid", teleport.RoleNode, pub)
+	c.Assert(err, IsNil)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(cert)
+	c.Assert(err, IsNil)
+	c.Assert(parsed.(*ssh.Certificate).ValidPrincipals[0], Equals, "node-uuid.localhost")
+
+	// hosts can't get certificates of other hosts
+	_, err = clt.RenewHostCert("other-uuid", teleport.RoleNode, pub)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true, Commentf("%#v", err))
+
+	// every connection is served with the identity of its own host
+	other := newClient("other-uuid")
+	defer other.Close()
+	_, err = other.RenewHostCert("other-uuid", teleport.RoleNode, pub)
+	c.Assert(err, IsNil)
+	_, err = other.RenewHostCert("node-uuid", teleport.RoleNode, pub)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true, Commentf("%#v", err))
+}
+
+func (s *TunSuite) TestNegativeClockSkew(c *C) {
+	_, err := NewTunnel(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:0"},
+		[]ssh.Signer{s.signer},
+		s.srv, s.a, SetClockSkew(-time.Second))
+	c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf("%v", err))
+}
+
+func (s *TunSuite) TestRegisterErrors(c *C) {
+	id := IdentityID{HostUUID: "node.localhost", Role: teleport.RoleNode}
+
+	// the auth server rejects an unknown token
+	err := Register(c.MkDir(), "unknown-token", id,
+		[]utils.NetAddr{{AddrNetwork: "tcp", Addr: s.tsrv.Addr()}})
+	c.Assert(teleport.IsAccessDenied(err), Equals, true, Commentf("%#v", err))
+
+	// a connection dropped during the handshake is not a rejection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go dropConnections(listener)
+	err = Register(c.MkDir(), "unknown-token", id,
+		[]utils.NetAddr{{AddrNetwork: "tcp", Addr: listener.Addr().String()}})
+	c.Assert(teleport.IsAccessDenied(err), Equals, false, Commentf("%#v", err))
+	c.Assert(teleport.IsConnectionProblem(err), Equals, true, Commentf("%#v", err))
+}
+
+// dropConnections closes every accepted connection right away
+func dropConnections(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
@@ -18,7 +18,12 @@ limitations under the License.
 package backend
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"time"
+
+	"github.com/gravitational/trace"
 )
 
 // Forever means that object TTL will not expire unless deleted
@@ -55,4 +60,49 @@ type Backend interface {
 	ReleaseLock(token string) error
 	// CompareAndSwap implements compare ans swap operation for a key
 	CompareAndSwap(bucket []string, key string, val []byte, ttl time.Duration, prevVal []byte) ([]byte, error)
+	// Backup writes all keys with their values and TTLs to the archive
+	// signed with signingKey, see BackupWriter
+	Backup(w io.Writer, signingKey []byte) error
+	// Restore verifies the archive signature and upserts all keys from it,
+	// nothing is written if the archive fails verification
+	Restore(r io.Reader, signingKey []byte) error
+}
+
+// HealthCheckTTL is a TTL of keys written by CheckReadWrite, so they
+// don't pile up in the backend
+const HealthCheckTTL = time.Minute
+
+// CheckReadWrite makes a write-then-read round trip to the backend with
+// a short lived key, it returns error if the backend can't be written
+// to or returns a different value
+func CheckReadWrite(b Backend, key string) error {
+	bucket := []string{"health"}
+	val := []byte(fmt.Sprintf("%v", time.Now().UnixNano()))
+	if err := b.UpsertVal(bucket, key, val, HealthCheckTTL); err != nil {
+		return trace.Wrap(err)
+	}
+	out, err := b.GetVal(bucket, key)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !bytes.Equal(out, val) {
+		return trace.Errorf("backend returned %q instead of %q written to it", out, val)
+	}
+	return nil
+}
+
+// HealthChecker is implemented by backends that can lose the ability to
+// write while they still serve reads, e.g. etcd without quorum
+type HealthChecker interface {
+	// Degraded returns a ReadonlyError with the reason if the backend
+	// rejects writes, or nil if it's healthy
+	Degraded() error
+}
+
+// BucketReplacer is implemented by backends that can replace all values
+// in a bucket in a single transaction
+type BucketReplacer interface {
+	// ReplaceBucket deletes all keys in the bucket and inserts vals
+	// with a given TTL, so readers see either the old or the new set
+	ReplaceBucket(bucket []string, vals map[string][]byte, ttl time.Duration) error
 }
@@ -0,0 +1,131 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backend
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// BackupRecord is a single key stored in a backup archive
+type BackupRecord struct {
+	// Bucket is a path to the bucket holding the key
+	Bucket []string `json:"bucket"`
+	// Key is a key name in the bucket
+	Key string `json:"key"`
+	// Value is a value of the key
+	Value []byte `json:"val"`
+	// TTL is the time left before the key expires, Forever if it never does
+	TTL time.Duration `json:"ttl"`
+}
+
+// backupLine is a single line of the archive: every line but the last one
+// holds a record, the last one holds HMAC-SHA256 of all preceding lines
+type backupLine struct {
+	Record *BackupRecord `json:"record,omitempty"`
+	HMAC   string        `json:"hmac,omitempty"`
+}
+
+// BackupWriter writes records to a backup archive and signs it
+// with the signing key on Close
+type BackupWriter struct {
+	w   io.Writer
+	mac hash.Hash
+}
+
+// NewBackupWriter returns a writer of the archive signed with signingKey
+func NewBackupWriter(w io.Writer, signingKey []byte) (*BackupWriter, error) {
+	if len(signingKey) == 0 {
+		return nil, trace.Wrap(teleport.BadParameter("signingKey", "missing backup signing key"))
+	}
+	return &BackupWriter{w: w, mac: hmac.New(sha256.New, signingKey)}, nil
+}
+
+// Write appends the record to the archive
+func (a *BackupWriter) Write(r BackupRecord) error {
+	line, err := json.Marshal(backupLine{Record: &r})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	line = append(line, '\n')
+	if _, err := io.MultiWriter(a.w, a.mac).Write(line); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// Close writes the signature trailer, the archive is not
+// accepted by ReadBackup without it
+func (a *BackupWriter) Close() error {
+	line, err := json.Marshal(backupLine{HMAC: hex.EncodeToString(a.mac.Sum(nil))})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = a.w.Write(append(line, '\n'))
+	return trace.Wrap(err)
+}
+
+// ReadBackup reads all records from the archive and verifies its signature,
+// records are returned only if the archive has not been modified or truncated
+func ReadBackup(r io.Reader, signingKey []byte) ([]BackupRecord, error) {
+	if len(signingKey) == 0 {
+		return nil, trace.Wrap(teleport.BadParameter("signingKey", "missing backup signing key"))
+	}
+	mac := hmac.New(sha256.New, signingKey)
+	reader := bufio.NewReader(r)
+	var records []BackupRecord
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil, trace.Wrap(teleport.BadParameter(
+					"archive", "backup archive is missing a signature, it may be truncated"))
+			}
+			return nil, trace.Wrap(err)
+		}
+		var l backupLine
+		if err := json.Unmarshal(line, &l); err != nil {
+			return nil, trace.Wrap(teleport.BadParameter(
+				"archive", "backup archive is corrupted: "+err.Error()))
+		}
+		if l.Record != nil {
+			mac.Write(line)
+			records = append(records, *l.Record)
+			continue
+		}
+		expected, err := hex.DecodeString(l.HMAC)
+		if err != nil || !hmac.Equal(expected, mac.Sum(nil)) {
+			return nil, trace.Wrap(teleport.AccessDenied(
+				"backup archive signature does not match, it was modified or signed with another key"))
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			return nil, trace.Wrap(teleport.BadParameter(
+				"archive", "unexpected data after the backup archive signature"))
+		}
+		return records, nil
+	}
+}
@@ -21,6 +21,7 @@ package boltbk
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -28,6 +29,7 @@ import (
 	"time"
 
 	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/backend"
 
 	"github.com/boltdb/bolt"
 	"github.com/gravitational/trace"
@@ -41,6 +43,14 @@ type BoltBackend struct {
 	db    *bolt.DB
 	clock timetools.TimeProvider
 	locks map[string]time.Time
+
+	// openTimeout is a time to wait for the database file lock held
+	// by another process, zero waits forever
+	openTimeout time.Duration
+
+	// readOnly is set for snapshots opened with OpenSnapshot, all
+	// writes fail and expired keys are skipped instead of deleted
+	readOnly bool
 }
 
 // Option sets functional options for the backend
@@ -54,6 +64,15 @@ func Clock(clock timetools.TimeProvider) Option {
 	}
 }
 
+// OpenTimeout sets a time to wait for the database file lock held by
+// another process, New fails with AlreadyAcquiredError after it
+func OpenTimeout(timeout time.Duration) Option {
+	return func(b *BoltBackend) error {
+		b.openTimeout = timeout
+		return nil
+	}
+}
+
 // New returns a new isntance of bolt backend
 func New(path string, opts ...Option) (*BoltBackend, error) {
 	path, err := filepath.Abs(path)
@@ -70,8 +89,27 @@ func New(path string, opts ...Option) (*BoltBackend, error) {
 			teleport.BadParameter(
 				"path", fmt.Sprintf("path '%v' should be a valid directory", dir)))
 	}
+	return open(path, false, opts)
+}
+
+// OpenSnapshot opens a database file written by Snapshot as a read-only
+// backend, writes to it fail with ReadonlyError. The file can be opened
+// by several processes at once
+func OpenSnapshot(path string, opts ...Option) (*BoltBackend, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, trace.Wrap(err, "failed to convert path")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	return open(path, true, opts)
+}
+
+func open(path string, readOnly bool, opts []Option) (*BoltBackend, error) {
 	b := &BoltBackend{
-		locks: make(map[string]time.Time),
+		locks:    make(map[string]time.Time),
+		readOnly: readOnly,
 	}
 	for _, option := range opts {
 		if err := option(b); err != nil {
@@ -81,14 +119,45 @@ func New(path string, opts ...Option) (*BoltBackend, error) {
 	if b.clock == nil {
 		b.clock = &timetools.RealTime{}
 	}
-	db, err := bolt.Open(path, 0600, nil)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: b.openTimeout, ReadOnly: readOnly})
 	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, trace.Wrap(&teleport.AlreadyAcquiredError{
+				Message: fmt.Sprintf("database '%v' is locked by another process", path)})
+		}
 		return nil, trace.Wrap(err)
 	}
 	b.db = db
 	return b, nil
 }
 
+// Snapshot writes a consistent point-in-time copy of the database file
+// to w, the database stays available for reads and writes meanwhile.
+// The copy can be opened with OpenSnapshot
+func (b *BoltBackend) Snapshot(w io.Writer) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return trace.Wrap(err)
+	})
+}
+
+// update runs fn in a read-write transaction, it fails for snapshots
+func (b *BoltBackend) update(fn func(tx *bolt.Tx) error) error {
+	if b.readOnly {
+		return trace.Wrap(&teleport.ReadonlyError{Message: "bolt snapshot is read-only"})
+	}
+	return b.db.Update(fn)
+}
+
+// expire deletes the expired key, snapshots can't be modified, so
+// the key stays there and is skipped on reads
+func (b *BoltBackend) expire(path []string, key string) error {
+	if b.readOnly {
+		return nil
+	}
+	return b.deleteKey(path, key)
+}
+
 // Close closes the backend resources
 func (b *BoltBackend) Close() error {
 	return b.db.Close()
@@ -102,6 +171,17 @@ func (b *BoltBackend) GetKeys(path []string) ([]string, error) {
 		}
 		return nil, trace.Wrap(err)
 	}
+	if b.readOnly {
+		// expired keys can't be deleted from a snapshot, skip them
+		live := keys[:0]
+		for _, key := range keys {
+			if !b.isExpired(path, key) {
+				live = append(live, key)
+			}
+		}
+		sort.Sort(sort.StringSlice(live))
+		return live, nil
+	}
 	// now do an iteration to expire keys
 	for _, key := range keys {
 		b.GetVal(path, key)
@@ -114,6 +194,20 @@ func (b *BoltBackend) GetKeys(path []string) ([]string, error) {
 	return keys, nil
 }
 
+// isExpired returns true if key is a value with expired TTL, nested
+// buckets never expire
+func (b *BoltBackend) isExpired(path []string, key string) bool {
+	var val []byte
+	if err := b.getKey(path, key, &val); err != nil {
+		return false
+	}
+	var k *kv
+	if err := json.Unmarshal(val, &k); err != nil {
+		return false
+	}
+	return k.TTL != 0 && b.clock.UtcNow().Sub(k.Created) > k.TTL
+}
+
 func (b *BoltBackend) UpsertVal(path []string, key string, val []byte, ttl time.Duration) error {
 	return b.upsertVal(path, key, val, ttl)
 }
@@ -133,7 +227,7 @@ func (b *BoltBackend) CreateVal(bucket []string, key string, val []byte, ttl tim
 }
 
 func (b *BoltBackend) TouchVal(bucket []string, key string, ttl time.Duration) error {
-	err := b.db.Update(func(tx *bolt.Tx) error {
+	err := b.update(func(tx *bolt.Tx) error {
 		bkt, err := UpsertBucket(tx, bucket)
 		if err != nil {
 			return trace.Wrap(err)
@@ -158,6 +252,128 @@ func (b *BoltBackend) TouchVal(bucket []string, key string, ttl time.Duration) e
 	return trace.Wrap(err)
 }
 
+// ReplaceBucket deletes all keys in the bucket and inserts vals
+// with a given TTL in a single transaction
+func (b *BoltBackend) ReplaceBucket(path []string, vals map[string][]byte, ttl time.Duration) error {
+	if len(path) == 0 {
+		return trace.Wrap(teleport.BadParameter("path", "bucket path can't be empty"))
+	}
+	created := b.clock.UtcNow()
+	b.Lock()
+	defer b.Unlock()
+	return b.update(func(tx *bolt.Tx) error {
+		parent, err := UpsertBucket(tx, path[:len(path)-1])
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		name := []byte(path[len(path)-1])
+		if parent.Bucket(name) != nil {
+			if err := parent.DeleteBucket(name); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+		bkt, err := parent.CreateBucket(name)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		for key, val := range vals {
+			bytes, err := json.Marshal(&kv{Created: created, Value: val, TTL: ttl})
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			if err := bkt.Put([]byte(key), bytes); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+// Backup writes all keys that have not expired yet to the signed archive
+func (b *BoltBackend) Backup(w io.Writer, signingKey []byte) error {
+	archive, err := backend.NewBackupWriter(w, signingKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	now := b.clock.UtcNow()
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bkt *bolt.Bucket) error {
+			return backupBucket(archive, []string{string(name)}, bkt, now)
+		})
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(archive.Close())
+}
+
+func backupBucket(archive *backend.BackupWriter, path []string, bkt *bolt.Bucket, now time.Time) error {
+	c := bkt.Cursor()
+	for key, val := c.First(); key != nil; key, val = c.Next() {
+		// nested buckets have nil values
+		if val == nil {
+			nested := append(append([]string{}, path...), string(key))
+			if err := backupBucket(archive, nested, bkt.Bucket(key), now); err != nil {
+				return trace.Wrap(err)
+			}
+			continue
+		}
+		var k *kv
+		if err := json.Unmarshal(val, &k); err != nil {
+			return trace.Wrap(err)
+		}
+		ttl := k.TTL
+		if ttl != 0 {
+			ttl = k.Created.Add(k.TTL).Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+		}
+		err := archive.Write(backend.BackupRecord{
+			Bucket: path,
+			Key:    string(key),
+			Value:  k.Value,
+			TTL:    ttl,
+		})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Restore verifies the archive and upserts all keys from it
+// in a single transaction
+func (b *BoltBackend) Restore(r io.Reader, signingKey []byte) error {
+	records, err := backend.ReadBackup(r, signingKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	created := b.clock.UtcNow()
+	b.Lock()
+	defer b.Unlock()
+	return b.update(func(tx *bolt.Tx) error {
+		for _, rec := range records {
+			if len(rec.Bucket) == 0 {
+				return trace.Wrap(teleport.BadParameter(
+					rec.Key, "bolt backend does not support keys outside of buckets"))
+			}
+			bkt, err := UpsertBucket(tx, rec.Bucket)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			bytes, err := json.Marshal(&kv{Created: created, Value: rec.Value, TTL: rec.TTL})
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			if err := bkt.Put([]byte(rec.Key), bytes); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
 func (b *BoltBackend) upsertVal(path []string, key string, val []byte, ttl time.Duration) error {
 	v := &kv{
 		Created: b.clock.UtcNow(),
@@ -206,7 +422,7 @@ func (b *BoltBackend) GetVal(path []string, key string) ([]byte, error) {
 		return nil, trace.Wrap(err)
 	}
 	if k.TTL != 0 && b.clock.UtcNow().Sub(k.Created) > k.TTL {
-		if err := b.deleteKey(path, key); err != nil {
+		if err := b.expire(path, key); err != nil {
 			return nil, err
 		}
 		return nil, trace.Wrap(&teleport.NotFoundError{
@@ -225,7 +441,7 @@ func (b *BoltBackend) GetValAndTTL(path []string, key string) ([]byte, time.Dura
 		return nil, 0, trace.Wrap(err)
 	}
 	if k.TTL != 0 && b.clock.UtcNow().Sub(k.Created) > k.TTL {
-		if err := b.deleteKey(path, key); err != nil {
+		if err := b.expire(path, key); err != nil {
 			return nil, 0, trace.Wrap(err)
 		}
 		return nil, 0, trace.Wrap(&teleport.NotFoundError{
@@ -252,7 +468,7 @@ func (b *BoltBackend) DeleteBucket(path []string, bucket string) error {
 }
 
 func (b *BoltBackend) deleteBucket(buckets []string, bucket string) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+	return b.update(func(tx *bolt.Tx) error {
 		bkt, err := GetBucket(tx, buckets)
 		if err != nil {
 			return trace.Wrap(err)
@@ -266,7 +482,7 @@ func (b *BoltBackend) deleteBucket(buckets []string, bucket string) error {
 }
 
 func (b *BoltBackend) deleteKey(buckets []string, key string) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+	return b.update(func(tx *bolt.Tx) error {
 		bkt, err := GetBucket(tx, buckets)
 		if err != nil {
 			return trace.Wrap(err)
@@ -281,7 +497,7 @@ func (b *BoltBackend) deleteKey(buckets []string, key string) error {
 }
 
 func (b *BoltBackend) upsertKey(buckets []string, key string, bytes []byte) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+	return b.update(func(tx *bolt.Tx) error {
 		bkt, err := UpsertBucket(tx, buckets)
 		if err != nil {
 			return trace.Wrap(err)
@@ -291,7 +507,7 @@ func (b *BoltBackend) upsertKey(buckets []string, key string, bytes []byte) erro
 }
 
 func (b *BoltBackend) createKey(buckets []string, key string, bytes []byte) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+	return b.update(func(tx *bolt.Tx) error {
 		bkt, err := UpsertBucket(tx, buckets)
 		if err != nil {
 			return trace.Wrap(err)
@@ -310,7 +526,7 @@ func (b *BoltBackend) upsertJSONKey(buckets []string, key string, val interface{
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	return b.db.Update(func(tx *bolt.Tx) error {
+	return b.update(func(tx *bolt.Tx) error {
 		bkt, err := UpsertBucket(tx, buckets)
 		if err != nil {
 			return trace.Wrap(err)
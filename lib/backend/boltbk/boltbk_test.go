@@ -16,12 +16,17 @@ limitations under the License.
 package boltbk
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/backend/test"
 	"github.com/gravitational/teleport/lib/utils"
 
+	"github.com/mailgun/timetools"
 	. "gopkg.in/check.v1"
 )
 
@@ -81,3 +86,125 @@ func (s *BoltSuite) TestLock(c *C) {
 func (s *BoltSuite) TestValueAndTTL(c *C) {
 	s.suite.ValueAndTTl(c)
 }
+
+func (s *BoltSuite) TestReadWriteCheck(c *C) {
+	s.suite.ReadWriteCheck(c)
+}
+
+func (s *BoltSuite) TestBackupRestore(c *C) {
+	s.suite.BackupRestore(c)
+}
+
+func (s *BoltSuite) TestSnapshotDuringWrites(c *C) {
+	// every write replaces all keys of the bucket with the same value,
+	// a consistent snapshot never has values from different writes
+	vals := func(i int) map[string][]byte {
+		out := make(map[string][]byte)
+		for k := 0; k < 10; k++ {
+			out[fmt.Sprintf("key%v", k)] = []byte(fmt.Sprintf("%v", i))
+		}
+		return out
+	}
+	c.Assert(s.bk.ReplaceBucket([]string{"a", "b"}, vals(0), 0), IsNil)
+
+	doneC := make(chan struct{})
+	errC := make(chan error, 1)
+	go func() {
+		for i := 1; ; i++ {
+			select {
+			case <-doneC:
+				errC <- nil
+				return
+			default:
+			}
+			if err := s.bk.ReplaceBucket([]string{"a", "b"}, vals(i), 0); err != nil {
+				errC <- err
+				return
+			}
+		}
+	}()
+
+	var paths []string
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(s.dir, fmt.Sprintf("snapshot%v", i))
+		f, err := os.Create(path)
+		c.Assert(err, IsNil)
+		c.Assert(s.bk.Snapshot(f), IsNil)
+		c.Assert(f.Close(), IsNil)
+		paths = append(paths, path)
+	}
+	close(doneC)
+	c.Assert(<-errC, IsNil)
+
+	for _, path := range paths {
+		snap, err := OpenSnapshot(path)
+		c.Assert(err, IsNil)
+		keys, err := snap.GetKeys([]string{"a", "b"})
+		c.Assert(err, IsNil)
+		c.Assert(keys, HasLen, 10)
+		first, err := snap.GetVal([]string{"a", "b"}, keys[0])
+		c.Assert(err, IsNil)
+		for _, key := range keys[1:] {
+			val, err := snap.GetVal([]string{"a", "b"}, key)
+			c.Assert(err, IsNil)
+			c.Assert(string(val), Equals, string(first), Commentf("%v in %v", key, path))
+		}
+		c.Assert(snap.Close(), IsNil)
+	}
+}
+
+func (s *BoltSuite) TestSnapshotReadOnly(c *C) {
+	c.Assert(s.bk.UpsertVal([]string{"a", "b"}, "forever", []byte("1"), 0), IsNil)
+	c.Assert(s.bk.UpsertVal([]string{"a", "b"}, "short", []byte("2"), time.Minute), IsNil)
+
+	path := filepath.Join(s.dir, "snapshot")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	c.Assert(s.bk.Snapshot(f), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	// snapshot does not hold the lock of the live database and can
+	// be opened by several readers at once
+	snap, err := OpenSnapshot(path, OpenTimeout(time.Second))
+	c.Assert(err, IsNil)
+	defer snap.Close()
+	other, err := OpenSnapshot(path, OpenTimeout(time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(other.Close(), IsNil)
+
+	keys, err := snap.GetKeys([]string{"a", "b"})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"forever", "short"})
+	keys, err = snap.GetKeys([]string{"a"})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"b"})
+	val, ttl, err := snap.GetValAndTTL([]string{"a", "b"}, "short")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "2")
+	c.Assert(ttl > 0, Equals, true)
+
+	// writes made after the snapshot are not in it
+	c.Assert(s.bk.UpsertVal([]string{"a", "b"}, "later", []byte("3"), 0), IsNil)
+	_, err = snap.GetVal([]string{"a", "b"}, "later")
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+
+	// writes are rejected
+	c.Assert(teleport.IsReadonly(snap.UpsertVal([]string{"a"}, "c", []byte("4"), 0)), Equals, true)
+	c.Assert(teleport.IsReadonly(snap.DeleteKey([]string{"a", "b"}, "forever")), Equals, true)
+	c.Assert(teleport.IsReadonly(snap.DeleteBucket([]string{"a"}, "b")), Equals, true)
+
+	// expired keys are skipped, but stay in the snapshot
+	expired, err := OpenSnapshot(path, Clock(&timetools.FreezedTime{CurrentTime: time.Now().Add(time.Hour)}))
+	c.Assert(err, IsNil)
+	defer expired.Close()
+	keys, err = expired.GetKeys([]string{"a", "b"})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"forever"})
+	_, err = expired.GetVal([]string{"a", "b"}, "short")
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+	_, err = snap.GetVal([]string{"a", "b"}, "short")
+	c.Assert(err, IsNil)
+
+	_, err = OpenSnapshot(filepath.Join(s.dir, "missing"))
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+}
@@ -17,7 +17,12 @@ limitations under the License.
 package etcdbk
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/backend"
@@ -33,6 +38,25 @@ type Config struct {
 	TLSKeyFile  string   `json:"tls_key_file"`
 	TLSCertFile string   `json:"tls_cert_file"`
 	TLSCAFile   string   `json:"tls_ca_file"`
+	// ClusterName identifies the cluster that owns the data under Key,
+	// the backend refuses to start on a prefix owned by another cluster
+	ClusterName string `json:"cluster_name,omitempty"`
+	// ForceClusterName takes over a prefix owned by another cluster
+	ForceClusterName bool `json:"force_cluster_name,omitempty"`
+	// NodesFile is a file with etcd nodes, one per line, maintained by
+	// an external service discovery. It replaces Nodes and is re-read
+	// every NodesFileRefresh
+	NodesFile string `json:"nodes_file,omitempty"`
+	// NodesFileRefresh is a period of re-reading NodesFile,
+	// defaults.EtcdNodesFileRefresh is used if it's zero
+	NodesFileRefresh time.Duration `json:"nodes_file_refresh,omitempty"`
+	// QuorumCheckPeriod turns on the check of etcd quorum on start and
+	// every period after. Without quorum the backend rejects writes with
+	// ReadonlyError instead of waiting for etcd
+	QuorumCheckPeriod time.Duration `json:"quorum_check_period,omitempty"`
+	// RequestTimeout is a time a single etcd request has to complete,
+	// defaults.EtcdRequestTimeout is used if it's zero
+	RequestTimeout time.Duration `json:"request_timeout,omitempty"`
 }
 
 // Check checks if all the parameters are valid
@@ -40,7 +64,16 @@ func (cfg *Config) Check() error {
 	if len(cfg.Key) == 0 {
 		return trace.Wrap(teleport.BadParameter("Key", `supply a valid root key for Teleport data`))
 	}
-	if len(cfg.Nodes) == 0 {
+	if cfg.NodesFileRefresh < 0 {
+		return trace.Wrap(teleport.BadParameter("NodesFileRefresh", `nodes file refresh period can't be negative`))
+	}
+	if cfg.QuorumCheckPeriod < 0 {
+		return trace.Wrap(teleport.BadParameter("QuorumCheckPeriod", `quorum check period can't be negative`))
+	}
+	if cfg.RequestTimeout < 0 {
+		return trace.Wrap(teleport.BadParameter("RequestTimeout", `request timeout can't be negative`))
+	}
+	if len(cfg.Nodes) == 0 && cfg.NodesFile == "" {
 		return trace.Wrap(teleport.BadParameter("Nodes", `please supply a valid dictionary, e.g. {"nodes": ["http://localhost:4001]}`))
 	}
 	if cfg.TLSKeyFile == "" {
@@ -52,6 +85,33 @@ func (cfg *Config) Check() error {
 	return nil
 }
 
+// ReadNodesFile reads a list of etcd nodes from a file, one node per
+// line, empty lines and lines starting with '#' are skipped
+func ReadNodesFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	defer f.Close()
+	var nodes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		nodes = append(nodes, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(nodes) == 0 {
+		return nil, trace.Wrap(teleport.BadParameter("NodesFile",
+			fmt.Sprintf("no etcd nodes in %v", path)))
+	}
+	return nodes, nil
+}
+
 // FromObject initialized the backend from backend-specific string
 func FromObject(in interface{}) (backend.Backend, error) {
 	var cfg *Config
@@ -63,10 +123,19 @@ func FromObject(in interface{}) (backend.Backend, error) {
 
 // FromJSON returns backend initialized from JSON-encoded string
 func FromJSON(paramsJSON string) (backend.Backend, error) {
+	cfg, err := ParseConfig(paramsJSON)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return New(*cfg)
+}
+
+// ParseConfig parses JSON-encoded backend config
+func ParseConfig(paramsJSON string) (*Config, error) {
 	cfg := Config{}
 	err := json.Unmarshal([]byte(paramsJSON), &cfg)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	return New(cfg)
+	return &cfg, nil
 }
@@ -19,14 +19,19 @@ package etcdbk
 
 import (
 	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/backend"
 	"github.com/gravitational/teleport/lib/defaults"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/etcd/client"
 	"github.com/coreos/etcd/pkg/transport"
 	"github.com/gravitational/trace"
@@ -34,6 +39,7 @@ import (
 )
 
 type bk struct {
+	sync.Mutex
 	nodes []string
 
 	cfg     Config
@@ -42,6 +48,11 @@ type bk struct {
 	api     client.KeysAPI
 	cancelC chan bool
 	stopC   chan bool
+	// closeOnce closes stopC
+	closeOnce sync.Once
+	// noQuorum is the error of the last failed quorum check, it's nil
+	// if etcd has quorum or the check is off
+	noQuorum error
 }
 
 // New returns new instance of Etcd-powered backend
@@ -49,6 +60,9 @@ func New(cfg Config) (backend.Backend, error) {
 	if err := cfg.Check(); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = defaults.EtcdRequestTimeout
+	}
 	b := &bk{
 		cfg:     cfg,
 		nodes:   cfg.Nodes,
@@ -56,13 +70,168 @@ func New(cfg Config) (backend.Backend, error) {
 		cancelC: make(chan bool, 1),
 		stopC:   make(chan bool, 1),
 	}
+	if cfg.NodesFile != "" {
+		nodes, err := ReadNodesFile(cfg.NodesFile)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		b.nodes = nodes
+	}
 	if err := b.reconnect(); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	if cfg.NodesFile != "" {
+		refresh := cfg.NodesFileRefresh
+		if refresh == 0 {
+			refresh = defaults.EtcdNodesFileRefresh
+		}
+		go b.watchNodesFile(refresh)
+	}
+	if cfg.QuorumCheckPeriod != 0 {
+		b.checkQuorum()
+		go b.watchQuorum(cfg.QuorumCheckPeriod)
+	}
+	if cfg.ClusterName != "" {
+		if err := b.claimPrefix(cfg.ClusterName, cfg.ForceClusterName); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
 	return b, nil
 }
 
+// clusterMarkerKey is a reserved key under the prefix that holds the name
+// of the cluster owning the prefix
+const clusterMarkerKey = ".cluster_name"
+
+// claimPrefix writes the cluster marker under the prefix or makes sure
+// the existing marker belongs to this cluster. Two clusters sharing
+// a prefix would overwrite each other's locks and certificate authorities
+func (b *bk) claimPrefix(clusterName string, force bool) error {
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		// without quorum the prefix can only be checked, not claimed
+		re, getErr := b.api.Get(ctx, b.key(clusterMarkerKey), nil)
+		if getErr == nil && re.Node.Value == clusterName {
+			return nil
+		}
+		return trace.Wrap(err)
+	}
+	_, err := b.api.Set(ctx, b.key(clusterMarkerKey), clusterName,
+		&client.SetOptions{PrevExist: client.PrevNoExist})
+	err = convertErr(err)
+	if err == nil {
+		return nil
+	}
+	if !teleport.IsAlreadyExists(err) && !teleport.IsCompareFailed(err) {
+		return trace.Wrap(err)
+	}
+	re, err := b.api.Get(ctx, b.key(clusterMarkerKey), nil)
+	if err != nil {
+		return trace.Wrap(convertErr(err))
+	}
+	if re.Node.Value == clusterName {
+		return nil
+	}
+	if !force {
+		return trace.Wrap(teleport.AlreadyExists(fmt.Sprintf(
+			"etcd prefix '%v' is used by cluster '%v', refusing to start cluster '%v' on it: "+
+				"use a different prefix or set force_cluster_name to take it over",
+			b.etcdKey, re.Node.Value, clusterName)))
+	}
+	log.Warningf("[ETCD] taking over prefix '%v' from cluster '%v' for cluster '%v'",
+		b.etcdKey, re.Node.Value, clusterName)
+	_, err = b.api.Set(ctx, b.key(clusterMarkerKey), clusterName, nil)
+	return trace.Wrap(convertErr(err))
+}
+
 func (b *bk) Close() error {
+	b.closeOnce.Do(func() { close(b.stopC) })
+	return nil
+}
+
+// watchNodesFile re-reads the nodes file every period until the backend
+// is closed
+func (b *bk) watchNodesFile(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopC:
+			return
+		case <-ticker.C:
+			if err := b.reloadNodes(); err != nil {
+				log.Warningf("[ETCD] failed to reload nodes from %v: %v", b.cfg.NodesFile, err)
+			}
+		}
+	}
+}
+
+// watchQuorum checks etcd quorum every period until the backend is closed
+func (b *bk) watchQuorum(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopC:
+			return
+		case <-ticker.C:
+			b.checkQuorum()
+		}
+	}
+}
+
+// checkQuorum makes a quorum read that only succeeds if the etcd cluster
+// has a leader and the majority of members, and switches the backend to
+// read-only mode and back depending on the result
+func (b *bk) checkQuorum() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaults.EtcdQuorumCheckTimeout)
+	defer cancel()
+	_, err := b.api.Get(ctx, b.key(), &client.GetOptions{Quorum: true})
+	err = convertErr(err)
+	if teleport.IsNotFound(err) {
+		err = nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch {
+	case err != nil && b.noQuorum == nil:
+		log.Errorf("[ETCD] quorum check failed, rejecting writes until it passes: %v", err)
+	case err == nil && b.noQuorum != nil:
+		log.Infof("[ETCD] quorum check passed, accepting writes again")
+	}
+	b.noQuorum = err
+}
+
+// Degraded returns ReadonlyError if the last quorum check has failed
+func (b *bk) Degraded() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.noQuorum == nil {
+		return nil
+	}
+	return &teleport.ReadonlyError{
+		Message: fmt.Sprintf("etcd has no quorum, can't modify data: %v", b.noQuorum),
+	}
+}
+
+// reloadNodes reads the nodes file and switches the client to the new
+// list of nodes if it has changed
+func (b *bk) reloadNodes() error {
+	nodes, err := ReadNodesFile(b.cfg.NodesFile)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	b.Lock()
+	defer b.Unlock()
+	if reflect.DeepEqual(nodes, b.nodes) {
+		return nil
+	}
+	if err := b.client.SetEndpoints(nodes); err != nil {
+		return trace.Wrap(err)
+	}
+	log.Infof("[ETCD] nodes changed from %v to %v", b.nodes, nodes)
+	b.nodes = nodes
 	return nil
 }
 
@@ -94,6 +263,12 @@ func (b *bk) reconnect() error {
 	return nil
 }
 
+// requestContext returns a context of a single etcd request, etcd that
+// has lost quorum accepts writes, but never completes them
+func (b *bk) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), b.cfg.RequestTimeout)
+}
+
 func (b *bk) GetKeys(path []string) ([]string, error) {
 	keys, err := b.getKeys(b.key(path...))
 	if err != nil {
@@ -104,8 +279,13 @@ func (b *bk) GetKeys(path []string) ([]string, error) {
 }
 
 func (b *bk) CreateVal(path []string, key string, val []byte, ttl time.Duration) error {
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		return trace.Wrap(err)
+	}
 	_, err := b.api.Set(
-		context.Background(),
+		ctx,
 		b.key(append(path, key)...), base64.StdEncoding.EncodeToString(val),
 		&client.SetOptions{PrevExist: client.PrevNoExist, TTL: ttl})
 	return trace.Wrap(convertErr(err))
@@ -115,15 +295,20 @@ func (b *bk) CreateVal(path []string, key string, val []byte, ttl time.Duration)
 const maxOptimisticAttempts = 5
 
 func (b *bk) TouchVal(path []string, key string, ttl time.Duration) error {
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		return trace.Wrap(err)
+	}
 	var err error
 	var re *client.Response
 	for i := 0; i < maxOptimisticAttempts; i++ {
-		re, err = b.api.Get(context.Background(), key, nil)
+		re, err = b.api.Get(ctx, key, nil)
 		if err != nil {
 			return trace.Wrap(convertErr(err))
 		}
 		_, err = b.api.Set(
-			context.Background(),
+			ctx,
 			b.key(append(path, key)...), re.Node.Value,
 			&client.SetOptions{TTL: ttl, PrevValue: re.Node.Value, PrevExist: client.PrevExist})
 		err = convertErr(err)
@@ -135,23 +320,33 @@ func (b *bk) TouchVal(path []string, key string, ttl time.Duration) error {
 }
 
 func (b *bk) UpsertVal(path []string, key string, val []byte, ttl time.Duration) error {
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		return trace.Wrap(err)
+	}
 	_, err := b.api.Set(
-		context.Background(),
+		ctx,
 		b.key(append(path, key)...), base64.StdEncoding.EncodeToString(val), &client.SetOptions{TTL: ttl})
 	return convertErr(err)
 }
 
 func (b *bk) CompareAndSwap(path []string, key string, val []byte, ttl time.Duration, prevVal []byte) ([]byte, error) {
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	var err error
 	var re *client.Response
 	if len(prevVal) != 0 {
 		re, err = b.api.Set(
-			context.Background(),
+			ctx,
 			b.key(append(path, key)...), base64.StdEncoding.EncodeToString(val),
 			&client.SetOptions{TTL: ttl, PrevValue: base64.StdEncoding.EncodeToString(prevVal), PrevExist: client.PrevExist})
 	} else {
 		re, err = b.api.Set(
-			context.Background(),
+			ctx,
 			b.key(append(path, key)...), base64.StdEncoding.EncodeToString(val),
 			&client.SetOptions{TTL: ttl, PrevExist: client.PrevNoExist})
 	}
@@ -171,7 +366,9 @@ func (b *bk) CompareAndSwap(path []string, key string, val []byte, ttl time.Dura
 }
 
 func (b *bk) GetVal(path []string, key string) ([]byte, error) {
-	re, err := b.api.Get(context.Background(), b.key(append(path, key)...), nil)
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	re, err := b.api.Get(ctx, b.key(append(path, key)...), nil)
 	if err != nil {
 		return nil, convertErr(err)
 	}
@@ -186,7 +383,9 @@ func (b *bk) GetVal(path []string, key string) ([]byte, error) {
 }
 
 func (b *bk) GetValAndTTL(path []string, key string) ([]byte, time.Duration, error) {
-	re, err := b.api.Get(context.Background(), b.key(append(path, key)...), nil)
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	re, err := b.api.Get(ctx, b.key(append(path, key)...), nil)
 	if err != nil {
 		return nil, 0, convertErr(err)
 	}
@@ -202,22 +401,108 @@ func (b *bk) GetValAndTTL(path []string, key string) ([]byte, time.Duration, err
 }
 
 func (b *bk) DeleteKey(path []string, key string) error {
-	_, err := b.api.Delete(context.Background(), b.key(append(path, key)...), nil)
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		return trace.Wrap(err)
+	}
+	_, err := b.api.Delete(ctx, b.key(append(path, key)...), nil)
 	return convertErr(err)
 }
 
 func (b *bk) DeleteBucket(path []string, key string) error {
-	_, err := b.api.Delete(context.Background(), b.key(append(path, key)...), &client.DeleteOptions{Dir: true, Recursive: true})
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		return trace.Wrap(err)
+	}
+	_, err := b.api.Delete(ctx, b.key(append(path, key)...), &client.DeleteOptions{Dir: true, Recursive: true})
 	return convertErr(err)
 }
 
+// Backup writes all keys under the prefix to the signed archive,
+// locks and the cluster marker are not included
+func (b *bk) Backup(w io.Writer, signingKey []byte) error {
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	archive, err := backend.NewBackupWriter(w, signingKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	re, err := b.api.Get(ctx, b.key(), &client.GetOptions{Recursive: true})
+	err = convertErr(err)
+	if err != nil && !teleport.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	if err == nil {
+		for _, n := range re.Node.Nodes {
+			name := suffix(n.Key)
+			if name == clusterMarkerKey || name == "locks" {
+				continue
+			}
+			if err := backupNode(archive, nil, n); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+	}
+	return trace.Wrap(archive.Close())
+}
+
+func backupNode(archive *backend.BackupWriter, path []string, n *client.Node) error {
+	if isDir(n) {
+		nested := append(append([]string{}, path...), suffix(n.Key))
+		for _, child := range n.Nodes {
+			if err := backupNode(archive, nested, child); err != nil {
+				return trace.Wrap(err)
+			}
+		}
+		return nil
+	}
+	value, err := base64.StdEncoding.DecodeString(n.Value)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return archive.Write(backend.BackupRecord{
+		Bucket: path,
+		Key:    suffix(n.Key),
+		Value:  value,
+		TTL:    time.Duration(n.TTL) * time.Second,
+	})
+}
+
+// Restore verifies the archive and upserts all keys from it, etcd has
+// no transactions, so a failure can leave the keys partially restored
+func (b *bk) Restore(r io.Reader, signingKey []byte) error {
+	records, err := backend.ReadBackup(r, signingKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, rec := range records {
+		ttl := rec.TTL
+		// etcd TTLs have a second precision and zero means forever
+		if ttl > 0 && ttl < time.Second {
+			ttl = time.Second
+		}
+		if err := b.UpsertVal(rec.Bucket, rec.Key, rec.Value, ttl); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
 const delayBetweenLockAttempts = 100 * time.Millisecond
 
 func (b *bk) AcquireLock(token string, ttl time.Duration) error {
 	for {
+		// quorum can be lost while waiting for the lock
+		if err := b.Degraded(); err != nil {
+			return trace.Wrap(err)
+		}
+		ctx, cancel := b.requestContext()
 		_, err := b.api.Set(
-			context.Background(),
+			ctx,
 			b.key("locks", token), "lock", &client.SetOptions{TTL: ttl, PrevExist: client.PrevNoExist})
+		cancel()
 		err = convertErr(err)
 		if err == nil {
 			return nil
@@ -232,13 +517,20 @@ func (b *bk) AcquireLock(token string, ttl time.Duration) error {
 }
 
 func (b *bk) ReleaseLock(token string) error {
-	_, err := b.api.Delete(context.Background(), b.key("locks", token), nil)
+	ctx, cancel := b.requestContext()
+	defer cancel()
+	if err := b.Degraded(); err != nil {
+		return trace.Wrap(err)
+	}
+	_, err := b.api.Delete(ctx, b.key("locks", token), nil)
 	return convertErr(err)
 }
 
 func (b *bk) getKeys(key string) ([]string, error) {
+	ctx, cancel := b.requestContext()
+	defer cancel()
 	var vals []string
-	re, err := b.api.Get(context.Background(), key, nil)
+	re, err := b.api.Get(ctx, key, nil)
 	err = convertErr(err)
 	if err != nil {
 		if teleport.IsNotFound(err) {
@@ -17,11 +17,17 @@ limitations under the License.
 package etcdbk
 
 import (
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/backend/test"
+	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/coreos/etcd/client"
@@ -100,3 +106,213 @@ func (s *EtcdSuite) TestLock(c *C) {
 func (s *EtcdSuite) TestValueAndTTL(c *C) {
 	s.suite.ValueAndTTl(c)
 }
+
+func (s *EtcdSuite) TestReadWriteCheck(c *C) {
+	s.suite.ReadWriteCheck(c)
+}
+
+func (s *EtcdSuite) TestBackupRestore(c *C) {
+	s.suite.BackupRestore(c)
+}
+
+func (s *EtcdSuite) TestClusterName(c *C) {
+	cfg, err := ParseConfig(s.configString)
+	c.Assert(err, IsNil)
+
+	cfg.ClusterName = "a.example.com"
+	b, err := New(*cfg)
+	c.Assert(err, IsNil)
+	c.Assert(b.(*bk).Close(), IsNil)
+
+	// the same cluster can start again
+	b, err = New(*cfg)
+	c.Assert(err, IsNil)
+	c.Assert(b.(*bk).Close(), IsNil)
+
+	// a different cluster on the same prefix is refused
+	cfg.ClusterName = "b.example.com"
+	_, err = New(*cfg)
+	c.Assert(teleport.IsAlreadyExists(err), Equals, true)
+	c.Assert(err, ErrorMatches, ".*used by cluster 'a.example.com'.*")
+
+	// unless forced
+	cfg.ForceClusterName = true
+	b, err = New(*cfg)
+	c.Assert(err, IsNil)
+	c.Assert(b.(*bk).Close(), IsNil)
+
+	cfg.ClusterName, cfg.ForceClusterName = "a.example.com", false
+	_, err = New(*cfg)
+	c.Assert(teleport.IsAlreadyExists(err), Equals, true)
+}
+
+func (s *EtcdSuite) TestQuorumLoss(c *C) {
+	cfg, err := ParseConfig(s.configString)
+	c.Assert(err, IsNil)
+	// checks are made by the test
+	cfg.QuorumCheckPeriod = time.Hour
+	b, err := New(*cfg)
+	c.Assert(err, IsNil)
+	defer b.(*bk).Close()
+	etcd := b.(*bk)
+	c.Assert(etcd.Degraded(), IsNil)
+	c.Assert(b.UpsertVal([]string{"a"}, "b", []byte("val"), 0), IsNil)
+
+	// cut the backend off the cluster, so quorum reads fail
+	nodes := etcd.client.Endpoints()
+	c.Assert(etcd.client.SetEndpoints([]string{"http://127.0.0.1:1"}), IsNil)
+	etcd.checkQuorum()
+	c.Assert(teleport.IsReadonly(etcd.Degraded()), Equals, true)
+	c.Assert(teleport.IsReadonly(b.UpsertVal([]string{"a"}, "b", []byte("val2"), 0)), Equals, true)
+	c.Assert(teleport.IsReadonly(b.DeleteKey([]string{"a"}, "b")), Equals, true)
+	c.Assert(teleport.IsReadonly(b.AcquireLock("lock", time.Minute)), Equals, true)
+
+	// writes are accepted again once quorum is back
+	c.Assert(etcd.client.SetEndpoints(nodes), IsNil)
+	etcd.checkQuorum()
+	c.Assert(etcd.Degraded(), IsNil)
+	c.Assert(b.UpsertVal([]string{"a"}, "b", []byte("val2"), 0), IsNil)
+	out, err := b.GetVal([]string{"a"}, "b")
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "val2")
+}
+
+// NodesFileSuite tests the nodes file, it does not need etcd as the client
+// does not connect to nodes until the first request
+type NodesFileSuite struct{}
+
+var _ = Suite(&NodesFileSuite{})
+
+func (s *NodesFileSuite) TestNodesFile(c *C) {
+	dir := c.MkDir()
+	creds, err := utils.GenerateSelfSignedCert([]string{"localhost"})
+	c.Assert(err, IsNil)
+	cfg := Config{
+		Key:         "/teleport",
+		TLSKeyFile:  filepath.Join(dir, "etcd.key"),
+		TLSCertFile: filepath.Join(dir, "etcd.cert"),
+		NodesFile:   filepath.Join(dir, "nodes"),
+	}
+	c.Assert(ioutil.WriteFile(cfg.TLSKeyFile, creds.PrivateKey, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(cfg.TLSCertFile, creds.Cert, 0600), IsNil)
+
+	// the nodes file is required to exist and to have nodes
+	_, err = New(cfg)
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+	c.Assert(ioutil.WriteFile(cfg.NodesFile, []byte("# no nodes yet\n"), 0600), IsNil)
+	_, err = New(cfg)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+
+	c.Assert(ioutil.WriteFile(cfg.NodesFile, []byte(`# etcd nodes
+https://10.0.0.1:2379
+
+https://10.0.0.2:2379
+`), 0600), IsNil)
+	b, err := New(cfg)
+	c.Assert(err, IsNil)
+	defer b.(*bk).Close()
+	clt := b.(*bk).client
+	// the client shuffles endpoints
+	endpoints := func() []string {
+		out := append([]string{}, clt.Endpoints()...)
+		sort.Strings(out)
+		return out
+	}
+	c.Assert(endpoints(), DeepEquals, []string{"https://10.0.0.1:2379", "https://10.0.0.2:2379"})
+
+	// updated file changes the endpoints of the client
+	c.Assert(ioutil.WriteFile(cfg.NodesFile, []byte("https://10.0.0.3:2379\n"), 0600), IsNil)
+	c.Assert(b.(*bk).reloadNodes(), IsNil)
+	c.Assert(endpoints(), DeepEquals, []string{"https://10.0.0.3:2379"})
+
+	// broken file keeps the current endpoints
+	c.Assert(ioutil.WriteFile(cfg.NodesFile, []byte("\n"), 0600), IsNil)
+	c.Assert(b.(*bk).reloadNodes(), NotNil)
+	c.Assert(endpoints(), DeepEquals, []string{"https://10.0.0.3:2379"})
+
+	// the file is re-read periodically
+	cfg.NodesFileRefresh = 10 * time.Millisecond
+	c.Assert(ioutil.WriteFile(cfg.NodesFile, []byte("https://10.0.0.4:2379\n"), 0600), IsNil)
+	b, err = New(cfg)
+	c.Assert(err, IsNil)
+	defer b.(*bk).Close()
+	clt = b.(*bk).client
+	c.Assert(ioutil.WriteFile(cfg.NodesFile, []byte("https://10.0.0.5:2379\n"), 0600), IsNil)
+	start := time.Now()
+	for endpoints()[0] != "https://10.0.0.5:2379" {
+		c.Assert(time.Now().Sub(start) < 5*time.Second, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// either nodes or nodes file are required
+	cfg.NodesFile = ""
+	c.Assert(teleport.IsBadParameter(cfg.Check()), Equals, true)
+}
+
+func (s *NodesFileSuite) TestNoQuorumOnStart(c *C) {
+	dir := c.MkDir()
+	creds, err := utils.GenerateSelfSignedCert([]string{"localhost"})
+	c.Assert(err, IsNil)
+	cfg := Config{
+		Key:               "/teleport",
+		TLSKeyFile:        filepath.Join(dir, "etcd.key"),
+		TLSCertFile:       filepath.Join(dir, "etcd.cert"),
+		Nodes:             []string{"http://127.0.0.1:1"},
+		QuorumCheckPeriod: time.Hour,
+	}
+	c.Assert(ioutil.WriteFile(cfg.TLSKeyFile, creds.PrivateKey, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(cfg.TLSCertFile, creds.Cert, 0600), IsNil)
+
+	// the backend starts read-only if etcd is unreachable
+	b, err := New(cfg)
+	c.Assert(err, IsNil)
+	defer b.(*bk).Close()
+	c.Assert(teleport.IsReadonly(b.(*bk).Degraded()), Equals, true)
+	c.Assert(teleport.IsReadonly(b.UpsertVal([]string{"a"}, "b", []byte("val"), 0)), Equals, true)
+
+	cfg.QuorumCheckPeriod = -time.Second
+	c.Assert(teleport.IsBadParameter(cfg.Check()), Equals, true)
+}
+
+func (s *NodesFileSuite) TestRequestTimeout(c *C) {
+	// etcd that accepts connections, but never responds, like
+	// a member waiting for the quorum to come back
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dir := c.MkDir()
+	creds, err := utils.GenerateSelfSignedCert([]string{"localhost"})
+	c.Assert(err, IsNil)
+	cfg := Config{
+		Key:            "/teleport",
+		TLSKeyFile:     filepath.Join(dir, "etcd.key"),
+		TLSCertFile:    filepath.Join(dir, "etcd.cert"),
+		Nodes:          []string{"http://" + l.Addr().String()},
+		RequestTimeout: 100 * time.Millisecond,
+	}
+	c.Assert(ioutil.WriteFile(cfg.TLSKeyFile, creds.PrivateKey, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(cfg.TLSCertFile, creds.Cert, 0600), IsNil)
+	b, err := New(cfg)
+	c.Assert(err, IsNil)
+	defer b.(*bk).Close()
+
+	start := time.Now()
+	c.Assert(b.UpsertVal([]string{"a"}, "b", []byte("val"), 0), NotNil)
+	_, err = b.GetVal([]string{"a"}, "b")
+	c.Assert(err, NotNil)
+	// both requests give up before the client header timeout
+	c.Assert(time.Now().Sub(start) < defaults.DefaultReadHeadersTimeout, Equals, true)
+
+	cfg.RequestTimeout = -time.Second
+	c.Assert(teleport.IsBadParameter(cfg.Check()), Equals, true)
+}
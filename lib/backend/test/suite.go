@@ -19,6 +19,7 @@ limitations under the License.
 package test
 
 import (
+	"bytes"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -187,6 +188,53 @@ func (s *BackendSuite) ValueAndTTl(c *C) {
 	c.Assert(ttlIsRight, Equals, true)
 }
 
+func (s *BackendSuite) ReadWriteCheck(c *C) {
+	c.Assert(backend.CheckReadWrite(s.B, "host1"), IsNil)
+	c.Assert(backend.CheckReadWrite(s.B, "host1"), IsNil)
+
+	_, ttl, err := s.B.GetValAndTTL([]string{"health"}, "host1")
+	c.Assert(err, IsNil)
+	c.Assert(ttl > 0 && ttl <= backend.HealthCheckTTL, Equals, true)
+}
+
+func (s *BackendSuite) BackupRestore(c *C) {
+	signingKey := []byte("backup signing key")
+	c.Assert(s.B.UpsertVal([]string{"backup", "a"}, "k1", []byte("v1"), backend.Forever), IsNil)
+	c.Assert(s.B.UpsertVal([]string{"backup", "a", "b"}, "k2", []byte("v2"), time.Hour), IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(s.B.Backup(&buf, signingKey), IsNil)
+	archive := buf.Bytes()
+
+	c.Assert(s.B.DeleteBucket([]string{"backup"}, "a"), IsNil)
+	c.Assert(s.B.Restore(bytes.NewReader(archive), signingKey), IsNil)
+
+	val, ttl, err := s.B.GetValAndTTL([]string{"backup", "a"}, "k1")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "v1")
+	c.Assert(ttl, Equals, backend.Forever)
+	val, ttl, err = s.B.GetValAndTTL([]string{"backup", "a", "b"}, "k2")
+	c.Assert(err, IsNil)
+	c.Assert(string(val), Equals, "v2")
+	c.Assert(ttl > 0 && ttl <= time.Hour, Equals, true, Commentf("%v", ttl))
+
+	// "djE=" is base64 of "v1"
+	tampered := bytes.Replace(archive, []byte("djE="), []byte("djI="), 1)
+	c.Assert(bytes.Equal(tampered, archive), Equals, false)
+	c.Assert(s.B.DeleteBucket([]string{"backup"}, "a"), IsNil)
+
+	err = s.B.Restore(bytes.NewReader(tampered), signingKey)
+	c.Assert(teleport.IsAccessDenied(err), Equals, true, Commentf("%#v", err))
+	err = s.B.Restore(bytes.NewReader(archive), []byte("another key"))
+	c.Assert(teleport.IsAccessDenied(err), Equals, true, Commentf("%#v", err))
+	truncated := archive[:bytes.LastIndex(archive[:len(archive)-1], []byte("\n"))+1]
+	err = s.B.Restore(bytes.NewReader(truncated), signingKey)
+	c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf("%#v", err))
+
+	_, err = s.B.GetVal([]string{"backup", "a"}, "k1")
+	c.Assert(teleport.IsNotFound(err), Equals, true, Commentf("%#v", err))
+}
+
 func (s *BackendSuite) Locking(c *C) {
 	tok1 := "token1"
 	tok2 := "token2"
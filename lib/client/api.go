@@ -24,7 +24,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"os"
 	"os/signal"
@@ -77,6 +76,15 @@ type Config struct {
 
 	// InsecureSkipVerify is an option to skip HTTPS cert check
 	InsecureSkipVerify bool
+
+	// KeyStore stores the keys signed by the proxy, the store set by
+	// TELEPORT_KEYSTORE environment variable is used if it is not set
+	KeyStore KeyStore
+
+	// HostSignersFile is a name of the file in the keys directory that
+	// stores trusted host CAs, TELEPORT_HOST_SIGNERS_FILE environment
+	// variable or HostSignersFilename is used if it is not set
+	HostSignersFile string
 }
 
 // ProxyHostPort returns a full host:port address of the proxy or an empty string if no
@@ -128,9 +136,26 @@ func NewClient(c *Config) (tc *TeleportClient, err error) {
 		log.Infof("no host login given. defaulting to %s", c.HostLogin)
 	}
 	if c.KeyTTL == 0 {
-		c.KeyTTL = defaults.CertDuration
-	} else if c.KeyTTL > defaults.MaxCertDuration || c.KeyTTL < defaults.MinCertDuration {
-		return nil, trace.Errorf("invalid requested cert TTL")
+		c.KeyTTL, err = DefaultKeyTTL()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	} else if err = checkKeyTTL(c.KeyTTL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if c.KeyStore == nil {
+		c.KeyStore, err = DefaultKeyStore()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	if c.HostSignersFile == "" {
+		c.HostSignersFile, err = HostSignersFile()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	} else if err = checkHostSignersFile(c.HostSignersFile); err != nil {
+		return nil, trace.Wrap(err)
 	}
 
 	tc = &TeleportClient{
@@ -146,7 +171,7 @@ func NewClient(c *Config) (tc *TeleportClient, err error) {
 
 	// then, we can authenticate via a locally stored cert previously
 	// signed by the CA:
-	localAgent, err := GetLocalAgent()
+	localAgent, err := getAgent(tc.KeyStore)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -525,7 +550,7 @@ func (tc *TeleportClient) ConnectToProxy() (*ProxyClient, error) {
 	proxyAddr := tc.Config.ProxyHostPort(defaults.SSHProxyListenPort)
 	sshConfig := &ssh.ClientConfig{
 		User:            tc.Config.Login,
-		HostKeyCallback: CheckHostSignature,
+		HostKeyCallback: tc.checkHostSignature,
 	}
 	if len(tc.authMethods) == 0 {
 		return nil, trace.Errorf("no authentication methods provided")
@@ -632,23 +657,37 @@ func (tc *TeleportClient) Login() error {
 		return trace.Wrap(err)
 	}
 	key := Key{
-		Priv:     priv,
-		Cert:     response.Cert,
-		Deadline: time.Now().Add(tc.KeyTTL),
+		Priv: priv,
+		Cert: response.Cert,
 	}
-	keyPath := filepath.Join(getKeysDir(), KeyFilePrefix+strconv.FormatInt(rand.Int63n(100), 16)+KeyFileSuffix)
-	err = saveKey(key, keyPath)
+	name, err := newKeyName()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	err = saveKey(tc.KeyStore, name, key, tc.KeyTTL)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 	// save the list of CAs we trust to the cache file
-	err = AddHostSignersToCache(response.HostSigners)
+	err = addHostSigners(tc.hostSignersPath(), response.HostSigners)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 	return nil
 }
 
+// hostSignersPath returns a path to the file with trusted host CAs
+// of this client
+func (tc *TeleportClient) hostSignersPath() string {
+	return filepath.Join(getKeysDir(), tc.HostSignersFile)
+}
+
+// checkHostSignature checks that the host certificate is signed by one
+// of the host CAs trusted by this client
+func (tc *TeleportClient) checkHostSignature(hostID string, remote net.Addr, key ssh.PublicKey) error {
+	return checkHostSignature(tc.hostSignersPath(), key)
+}
+
 // loopbackPool reads trusted CAs if it finds it in a predefined location
 // and will work only if target proxy address is loopback
 func loopbackPool(proxyAddr string) *x509.CertPool {
@@ -17,8 +17,15 @@ limitations under the License.
 package client
 
 import (
-	"gopkg.in/check.v1"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
+
+	"gopkg.in/check.v1"
 )
 
 // register test suite
@@ -65,3 +72,42 @@ func (s *APITestSuite) TestParseLabels(c *check.C) {
 	c.Assert(m, check.IsNil)
 	c.Assert(err, check.NotNil)
 }
+
+func (s *APITestSuite) TestKeyTTL(c *check.C) {
+	defer os.Unsetenv(teleport.KeyTTLEnvVar)
+
+	os.Unsetenv(teleport.KeyTTLEnvVar)
+	ttl, err := DefaultKeyTTL()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl, check.Equals, defaults.CertDuration)
+
+	os.Setenv(teleport.KeyTTLEnvVar, "2h")
+	ttl, err = DefaultKeyTTL()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl, check.Equals, 2*time.Hour)
+
+	tc, err := NewClient(&Config{ProxyHost: "proxy", Host: "localhost"})
+	c.Assert(err, check.IsNil)
+	c.Assert(tc.KeyTTL, check.Equals, 2*time.Hour)
+
+	// saved key gets the deadline from the TTL
+	store := NewFSKeyStore(c.MkDir())
+	path := filepath.Join(store.Dir, KeyFilePrefix+"test"+KeyFileSuffix)
+	start := time.Now()
+	c.Assert(saveKey(store, filepath.Base(path), Key{Priv: []byte("priv"), Cert: []byte("cert")}, ttl), check.IsNil)
+	key, err := loadKey(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.Deadline.Before(start.Add(ttl)), check.Equals, false)
+	c.Assert(key.Deadline.After(time.Now().Add(ttl)), check.Equals, false)
+
+	// lifetime has to be within the cluster limits
+	c.Assert(saveKey(store, filepath.Base(path), Key{}, defaults.MaxCertDuration+time.Hour), check.NotNil)
+	os.Setenv(teleport.KeyTTLEnvVar, "100h")
+	_, err = DefaultKeyTTL()
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	os.Setenv(teleport.KeyTTLEnvVar, "day")
+	_, err = DefaultKeyTTL()
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	_, err = NewClient(&Config{ProxyHost: "proxy", Host: "localhost"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// Keyring is a secret storage of the operating system,
+// e.g. macOS Keychain or Secret Service on Linux
+type Keyring interface {
+	// Get returns the secret saved under the name or NotFound
+	Get(name string) ([]byte, error)
+	// Set saves the secret under the name, replacing existing one
+	Set(name string, data []byte) error
+	// Delete deletes the secret saved under the name
+	Delete(name string) error
+}
+
+// keyringIndex is a name of the keyring item listing the names
+// of saved keys, keyrings can't list items reliably
+const keyringIndex = "teleport_keys"
+
+// keyringLockFile is a name of the lock file of the index in keys dir
+const keyringLockFile = "keyring.lock"
+
+// KeyringStore stores keys in the system keyring
+type KeyringStore struct {
+	keyring Keyring
+	// lockPath is a file locked while the index is updated
+	lockPath string
+}
+
+// NewKeyringStore returns the key store keeping keys in the keyring,
+// lockPath is a file that serializes updates of the index by tsh
+// processes running at the same time
+func NewKeyringStore(keyring Keyring, lockPath string) *KeyringStore {
+	return &KeyringStore{keyring: keyring, lockPath: lockPath}
+}
+
+// AddKey saves the key to the keyring and adds it to the index
+func (k *KeyringStore) AddKey(name string, key Key) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := k.keyring.Set(name, data); err != nil {
+		return trace.Wrap(err)
+	}
+	unlock, err := k.lockIndex()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer unlock()
+	names, err := k.GetKeyNames()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+	return trace.Wrap(k.setKeyNames(append(names, name)))
+}
+
+// GetKey returns the key saved in the keyring
+func (k *KeyringStore) GetKey(name string) (*Key, error) {
+	data, err := k.keyring.Get(name)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var key Key
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &key, nil
+}
+
+// GetKeyNames returns names of the keys in the index
+func (k *KeyringStore) GetKeyNames() ([]string, error) {
+	data, err := k.keyring.Get(keyringIndex)
+	if err != nil {
+		if teleport.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, trace.Wrap(err)
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return names, nil
+}
+
+// DeleteKey deletes the key from the keyring and the index
+func (k *KeyringStore) DeleteKey(name string) error {
+	if err := k.keyring.Delete(name); err != nil && !teleport.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	unlock, err := k.lockIndex()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer unlock()
+	names, err := k.GetKeyNames()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		if n != name {
+			out = append(out, n)
+		}
+	}
+	return trace.Wrap(k.setKeyNames(out))
+}
+
+// lockIndex takes an exclusive lock of the index, so concurrent updates
+// don't lose each other's names, the returned function releases it
+func (k *KeyringStore) lockIndex() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(k.lockPath), os.ModeDir|0700); err != nil {
+		return nil, trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	f, err := os.OpenFile(k.lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, trace.Wrap(err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (k *KeyringStore) setKeyNames(names []string) error {
+	data, err := json.Marshal(names)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(k.keyring.Set(keyringIndex, data))
+}
+
+// keyringService is a service name of teleport items in the keyring
+const keyringService = "teleport"
+
+// SystemKeyring returns the keyring of the operating system, it uses
+// "security" tool on macOS and "secret-tool" of libsecret on Linux
+func SystemKeyring() (Keyring, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return darwinKeyring(), nil
+	case "linux":
+		return linuxKeyring(), nil
+	}
+	return nil, trace.Wrap(teleport.BadParameter("keystore",
+		fmt.Sprintf("system keyring is not supported on %v", runtime.GOOS)))
+}
+
+// darwinKeyring uses macOS Keychain with "security" tool
+func darwinKeyring() *commandKeyring {
+	return &commandKeyring{
+		get: func(name string) []string {
+			return []string{"security", "find-generic-password", "-s", keyringService, "-a", name, "-w"}
+		},
+		set: func(name, secret string) ([]string, string) {
+			// security accepts the password only as an argument, the
+			// command is read from stdin in interactive mode to keep
+			// the secret out of the process list
+			return []string{"security", "-i"}, fmt.Sprintf("add-generic-password -U -s %v -a %v -w %v\n",
+				keyringService, name, secret)
+		},
+		delete: func(name string) []string {
+			return []string{"security", "delete-generic-password", "-s", keyringService, "-a", name}
+		},
+	}
+}
+
+// linuxKeyring uses Secret Service with "secret-tool" of libsecret
+func linuxKeyring() *commandKeyring {
+	return &commandKeyring{
+		get: func(name string) []string {
+			return []string{"secret-tool", "lookup", "service", keyringService, "name", name}
+		},
+		set: func(name, secret string) ([]string, string) {
+			return []string{"secret-tool", "store", "--label", fmt.Sprintf("%v %v", keyringService, name),
+				"service", keyringService, "name", name}, secret
+		},
+		delete: func(name string) []string {
+			return []string{"secret-tool", "clear", "service", keyringService, "name", name}
+		},
+	}
+}
+
+// commandKeyring accesses the keyring with command line tools,
+// secrets are base64 encoded as the tools handle text only
+type commandKeyring struct {
+	get    func(name string) []string
+	set    func(name, secret string) (args []string, stdin string)
+	delete func(name string) []string
+}
+
+func (c *commandKeyring) Get(name string) ([]byte, error) {
+	if err := checkKeyringName(name); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	out, err := runKeyringCommand(c.get(name), "")
+	if err != nil {
+		// tools exit with an error and print nothing if the item is missing
+		if _, ok := err.(*keyringCommandError); ok && len(out) == 0 {
+			return nil, trace.Wrap(teleport.NotFound(fmt.Sprintf("keyring item %q is not found", name)))
+		}
+		return nil, trace.Wrap(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return data, nil
+}
+
+func (c *commandKeyring) Set(name string, data []byte) error {
+	if err := checkKeyringName(name); err != nil {
+		return trace.Wrap(err)
+	}
+	args, stdin := c.set(name, base64.StdEncoding.EncodeToString(data))
+	_, err := runKeyringCommand(args, stdin)
+	return trace.Wrap(err)
+}
+
+func (c *commandKeyring) Delete(name string) error {
+	if err := checkKeyringName(name); err != nil {
+		return trace.Wrap(err)
+	}
+	_, err := runKeyringCommand(c.delete(name), "")
+	return trace.Wrap(err)
+}
+
+// checkKeyringName makes sure the name can be passed to the tools
+// as a single word, security reads it from a command line on stdin
+func checkKeyringName(name string) error {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '\'' || r == '\\'
+	}) != -1 {
+		return trace.Wrap(teleport.BadParameter("name", fmt.Sprintf("unsupported keyring item name %q", name)))
+	}
+	return nil
+}
+
+// keyringCommandError is returned when a keyring tool fails
+type keyringCommandError struct {
+	args   []string
+	err    error
+	stderr string
+}
+
+func (e *keyringCommandError) Error() string {
+	return fmt.Sprintf("%v %v failed: %v %v", e.args[0], e.args[1], e.err, e.stderr)
+}
+
+func runKeyringCommand(args []string, stdin string) (string, error) {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		// not a missing item, the keyring can't be used at all
+		return "", trace.Wrap(teleport.BadParameter("keystore",
+			fmt.Sprintf("%v is required to use the system keyring: %v", args[0], err)))
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil && stdin != "" && stderr.Len() != 0 {
+		// security -i exits with zero if a command read from stdin fails
+		err = fmt.Errorf("unexpected output")
+	}
+	if err != nil {
+		return stdout.String(), &keyringCommandError{args: args, err: err, stderr: strings.TrimSpace(stderr.String())}
+	}
+	return stdout.String(), nil
+}
@@ -22,6 +22,7 @@ package client
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -30,9 +31,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/backend/boltbk"
+	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/sshutils"
+	"github.com/gravitational/teleport/lib/utils"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gravitational/trace"
@@ -48,10 +52,20 @@ import (
 //
 // Why do we trust these CAs? Because we received them from a trusted Teleport Proxy.
 // Why do we trust the proxy? Because we've connected to it via HTTPS + username + Password + HOTP.
+//
+// CAs are added to the file set by TELEPORT_HOST_SIGNERS_FILE
 func AddHostSignersToCache(hostSigners []services.CertAuthority) error {
-	bk, err := boltbk.New(filepath.Join(getKeysDir(), HostSignersFilename))
+	path, err := defaultHostSignersPath()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return addHostSigners(path, hostSigners)
+}
+
+func addHostSigners(path string, hostSigners []services.CertAuthority) error {
+	bk, err := openHostSigners(path)
 	if err != nil {
-		return trace.Wrap(nil)
+		return trace.Wrap(err)
 	}
 	defer bk.Close()
 	ca := services.NewCAService(bk)
@@ -59,23 +73,51 @@ func AddHostSignersToCache(hostSigners []services.CertAuthority) error {
 	for _, hostSigner := range hostSigners {
 		err := ca.UpsertCertAuthority(hostSigner, 0)
 		if err != nil {
-			return trace.Wrap(nil)
+			return trace.Wrap(err)
 		}
 	}
 	return nil
 }
 
+// ReplaceHostSigners replaces the whole list of trusted CAs with hostSigners
+// in a single transaction, so CAs missing from the list are no longer trusted
+func ReplaceHostSigners(hostSigners []services.CertAuthority) error {
+	path, err := defaultHostSignersPath()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return replaceHostSigners(path, hostSigners)
+}
+
+func replaceHostSigners(path string, hostSigners []services.CertAuthority) error {
+	bk, err := openHostSigners(path)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer bk.Close()
+	ca := services.NewCAService(bk)
+	return trace.Wrap(ca.ReplaceCertAuthorities(services.HostCA, hostSigners))
+}
+
 // CheckHostSignature checks if the given host key was signed by one of the trusted
-// certificaate authorities (CAs)
+// certificaate authorities (CAs) stored in the file set by TELEPORT_HOST_SIGNERS_FILE
 func CheckHostSignature(hostId string, remote net.Addr, key ssh.PublicKey) error {
+	path, err := defaultHostSignersPath()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return checkHostSignature(path, key)
+}
+
+func checkHostSignature(path string, key ssh.PublicKey) error {
 	cert, ok := key.(*ssh.Certificate)
 	if !ok {
 		return trace.Errorf("expected certificate")
 	}
 
-	bk, err := boltbk.New(filepath.Join(getKeysDir(), HostSignersFilename))
+	bk, err := openHostSigners(path)
 	if err != nil {
-		return trace.Wrap(nil)
+		return trace.Wrap(err)
 	}
 	defer bk.Close()
 	ca := services.NewCAService(bk)
@@ -99,15 +141,207 @@ func CheckHostSignature(hostId string, remote net.Addr, key ssh.PublicKey) error
 	return trace.Errorf("no matching authority found")
 }
 
+// HostSignersFile returns a name of the file in the keys directory with
+// trusted host CAs, set by TELEPORT_HOST_SIGNERS_FILE environment variable,
+// HostSignersFilename is used if it's not set
+func HostSignersFile() (string, error) {
+	name := os.Getenv(teleport.HostSignersFileEnvVar)
+	if name == "" {
+		return HostSignersFilename, nil
+	}
+	if err := checkHostSignersFile(name); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return name, nil
+}
+
+// checkHostSignersFile makes sure the name of the host signers file
+// does not point outside of the keys directory
+func checkHostSignersFile(name string) error {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return trace.Wrap(teleport.BadParameter(teleport.HostSignersFileEnvVar,
+			fmt.Sprintf("expected a file name without a directory, got %q", name)))
+	}
+	return nil
+}
+
+func defaultHostSignersPath() (string, error) {
+	name, err := HostSignersFile()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return filepath.Join(getKeysDir(), name), nil
+}
+
+// openHostSigners opens the database of trusted host signers, it retries
+// with a backoff while the database is locked by another tsh process
+func openHostSigners(path string) (*boltbk.BoltBackend, error) {
+	period := HostSignersRetryPeriod
+	for i := 1; ; i++ {
+		bk, err := boltbk.New(path, boltbk.OpenTimeout(HostSignersLockTimeout))
+		if err == nil {
+			return bk, nil
+		}
+		if !teleport.IsAlreadyAcquired(err) || i >= HostSignersOpenAttempts {
+			return nil, trace.Wrap(err)
+		}
+		log.Debugf("host signers database is locked, attempt %v of %v, retrying in %v",
+			i, HostSignersOpenAttempts, period)
+		time.Sleep(period)
+		period *= 2
+	}
+}
+
+// KeyStore stores client keys under unique names
+type KeyStore interface {
+	// AddKey saves the key under the name, replacing existing one
+	AddKey(name string, key Key) error
+	// GetKey returns the key saved under the name or NotFound
+	GetKey(name string) (*Key, error)
+	// GetKeyNames returns names of all saved keys
+	GetKeyNames() ([]string, error)
+	// DeleteKey deletes the key saved under the name
+	DeleteKey(name string) error
+}
+
+const (
+	// KeyStoreFile stores keys as files in the keys directory
+	KeyStoreFile = "file"
+	// KeyStoreKeyring stores keys in the system keyring
+	KeyStoreKeyring = "keyring"
+)
+
+// NewKeyStore returns the key store of the given kind, file
+// store is used if kind is empty
+func NewKeyStore(kind string) (KeyStore, error) {
+	switch kind {
+	case "", KeyStoreFile:
+		return NewFSKeyStore(getKeysDir()), nil
+	case KeyStoreKeyring:
+		keyring, err := SystemKeyring()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return NewKeyringStore(keyring, filepath.Join(getKeysDir(), keyringLockFile)), nil
+	}
+	return nil, trace.Wrap(teleport.BadParameter("keystore",
+		fmt.Sprintf("unsupported key store %q, supported are %q and %q", kind, KeyStoreFile, KeyStoreKeyring)))
+}
+
+// DefaultKeyStore returns the key store set by TELEPORT_KEYSTORE
+// environment variable, keys are stored as files by default
+func DefaultKeyStore() (KeyStore, error) {
+	store, err := NewKeyStore(os.Getenv(teleport.KeyStoreEnvVar))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return store, nil
+}
+
+// FSKeyStore stores keys as JSON files in a directory
+type FSKeyStore struct {
+	// Dir is a directory with key files
+	Dir string
+}
+
+// NewFSKeyStore returns the key store keeping keys in dir
+func NewFSKeyStore(dir string) *FSKeyStore {
+	return &FSKeyStore{Dir: dir}
+}
+
+// AddKey saves the key to the file with the name
+func (fs *FSKeyStore) AddKey(name string, key Key) error {
+	if err := os.MkdirAll(fs.Dir, os.ModeDir|0777); err != nil {
+		return trace.Wrap(err)
+	}
+	bytes, err := json.Marshal(key)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fs.Dir, name), bytes, 0666); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// GetKey loads the key from the file with the name
+func (fs *FSKeyStore) GetKey(name string) (*Key, error) {
+	path := filepath.Join(fs.Dir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, trace.Wrap(teleport.NotFound(fmt.Sprintf("key %q is not found", name)))
+	}
+	key, err := loadKey(path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &key, nil
+}
+
+// GetKeyNames returns names of the key files in the directory
+func (fs *FSKeyStore) GetKeyNames() ([]string, error) {
+	files, err := ioutil.ReadDir(fs.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, trace.Wrap(err)
+	}
+	var names []string
+	for _, file := range files {
+		if isKeyFile(file) {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+// DeleteKey removes the file with the name
+func (fs *FSKeyStore) DeleteKey(name string) error {
+	if err := os.Remove(filepath.Join(fs.Dir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return trace.Wrap(teleport.NotFound(fmt.Sprintf("key %q is not found", name)))
+		}
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+func isKeyFile(file os.FileInfo) bool {
+	return !file.IsDir() && strings.HasPrefix(file.Name(), KeyFilePrefix) &&
+		strings.HasSuffix(file.Name(), KeyFileSuffix)
+}
+
+// newKeyName returns a random name for a new key
+func newKeyName() (string, error) {
+	id, err := utils.CryptoRandomHex(8)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return KeyFilePrefix + id + KeyFileSuffix, nil
+}
+
 // GetLocalAgentKeys returns a list of local keys agents can use
 // to authenticate
 func GetLocalAgentKeys() ([]agent.AddedKey, error) {
+	store, err := DefaultKeyStore()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return getAgentKeys(store)
+}
+
+func getAgentKeys(store KeyStore) ([]agent.AddedKey, error) {
+	// keys dir keeps the trusted host signers regardless of the key store
 	err := initKeysDir()
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 
-	existingKeys, err := loadAllKeys()
+	grace, err := KeyGracePeriod()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	existingKeys, err := loadAllKeys(store, grace)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -136,7 +370,15 @@ func GetLocalAgentKeys() ([]agent.AddedKey, error) {
 // GetLocalAgent loads all the saved teleport certificates and
 // creates ssh agent with them
 func GetLocalAgent() (agent.Agent, error) {
-	keys, err := GetLocalAgentKeys()
+	store, err := DefaultKeyStore()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return getAgent(store)
+}
+
+func getAgent(store KeyStore) (agent.Agent, error) {
+	keys, err := getAgentKeys(store)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -170,23 +412,66 @@ type Key struct {
 	Deadline time.Time
 }
 
-func saveKey(key Key, filename string) error {
-	err := initKeysDir()
-	if err != nil {
-		return trace.Wrap(err)
+// DefaultKeyTTL returns the lifetime of client keys used when it is not
+// set explicitly: the value of TELEPORT_KEY_TTL environment variable
+// if it is set, or defaults.CertDuration otherwise
+func DefaultKeyTTL() (time.Duration, error) {
+	value := os.Getenv(teleport.KeyTTLEnvVar)
+	if value == "" {
+		return defaults.CertDuration, nil
 	}
-	bytes, err := json.Marshal(key)
+	ttl, err := time.ParseDuration(value)
 	if err != nil {
-		return trace.Wrap(err)
+		return 0, trace.Wrap(teleport.BadParameter(teleport.KeyTTLEnvVar,
+			fmt.Sprintf("failed to parse '%v': %v", value, err)))
+	}
+	if err := checkKeyTTL(ttl); err != nil {
+		return 0, trace.Wrap(err)
 	}
+	return ttl, nil
+}
 
-	err = ioutil.WriteFile(filename, bytes, 0666)
+// KeyGracePeriod returns the time expired client keys are still loaded for,
+// so they survive minor clock skew: the value of TELEPORT_KEY_GRACE_PERIOD
+// environment variable if it is set, or zero otherwise
+func KeyGracePeriod() (time.Duration, error) {
+	value := os.Getenv(teleport.KeyGracePeriodEnvVar)
+	if value == "" {
+		return 0, nil
+	}
+	grace, err := time.ParseDuration(value)
 	if err != nil {
-		return trace.Wrap(err)
+		return 0, trace.Wrap(teleport.BadParameter(teleport.KeyGracePeriodEnvVar,
+			fmt.Sprintf("failed to parse '%v': %v", value, err)))
+	}
+	if grace < 0 {
+		return 0, trace.Wrap(teleport.BadParameter(teleport.KeyGracePeriodEnvVar,
+			fmt.Sprintf("grace period %v can't be negative", grace)))
+	}
+	return grace, nil
+}
+
+// checkKeyTTL makes sure the key lifetime is within the limits of
+// certificate duration the cluster accepts
+func checkKeyTTL(ttl time.Duration) error {
+	if ttl < defaults.MinCertDuration || ttl > defaults.MaxCertDuration {
+		return trace.Wrap(teleport.BadParameter("ttl",
+			fmt.Sprintf("key TTL %v is out of range, it should be between %v and %v",
+				ttl, defaults.MinCertDuration, defaults.MaxCertDuration)))
 	}
 	return nil
 }
 
+// saveKey saves the key that expires after ttl to the store
+func saveKey(store KeyStore, name string, key Key, ttl time.Duration) error {
+	if err := checkKeyTTL(ttl); err != nil {
+		return trace.Wrap(err)
+	}
+	key.Deadline = time.Now().Add(ttl)
+	return trace.Wrap(store.AddKey(name, key))
+}
+
+// loadKey reads the key from the key file
 func loadKey(filename string) (Key, error) {
 	bytes, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -204,35 +489,162 @@ func loadKey(filename string) (Key, error) {
 
 }
 
-func loadAllKeys() ([]Key, error) {
+// loadAllKeys returns the keys from the store that are not expired yet
+// or expired less than grace ago, keys expired longer ago are removed
+func loadAllKeys(store KeyStore, grace time.Duration) ([]Key, error) {
 	keys := make([]Key, 0)
-	files, err := ioutil.ReadDir(getKeysDir())
+	names, err := store.GetKeyNames()
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	for _, file := range files {
-		if !file.IsDir() && strings.HasPrefix(file.Name(), KeyFilePrefix) &&
-			strings.HasSuffix(file.Name(), KeyFileSuffix) {
-			key, err := loadKey(filepath.Join(getKeysDir(), file.Name()))
-			if err != nil {
-				log.Errorf(err.Error())
-				continue
-			}
+	for _, name := range names {
+		key, err := store.GetKey(name)
+		if err != nil {
+			log.Errorf("failed to load key %v: %v", name, err)
+			continue
+		}
 
-			if time.Now().Before(key.Deadline) {
-				keys = append(keys, key)
-			} else {
-				// remove old keys
-				err = os.Remove(filepath.Join(getKeysDir(), file.Name()))
-				if err != nil {
-					log.Errorf(err.Error())
-				}
+		if time.Now().Before(key.Deadline.Add(grace)) {
+			keys = append(keys, *key)
+		} else {
+			// remove old keys
+			if err := store.DeleteKey(name); err != nil {
+				log.Errorf("failed to remove key %v: %v", name, err)
 			}
 		}
 	}
 	return keys, nil
 }
 
+// ImportKeys copies valid keys found in srcDir, e.g. the keys directory
+// of another machine or user, into the active key store. Expired and
+// malformed keys are skipped. It returns the number of imported keys
+func ImportKeys(srcDir string) (imported int, err error) {
+	store, err := DefaultKeyStore()
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	return importKeys(srcDir, store)
+}
+
+func importKeys(srcDir string, store KeyStore) (int, error) {
+	files, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	// keys already in the store or imported earlier are not added again
+	seen, err := keyFingerprints(store)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	imported := 0
+	for _, file := range files {
+		if !isKeyFile(file) {
+			continue
+		}
+		path := filepath.Join(srcDir, file.Name())
+		key, err := loadKey(path)
+		if err != nil {
+			log.Warningf("skipping malformed key %v: %v", path, err)
+			continue
+		}
+		if err := checkKey(key); err != nil {
+			log.Warningf("skipping malformed key %v: %v", path, err)
+			continue
+		}
+		fingerprint, err := keyFingerprint(key)
+		if err != nil {
+			log.Warningf("skipping malformed key %v: %v", path, err)
+			continue
+		}
+		if seen[fingerprint] {
+			log.Infof("skipping duplicate key %v", path)
+			continue
+		}
+		ttl := key.Deadline.Sub(time.Now())
+		if ttl < defaults.MinCertDuration {
+			log.Infof("skipping expired key %v", path)
+			continue
+		}
+		name, err := uniqueKeyName(store, file.Name())
+		if err != nil {
+			return imported, trace.Wrap(err)
+		}
+		if err := saveKey(store, name, key, ttl); err != nil {
+			log.Warningf("skipping key %v: %v", path, err)
+			continue
+		}
+		seen[fingerprint] = true
+		imported++
+	}
+	return imported, nil
+}
+
+// checkKey makes sure the key holds a certificate and a private key
+// agents can use
+func checkKey(key Key) error {
+	pcert, _, _, _, err := ssh.ParseAuthorizedKey(key.Cert)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if _, ok := pcert.(*ssh.Certificate); !ok {
+		return trace.Wrap(teleport.BadParameter("cert", "expected certificate"))
+	}
+	if _, err := ssh.ParseRawPrivateKey(key.Priv); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// keyFingerprint returns the fingerprint of the key certificate
+func keyFingerprint(key Key) (string, error) {
+	pcert, _, _, _, err := ssh.ParseAuthorizedKey(key.Cert)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return utils.Fingerprint(pcert), nil
+}
+
+// keyFingerprints returns the set of fingerprints of the keys in the
+// store, keys that can't be read are skipped
+func keyFingerprints(store KeyStore) (map[string]bool, error) {
+	names, err := store.GetKeyNames()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	fingerprints := make(map[string]bool, len(names))
+	for _, name := range names {
+		key, err := store.GetKey(name)
+		if err != nil {
+			continue
+		}
+		fingerprint, err := keyFingerprint(*key)
+		if err != nil {
+			continue
+		}
+		fingerprints[fingerprint] = true
+	}
+	return fingerprints, nil
+}
+
+// uniqueKeyName returns a name for the key in the store, keeping the
+// name if it is not taken yet
+func uniqueKeyName(store KeyStore, name string) (string, error) {
+	// the name is taken by another key, possibly unreadable one
+	_, err := store.GetKey(name)
+	for !teleport.IsNotFound(err) {
+		name, err = newKeyName()
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		_, err = store.GetKey(name)
+		if err != nil && !teleport.IsNotFound(err) {
+			return "", trace.Wrap(err)
+		}
+	}
+	return name, nil
+}
+
 // getKeysDir() returns the directory where a client can store the temporary keys
 func getKeysDir() string {
 	var baseDir string
@@ -249,4 +661,13 @@ var (
 	KeyFilePrefix       = "teleport_"
 	KeyFileSuffix       = ".tkey"
 	HostSignersFilename = "hostsigners.db"
+
+	// HostSignersOpenAttempts is a number of attempts to open the database
+	// of trusted host signers locked by another tsh process
+	HostSignersOpenAttempts = defaults.HostSignersOpenAttempts
+	// HostSignersLockTimeout is a time every attempt waits for the lock
+	HostSignersLockTimeout = defaults.HostSignersLockTimeout
+	// HostSignersRetryPeriod is a delay after the first failed attempt,
+	// it doubles after every next one
+	HostSignersRetryPeriod = defaults.HostSignersRetryPeriod
 )
@@ -0,0 +1,416 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth/native"
+	"github.com/gravitational/teleport/lib/auth/testauthority"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+type KeystoreSuite struct {
+}
+
+var _ = check.Suite(&KeystoreSuite{})
+
+func (s *KeystoreSuite) TestOpenLockedHostSigners(c *check.C) {
+	path := filepath.Join(c.MkDir(), HostSignersFilename)
+
+	// another tsh process holds the lock for a moment
+	db, err := bolt.Open(path, 0600, nil)
+	c.Assert(err, check.IsNil)
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(3 * HostSignersLockTimeout)
+		c.Check(db.Close(), check.IsNil)
+		close(released)
+	}()
+
+	bk, err := openHostSigners(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(bk.Close(), check.IsNil)
+	<-released
+
+	// lock that is never released fails after all attempts
+	db, err = bolt.Open(path, 0600, nil)
+	c.Assert(err, check.IsNil)
+	defer db.Close()
+	defer func(attempts int) { HostSignersOpenAttempts = attempts }(HostSignersOpenAttempts)
+	HostSignersOpenAttempts = 2
+	_, err = openHostSigners(path)
+	c.Assert(teleport.IsAlreadyAcquired(err), check.Equals, true)
+}
+
+func (s *KeystoreSuite) TestHostSignersFiles(c *check.C) {
+	keygen := native.New()
+	defer keygen.Close()
+	caPrivA, caPubA, err := keygen.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	_, caPubB, err := keygen.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	_, hostPub, err := keygen.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	certBytes, err := keygen.GenerateHostCert(caPrivA, hostPub, "node", "a.example.com", teleport.RoleNode, time.Hour)
+	c.Assert(err, check.IsNil)
+	hostCert, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	c.Assert(err, check.IsNil)
+
+	// two contexts sharing the keys dir trust different authorities
+	dir := c.MkDir()
+	pathA, pathB := filepath.Join(dir, "a.db"), filepath.Join(dir, "b.db")
+	c.Assert(addHostSigners(pathA, []services.CertAuthority{
+		{Type: services.HostCA, DomainName: "a.example.com", CheckingKeys: [][]byte{caPubA}},
+	}), check.IsNil)
+	c.Assert(addHostSigners(pathB, []services.CertAuthority{
+		{Type: services.HostCA, DomainName: "b.example.com", CheckingKeys: [][]byte{caPubB}},
+	}), check.IsNil)
+
+	c.Assert(checkHostSignature(pathA, hostCert), check.IsNil)
+	c.Assert(checkHostSignature(pathB, hostCert), check.NotNil)
+}
+
+func (s *KeystoreSuite) TestReplaceHostSigners(c *check.C) {
+	keygen := native.New()
+	defer keygen.Close()
+	caPrivA, caPubA, err := keygen.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	caPrivB, caPubB, err := keygen.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	_, hostPub, err := keygen.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	hostCert := func(caPriv []byte, domain string) ssh.PublicKey {
+		certBytes, err := keygen.GenerateHostCert(caPriv, hostPub, "node", domain, teleport.RoleNode, time.Hour)
+		c.Assert(err, check.IsNil)
+		cert, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+		c.Assert(err, check.IsNil)
+		return cert
+	}
+	certA, certB := hostCert(caPrivA, "a.example.com"), hostCert(caPrivB, "b.example.com")
+
+	path := filepath.Join(c.MkDir(), HostSignersFilename)
+	c.Assert(addHostSigners(path, []services.CertAuthority{
+		{Type: services.HostCA, DomainName: "a.example.com", CheckingKeys: [][]byte{caPubA}},
+		{Type: services.HostCA, DomainName: "b.example.com", CheckingKeys: [][]byte{caPubB}},
+	}), check.IsNil)
+	c.Assert(checkHostSignature(path, certA), check.IsNil)
+	c.Assert(checkHostSignature(path, certB), check.IsNil)
+
+	// the authority missing from the new list is no longer trusted
+	c.Assert(replaceHostSigners(path, []services.CertAuthority{
+		{Type: services.HostCA, DomainName: "b.example.com", CheckingKeys: [][]byte{caPubB}},
+	}), check.IsNil)
+	c.Assert(checkHostSignature(path, certA), check.NotNil)
+	c.Assert(checkHostSignature(path, certB), check.IsNil)
+}
+
+func (s *KeystoreSuite) TestHostSignersFile(c *check.C) {
+	defer os.Unsetenv(teleport.HostSignersFileEnvVar)
+
+	os.Unsetenv(teleport.HostSignersFileEnvVar)
+	name, err := HostSignersFile()
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, HostSignersFilename)
+
+	os.Setenv(teleport.HostSignersFileEnvVar, "staging.db")
+	name, err = HostSignersFile()
+	c.Assert(err, check.IsNil)
+	c.Assert(name, check.Equals, "staging.db")
+
+	// the file has to stay in the keys dir
+	for _, bad := range []string{"..", "../hostsigners.db", "/tmp/hostsigners.db", "ctx/hostsigners.db"} {
+		os.Setenv(teleport.HostSignersFileEnvVar, bad)
+		_, err = HostSignersFile()
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", bad))
+	}
+}
+
+func (s *KeystoreSuite) TestImportKeys(c *check.C) {
+	a := testauthority.New()
+	caPriv, _, err := a.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	priv, pub, err := a.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	cert, err := a.GenerateUserCert(caPriv, pub, "alice", []string{"alice"}, time.Hour)
+	c.Assert(err, check.IsNil)
+	certBob, err := a.GenerateUserCert(caPriv, pub, "bob", []string{"bob"}, time.Hour)
+	c.Assert(err, check.IsNil)
+
+	srcDir, dstDir := c.MkDir(), c.MkDir()
+	writeKey := func(name string, key Key) {
+		bytes, err := json.Marshal(key)
+		c.Assert(err, check.IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(srcDir, name), bytes, 0600), check.IsNil)
+	}
+	valid := Key{Priv: priv, Cert: cert, Deadline: time.Now().Add(time.Hour)}
+	writeKey(KeyFilePrefix+"a"+KeyFileSuffix, valid)
+	writeKey(KeyFilePrefix+"b"+KeyFileSuffix, Key{Priv: priv, Cert: certBob, Deadline: time.Now().Add(time.Hour)})
+	// the same key under another name is imported once
+	writeKey(KeyFilePrefix+"c"+KeyFileSuffix, valid)
+	writeKey(KeyFilePrefix+"expired"+KeyFileSuffix,
+		Key{Priv: priv, Cert: cert, Deadline: time.Now().Add(-time.Hour)})
+	writeKey(KeyFilePrefix+"bad"+KeyFileSuffix,
+		Key{Priv: []byte("priv"), Cert: []byte("cert"), Deadline: time.Now().Add(time.Hour)})
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, KeyFilePrefix+"garbage"+KeyFileSuffix),
+		[]byte("{"), 0600), check.IsNil)
+	// files that are not keys are ignored
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "notes.txt"), []byte("hi"), 0600), check.IsNil)
+
+	// a key with the same name in the destination is not overwritten
+	existing := filepath.Join(dstDir, KeyFilePrefix+"a"+KeyFileSuffix)
+	c.Assert(ioutil.WriteFile(existing, []byte("existing"), 0600), check.IsNil)
+
+	imported, err := importKeys(srcDir, NewFSKeyStore(dstDir))
+	c.Assert(err, check.IsNil)
+	c.Assert(imported, check.Equals, 2)
+
+	bytes, err := ioutil.ReadFile(existing)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(bytes), check.Equals, "existing")
+
+	files, err := ioutil.ReadDir(dstDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 3)
+	for _, file := range files {
+		if file.Name() == filepath.Base(existing) {
+			continue
+		}
+		key, err := loadKey(filepath.Join(dstDir, file.Name()))
+		c.Assert(err, check.IsNil)
+		c.Assert(key.Priv, check.DeepEquals, priv)
+		c.Assert(key.Deadline.After(time.Now().Add(time.Hour-time.Minute)), check.Equals, true)
+	}
+
+	// importing the same keys again adds nothing
+	imported, err = importKeys(srcDir, NewFSKeyStore(dstDir))
+	c.Assert(err, check.IsNil)
+	c.Assert(imported, check.Equals, 0)
+	files, err = ioutil.ReadDir(dstDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 3)
+
+	_, err = importKeys(filepath.Join(srcDir, "missing"), NewFSKeyStore(dstDir))
+	c.Assert(err, check.NotNil)
+}
+
+// mockKeyring keeps secrets in memory
+type mockKeyring struct {
+	sync.Mutex
+	items map[string][]byte
+}
+
+func (m *mockKeyring) Get(name string) ([]byte, error) {
+	m.Lock()
+	data, ok := m.items[name]
+	m.Unlock()
+	// let other writers run between reads and writes like tools do
+	runtime.Gosched()
+	if !ok {
+		return nil, teleport.NotFound(name)
+	}
+	return data, nil
+}
+
+func (m *mockKeyring) Set(name string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.items[name] = data
+	return nil
+}
+
+func (m *mockKeyring) Delete(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.items[name]; !ok {
+		return teleport.NotFound(name)
+	}
+	delete(m.items, name)
+	return nil
+}
+
+func (s *KeystoreSuite) TestKeyStores(c *check.C) {
+	keyring := &mockKeyring{items: make(map[string][]byte)}
+	stores := []KeyStore{NewFSKeyStore(filepath.Join(c.MkDir(), "keys")), NewKeyringStore(keyring, filepath.Join(c.MkDir(), "keyring.lock"))}
+	for _, store := range stores {
+		comment := check.Commentf("%T", store)
+
+		names, err := store.GetKeyNames()
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(names, check.HasLen, 0, comment)
+		_, err = store.GetKey(KeyFilePrefix + "a" + KeyFileSuffix)
+		c.Assert(teleport.IsNotFound(err), check.Equals, true, comment)
+
+		key := Key{Priv: []byte("priv"), Cert: []byte("cert")}
+		c.Assert(saveKey(store, KeyFilePrefix+"a"+KeyFileSuffix, key, time.Hour), check.IsNil, comment)
+		c.Assert(saveKey(store, KeyFilePrefix+"b"+KeyFileSuffix, key, time.Hour), check.IsNil, comment)
+		// saving again replaces the key
+		c.Assert(saveKey(store, KeyFilePrefix+"b"+KeyFileSuffix, key, time.Hour), check.IsNil, comment)
+
+		names, err = store.GetKeyNames()
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(names, check.DeepEquals, []string{KeyFilePrefix + "a" + KeyFileSuffix, KeyFilePrefix + "b" + KeyFileSuffix}, comment)
+		out, err := store.GetKey(KeyFilePrefix + "a" + KeyFileSuffix)
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(out.Priv, check.DeepEquals, key.Priv, comment)
+		c.Assert(out.Cert, check.DeepEquals, key.Cert, comment)
+
+		// expired keys are removed when keys are loaded
+		expired := Key{Priv: []byte("old"), Cert: []byte("old"), Deadline: time.Now().Add(-time.Minute)}
+		c.Assert(store.AddKey(KeyFilePrefix+"c"+KeyFileSuffix, expired), check.IsNil, comment)
+		keys, err := loadAllKeys(store, 0)
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(keys, check.HasLen, 2, comment)
+		_, err = store.GetKey(KeyFilePrefix + "c" + KeyFileSuffix)
+		c.Assert(teleport.IsNotFound(err), check.Equals, true, comment)
+
+		c.Assert(store.DeleteKey(KeyFilePrefix+"a"+KeyFileSuffix), check.IsNil, comment)
+		names, err = store.GetKeyNames()
+		c.Assert(err, check.IsNil, comment)
+		c.Assert(names, check.DeepEquals, []string{KeyFilePrefix + "b" + KeyFileSuffix}, comment)
+	}
+}
+
+func (s *KeystoreSuite) TestKeyringConcurrentUpdates(c *check.C) {
+	keyring := &mockKeyring{items: make(map[string][]byte)}
+	lockPath := filepath.Join(c.MkDir(), "keyring.lock")
+
+	// every store stands for a separate tsh process
+	var wg sync.WaitGroup
+	errC := make(chan error, 40)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := NewKeyringStore(keyring, lockPath)
+			for j := 0; j < 10; j++ {
+				errC <- store.AddKey(fmt.Sprintf("key-%v-%v", i, j), Key{Priv: []byte("priv")})
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		c.Assert(err, check.IsNil)
+	}
+	names, err := NewKeyringStore(keyring, lockPath).GetKeyNames()
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 40)
+}
+
+func (s *KeystoreSuite) TestCommandKeyring(c *check.C) {
+	// secrets are written to stdin of the tools, never to arguments
+	for _, keyring := range []*commandKeyring{darwinKeyring(), linuxKeyring()} {
+		args, stdin := keyring.set("teleport_a.tkey", "c2VjcmV0")
+		c.Assert(strings.Join(args, " "), check.Not(check.Matches), ".*c2VjcmV0.*")
+		c.Assert(stdin, check.Matches, "(?s).*c2VjcmV0.*")
+	}
+
+	dir := c.MkDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		c.Assert(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755), check.IsNil)
+		return path
+	}
+	missing := script("missing", "exit 1\n")
+	keyring := &commandKeyring{
+		get: func(name string) []string { return []string{missing, "lookup"} },
+	}
+	// a missing item is NotFound
+	_, err := keyring.Get("teleport_a.tkey")
+	c.Assert(teleport.IsNotFound(err), check.Equals, true, check.Commentf("%v", err))
+
+	// while a missing tool is not
+	keyring.get = func(name string) []string { return []string{filepath.Join(dir, "secret-tool"), "lookup"} }
+	_, err = keyring.Get("teleport_a.tkey")
+	c.Assert(teleport.IsNotFound(err), check.Equals, false, check.Commentf("%v", err))
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+
+	// errors of commands read from stdin are reported on stderr only
+	failing := script("failing", "echo 'item is locked' >&2\n")
+	keyring.set = func(name, secret string) ([]string, string) { return []string{failing, "-i"}, secret }
+	c.Assert(keyring.Set("teleport_a.tkey", []byte("secret")), check.ErrorMatches, ".*item is locked.*")
+
+	_, err = keyring.Get("teleport a.tkey")
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+}
+
+func (s *KeystoreSuite) TestKeyGracePeriod(c *check.C) {
+	defer os.Unsetenv(teleport.KeyGracePeriodEnvVar)
+
+	os.Unsetenv(teleport.KeyGracePeriodEnvVar)
+	grace, err := KeyGracePeriod()
+	c.Assert(err, check.IsNil)
+	c.Assert(grace, check.Equals, time.Duration(0))
+	os.Setenv(teleport.KeyGracePeriodEnvVar, "5m")
+	grace, err = KeyGracePeriod()
+	c.Assert(err, check.IsNil)
+	c.Assert(grace, check.Equals, 5*time.Minute)
+	for _, value := range []string{"-1m", "soon"} {
+		os.Setenv(teleport.KeyGracePeriodEnvVar, value)
+		_, err = KeyGracePeriod()
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf(value))
+	}
+
+	store := NewFSKeyStore(c.MkDir())
+	recent := Key{Priv: []byte("recent"), Cert: []byte("recent"), Deadline: time.Now().Add(-time.Minute)}
+	old := Key{Priv: []byte("old"), Cert: []byte("old"), Deadline: time.Now().Add(-10 * time.Minute)}
+	c.Assert(store.AddKey(KeyFilePrefix+"recent"+KeyFileSuffix, recent), check.IsNil)
+	c.Assert(store.AddKey(KeyFilePrefix+"old"+KeyFileSuffix, old), check.IsNil)
+
+	// the key expired within the grace period is still loaded
+	keys, err := loadAllKeys(store, 5*time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].Priv, check.DeepEquals, recent.Priv)
+	_, err = store.GetKey(KeyFilePrefix + "recent" + KeyFileSuffix)
+	c.Assert(err, check.IsNil)
+	_, err = store.GetKey(KeyFilePrefix + "old" + KeyFileSuffix)
+	c.Assert(teleport.IsNotFound(err), check.Equals, true)
+
+	// without the grace period it is removed as well
+	keys, err = loadAllKeys(store, 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 0)
+	_, err = store.GetKey(KeyFilePrefix + "recent" + KeyFileSuffix)
+	c.Assert(teleport.IsNotFound(err), check.Equals, true)
+}
+
+func (s *KeystoreSuite) TestNewKeyStore(c *check.C) {
+	store, err := NewKeyStore("")
+	c.Assert(err, check.IsNil)
+	c.Assert(store, check.FitsTypeOf, &FSKeyStore{})
+	store, err = NewKeyStore(KeyStoreFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(store, check.FitsTypeOf, &FSKeyStore{})
+
+	_, err = NewKeyStore("vault")
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
@@ -23,6 +23,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/defaults"
 	"gopkg.in/check.v1"
 )
@@ -92,6 +93,75 @@ func (s *ConfigTestSuite) TestSampleConfig(c *check.C) {
 
 }
 
+func (s *ConfigTestSuite) TestReadFromDir(c *check.C) {
+	dir := c.MkDir()
+	confDir := filepath.Join(dir, "teleport.yaml.d")
+	c.Assert(os.Mkdir(confDir, 0700), check.IsNil)
+	write := func(path, content string) {
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0600), check.IsNil)
+	}
+	// fragments are applied in lexical order, not in order of creation
+	write(filepath.Join(confDir, "20-node.yaml"), `
+teleport:
+  nodename: node-20
+  auth_servers: [auth2]
+ssh_service:
+  labels: {role: db, env: staging}
+  commands:
+  - name: arch
+    command: [uname, -m]
+    period: 1h
+`)
+	write(filepath.Join(confDir, "10-base.yaml"), `
+teleport:
+  nodename: node-10
+  auth_servers: [auth1]
+  storage:
+    data_dir: /var/lib/teleport
+ssh_service:
+  enabled: yes
+  labels: {env: dev}
+`)
+	// files with other extensions are ignored
+	write(filepath.Join(confDir, "30-disabled.yaml.bak"), "teleport:\n  nodename: bak\n")
+
+	main := filepath.Join(dir, "teleport.yaml")
+	write(main, `
+teleport:
+  nodename: main
+ssh_service:
+  labels: {env: prod}
+  commands:
+  - name: hostname
+    command: [hostname]
+    period: 1m
+`)
+
+	fc, err := ReadFromDir(confDir, main)
+	c.Assert(err, check.IsNil)
+	// the main file is applied last
+	c.Assert(fc.NodeName, check.Equals, "main")
+	c.Assert(fc.Storage.DirName, check.Equals, "/var/lib/teleport")
+	c.Assert(fc.SSH.Enabled(), check.Equals, true)
+	// maps and lists are extended by later files
+	c.Assert(fc.AuthServers, check.DeepEquals, []string{"auth1", "auth2"})
+	c.Assert(fc.SSH.Labels, check.DeepEquals, map[string]string{"role": "db", "env": "prod"})
+	c.Assert(fc.SSH.Commands, check.HasLen, 2)
+	c.Assert(fc.SSH.Commands[0].Name, check.Equals, "arch")
+	c.Assert(fc.SSH.Commands[1].Name, check.Equals, "hostname")
+
+	// main file is optional
+	fc, err = ReadFromDir(confDir, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(fc.NodeName, check.Equals, "node-20")
+	c.Assert(fc.SSH.Labels, check.DeepEquals, map[string]string{"role": "db", "env": "staging"})
+
+	// errors point to the broken fragment
+	write(filepath.Join(confDir, "15-typo.yaml"), "teleport:\n  nodname: node\n")
+	_, err = ReadFromDir(confDir, main)
+	c.Assert(teleport.ErrorCode(err), check.Equals, teleport.CodeUnknownConfigKey)
+}
+
 func (s *ConfigTestSuite) TestConfigReading(c *check.C) {
 	// invalid config file type:
 	conf, err := ReadFromFile("/bin/true")
@@ -110,6 +180,11 @@ func (s *ConfigTestSuite) TestConfigReading(c *check.C) {
 	conf, err = ReadFromFile(s.configFileNoContent)
 	c.Assert(err, check.IsNil)
 	c.Assert(conf, check.NotNil)
+	// misspelled key
+	fn := filepath.Join(s.tempDir, "unknown-key.yaml")
+	c.Assert(ioutil.WriteFile(fn, []byte("teleport:\n  nodname: node\n"), 0660), check.IsNil)
+	_, err = ReadFromFile(fn)
+	c.Assert(teleport.ErrorCode(err), check.Equals, teleport.CodeUnknownConfigKey)
 
 	// good config
 	conf, err = ReadFromFile(s.configFile)
@@ -243,6 +318,65 @@ func makeConfigFixture() string {
 	return conf.DebugDumpToYAML()
 }
 
+func (s *ConfigTestSuite) TestStorageCheck(c *check.C) {
+	read := func(storage string) *FileConfig {
+		path := filepath.Join(c.MkDir(), "teleport.yaml")
+		c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  storage:\n"+storage), 0600), check.IsNil)
+		fc, err := ReadFromFile(path)
+		c.Assert(err, check.IsNil)
+		return fc
+	}
+
+	// bolt storage with etcd peers left from another config
+	err := read("    type: bolt\n    data_dir: /var/lib/teleport\n    peers: ['10.0.0.1:2379']\n").Storage.Check()
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+	c.Assert(err, check.ErrorMatches, ".*peers valid only for etcd.*")
+
+	// storage type defaults to bolt
+	err = read("    prefix: teleport\n    quorum_check_period: 10s\n").Storage.Check()
+	c.Assert(err, check.ErrorMatches, ".*prefix, quorum_check_period valid only for etcd.*")
+
+	// etcd storage with bolt settings only
+	err = read("    type: etcd\n    data_dir: /var/lib/teleport\n").Storage.Check()
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+	c.Assert(err, check.ErrorMatches, ".*requires peers or etcd_peers_file.*")
+
+	for _, storage := range []string{
+		"    type: bolt\n    data_dir: /var/lib/teleport\n",
+		"    data_dir: /var/lib/teleport\n",
+		"    type: etcd\n    data_dir: /var/lib/teleport\n    peers: ['10.0.0.1:2379']\n",
+		"    type: etcd\n    etcd_peers_file: /var/lib/discovery/peers\n",
+	} {
+		c.Assert(read(storage).Storage.Check(), check.IsNil, check.Commentf(storage))
+	}
+}
+
+func (s *ConfigTestSuite) TestKeyPassphrase(c *check.C) {
+	dir := c.MkDir()
+	read := func(passphrase string) (string, error) {
+		passphraseFile := filepath.Join(dir, "passphrase")
+		c.Assert(ioutil.WriteFile(passphraseFile, []byte(passphrase), 0600), check.IsNil)
+		path := filepath.Join(dir, "teleport.yaml")
+		conf := "teleport:\n  key_passphrase_file: " + passphraseFile + "\n"
+		c.Assert(ioutil.WriteFile(path, []byte(conf), 0600), check.IsNil)
+		fc, err := ReadFromFile(path)
+		c.Assert(err, check.IsNil)
+		return fc.KeyPassphrase()
+	}
+
+	passphrase, err := read("secret\n")
+	c.Assert(err, check.IsNil)
+	c.Assert(passphrase, check.Equals, "secret")
+
+	_, err = read(" \n")
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+
+	// no passphrase file is not an error
+	passphrase, err = (&Global{}).KeyPassphrase()
+	c.Assert(err, check.IsNil)
+	c.Assert(passphrase, check.Equals, "")
+}
+
 const (
 	StaticConfigString = `
 #
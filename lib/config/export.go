@@ -0,0 +1,337 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/backend/etcdbk"
+	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/service"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigHash returns a hex encoded SHA256 of the canonical form of cfg,
+// the config file produced by ToFileConfig, so equivalent configurations
+// have the same hash regardless of how they were written. Secrets, the
+// ones service.ConfigDiff redacts, are left out, so the hash does not
+// carry them and rotating a token is not a config change
+func ConfigHash(cfg *service.Config) (string, error) {
+	fc, err := ToFileConfig(cfg)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	fc.AuthToken = ""
+	fc.Auth.Tokens = nil
+	fc.Proxy.KeyFile = ""
+	if fc.Auth.EventWebhook != nil {
+		fc.Auth.EventWebhook.AuthHeader = ""
+	}
+	bytes, err := yaml.Marshal(fc)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ToFileConfig maps the runtime configuration back to the config file
+// schema, the result applied to the default configuration reproduces cfg.
+// Settings the file can't express, e.g. different tokens per role, are
+// reported as errors. The key passphrase is never exported
+func ToFileConfig(cfg *service.Config) (*FileConfig, error) {
+	fc := &FileConfig{}
+
+	// "teleport" section
+	fc.NodeName = cfg.Hostname
+	fc.AdvertiseIP = cfg.AdvertiseIP
+	fc.AdvertiseIPCheck = cfg.AdvertiseIPCheck
+	for _, addr := range cfg.AuthServers {
+		fc.AuthServers = append(fc.AuthServers, addr.FullAddress())
+	}
+	if cfg.SSH.Token != cfg.Auth.Token || cfg.Proxy.Token != cfg.Auth.Token {
+		return nil, trace.Wrap(teleport.BadParameter("auth_token",
+			"roles use different tokens, the config file has a single token"))
+	}
+	fc.AuthToken = cfg.Auth.Token
+	fc.MaxAuthServers = cfg.MaxAuthServers
+	fc.AuthServerHostKey = cfg.AuthServerHostKey
+	fc.AuthServerStrategy = string(cfg.AuthServerStrategy)
+	fc.StartMode = string(cfg.StartMode)
+	fc.HostCertCheck = string(cfg.HostCertCheck)
+	fc.MinKeySize = cfg.MinKeySize
+	fc.RegisterRetries = cfg.RegisterRetries
+	fc.AuthCacheTTL = cfg.AuthCacheTTL
+	fc.ShutdownTimeout = cfg.ShutdownTimeout
+	clockSkew := cfg.ClockSkew
+	fc.ClockSkew = &clockSkew
+	fc.ReusePort = cfg.ReusePort
+	fc.ConnectionLogging = cfg.ConnectionLogging
+	panicRecovery := cfg.PanicRecovery
+	fc.PanicRecovery = &panicRecovery
+	fc.AuditConfigLoad = cfg.AuditConfigLoad
+	fc.PostStartCommand = cfg.PostStart.Command
+	fc.PostStartTimeout = cfg.PostStart.Timeout
+	fc.PostStartAbortOnError = cfg.PostStart.AbortOnError
+	fc.HeartbeatTTL = cfg.HeartbeatTTL
+	fc.AuthServersRefreshPeriod = cfg.AuthServersRefreshPeriod
+	if !cfg.DiagnosticAddr.IsEmpty() {
+		fc.DiagAddr = cfg.DiagnosticAddr.Addr
+	}
+	if err := exportStorage(cfg, &fc.Storage); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := exportLimits(cfg, &fc.Limits); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// "auth_service" section
+	fc.Auth.EnabledFlag = enabledFlag(cfg.Auth.Enabled)
+	fc.Auth.ListenAddress = cfg.Auth.SSHAddr.Addr
+	fc.Auth.Limits.Disabled = cfg.Auth.Limiter.Disabled
+	fc.Auth.Limits.WarnThreshold = cfg.Auth.Limiter.WarnThreshold
+	fc.Auth.DomainName = cfg.Auth.DomainName
+	for _, network := range cfg.Auth.AllowedSourceCIDRs {
+		fc.Auth.AllowedSourceCIDRs = append(fc.Auth.AllowedSourceCIDRs, network.String())
+	}
+	tokens := make([]string, 0, len(cfg.Auth.AllowedTokens))
+	for token := range cfg.Auth.AllowedTokens {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	for _, token := range tokens {
+		allowed := AllowedToken{Token: token}
+		for _, network := range cfg.Auth.AllowedTokenSources[token] {
+			allowed.Sources = append(allowed.Sources, network.String())
+		}
+		fc.Auth.Tokens = append(fc.Auth.Tokens, allowed)
+	}
+	sshTunnel := cfg.Auth.TunnelEnabled
+	fc.Auth.EnableSSHTunnel = &sshTunnel
+	if !cfg.Auth.HTTPAddr.IsEmpty() {
+		fc.Auth.HTTPListenAddress = cfg.Auth.HTTPAddr.Addr
+		fc.Auth.KeyFile = cfg.Auth.HTTPTLSKey
+		fc.Auth.CertFile = cfg.Auth.HTTPTLSCert
+		fc.Auth.ClientCAFile = cfg.Auth.HTTPClientCAFile
+	}
+	fc.Auth.MaxSessionSize = cfg.Auth.MaxSessionSize
+	if cfg.Auth.EventWebhook.Enabled() {
+		retries := cfg.Auth.EventWebhook.Retries
+		fc.Auth.EventWebhook = &EventWebhook{
+			URL:         cfg.Auth.EventWebhook.URL,
+			AuthHeader:  cfg.Auth.EventWebhook.AuthHeader,
+			QueueSize:   cfg.Auth.EventWebhook.QueueSize,
+			Retries:     &retries,
+			RetryPeriod: cfg.Auth.EventWebhook.RetryPeriod,
+			Timeout:     cfg.Auth.EventWebhook.Timeout,
+			OnFull:      cfg.Auth.EventWebhook.OnFull,
+		}
+	}
+
+	// "ssh_service" section
+	fc.SSH.EnabledFlag = enabledFlag(cfg.SSH.Enabled)
+	fc.SSH.ListenAddress = cfg.SSH.Addr.Addr
+	fc.SSH.Limits.Disabled = cfg.SSH.Limiter.Disabled
+	fc.SSH.Limits.WarnThreshold = cfg.SSH.Limiter.WarnThreshold
+	fc.SSH.Labels = cfg.SSH.Labels
+	names := make([]string, 0, len(cfg.SSH.CmdLabels))
+	for name := range cfg.SSH.CmdLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		label := cfg.SSH.CmdLabels[name]
+		fc.SSH.Commands = append(fc.SSH.Commands, CommandLabel{
+			Name:          name,
+			Command:       label.Command,
+			Period:        label.Period,
+			User:          label.User,
+			ExitCodes:     label.ExitCodes,
+			CaptureStderr: label.CaptureStderr,
+			StableRuns:    label.StableRuns,
+		})
+	}
+	fc.SSH.VersionString = cfg.SSH.VersionString
+	fc.SSH.MOTD = cfg.SSH.MOTD
+	keepAliveInterval := cfg.SSH.KeepAliveInterval
+	fc.SSH.KeepAliveInterval = &keepAliveInterval
+	fc.SSH.KeepAliveCountMax = cfg.SSH.KeepAliveCountMax
+	useLoginShell := cfg.SSH.UseLoginShell
+	fc.SSH.UseLoginShell = &useLoginShell
+	fc.SSH.Shell = cfg.SSH.Shell
+	recordSessions := cfg.SSH.RecordSessions
+	fc.SSH.RecordSessions = &recordSessions
+	fc.SSH.HandshakeTimeout = cfg.SSH.HandshakeTimeout
+	fc.SSH.HostKeyRotationPeriod = cfg.SSH.HostKeyRotationPeriod
+	labelJitter := cfg.SSH.LabelJitter
+	fc.SSH.LabelJitter = &labelJitter
+	maxCount, maxSize := cfg.SSH.LabelPolicy.MaxCount, cfg.SSH.LabelPolicy.MaxSize
+	fc.SSH.LabelPolicy = &LabelPolicy{
+		KeyPattern:   cfg.SSH.LabelPolicy.KeyPattern,
+		ValuePattern: cfg.SSH.LabelPolicy.ValuePattern,
+		MaxCount:     &maxCount,
+		MaxSize:      &maxSize,
+	}
+
+	// "proxy_service" section
+	fc.Proxy.EnabledFlag = enabledFlag(cfg.Proxy.Enabled)
+	fc.Proxy.ListenAddress = cfg.Proxy.SSHAddr.Addr
+	fc.Proxy.Limits.Disabled = cfg.Proxy.Limiter.Disabled
+	fc.Proxy.Limits.WarnThreshold = cfg.Proxy.Limiter.WarnThreshold
+	fc.Proxy.WebAddr = cfg.Proxy.WebAddr.Addr
+	fc.Proxy.KeyFile = cfg.Proxy.TLSKey
+	fc.Proxy.CertFile = cfg.Proxy.TLSCert
+	fc.Proxy.RequireProvidedTLS = cfg.Proxy.RequireProvidedTLS
+	reverseTunnel := cfg.Proxy.ReverseTunnelEnabled
+	fc.Proxy.EnableReverseTunnel = &reverseTunnel
+	if cfg.Proxy.TLSMinVersion != 0 {
+		version, err := utils.TLSVersionName(cfg.Proxy.TLSMinVersion)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		fc.Proxy.TLSMinVersion = version
+	}
+	if len(cfg.Proxy.TLSCipherSuites) != 0 {
+		suites, err := utils.CipherSuiteNames(cfg.Proxy.TLSCipherSuites)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		fc.Proxy.TLSCipherSuites = suites
+	}
+	headers := cfg.Proxy.SecurityHeaders
+	fc.Proxy.SecurityHeaders = SecurityHeaders{
+		EnabledFlag:           enabledFlag(headers.Enabled),
+		HSTSMaxAge:            headers.HSTSMaxAge,
+		HSTSIncludeSubdomains: headers.HSTSIncludeSubdomains,
+		FrameOptions:          headers.FrameOptions,
+		ContentSecurityPolicy: headers.ContentSecurityPolicy,
+	}
+	return fc, nil
+}
+
+// exportStorage fills in 'storage' section from the auth backends
+func exportStorage(cfg *service.Config, s *StorageBackend) error {
+	s.RequireExistingDataDir = cfg.RequireExistingDataDir
+	s.RequirePersistentDataDir = cfg.RequirePersistentDataDir
+	s.CheckTimeout = cfg.Auth.BackendCheckTimeout
+
+	// events and recordings are always kept in bolt, in the same dir
+	dir, err := boltDir(cfg.Auth.EventsBackend.Type, cfg.Auth.EventsBackend.Params)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	recordsDir, err := boltDir(cfg.Auth.RecordsBackend.Type, cfg.Auth.RecordsBackend.Params)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if recordsDir != dir {
+		return trace.Wrap(teleport.BadParameter("storage",
+			fmt.Sprintf("events and recordings are stored in different dirs: %v and %v", dir, recordsDir)))
+	}
+	s.DirName = dir
+
+	keys := cfg.Auth.KeysBackend
+	switch keys.Type {
+	case teleport.BoltBackendType:
+		keysDir, err := boltDir(keys.Type, keys.Params)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if keysDir != dir {
+			return trace.Wrap(teleport.BadParameter("storage",
+				fmt.Sprintf("keys and events are stored in different dirs: %v and %v", keysDir, dir)))
+		}
+		s.Type = teleport.BoltBackendType
+	case teleport.ETCDBackendType:
+		var etcdCfg etcdbk.Config
+		if err := json.Unmarshal([]byte(keys.Params), &etcdCfg); err != nil {
+			return trace.Wrap(err)
+		}
+		s.Type = teleport.ETCDBackendType
+		s.Peers = etcdCfg.Nodes
+		s.PeersFile = etcdCfg.NodesFile
+		s.Prefix = etcdCfg.Key
+		s.TLSKeyFile = etcdCfg.TLSKeyFile
+		s.TLSCertFile = etcdCfg.TLSCertFile
+		s.TLSCAFile = etcdCfg.TLSCAFile
+		s.ForceClusterName = etcdCfg.ForceClusterName
+		s.QuorumCheckPeriod = etcdCfg.QuorumCheckPeriod
+	default:
+		return trace.Wrap(teleport.BadParameter("storage",
+			fmt.Sprintf("unsupported storage type: '%v'", keys.Type)))
+	}
+	return nil
+}
+
+// boltDir returns a directory of the bolt backend's database file
+func boltDir(backendType, backendParams string) (string, error) {
+	if backendType != teleport.BoltBackendType {
+		return "", trace.Wrap(teleport.BadParameter("storage",
+			fmt.Sprintf("expected '%v' backend, got '%v'", teleport.BoltBackendType, backendType)))
+	}
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal([]byte(backendParams), &params); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return filepath.Dir(params.Path), nil
+}
+
+// exportLimits fills in 'connection_limits' section, the config file
+// has the same limits for all services
+func exportLimits(cfg *service.Config, limits *ConnectionLimits) error {
+	l := cfg.SSH.Limiter
+	for _, other := range []limiter.LimiterConfig{cfg.Auth.Limiter, cfg.Proxy.Limiter} {
+		if other.MaxConnections != l.MaxConnections ||
+			other.MaxNumberOfUsers != l.MaxNumberOfUsers ||
+			other.MaxHandshakes != l.MaxHandshakes ||
+			!reflect.DeepEqual(other.Rates, l.Rates) {
+			return trace.Wrap(teleport.BadParameter("connection_limits",
+				"services use different connection limits, the config file has the same limits for all of them"))
+		}
+	}
+	limits.MaxConnections = l.MaxConnections
+	limits.MaxUsers = l.MaxNumberOfUsers
+	limits.MaxHandshakes = l.MaxHandshakes
+	for _, rate := range l.Rates {
+		limits.Rates = append(limits.Rates, ConnectionRate{
+			Period:  rate.Period,
+			Average: rate.Average,
+			Burst:   rate.Burst,
+		})
+	}
+	return nil
+}
+
+// enabledFlag returns a value of the "enabled" flag of a service
+func enabledFlag(enabled bool) string {
+	if enabled {
+		return "yes"
+	}
+	return "no"
+}
@@ -17,15 +17,18 @@ limitations under the License.
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/service"
+	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/gravitational/trace"
 	"gopkg.in/yaml.v2"
@@ -34,41 +37,118 @@ import (
 var (
 	// all possible valid YAML config keys
 	validKeys = map[string]bool{
-		"teleport":          true,
-		"enabled":           true,
-		"ssh_service":       true,
-		"proxy_service":     true,
-		"auth_service":      true,
-		"auth_token":        true,
-		"auth_servers":      true,
-		"domain_name":       true,
-		"storage":           true,
-		"nodename":          true,
-		"log":               true,
-		"period":            true,
-		"connection_limits": true,
-		"max_connections":   true,
-		"max_users":         true,
-		"rates":             true,
-		"commands":          true,
-		"labels":            false,
-		"output":            true,
-		"severity":          true,
-		"role":              true,
-		"name":              true,
-		"type":              true,
-		"data_dir":          true,
-		"peers":             true,
-		"prefix":            true,
-		"web_listen_addr":   true,
-		"ssh_listen_addr":   true,
-		"listen_addr":       true,
-		"https_key_file":    true,
-		"https_cert_file":   true,
-		"advertise_ip":      true,
-		"tls_key_file":      true,
-		"tls_cert_file":     true,
-		"tls_ca_file":       true,
+		"teleport":                    true,
+		"enabled":                     true,
+		"ssh_service":                 true,
+		"proxy_service":               true,
+		"auth_service":                true,
+		"auth_token":                  true,
+		"auth_servers":                true,
+		"domain_name":                 true,
+		"storage":                     true,
+		"nodename":                    true,
+		"log":                         true,
+		"period":                      true,
+		"connection_limits":           true,
+		"max_handshakes":              true,
+		"max_connections":             true,
+		"max_users":                   true,
+		"rates":                       true,
+		"commands":                    true,
+		"labels":                      false,
+		"output":                      true,
+		"severity":                    true,
+		"role":                        true,
+		"name":                        true,
+		"type":                        true,
+		"data_dir":                    true,
+		"require_existing_data_dir":   true,
+		"force_cluster_name":          true,
+		"quorum_check_period":         true,
+		"peers":                       true,
+		"prefix":                      true,
+		"web_listen_addr":             true,
+		"ssh_listen_addr":             true,
+		"listen_addr":                 true,
+		"https_key_file":              true,
+		"https_cert_file":             true,
+		"advertise_ip":                true,
+		"tls_key_file":                true,
+		"tls_cert_file":               true,
+		"tls_ca_file":                 true,
+		"diag_addr":                   true,
+		"bind_ip":                     true,
+		"limits":                      true,
+		"warn_threshold":              true,
+		"auth_server_strategy":        true,
+		"heartbeat_ttl":               true,
+		"auth_servers_refresh_period": true,
+		"max_auth_servers":            true,
+		"auth_server_host_key":        true,
+		"default_roles":               true,
+		"allowed_source_cidrs":        true,
+		"tokens":                      true,
+		"token":                       true,
+		"sources":                     true,
+		"require_persistent_data_dir": true,
+		"key_passphrase_file":         true,
+		"clock_skew":                  true,
+		"strict_advertise_ip":         true,
+		"advertise_ip_behind_nat":     true,
+		"advertise_ip_check":          true,
+		"start_mode":                  true,
+		"tag":                         true,
+		"shutdown_timeout":            true,
+		"auth_cache_ttl":              true,
+		"post_start_command":          true,
+		"post_start_timeout":          true,
+		"post_start_abort_on_error":   true,
+		"version_string":              true,
+		"motd":                        true,
+		"keepalive_interval":          true,
+		"keepalive_count_max":         true,
+		"use_login_shell":             true,
+		"shell":                       true,
+		"record_sessions":             true,
+		"enable_reverse_tunnel":       true,
+		"handshake_timeout":           true,
+		"host_key_rotation_period":    true,
+		"label_jitter":                true,
+		"audit_config_load":           true,
+		"host_cert_check":             true,
+		"check_timeout":               true,
+		"require_provided_tls":        true,
+		"etcd_peers_file":             true,
+		"min_key_size":                true,
+		"register_retries":            true,
+		"max_session_size":            true,
+		"http_listen_addr":            true,
+		"https_client_ca_file":        true,
+		"enable_ssh_tunnel":           true,
+		"reuse_port":                  true,
+		"connection_logging":          true,
+		"panic_recovery":              true,
+		"label_policy":                true,
+		"key_pattern":                 true,
+		"value_pattern":               true,
+		"max_count":                   true,
+		"max_size":                    true,
+		"disabled":                    true,
+		"tls_min_version":             true,
+		"tls_cipher_suites":           true,
+		"security_headers":            true,
+		"hsts_max_age":                true,
+		"hsts_include_subdomains":     true,
+		"frame_options":               true,
+		"content_security_policy":     true,
+		"event_webhook":               true,
+		"url":                         true,
+		"auth_header":                 true,
+		"queue_size":                  true,
+		"retries":                     true,
+		"retry_period":                true,
+		"timeout":                     true,
+		"on_full":                     true,
 	}
 )
 
@@ -93,14 +173,89 @@ func ReadFromFile(fp string) (fc *FileConfig, err error) {
 		return nil, trace.Errorf("invalid configuration file type: '%v'. Only .yml is supported", fp)
 	}
 
-	fc = &FileConfig{}
 	// read & parse YAML config:
 	bytes, err := ioutil.ReadFile(fp)
 	if err != nil {
 		return nil, trace.Wrap(err, "failed reading Teleport configuration: %v", fp)
 	}
-	if err = yaml.Unmarshal(bytes, fc); err != nil {
-		return nil, trace.Wrap(err, "failed to parse Teleport configuration: %v", fp)
+	return parseConfig(bytes, fp)
+}
+
+// ReadFromDir reads drop-in configuration fragments, *.yaml files of dir,
+// in lexical order and merges them with the main configuration file, which
+// is applied last and is optional. Sections are merged key by key, lists
+// are extended and other values are replaced by later files
+func ReadFromDir(dir, mainFile string) (*FileConfig, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sort.Strings(paths)
+	if mainFile != "" {
+		paths = append(paths, mainFile)
+	}
+	var merged interface{}
+	for _, path := range paths {
+		// check every file on its own, so errors point to the file
+		if _, err := ReadFromFile(path); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		fragment := YAMLMap{}
+		if err := yaml.Unmarshal(bytes, &fragment); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		merged = mergeYAML(merged, fragment)
+	}
+	bytes, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return parseConfig(bytes, dir)
+}
+
+// mergeYAML merges src YAML value into dst: maps are merged key by key,
+// lists are appended and other values are replaced
+func mergeYAML(dst, src interface{}) interface{} {
+	switch s := src.(type) {
+	case YAMLMap:
+		return mergeYAMLMaps(dst, s)
+	case map[interface{}]interface{}:
+		return mergeYAMLMaps(dst, s)
+	case []interface{}:
+		if d, ok := dst.([]interface{}); ok {
+			return append(append([]interface{}{}, d...), s...)
+		}
+	}
+	return src
+}
+
+func mergeYAMLMaps(dst interface{}, src map[interface{}]interface{}) interface{} {
+	out := map[interface{}]interface{}{}
+	switch d := dst.(type) {
+	case YAMLMap:
+		for k, v := range d {
+			out[k] = v
+		}
+	case map[interface{}]interface{}:
+		for k, v := range d {
+			out[k] = v
+		}
+	}
+	for k, v := range src {
+		out[k] = mergeYAML(out[k], v)
+	}
+	return out
+}
+
+// parseConfig parses YAML configuration read from source
+func parseConfig(bytes []byte, source string) (*FileConfig, error) {
+	fc := &FileConfig{}
+	if err := yaml.Unmarshal(bytes, fc); err != nil {
+		return nil, trace.Wrap(err, "failed to parse Teleport configuration: %v", source)
 	}
 	// now check for unknown (misspelled) config keys:
 	var validateKeys func(m YAMLMap) error
@@ -110,7 +265,7 @@ func ReadFromFile(fp string) (fc *FileConfig, err error) {
 		for k, v := range m {
 			if key, ok = k.(string); ok {
 				if recursive, ok = validKeys[key]; !ok {
-					return trace.Wrap(teleport.BadParameter(key, "this configuration key is unknown"))
+					return trace.Wrap(teleport.BadParameterWithCode(teleport.CodeUnknownConfigKey, key, "this configuration key is unknown"))
 				}
 				if recursive {
 					if m2, ok := v.(YAMLMap); ok {
@@ -125,10 +280,10 @@ func ReadFromFile(fp string) (fc *FileConfig, err error) {
 	}
 	// validate configuration keys:
 	var tmp YAMLMap
-	if err = yaml.Unmarshal(bytes, &tmp); err != nil {
+	if err := yaml.Unmarshal(bytes, &tmp); err != nil {
 		return nil, trace.Errorf("error parsing YAML config")
 	}
-	if err = validateKeys(tmp); err != nil {
+	if err := validateKeys(tmp); err != nil {
 		return nil, trace.Wrap(err)
 	}
 	return fc, nil
@@ -254,6 +409,7 @@ type ConnectionRate struct {
 type ConnectionLimits struct {
 	MaxConnections int64            `yaml:"max_connections"`
 	MaxUsers       int              `yaml:"max_users"`
+	MaxHandshakes  int              `yaml:"max_handshakes,omitempty"`
 	Rates          []ConnectionRate `yaml:"rates,omitempty"`
 }
 
@@ -261,16 +417,33 @@ type ConnectionLimits struct {
 type Log struct {
 	Output   string `yaml:"output,omitempty"`
 	Severity string `yaml:"severity,omitempty"`
+	// Tag is added to every log line to tell apart logs of many
+	// processes, defaults to the node name
+	Tag string `yaml:"tag,omitempty"`
 }
 
 // StorageBackend is used for 'storage' config section. stores values for 'boltdb' and 'etcd'
 type StorageBackend struct {
 	// Type can be "bolt" or "etcd"
 	Type string `yaml:"type,omitempty"`
-	// DirName is valid only for bolt
+	// DirName is a directory of bolt databases, etcd storage keeps
+	// events and recorded sessions there as well
 	DirName string `yaml:"data_dir,omitempty"`
+	// RequireExistingDataDir makes teleport fail if the parent of the
+	// data dir does not exist, to catch mistyped paths
+	RequireExistingDataDir bool `yaml:"require_existing_data_dir,omitempty"`
+	// RequirePersistentDataDir makes teleport fail if the data dir is on
+	// tmpfs or ramfs, by default teleport only warns about it
+	RequirePersistentDataDir bool `yaml:"require_persistent_data_dir,omitempty"`
+	// CheckTimeout is a time the auth server waits for the storage to pass
+	// a read-write check on start before reporting ready, e.g. "30s"
+	CheckTimeout time.Duration `yaml:"check_timeout,omitempty"`
 	// Peers is a lsit of etcd peers,  valid only for etcd
 	Peers []string `yaml:"peers,omitempty"`
+	// PeersFile is a file with etcd peers, one per line, maintained by
+	// an external service discovery, it's re-read periodically and
+	// replaces peers, valid only for etcd
+	PeersFile string `yaml:"etcd_peers_file,omitempty"`
 	// Prefix is etcd key prefix, valid only for etcd
 	Prefix string `yaml:"prefix,omitempty"`
 	// TLSCertFile is a tls client cert file, used for etcd
@@ -279,6 +452,57 @@ type StorageBackend struct {
 	TLSKeyFile string `yaml:"tls_key_file,omitempty"`
 	// TLSCAFile is a tls client trusted CA file, used for etcd
 	TLSCAFile string `yaml:"tls_ca_file,omitempty"`
+	// ForceClusterName makes the cluster take over etcd prefix used
+	// by another cluster, valid only for etcd
+	ForceClusterName bool `yaml:"force_cluster_name,omitempty"`
+	// QuorumCheckPeriod turns on periodic checks of etcd quorum, the auth
+	// server rejects writes while quorum is lost, valid only for etcd
+	QuorumCheckPeriod time.Duration `yaml:"quorum_check_period,omitempty"`
+}
+
+// Check makes sure that fields of the storage section match the storage
+// type, e.g. etcd peers set for bolt storage are most likely a copy-paste
+// error and it's not clear which storage the user wants
+func (s *StorageBackend) Check() error {
+	switch s.Type {
+	case "", teleport.BoltBackendType:
+		var fields []string
+		if len(s.Peers) != 0 {
+			fields = append(fields, "peers")
+		}
+		if s.PeersFile != "" {
+			fields = append(fields, "etcd_peers_file")
+		}
+		if s.Prefix != "" {
+			fields = append(fields, "prefix")
+		}
+		if s.TLSCertFile != "" {
+			fields = append(fields, "tls_cert_file")
+		}
+		if s.TLSKeyFile != "" {
+			fields = append(fields, "tls_key_file")
+		}
+		if s.TLSCAFile != "" {
+			fields = append(fields, "tls_ca_file")
+		}
+		if s.ForceClusterName {
+			fields = append(fields, "force_cluster_name")
+		}
+		if s.QuorumCheckPeriod != 0 {
+			fields = append(fields, "quorum_check_period")
+		}
+		if len(fields) != 0 {
+			return trace.Wrap(teleport.BadParameter("storage",
+				fmt.Sprintf("%v valid only for etcd storage, but storage type is %v, set type: etcd or remove them",
+					strings.Join(fields, ", "), teleport.BoltBackendType)))
+		}
+	case teleport.ETCDBackendType:
+		if len(s.Peers) == 0 && s.PeersFile == "" {
+			return trace.Wrap(teleport.BadParameter("storage",
+				"etcd storage requires peers or etcd_peers_file, data_dir alone configures bolt storage, set type: bolt or add peers"))
+		}
+	}
+	return nil
 }
 
 // Global is 'teleport' (global) section of the config file
@@ -290,12 +514,122 @@ type Global struct {
 	Logger      Log              `yaml:"log,omitempty"`
 	Storage     StorageBackend   `yaml:"storage,omitempty"`
 	AdvertiseIP net.IP           `yaml:"advertise_ip,omitempty"`
+	// BindIP is an IP address all services listen on, it replaces
+	// the host part of every listen address
+	BindIP net.IP `yaml:"bind_ip,omitempty"`
+	// DiagAddr is an address of the diagnostic endpoint serving metrics
+	DiagAddr string `yaml:"diag_addr,omitempty"`
+	// AuthServerStrategy is an order in which auth servers are tried:
+	// ordered, random or round-robin
+	AuthServerStrategy string `yaml:"auth_server_strategy,omitempty"`
+	// StartMode is either all-or-nothing (default) or best-effort, in
+	// best-effort mode a role that fails to start does not stop the others
+	StartMode string `yaml:"start_mode,omitempty"`
+	// HostCertCheck is warn (default) or off, it defines what happens
+	// when the host certificate is not valid for the advertise IP
+	HostCertCheck string `yaml:"host_cert_check,omitempty"`
+	// MinKeySize is a minimum size in bits of RSA host keys, e.g. 2048,
+	// smaller keys are rejected on start
+	MinKeySize int `yaml:"min_key_size,omitempty"`
+	// RegisterRetries is a number of attempts to join the cluster while
+	// the auth server is unreachable, nodes retry forever if it's not set
+	RegisterRetries int `yaml:"register_retries,omitempty"`
+	// AuthCacheTTL is a time nodes and proxies cache cert authorities
+	// and nodes fetched from the auth server, e.g. "10s"
+	AuthCacheTTL time.Duration `yaml:"auth_cache_ttl,omitempty"`
+	// ShutdownTimeout is a time teleport waits for active sessions to
+	// end on shutdown before it exits anyway, e.g. "1m"
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty"`
+	// PostStartCommand is a command with arguments run once all enabled
+	// roles have started, e.g. to register the host in Consul
+	PostStartCommand []string `yaml:"post_start_command,flow,omitempty"`
+	// PostStartTimeout is a time the post start command has to complete
+	PostStartTimeout time.Duration `yaml:"post_start_timeout,omitempty"`
+	// PostStartAbortOnError stops teleport if the post start command fails
+	PostStartAbortOnError bool `yaml:"post_start_abort_on_error,omitempty"`
+	// HeartbeatTTL is a TTL of the presence records servers send
+	// to the auth server, e.g. "30s"
+	HeartbeatTTL time.Duration `yaml:"heartbeat_ttl,omitempty"`
+	// AuthServersRefreshPeriod is a period for clients to refresh the
+	// list of auth servers, it should be smaller than HeartbeatTTL
+	AuthServersRefreshPeriod time.Duration `yaml:"auth_servers_refresh_period,omitempty"`
+	// MaxAuthServers is a maximum number of auth servers allowed in
+	// the configuration
+	MaxAuthServers int `yaml:"max_auth_servers,omitempty"`
+	// AuthServerHostKey pins the host key of auth servers: a public key
+	// in authorized_keys format or its fingerprint, e.g. "SHA256:..."
+	AuthServerHostKey string `yaml:"auth_server_host_key,omitempty"`
+	// DefaultRoles is a list of roles to start when neither --roles flag
+	// nor the "enabled" flags of the services say otherwise
+	DefaultRoles []string `yaml:"default_roles,flow,omitempty"`
+	// KeyPassphraseFile is a path to a file with a passphrase that
+	// encrypts private keys of host identities in the data dir
+	KeyPassphraseFile string `yaml:"key_passphrase_file,omitempty"`
+	// ClockSkew is a tolerated difference between clocks of cluster hosts
+	// when certificate validity is checked, e.g. "2m", "0" disables it
+	ClockSkew *time.Duration `yaml:"clock_skew,omitempty"`
+	// StrictAdvertiseIP requires the advertise IP to be assigned to
+	// one of the local network interfaces
+	StrictAdvertiseIP bool `yaml:"strict_advertise_ip,omitempty"`
+	// AdvertiseIPBehindNAT turns off the strict advertise IP check for
+	// hosts behind NAT, where the advertise IP is not local
+	AdvertiseIPBehindNAT bool `yaml:"advertise_ip_behind_nat,omitempty"`
+	// AdvertiseIPCheck makes roles dial their own advertised address on
+	// start and warn if it's not reachable
+	AdvertiseIPCheck bool `yaml:"advertise_ip_check,omitempty"`
+	// ReusePort binds listeners with SO_REUSEPORT for restarts without
+	// downtime, it's supported on Linux only
+	ReusePort bool `yaml:"reuse_port,omitempty"`
+	// ConnectionLogging logs accepted, authenticated and closed SSH
+	// connections of all roles with the source IP and principal
+	ConnectionLogging bool `yaml:"connection_logging,omitempty"`
+	// PanicRecovery recovers from panics in request handlers, so a panic
+	// in one role doesn't stop the others, it's on by default
+	PanicRecovery *bool `yaml:"panic_recovery,omitempty"`
+	// AuditConfigLoad emits an event with the SHA256 of the configuration
+	// every time it's loaded
+	AuditConfigLoad bool `yaml:"audit_config_load,omitempty"`
+}
+
+// RequireLocalAdvertiseIP returns true if the advertise IP has to be
+// assigned to a local network interface
+func (g *Global) RequireLocalAdvertiseIP() bool {
+	return g.StrictAdvertiseIP && !g.AdvertiseIPBehindNAT
+}
+
+// KeyPassphrase reads the passphrase from key_passphrase_file, it returns
+// an empty string if the file is not set
+func (g *Global) KeyPassphrase() (string, error) {
+	if g.KeyPassphraseFile == "" {
+		return "", nil
+	}
+	data, err := utils.ReadPath(g.KeyPassphraseFile)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	passphrase := strings.TrimSpace(string(data))
+	if passphrase == "" {
+		return "", trace.Wrap(teleport.BadParameter("key_passphrase_file",
+			fmt.Sprintf("passphrase file '%v' is empty", g.KeyPassphraseFile)))
+	}
+	return passphrase, nil
 }
 
 // Service is a common configuration of a teleport service
 type Service struct {
 	EnabledFlag   string `yaml:"enabled,omitempty"`
 	ListenAddress string `yaml:"listen_addr,omitempty"`
+	// Limits overrides connection limits for this service
+	Limits ServiceLimits `yaml:"limits,omitempty"`
+}
+
+// ServiceLimits is 'limits' section of a service
+type ServiceLimits struct {
+	// Disabled turns off connection and rate limiting for the service
+	Disabled bool `yaml:"disabled,omitempty"`
+	// WarnThreshold is a number of connections from a single IP that
+	// emits a warning event, it has to be below max_connections
+	WarnThreshold int64 `yaml:"warn_threshold,omitempty"`
 }
 
 // Configured determines if a given "_service" section has been specified
@@ -323,6 +657,61 @@ type Auth struct {
 	// DomainName is the name of the certificate authority
 	// managed by this domain
 	DomainName string `yaml:"domain_name,omitempty"`
+	// AllowedSourceCIDRs is a list of networks, e.g. "10.0.0.0/8",
+	// the auth server accepts connections from
+	AllowedSourceCIDRs []string `yaml:"allowed_source_cidrs,flow,omitempty"`
+	// Tokens are provisioning tokens set up on the first start
+	Tokens []AllowedToken `yaml:"tokens,omitempty"`
+	// EnableSSHTunnel turns the SSH tunnel to the auth API on listen_addr
+	// on or off, it's on by default
+	EnableSSHTunnel *bool `yaml:"enable_ssh_tunnel,omitempty"`
+	// HTTPListenAddress serves the auth API over HTTP(S) directly, for
+	// deployments that authenticate clients with their own gateway
+	HTTPListenAddress string `yaml:"http_listen_addr,omitempty"`
+	// KeyFile and CertFile are HTTPS key and certificate of http_listen_addr
+	KeyFile  string `yaml:"https_key_file,omitempty"`
+	CertFile string `yaml:"https_cert_file,omitempty"`
+	// ClientCAFile is a PEM bundle of CAs http_listen_addr verifies client
+	// certificates with, the role of a client is its certificate's organization
+	// and the host is its common name, e.g. "uuid.example.com"
+	ClientCAFile string `yaml:"https_client_ca_file,omitempty"`
+	// MaxSessionSize is a maximum number of bytes recorded per session,
+	// the rest of the session is not recorded
+	MaxSessionSize int64 `yaml:"max_session_size,omitempty"`
+	// EventWebhook delivers audit events to an HTTP endpoint
+	EventWebhook *EventWebhook `yaml:"event_webhook,omitempty"`
+}
+
+// AllowedToken is an entry of 'tokens' list of 'auth_service' section
+type AllowedToken struct {
+	// Token is a provisioning token prefixed with the role it's for,
+	// e.g. "n-xxxx" for nodes, it can be a secret reference
+	Token string `yaml:"token"`
+	// Sources restricts the token to source networks, e.g. "10.0.0.0/8",
+	// the token is accepted from anywhere if it's empty
+	Sources []string `yaml:"sources,flow,omitempty"`
+}
+
+// EventWebhook is `event_webhook` section of `auth_service` in the config
+// file, events are posted to the URL as JSON, one event per request
+type EventWebhook struct {
+	URL string `yaml:"url"`
+	// AuthHeader is sent as the Authorization header, it can be
+	// a secret reference
+	AuthHeader string `yaml:"auth_header,omitempty"`
+	// QueueSize is a number of events buffered for delivery
+	QueueSize int `yaml:"queue_size,omitempty"`
+	// Retries is a number of times failed delivery is retried, set it
+	// to 0 to disable retries
+	Retries *int `yaml:"retries,omitempty"`
+	// RetryPeriod is a delay before the first retry, e.g. "1s",
+	// doubled on every next retry
+	RetryPeriod time.Duration `yaml:"retry_period,omitempty"`
+	// Timeout is a time a single delivery request has to complete
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// OnFull is either "drop" or "block", it decides what happens to
+	// events emitted while the queue is full
+	OnFull string `yaml:"on_full,omitempty"`
 }
 
 // SSH is 'ssh_service' section of the config file
@@ -330,6 +719,49 @@ type SSH struct {
 	Service  `yaml:",inline"`
 	Labels   map[string]string `yaml:"labels,omitempty"`
 	Commands []CommandLabel    `yaml:"commands,omitempty"`
+	// VersionString is an SSH version string reported to clients
+	VersionString string `yaml:"version_string,omitempty"`
+	// MOTD is a message of the day shown after login, inline or an
+	// absolute path to a file. Supports {{.Hostname}} and {{.Username}}
+	MOTD string `yaml:"motd,omitempty"`
+	// KeepAliveInterval is a period between keepalive requests sent
+	// to clients, e.g. "1m", set it to "0" to disable keepalives
+	KeepAliveInterval *time.Duration `yaml:"keepalive_interval,omitempty"`
+	// KeepAliveCountMax is a number of unanswered keepalive requests
+	// after which the connection is closed
+	KeepAliveCountMax int `yaml:"keepalive_count_max,omitempty"`
+	// UseLoginShell makes sessions use the shell from the user's passwd
+	// entry instead of the default shell
+	UseLoginShell *bool `yaml:"use_login_shell,omitempty"`
+	// Shell is a shell for sessions, with use_login_shell it's used
+	// for users without a login shell, e.g. "/bin/sh"
+	Shell string `yaml:"shell,omitempty"`
+	// RecordSessions turns session recording on or off for this node,
+	// audit events are emitted either way
+	RecordSessions *bool `yaml:"record_sessions,omitempty"`
+	// HandshakeTimeout is a time clients have to complete the SSH
+	// handshake before the connection is dropped, e.g. "30s"
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout,omitempty"`
+	// HostKeyRotationPeriod is a period between regenerations of the
+	// host key of the node, e.g. "720h", keys are not rotated by default
+	HostKeyRotationPeriod time.Duration `yaml:"host_key_rotation_period,omitempty"`
+	// LabelJitter is a maximum random delay before the first run of
+	// command labels, e.g. "10s", set it to "0" to disable the delay
+	LabelJitter *time.Duration `yaml:"label_jitter,omitempty"`
+	// LabelPolicy sets patterns labels have to match and limits
+	// their number and size
+	LabelPolicy *LabelPolicy `yaml:"label_policy,omitempty"`
+}
+
+// LabelPolicy is `label_policy` section of `ssh_service` in the config file,
+// patterns are regular expressions that have to match the whole key or value
+type LabelPolicy struct {
+	KeyPattern   string `yaml:"key_pattern,omitempty"`
+	ValuePattern string `yaml:"value_pattern,omitempty"`
+	// MaxCount is a maximum number of labels of the node
+	MaxCount *int `yaml:"max_count,omitempty"`
+	// MaxSize is a maximum total size in bytes of label keys and values
+	MaxSize *int `yaml:"max_size,omitempty"`
 }
 
 // CommandLabel is `command` section of `ssh_service` in the config file
@@ -337,6 +769,15 @@ type CommandLabel struct {
 	Name    string        `yaml:"name"`
 	Command []string      `yaml:"command,flow"`
 	Period  time.Duration `yaml:"period"`
+	// User is an OS user to run the command as
+	User string `yaml:"user,omitempty"`
+	// ExitCodes maps exit codes to label values, e.g. {0: healthy, "*": unhealthy}
+	ExitCodes map[string]string `yaml:"exit_codes,omitempty"`
+	// CaptureStderr merges standard error into the label value
+	CaptureStderr bool `yaml:"capture_stderr,omitempty"`
+	// StableRuns is a number of consecutive runs a changed value has to
+	// be produced by before the label changes, use it for flapping commands
+	StableRuns int `yaml:"stable_runs,omitempty"`
 }
 
 // Proxy is `proxy_service` section of the config file:
@@ -345,4 +786,40 @@ type Proxy struct {
 	WebAddr  string `yaml:"web_listen_addr,omitempty"`
 	KeyFile  string `yaml:"https_key_file,omitempty"`
 	CertFile string `yaml:"https_cert_file,omitempty"`
+	// EnableReverseTunnel turns the reverse tunnel listener on or off,
+	// it's on by default when the proxy is enabled
+	EnableReverseTunnel *bool `yaml:"enable_reverse_tunnel,omitempty"`
+	// RequireProvidedTLS makes the proxy fail to start without
+	// https_key_file and https_cert_file instead of generating
+	// a self-signed certificate
+	RequireProvidedTLS bool `yaml:"require_provided_tls,omitempty"`
+	// TLSMinVersion is a minimum TLS version accepted by the web proxy,
+	// e.g. "tls1.2"
+	TLSMinVersion string `yaml:"tls_min_version,omitempty"`
+	// TLSCipherSuites is a list of cipher suites accepted by the web proxy,
+	// named as in Go's crypto/tls package
+	TLSCipherSuites []string `yaml:"tls_cipher_suites,omitempty"`
+	// SecurityHeaders configures security headers sent by the web proxy
+	SecurityHeaders SecurityHeaders `yaml:"security_headers,omitempty"`
+}
+
+// SecurityHeaders is 'security_headers' section of 'proxy_service',
+// values that are not set keep their defaults
+type SecurityHeaders struct {
+	// EnabledFlag turns security headers on or off
+	EnabledFlag string `yaml:"enabled,omitempty"`
+	// HSTSMaxAge is a max-age of Strict-Transport-Security header
+	HSTSMaxAge time.Duration `yaml:"hsts_max_age,omitempty"`
+	// HSTSIncludeSubdomains extends HSTS policy to subdomains
+	HSTSIncludeSubdomains bool `yaml:"hsts_include_subdomains,omitempty"`
+	// FrameOptions is a value of X-Frame-Options header
+	FrameOptions string `yaml:"frame_options,omitempty"`
+	// ContentSecurityPolicy is a value of Content-Security-Policy header
+	ContentSecurityPolicy string `yaml:"content_security_policy,omitempty"`
+}
+
+// Enabled returns 'false' if security headers have been explicitly turned off
+func (h *SecurityHeaders) Enabled() bool {
+	s := Service{EnabledFlag: h.EnabledFlag}
+	return s.Enabled()
 }
@@ -49,6 +49,14 @@ const (
 	// serve auth requests.
 	AuthListenPort = 3025
 
+	// AuthHTTPListenPort is a default port of the auth API served over
+	// HTTP(S) directly, without the SSH tunnel
+	AuthHTTPListenPort = 3026
+
+	// DiagnosticListenPort is a default port of the diagnostic HTTP
+	// endpoint that serves metrics
+	DiagnosticListenPort = 3434
+
 	// Default DB to use for persisting state. Another options is "etcd"
 	BackendType = "bolt"
 
@@ -67,6 +75,10 @@ const (
 	// By default all users use /bin/bash
 	DefaultShell = "/bin/bash"
 
+	// LabelCommandPath is PATH of label commands run as another user,
+	// they don't inherit the environment of the teleport process
+	LabelCommandPath = "/usr/local/bin:/usr/bin:/bin"
+
 	// InviteTokenTTL sets the lifespan of tokens used for adding nodes and users
 	// to a cluster
 	InviteTokenTTL = 15 * time.Minute
@@ -77,6 +89,10 @@ const (
 	// heartbeats coming to auth server
 	ServerHeartbeatTTL = 10 * time.Second
 
+	// DiagnosticRequestTimeout is a timeout for requests to the
+	// diagnostic endpoint of a running process
+	DiagnosticRequestTimeout = 5 * time.Second
+
 	// AuthServersRefreshPeriod is a period for clients to refresh their
 	// their stored list of auth servers
 	AuthServersRefreshPeriod = 5 * time.Second
@@ -105,6 +121,118 @@ const (
 	// ReverseTunnelAgentHeartbeatPeriod is the period between agent heartbeat messages
 	ReverseTunnelAgentHeartbeatPeriod = 3 * time.Second
 
+	// KeepAliveInterval is a period between keepalive requests the SSH
+	// server sends to clients to keep idle connections open through NATs
+	KeepAliveInterval = 5 * time.Minute
+
+	// KeepAliveCountMax is a number of keepalive requests left without
+	// a response before the SSH server closes the connection
+	KeepAliveCountMax = 3
+
+	// KeyGenAttempts is a number of attempts to generate keys and
+	// certificates when the auth server starts for the first time
+	KeyGenAttempts = 3
+
+	// KeyGenRetryPeriod is a period between key generation attempts
+	KeyGenRetryPeriod = time.Second
+
+	// RegisterRetryPeriod is a delay after the first failed attempt to
+	// join the cluster, it doubles after every attempt
+	RegisterRetryPeriod = time.Second
+
+	// MaxRegisterRetryPeriod is a maximum delay between attempts to
+	// join the cluster
+	MaxRegisterRetryPeriod = 30 * time.Second
+
+	// MaxAuthServers is a maximum number of auth servers a process can
+	// be configured with, it protects from slow starts caused by typos
+	MaxAuthServers = 20
+
+	// HandshakeTimeout is a time a client has to complete the SSH handshake,
+	// including authentication, before the server drops the connection
+	HandshakeTimeout = time.Minute
+
+	// ClockSkew is a tolerated difference between clocks of the host
+	// that issued a certificate and the host checking its validity
+	ClockSkew = time.Minute
+
+	// CommandLabelJitter is a maximum random delay before the first run
+	// of a command label, it spreads label commands of nodes started
+	// at the same time
+	CommandLabelJitter = 5 * time.Second
+
+	// MaxLabels is a default maximum number of static and command labels
+	// of a node, every label is sent with every heartbeat
+	MaxLabels = 1024
+
+	// MaxLabelsSize is a default maximum total size in bytes of label
+	// keys and static label values of a node
+	MaxLabelsSize = 64 * 1024
+
+	// HostSignersOpenAttempts is a number of attempts tsh makes to open
+	// the database of trusted host signers locked by another tsh process
+	HostSignersOpenAttempts = 5
+
+	// HostSignersLockTimeout is a time every attempt to open the database
+	// of trusted host signers waits for the lock
+	HostSignersLockTimeout = 100 * time.Millisecond
+
+	// HostSignersRetryPeriod is a delay after the first failed attempt to
+	// open the database of trusted host signers, it doubles after every attempt
+	HostSignersRetryPeriod = 50 * time.Millisecond
+
+	// ShutdownTimeout is a time teleport waits for active sessions to
+	// end on shutdown before it exits anyway
+	ShutdownTimeout = 30 * time.Second
+
+	// BackendCheckTimeout is a time the auth server waits for the keys
+	// backend to pass a read-write check before it reports ready anyway
+	BackendCheckTimeout = 30 * time.Second
+
+	// EtcdNodesFileRefresh is a period of re-reading the file with
+	// the list of etcd nodes
+	EtcdNodesFileRefresh = 30 * time.Second
+
+	// EtcdRequestTimeout is a time a single request to etcd has to
+	// complete, writes hang without it when etcd loses quorum
+	EtcdRequestTimeout = 10 * time.Second
+
+	// EtcdQuorumCheckTimeout is a time the quorum read of the etcd
+	// quorum check has to complete before quorum is considered lost
+	EtcdQuorumCheckTimeout = 5 * time.Second
+
+	// EventWebhookQueueSize is a number of audit events buffered for
+	// delivery to the event webhook
+	EventWebhookQueueSize = 1024
+
+	// EventWebhookRetries is a number of times delivery of an audit event
+	// to the event webhook is retried after the first attempt fails
+	EventWebhookRetries = 3
+
+	// EventWebhookRetryPeriod is a delay before the first retry of event
+	// delivery, doubled on every next retry
+	EventWebhookRetryPeriod = time.Second
+
+	// EventWebhookTimeout is a time a single event delivery request to
+	// the event webhook has to complete
+	EventWebhookTimeout = 10 * time.Second
+
+	// EventWebhookShutdownTimeout is a time queued audit events have to be
+	// delivered to the event webhook on shutdown before they are dropped
+	EventWebhookShutdownTimeout = 10 * time.Second
+
+	// BackendCheckPeriod is a delay between read-write checks of the keys
+	// backend on start
+	BackendCheckPeriod = time.Second
+
+	// AdvertiseIPCheckTimeout is a time a connection to the advertised
+	// address of a role has to be established in during the self-check
+	AdvertiseIPCheckTimeout = 5 * time.Second
+
+	// PostStartTimeout is a time the post start command has to complete
+	// before it gets killed
+	PostStartTimeout = 30 * time.Second
+
 	// MaxSignupTokenTTL is a maximum TTL for a web signup one time token
 	// clients can reduce this time, not increase it
 	MaxSignupTokenTTL = time.Hour
@@ -132,6 +260,10 @@ const (
 	// MaxIterationLimit is max iteration limit
 	MaxIterationLimit = 1000
 
+	// DataDirUsageTTL is a time the data dir usage reported by the status
+	// endpoint is cached for
+	DataDirUsageTTL = time.Minute
+
 	// ActiveSessionTTL is a TTL when session is marked as inactive
 	ActiveSessionTTL = 30 * time.Second
 
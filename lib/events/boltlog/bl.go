@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/gravitational/teleport"
@@ -315,3 +316,94 @@ func key(id []byte) []byte {
 	copy(out[8:], id[8:])   // node id and sequence
 	return out
 }
+
+// IterateEvents calls fn for every event logged strictly after since,
+// in ascending time order. Keys are RFC3339Nano timestamps that drop
+// trailing zeros, so they only sort correctly down to a second; entries
+// within the same second are collected and sorted before being passed on.
+// Events are read in batches, each in its own transaction, so a slow fn
+// does not keep a read transaction open
+func (b *BoltLog) IterateEvents(since time.Time, fn func(lunk.Entry) error) error {
+	since = since.UTC()
+	startKey := []byte(since.Format(secondPrefixFormat))
+	for key := startKey; key != nil; {
+		var groups []entriesByTime
+		var err error
+		groups, key, err = b.readEvents(key, len(startKey), since)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		for _, group := range groups {
+			sort.Sort(group)
+			for _, e := range group {
+				if err := fn(e); err != nil {
+					return trace.Wrap(err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// iterateBatchSize is a number of keys IterateEvents reads in a single
+// transaction, events of the same second are always read together
+var iterateBatchSize = 1000
+
+// readEvents reads events logged after since starting at startKey,
+// grouped by the second they were logged in. It stops at the first
+// second boundary after iterateBatchSize keys and returns the key to
+// resume from, or nil if there are no more events
+func (b *BoltLog) readEvents(startKey []byte, prefixLen int, since time.Time) ([]entriesByTime, []byte, error) {
+	var groups []entriesByTime
+	var next []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt, err := boltbk.GetBucket(tx, []string{"events"})
+		if err != nil {
+			if teleport.IsNotFound(err) {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		var prefix []byte
+		count := 0
+		c := bkt.Cursor()
+		for key, val := c.Seek(startKey); key != nil; key, val = c.Next() {
+			p := key
+			if len(p) > prefixLen {
+				p = p[:prefixLen]
+			}
+			if prefix == nil || !bytes.Equal(p, prefix) {
+				if count >= iterateBatchSize {
+					// keys are only valid during the transaction
+					next = append([]byte{}, key...)
+					return nil
+				}
+				prefix = p
+				groups = append(groups, nil)
+			}
+			count++
+			var e lunk.Entry
+			if err := json.Unmarshal(val, &e); err != nil {
+				return trace.Wrap(err)
+			}
+			if e.Time.After(since) {
+				groups[len(groups)-1] = append(groups[len(groups)-1], e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	return groups, next, nil
+}
+
+// secondPrefixFormat is a prefix of every event key that is common
+// to all events logged within the same second
+const secondPrefixFormat = "2006-01-02T15:04:05"
+
+type entriesByTime []lunk.Entry
+
+func (e entriesByTime) Len() int           { return len(e) }
+func (e entriesByTime) Less(i, j int) bool { return e[i].Time.Before(e[j].Time) }
+func (e entriesByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -19,10 +19,14 @@ package boltlog
 import (
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/events/test"
+	"github.com/gravitational/teleport/lib/session"
 	"github.com/gravitational/teleport/lib/utils"
 
+	"github.com/codahale/lunk"
 	. "gopkg.in/check.v1"
 )
 
@@ -58,6 +62,40 @@ func (s *BoltLogSuite) TestEventsCRUD(c *C) {
 	s.suite.EventsCRUD(c)
 }
 
+func (s *BoltLogSuite) TestIterateEvents(c *C) {
+	s.suite.IterateEvents(c)
+}
+
+func (s *BoltLogSuite) TestIterateEventsBatches(c *C) {
+	defer func(size int) { iterateBatchSize = size }(iterateBatchSize)
+	iterateBatchSize = 2
+
+	// events of the same second are read together even if they don't
+	// fit into a batch
+	start := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	var logged []lunk.Entry
+	for _, offset := range []time.Duration{
+		0, 100 * time.Millisecond, 200 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second} {
+		e := lunk.NewEntry(lunk.NewRootEventID(), &events.AuthAttempt{SessionID: string(session.NewID())})
+		e.Time = start.Add(offset)
+		c.Assert(s.l.LogEntry(e), IsNil)
+		logged = append(logged, e)
+	}
+
+	var out []lunk.Entry
+	err := s.l.IterateEvents(time.Time{}, func(e lunk.Entry) error {
+		// no read transaction is held while the events are handled
+		c.Assert(s.l.db.Stats().OpenTxN, Equals, 0)
+		out = append(out, e)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(out, HasLen, len(logged))
+	for i := range logged {
+		c.Assert(out[i].Time.Equal(logged[i].Time), Equals, true, Commentf("event %v", i))
+	}
+}
+
 func (s *BoltLogSuite) TestSessionsCRUD(c *C) {
 	s.suite.SessionsCRUD(c)
 }
@@ -41,8 +41,67 @@ const (
 	SCPEvent = "teleport.scp"
 	// ResizeEvent means that some user resized PTY on the client
 	ResizeEvent = "teleport.resize.pty"
+	// ConfigLoadEvent means that a teleport process loaded its configuration
+	ConfigLoadEvent = "teleport.config.load"
+	// SessionRecordingLimitEvent means that a session recording reached
+	// the maximum size and the rest of the session is not recorded
+	SessionRecordingLimitEvent = "teleport.session.recording.limit"
+	// ConnectionWarnThresholdEvent means that a client has reached the
+	// connection warn threshold of a service
+	ConnectionWarnThresholdEvent = "teleport.limiter.warn"
 )
 
+// SessionRecordingLimit is emitted when a session recording is stopped
+// because the session produced more than the maximum recorded size
+type SessionRecordingLimit struct {
+	// SessionID is teleport session id
+	SessionID string `json:"sid"`
+	// MaxSize is the maximum recorded size of a session in bytes
+	MaxSize int64 `json:"max_size"`
+}
+
+// Schema returns session recording limit event schema
+func (*SessionRecordingLimit) Schema() string {
+	return SessionRecordingLimitEvent
+}
+
+// ConnectionWarnThreshold is emitted when the number of simultaneous
+// connections from a client reaches the warn threshold of a service
+type ConnectionWarnThreshold struct {
+	// Component is the service that accepted the connections, e.g. node
+	Component string `json:"component"`
+	// Hostname is the name of the host that runs the service
+	Hostname string `json:"hostname"`
+	// RemoteAddr is the address of the client
+	RemoteAddr string `json:"remote_addr"`
+	// Connections is the number of connections from the client
+	Connections int64 `json:"connections"`
+	// MaxConnections is the hard limit, 0 if connections are not limited
+	MaxConnections int64 `json:"max_connections"`
+}
+
+// Schema returns connection warn threshold event schema
+func (*ConnectionWarnThreshold) Schema() string {
+	return ConnectionWarnThresholdEvent
+}
+
+// ConfigLoad is emitted when a teleport process loads its configuration
+type ConfigLoad struct {
+	// Hostname is the name of the host that loaded the configuration
+	Hostname string `json:"hostname"`
+	// HostUUID is the UUID of the host
+	HostUUID string `json:"host_uuid"`
+	// Source is the config file or directory, "defaults" if there was none
+	Source string `json:"source"`
+	// SHA256 is a hex encoded hash of the canonical configuration
+	SHA256 string `json:"sha256"`
+}
+
+// Schema returns config load event schema
+func (*ConfigLoad) Schema() string {
+	return ConfigLoadEvent
+}
+
 // AuthAttempt indicates authentication attempt
 // that can be either successfull or failed
 type AuthAttempt struct {
@@ -79,6 +79,9 @@ type Log interface {
 	LogSession(session.Session) error
 	GetEvents(filter Filter) ([]lunk.Entry, error)
 	GetSessionEvents(filter Filter) ([]session.Session, error)
+	// IterateEvents calls fn for every event logged strictly after since,
+	// in ascending time order, and stops at the first error returned by fn
+	IterateEvents(since time.Time, fn func(lunk.Entry) error) error
 }
 
 // FilterToURL encodes filter to URL query parameters
@@ -159,3 +162,7 @@ func (*NOPEventLogger) GetEvents(filter Filter) ([]lunk.Entry, error) {
 func (*NOPEventLogger) GetSessionEvents(filter Filter) ([]session.Session, error) {
 	return nil, nil
 }
+
+func (*NOPEventLogger) IterateEvents(since time.Time, fn func(lunk.Entry) error) error {
+	return nil
+}
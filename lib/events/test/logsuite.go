@@ -19,6 +19,7 @@ limitations under the License.
 package test
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -87,6 +88,48 @@ func (s *EventSuite) EventsCRUD(c *C) {
 	c.Assert(e2p(es...), DeepEquals, e2p(e1, e2))
 }
 
+func (s *EventSuite) IterateEvents(c *C) {
+	start := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	var logged []lunk.Entry
+	for i, offset := range []time.Duration{
+		0, 500 * time.Millisecond, 550 * time.Millisecond, time.Second, 2 * time.Second} {
+		e := lunk.NewEntry(lunk.NewRootEventID(),
+			&events.AuthAttempt{SessionID: string(session.NewID()), User: fmt.Sprintf("user%v", i)})
+		e.Time = start.Add(offset)
+		c.Assert(s.L.LogEntry(e), IsNil)
+		logged = append(logged, e)
+	}
+
+	iterate := func(since time.Time) []lunk.Entry {
+		var out []lunk.Entry
+		err := s.L.IterateEvents(since, func(e lunk.Entry) error {
+			out = append(out, e)
+			return nil
+		})
+		c.Assert(err, IsNil)
+		return out
+	}
+
+	// zero time returns everything in order
+	c.Assert(e2p(iterate(time.Time{})...), DeepEquals, e2p(logged...))
+
+	// since is exclusive
+	c.Assert(e2p(iterate(start)...), DeepEquals, e2p(logged[1:]...))
+	c.Assert(e2p(iterate(start.Add(500*time.Millisecond))...), DeepEquals, e2p(logged[2:]...))
+	c.Assert(e2p(iterate(start.Add(time.Second))...), DeepEquals, e2p(logged[4:]...))
+	c.Assert(iterate(start.Add(time.Hour)), HasLen, 0)
+
+	// errors returned by the callback stop the iteration
+	count := 0
+	err := s.L.IterateEvents(time.Time{}, func(e lunk.Entry) error {
+		count++
+		return fmt.Errorf("stop")
+	})
+	c.Assert(err, NotNil)
+	c.Assert(count, Equals, 1)
+}
+
 func (s *EventSuite) SessionsCRUD(c *C) {
 	start := time.Now().UTC()
 
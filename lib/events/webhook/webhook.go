@@ -0,0 +1,333 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook implements an event log that forwards audit events
+// to an HTTP endpoint in addition to storing them in another event log
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/session"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codahale/lunk"
+	"github.com/gravitational/trace"
+)
+
+const (
+	// DropPolicy drops events that don't fit into the full queue
+	DropPolicy = "drop"
+	// BlockPolicy makes emitters wait for free space in the full queue
+	BlockPolicy = "block"
+)
+
+// Config configures delivery of events to the webhook
+type Config struct {
+	// URL is an http(s) URL events are posted to as JSON
+	URL string
+	// AuthHeader is a value of the Authorization header sent with
+	// every request, e.g. "Bearer <token>", not sent if empty
+	AuthHeader string
+	// QueueSize is a number of events buffered for delivery
+	QueueSize int
+	// Retries is a number of times delivery of an event is retried
+	// after the first attempt fails, the event is dropped after that
+	Retries int
+	// RetryPeriod is a delay before the first retry, doubled on
+	// every next retry
+	RetryPeriod time.Duration
+	// Timeout is a time a single delivery request has to complete
+	Timeout time.Duration
+	// OnFull is a policy applied when the queue is full, DropPolicy
+	// or BlockPolicy
+	OnFull string
+}
+
+// Enabled returns true if the webhook is configured
+func (c Config) Enabled() bool {
+	return c.URL != ""
+}
+
+// CheckAndSetDefaults makes sure the config is valid and sets defaults
+// for the values that are not set
+func (c *Config) CheckAndSetDefaults() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return trace.Wrap(teleport.BadParameter("url",
+			fmt.Sprintf("expected an http or https URL, got %q", c.URL)))
+	}
+	if c.QueueSize < 0 {
+		return trace.Wrap(teleport.BadParameter("queue_size",
+			fmt.Sprintf("queue size can't be negative: %v", c.QueueSize)))
+	}
+	if c.Retries < 0 {
+		return trace.Wrap(teleport.BadParameter("retries",
+			fmt.Sprintf("number of retries can't be negative: %v", c.Retries)))
+	}
+	if c.RetryPeriod < 0 {
+		return trace.Wrap(teleport.BadParameter("retry_period",
+			fmt.Sprintf("retry period can't be negative: %v", c.RetryPeriod)))
+	}
+	if c.Timeout < 0 {
+		return trace.Wrap(teleport.BadParameter("timeout",
+			fmt.Sprintf("timeout can't be negative: %v", c.Timeout)))
+	}
+	switch c.OnFull {
+	case "":
+		c.OnFull = DropPolicy
+	case DropPolicy, BlockPolicy:
+	default:
+		return trace.Wrap(teleport.BadParameter("on_full",
+			fmt.Sprintf("unsupported policy %q, use %v or %v", c.OnFull, DropPolicy, BlockPolicy)))
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaults.EventWebhookQueueSize
+	}
+	if c.RetryPeriod == 0 {
+		c.RetryPeriod = defaults.EventWebhookRetryPeriod
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaults.EventWebhookTimeout
+	}
+	return nil
+}
+
+// Log stores events in the wrapped event log and delivers them to the
+// webhook asynchronously, so a slow or unavailable webhook never fails
+// or delays writes to the wrapped log beyond the queue policy
+type Log struct {
+	elog      events.Log
+	cfg       Config
+	client    *http.Client
+	queue     chan lunk.Entry
+	drainC    chan struct{}
+	closeC    chan struct{}
+	drainOnce sync.Once
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	dropped   int64
+}
+
+// New returns a log that wraps elog and starts delivering events
+// to the webhook
+func New(elog events.Log, cfg Config) (*Log, error) {
+	if err := cfg.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	l := &Log{
+		elog:   elog,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan lunk.Entry, cfg.QueueSize),
+		drainC: make(chan struct{}),
+		closeC: make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.deliverLoop()
+	return l, nil
+}
+
+// Log logs an event
+func (l *Log) Log(id lunk.EventID, e lunk.Event) {
+	en := lunk.NewEntry(id, e)
+	en.Time = time.Now()
+	if err := l.LogEntry(en); err != nil {
+		log.Errorf("[WEBHOOK] failed to log event %v: %v", en.Schema, err)
+	}
+}
+
+// LogEntry stores the entry in the wrapped log and queues it for
+// delivery, entries the wrapped log fails to store are not delivered
+func (l *Log) LogEntry(en lunk.Entry) error {
+	if err := l.elog.LogEntry(en); err != nil {
+		return trace.Wrap(err)
+	}
+	l.enqueue(en)
+	return nil
+}
+
+// LogSession stores the session in the wrapped log
+func (l *Log) LogSession(sess session.Session) error {
+	return l.elog.LogSession(sess)
+}
+
+// GetEvents returns events from the wrapped log
+func (l *Log) GetEvents(filter events.Filter) ([]lunk.Entry, error) {
+	return l.elog.GetEvents(filter)
+}
+
+// GetSessionEvents returns sessions from the wrapped log
+func (l *Log) GetSessionEvents(filter events.Filter) ([]session.Session, error) {
+	return l.elog.GetSessionEvents(filter)
+}
+
+// IterateEvents iterates over events of the wrapped log
+func (l *Log) IterateEvents(since time.Time, fn func(lunk.Entry) error) error {
+	return l.elog.IterateEvents(since, fn)
+}
+
+// Dropped returns a number of events that were not delivered because
+// the queue was full or all delivery attempts failed
+func (l *Log) Dropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Shutdown delivers events still in the queue and closes the log. Events
+// not delivered within the timeout are dropped
+func (l *Log) Shutdown(timeout time.Duration) error {
+	l.drainOnce.Do(func() {
+		close(l.drainC)
+	})
+	doneC := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(doneC)
+	}()
+	select {
+	case <-doneC:
+	case <-time.After(timeout):
+		log.Warningf("[WEBHOOK] queue was not delivered in %v", timeout)
+	}
+	return l.Close()
+}
+
+// Close stops delivery and closes the wrapped log, events still in the
+// queue are dropped
+func (l *Log) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeC)
+		l.wg.Wait()
+		var left int64
+		for len(l.queue) != 0 {
+			<-l.queue
+			left++
+		}
+		if left != 0 {
+			atomic.AddInt64(&l.dropped, left)
+			log.Warningf("[WEBHOOK] dropped %v undelivered events on close", left)
+		}
+		if closer, ok := l.elog.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return trace.Wrap(err)
+}
+
+func (l *Log) enqueue(en lunk.Entry) {
+	if l.cfg.OnFull == BlockPolicy {
+		select {
+		case l.queue <- en:
+		case <-l.closeC:
+			atomic.AddInt64(&l.dropped, 1)
+		}
+		return
+	}
+	select {
+	case l.queue <- en:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+		log.Warningf("[WEBHOOK] queue is full, dropped event %v", en.Schema)
+	}
+}
+
+func (l *Log) deliverLoop() {
+	defer l.wg.Done()
+	for {
+		select {
+		case en := <-l.queue:
+			l.deliverEntry(en)
+		case <-l.drainC:
+			// deliver what is left in the queue and stop
+			for {
+				select {
+				case en := <-l.queue:
+					l.deliverEntry(en)
+				case <-l.closeC:
+					return
+				default:
+					return
+				}
+			}
+		case <-l.closeC:
+			return
+		}
+	}
+}
+
+func (l *Log) deliverEntry(en lunk.Entry) {
+	if err := l.deliverWithRetries(en); err != nil {
+		atomic.AddInt64(&l.dropped, 1)
+		log.Warningf("[WEBHOOK] dropped event %v after %v attempts: %v",
+			en.Schema, l.cfg.Retries+1, err)
+	}
+}
+
+// deliverWithRetries makes up to Retries+1 attempts to deliver the entry
+func (l *Log) deliverWithRetries(en lunk.Entry) error {
+	data, err := json.Marshal(en)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	period := l.cfg.RetryPeriod
+	for attempt := 0; ; attempt++ {
+		err = l.deliver(data)
+		if err == nil || attempt >= l.cfg.Retries {
+			return trace.Wrap(err)
+		}
+		log.Debugf("[WEBHOOK] attempt %v to deliver event %v failed: %v", attempt+1, en.Schema, err)
+		select {
+		case <-time.After(period):
+		case <-l.closeC:
+			return trace.Wrap(err)
+		}
+		period *= 2
+	}
+}
+
+func (l *Log) deliver(data []byte) error {
+	req, err := http.NewRequest("POST", l.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.cfg.AuthHeader != "" {
+		req.Header.Set("Authorization", l.cfg.AuthHeader)
+	}
+	re, err := l.client.Do(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer re.Body.Close()
+	io.Copy(ioutil.Discard, re.Body)
+	if re.StatusCode < 200 || re.StatusCode > 299 {
+		return trace.Errorf("webhook responded with %v", re.Status)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/events/boltlog"
+	"github.com/gravitational/teleport/lib/events/test"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/codahale/lunk"
+	. "gopkg.in/check.v1"
+)
+
+func TestWebhook(t *testing.T) { TestingT(t) }
+
+type WebhookSuite struct {
+	bl *boltlog.BoltLog
+}
+
+var _ = Suite(&WebhookSuite{})
+
+func (s *WebhookSuite) SetUpSuite(c *C) {
+	utils.InitLoggerForTests()
+}
+
+func (s *WebhookSuite) SetUpTest(c *C) {
+	var err error
+	s.bl, err = boltlog.New(filepath.Join(c.MkDir(), "db"))
+	c.Assert(err, IsNil)
+}
+
+func (s *WebhookSuite) TearDownTest(c *C) {
+	c.Assert(s.bl.Close(), IsNil)
+}
+
+// request is a request received by the stub webhook
+type request struct {
+	auth  string
+	entry lunk.Entry
+}
+
+// stubWebhook responds to requests with codes returned by respond
+// and sends every received request to the returned channel
+func stubWebhook(c *C, respond func(attempt int) int) (*httptest.Server, chan request) {
+	requestsC := make(chan request, 16)
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		c.Assert(err, IsNil)
+		var en lunk.Entry
+		c.Assert(json.Unmarshal(data, &en), IsNil)
+		requestsC <- request{auth: r.Header.Get("Authorization"), entry: en}
+		w.WriteHeader(respond(int(atomic.AddInt32(&attempts, 1))))
+	}))
+	return srv, requestsC
+}
+
+func receive(c *C, requestsC chan request) request {
+	select {
+	case r := <-requestsC:
+		return r
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for the webhook request")
+	}
+	return request{}
+}
+
+func (s *WebhookSuite) TestEventsCRUD(c *C) {
+	srv, _ := stubWebhook(c, func(int) int { return http.StatusOK })
+	defer srv.Close()
+
+	l, err := New(s.bl, Config{URL: srv.URL})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	suite := test.EventSuite{L: l}
+	suite.EventsCRUD(c)
+}
+
+func (s *WebhookSuite) TestDelivery(c *C) {
+	srv, requestsC := stubWebhook(c, func(int) int { return http.StatusOK })
+	defer srv.Close()
+
+	l, err := New(s.bl, Config{URL: srv.URL, AuthHeader: "Bearer secret"})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s1", MaxSize: 10})
+
+	r := receive(c, requestsC)
+	c.Assert(r.auth, Equals, "Bearer secret")
+	c.Assert(r.entry.Schema, Equals, events.SessionRecordingLimitEvent)
+	c.Assert(r.entry.Properties[boltlog.SessionID], Equals, "s1")
+
+	// the event is stored in the wrapped log as well
+	stored, err := s.bl.GetEvents(events.Filter{
+		Start: time.Now().Add(-time.Hour),
+		End:   time.Now().Add(time.Hour),
+		Order: events.Asc,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(stored), Equals, 1)
+	c.Assert(l.Dropped(), Equals, int64(0))
+}
+
+func (s *WebhookSuite) TestRetries(c *C) {
+	// the webhook fails twice and accepts the third attempt
+	srv, requestsC := stubWebhook(c, func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer srv.Close()
+
+	l, err := New(s.bl, Config{URL: srv.URL, Retries: 2, RetryPeriod: time.Millisecond})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s1"})
+	for i := 0; i < 3; i++ {
+		r := receive(c, requestsC)
+		c.Assert(r.entry.Properties[boltlog.SessionID], Equals, "s1")
+	}
+	c.Assert(l.Close(), IsNil)
+	c.Assert(l.Dropped(), Equals, int64(0))
+}
+
+func (s *WebhookSuite) TestRetriesExhausted(c *C) {
+	srv, requestsC := stubWebhook(c, func(int) int { return http.StatusInternalServerError })
+	defer srv.Close()
+
+	l, err := New(s.bl, Config{URL: srv.URL, Retries: 2, RetryPeriod: time.Millisecond})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s1"})
+	for i := 0; i < 3; i++ {
+		receive(c, requestsC)
+	}
+	for i := 0; i < 100 && l.Dropped() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(l.Dropped(), Equals, int64(1))
+
+	// no attempts are made beyond the retry budget
+	select {
+	case <-requestsC:
+		c.Fatalf("unexpected delivery attempt")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *WebhookSuite) TestDropWhenFull(c *C) {
+	unblockC := make(chan struct{})
+	srv, requestsC := stubWebhook(c, func(int) int {
+		<-unblockC
+		return http.StatusOK
+	})
+	defer srv.Close()
+
+	l, err := New(s.bl, Config{URL: srv.URL, QueueSize: 1})
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	// the first event keeps the delivery busy, the second one is queued
+	// and the third one does not fit into the queue
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s1"})
+	receive(c, requestsC)
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s2"})
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s3"})
+	c.Assert(l.Dropped(), Equals, int64(1))
+
+	close(unblockC)
+	r := receive(c, requestsC)
+	c.Assert(r.entry.Properties[boltlog.SessionID], Equals, "s2")
+}
+
+func (s *WebhookSuite) TestShutdown(c *C) {
+	unblockC := make(chan struct{})
+	srv, requestsC := stubWebhook(c, func(int) int {
+		<-unblockC
+		return http.StatusOK
+	})
+	defer srv.Close()
+
+	l, err := New(s.bl, Config{URL: srv.URL})
+	c.Assert(err, IsNil)
+
+	// events queued behind a slow delivery are delivered on shutdown
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s1"})
+	receive(c, requestsC)
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s2"})
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s3"})
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- l.Shutdown(5 * time.Second)
+	}()
+	close(unblockC)
+	for _, id := range []string{"s2", "s3"} {
+		r := receive(c, requestsC)
+		c.Assert(r.entry.Properties[boltlog.SessionID], Equals, id)
+	}
+	c.Assert(<-errC, IsNil)
+	c.Assert(l.Dropped(), Equals, int64(0))
+
+	// the wrapped log is closed as well
+	_, err = s.bl.GetEvents(events.Filter{End: time.Now(), Order: events.Asc})
+	c.Assert(err, NotNil)
+}
+
+func (s *WebhookSuite) TestShutdownTimeout(c *C) {
+	unblockC := make(chan struct{})
+	srv, requestsC := stubWebhook(c, func(int) int {
+		<-unblockC
+		return http.StatusOK
+	})
+	defer srv.Close()
+	defer close(unblockC)
+
+	l, err := New(s.bl, Config{URL: srv.URL, Timeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s1"})
+	receive(c, requestsC)
+	l.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{SessionID: "s2"})
+
+	// the webhook never responds, so the first event fails and the
+	// second one is dropped once the deadline passes
+	c.Assert(l.Shutdown(10*time.Millisecond), IsNil)
+	c.Assert(l.Dropped(), Equals, int64(2))
+}
+
+func (s *WebhookSuite) TestConfig(c *C) {
+	cfg := Config{URL: "https://example.com/events"}
+	c.Assert(cfg.CheckAndSetDefaults(), IsNil)
+	c.Assert(cfg.OnFull, Equals, DropPolicy)
+	c.Assert(cfg.QueueSize > 0, Equals, true)
+
+	for _, bad := range []Config{
+		{URL: "example.com"},
+		{URL: "ftp://example.com"},
+		{URL: "https://example.com", Retries: -1},
+		{URL: "https://example.com", OnFull: "wait"},
+	} {
+		err := bad.CheckAndSetDefaults()
+		c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf("%v", bad))
+	}
+}
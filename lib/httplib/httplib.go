@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/gravitational/teleport"
 
@@ -97,40 +98,66 @@ func ConvertResponse(re *roundtrip.Response, err error) (*roundtrip.Response, er
 		}
 		return nil, trace.Wrap(err)
 	}
-	switch re.Code() {
+	if err := convertError(re.Code(), re.Bytes()); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return re, nil
+}
+
+// ConvertFileResponse converts HTTP error codes of a streamed response
+// to teleport errors, it closes the response body in case of error
+func ConvertFileResponse(re *roundtrip.FileResponse, err error) (*roundtrip.FileResponse, error) {
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok && uerr != nil && uerr.Err != nil {
+			return nil, trace.Wrap(uerr.Err)
+		}
+		return nil, trace.Wrap(err)
+	}
+	if re.Code() >= 200 && re.Code() <= 299 {
+		return re, nil
+	}
+	defer re.Close()
+	body, err := ioutil.ReadAll(re.Body())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return nil, trace.Wrap(convertError(re.Code(), body))
+}
+
+func convertError(code int, body []byte) error {
+	switch code {
 	case http.StatusNotFound:
 		e := teleport.NotFoundError{}
-		unmarshalError(&e, re)
-		return nil, trace.Wrap(&e)
+		unmarshalError(&e, body)
+		return &e
 	case http.StatusBadRequest:
 		e := teleport.BadParameterError{}
-		unmarshalError(&e, re)
-		return nil, trace.Wrap(&e)
+		unmarshalError(&e, body)
+		return &e
 	case http.StatusForbidden:
 		e := teleport.AccessDeniedError{}
-		unmarshalError(&e, re)
-		return nil, trace.Wrap(&e)
+		unmarshalError(&e, body)
+		return &e
 	case http.StatusConflict:
 		e := teleport.AlreadyExistsError{}
-		unmarshalError(&e, re)
-		return nil, trace.Wrap(&e)
+		unmarshalError(&e, body)
+		return &e
 	case StatusTooManyRequests:
 		e := teleport.LimitExceededError{}
-		unmarshalError(&e, re)
-		return nil, trace.Wrap(&e)
+		unmarshalError(&e, body)
+		return &e
 	}
-	if re.Code() < 200 || re.Code() > 299 {
-		return nil, trace.Wrap(
-			teleport.BadParameter("errorcode",
-				fmt.Sprintf("unrecognized http error: %v %v %v", err, re.Code(), string(re.Bytes()))))
+	if code < 200 || code > 299 {
+		return teleport.BadParameter("errorcode",
+			fmt.Sprintf("unrecognized http error: %v %v", code, string(body)))
 	}
-	return re, nil
+	return nil
 }
 
-func unmarshalError(err interface{}, re *roundtrip.Response) {
-	err2 := json.Unmarshal(re.Bytes(), err)
+func unmarshalError(err interface{}, body []byte) {
+	err2 := json.Unmarshal(body, err)
 	if err2 != nil {
-		log.Infof("error unmarshaling response: '%v', err: %v", string(re.Bytes()), err2)
+		log.Infof("error unmarshaling response: '%v', err: %v", string(body), err2)
 	}
 }
 
@@ -142,3 +169,51 @@ func InsecureSetDevmodeHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.Header().Set("Access-Control-Max-Age", "1728000")
 }
+
+// SecurityHeaders configures security related headers that are sent
+// with every response
+type SecurityHeaders struct {
+	// Enabled turns emission of security headers on or off
+	Enabled bool
+	// HSTSMaxAge is a max-age of Strict-Transport-Security header,
+	// the header is omitted if it's zero
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains extends HSTS policy to all subdomains
+	HSTSIncludeSubdomains bool
+	// FrameOptions is a value of X-Frame-Options header, e.g. DENY
+	FrameOptions string
+	// ContentSecurityPolicy is a value of Content-Security-Policy header
+	ContentSecurityPolicy string
+}
+
+// DefaultSecurityHeaders returns security headers configuration
+// suitable for the web UI
+func DefaultSecurityHeaders() SecurityHeaders {
+	return SecurityHeaders{
+		Enabled:               true,
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		FrameOptions:          "DENY",
+		ContentSecurityPolicy: "default-src 'self'; connect-src 'self' wss:; style-src 'self' 'unsafe-inline'; img-src 'self' data:; frame-ancestors 'none'",
+	}
+}
+
+// SetSecurityHeaders sets security headers on the response
+func SetSecurityHeaders(w http.ResponseWriter, h SecurityHeaders) {
+	if !h.Enabled {
+		return
+	}
+	if h.HSTSMaxAge > 0 {
+		value := fmt.Sprintf("max-age=%v", int64(h.HSTSMaxAge/time.Second))
+		if h.HSTSIncludeSubdomains {
+			value += "; includeSubDomains"
+		}
+		w.Header().Set("Strict-Transport-Security", value)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if h.FrameOptions != "" {
+		w.Header().Set("X-Frame-Options", h.FrameOptions)
+	}
+	if h.ContentSecurityPolicy != "" {
+		w.Header().Set("Content-Security-Policy", h.ContentSecurityPolicy)
+	}
+}
@@ -35,14 +35,26 @@ type ConnectionsLimiter struct {
 	*sync.Mutex
 	connections    map[string]int64
 	maxConnections int64
+	warnThreshold  int64
+	onWarn         func(token string, connections int64)
 }
 
 // NewConnectionsLimiter returns new connection limiter, in case if connection
 // limits are not set, they won't be tracked
 func NewConnectionsLimiter(config LimiterConfig) (*ConnectionsLimiter, error) {
+	if config.WarnThreshold < 0 {
+		return nil, trace.Wrap(teleport.BadParameter("warn_threshold",
+			fmt.Sprintf("warn threshold can't be negative: %v", config.WarnThreshold)))
+	}
+	if config.MaxConnections > 0 && config.WarnThreshold >= config.MaxConnections {
+		return nil, trace.Wrap(teleport.BadParameter("warn_threshold",
+			fmt.Sprintf("warn threshold %v should be below max connections %v", config.WarnThreshold, config.MaxConnections)))
+	}
 	limiter := ConnectionsLimiter{
 		Mutex:          &sync.Mutex{},
 		maxConnections: config.MaxConnections,
+		warnThreshold:  config.WarnThreshold,
+		onWarn:         config.OnWarn,
 		connections:    make(map[string]int64),
 	}
 
@@ -67,25 +79,53 @@ func (l *ConnectionsLimiter) WrapHandle(h http.Handler) {
 
 // AcquireConnection acquires connection and bumps counter
 func (l *ConnectionsLimiter) AcquireConnection(token string) error {
+	connections, err := l.acquireConnection(token)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	// the warning is reported once per crossing, outside of the lock,
+	// so a slow event log doesn't hold back other connections
+	if l.warnThreshold > 0 && connections == l.warnThreshold {
+		l.warn(token, connections)
+	}
+	return nil
+}
+
+func (l *ConnectionsLimiter) acquireConnection(token string) (int64, error) {
 	l.Lock()
 	defer l.Unlock()
 
-	if l.maxConnections == 0 {
-		return nil
+	if !l.tracking() {
+		return 0, nil
 	}
 
-	numberOfConnections, exists := l.connections[token]
-	if !exists {
-		l.connections[token] = 1
-		return nil
-	}
-	if numberOfConnections >= l.maxConnections {
-		return trace.Wrap(
+	numberOfConnections := l.connections[token]
+	if l.maxConnections > 0 && numberOfConnections >= l.maxConnections {
+		return 0, trace.Wrap(
 			teleport.LimitExceeded(
 				fmt.Sprintf("too many connections from %v: %v, max is %v", token, numberOfConnections, l.maxConnections)), nil)
 	}
 	l.connections[token] = numberOfConnections + 1
-	return nil
+	return numberOfConnections + 1, nil
+}
+
+// warn reports that the number of connections from the client has
+// reached the warn threshold
+func (l *ConnectionsLimiter) warn(token string, connections int64) {
+	log.WithFields(log.Fields{
+		"remote_addr":    token,
+		"connections":    connections,
+		"warn_threshold": l.warnThreshold,
+		"max":            l.maxConnections,
+	}).Warningf("[LIMITER] %v has reached the connection warn threshold", token)
+	if l.onWarn != nil {
+		l.onWarn(token, connections)
+	}
+}
+
+// tracking returns true if connections are counted per client
+func (l *ConnectionsLimiter) tracking() bool {
+	return l.maxConnections > 0 || l.warnThreshold > 0
 }
 
 // ReleaseConnection decrements the counter
@@ -94,7 +134,7 @@ func (l *ConnectionsLimiter) ReleaseConnection(token string) {
 	l.Lock()
 	defer l.Unlock()
 
-	if l.maxConnections == 0 {
+	if !l.tracking() {
 		return
 	}
 
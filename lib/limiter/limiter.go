@@ -19,7 +19,11 @@ package limiter
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/gravitational/teleport"
 
 	"github.com/gravitational/trace"
 	"github.com/mailgun/timetools"
@@ -31,6 +35,13 @@ type Limiter struct {
 	*ConnectionsLimiter
 	// rateLimiter limits request rate
 	rateLimiter *RateLimiter
+	// disabled turns limiter into a no-op
+	disabled bool
+	// handler is a handler wrapped by disabled limiter
+	handler http.Handler
+	// handshakes is a semaphore of connections in the middle of
+	// the handshake, it's nil if their number is not limited
+	handshakes chan struct{}
 }
 
 // LimiterConfig sets up rate limits and configuration limits parameters
@@ -41,8 +52,21 @@ type LimiterConfig struct {
 	MaxConnections int64
 	// MaxNumberOfUsers controls maximum number of simultaneously active users
 	MaxNumberOfUsers int
+	// MaxHandshakes limits the number of connections in the middle of
+	// the handshake, separately from established connections
+	MaxHandshakes int
+	// WarnThreshold is a number of simultaneous connections from a client
+	// that is reported as a warning before MaxConnections refuses them,
+	// warnings are off if it's 0
+	WarnThreshold int64
+	// OnWarn is an optional callback called when a client reaches
+	// WarnThreshold
+	OnWarn func(token string, connections int64) `json:"-"`
 	// Clock is an optional parameter, if not set, will use system time
-	Clock timetools.TimeProvider
+	Clock timetools.TimeProvider `json:"-"`
+	// Disabled turns off all limits, so limiter accepts unlimited
+	// connections and requests
+	Disabled bool
 }
 
 // SetEnv reads LimiterConfig from JSON string
@@ -53,10 +77,30 @@ func (l *LimiterConfig) SetEnv(v string) error {
 	return nil
 }
 
+// Effective returns a copy of the config with the defaults the limiter
+// falls back to filled in, so it reports the limits actually enforced
+func (l LimiterConfig) Effective() LimiterConfig {
+	out := LimiterConfig{
+		Rates:            append([]Rate{}, l.Rates...),
+		MaxConnections:   l.MaxConnections,
+		MaxNumberOfUsers: l.MaxNumberOfUsers,
+		MaxHandshakes:    l.MaxHandshakes,
+		WarnThreshold:    l.WarnThreshold,
+		Disabled:         l.Disabled,
+	}
+	if len(out.Rates) == 0 {
+		out.Rates = []Rate{{Period: time.Second, Average: DefaultRate, Burst: DefaultRate}}
+	}
+	if out.MaxNumberOfUsers <= 0 {
+		out.MaxNumberOfUsers = DefaultMaxNumberOfUsers
+	}
+	return out
+}
+
 // NewLimiter returns new rate and connection limiter
 func NewLimiter(config LimiterConfig) (*Limiter, error) {
 	var err error
-	limiter := Limiter{}
+	limiter := Limiter{disabled: config.Disabled}
 
 	limiter.ConnectionsLimiter, err = NewConnectionsLimiter(config)
 	if err != nil {
@@ -68,15 +112,75 @@ func NewLimiter(config LimiterConfig) (*Limiter, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	if config.MaxHandshakes < 0 {
+		return nil, trace.Wrap(teleport.BadParameter("max_handshakes",
+			fmt.Sprintf("max handshakes can't be negative: %v", config.MaxHandshakes)))
+	}
+	if config.MaxHandshakes > 0 && !config.Disabled {
+		limiter.handshakes = make(chan struct{}, config.MaxHandshakes)
+	}
+
 	return &limiter, nil
 }
 
+// AcquireConnection acquires connection and bumps counter
+func (l *Limiter) AcquireConnection(token string) error {
+	if l.disabled {
+		return nil
+	}
+	return l.ConnectionsLimiter.AcquireConnection(token)
+}
+
+// ReleaseConnection decrements the counter
+func (l *Limiter) ReleaseConnection(token string) {
+	if l.disabled {
+		return
+	}
+	l.ConnectionsLimiter.ReleaseConnection(token)
+}
+
+// AcquireHandshake blocks until the number of handshakes in progress
+// drops below the limit and takes a slot for a new one
+func (l *Limiter) AcquireHandshake() {
+	if l.handshakes != nil {
+		l.handshakes <- struct{}{}
+	}
+}
+
+// ReleaseHandshake frees a slot taken by AcquireHandshake once
+// the handshake is over
+func (l *Limiter) ReleaseHandshake() {
+	if l.handshakes != nil {
+		<-l.handshakes
+	}
+}
+
 func (l *Limiter) RegisterRequest(token string) error {
+	if l.disabled {
+		return nil
+	}
 	return l.rateLimiter.RegisterRequest(token)
 }
 
 // Add limiter to the handle
-func (l *Limiter) WrapHandle(h http.Handler) {
+func (l *Limiter) WrapHandle(h http.Handler) error {
+	if h == nil {
+		return trace.Wrap(teleport.BadParameter("handler", "missing HTTP handler"))
+	}
+	if l.disabled {
+		l.handler = h
+		return nil
+	}
 	l.rateLimiter.Wrap(h)
 	l.ConnLimiter.Wrap(l.rateLimiter)
+	return nil
+}
+
+// ServeHTTP serves HTTP requests through the wrapped handler
+func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.disabled {
+		l.handler.ServeHTTP(w, r)
+		return
+	}
+	l.ConnLimiter.ServeHTTP(w, r)
 }
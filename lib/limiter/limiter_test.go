@@ -16,9 +16,13 @@ limitations under the License.
 package limiter
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/utils"
 	"github.com/mailgun/timetools"
 
@@ -95,6 +99,162 @@ func (s *LimiterSuite) TestConnectionsLimiter(c *C) {
 	}
 }
 
+func (s *LimiterSuite) TestWarnThreshold(c *C) {
+	type warning struct {
+		token       string
+		connections int64
+	}
+	var warnings []warning
+	limiter, err := NewLimiter(LimiterConfig{
+		MaxConnections: 5,
+		WarnThreshold:  3,
+		OnWarn: func(token string, connections int64) {
+			warnings = append(warnings, warning{token, connections})
+		},
+	})
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		c.Assert(limiter.AcquireConnection("token1"), IsNil)
+	}
+	c.Assert(warnings, HasLen, 0)
+
+	// crossing the threshold warns, but the connection is accepted
+	c.Assert(limiter.AcquireConnection("token1"), IsNil)
+	c.Assert(warnings, DeepEquals, []warning{{"token1", 3}})
+
+	// further connections under the hard limit don't warn again
+	c.Assert(limiter.AcquireConnection("token1"), IsNil)
+	c.Assert(limiter.AcquireConnection("token1"), IsNil)
+	c.Assert(limiter.AcquireConnection("token1"), NotNil)
+	c.Assert(warnings, HasLen, 1)
+
+	// other clients are tracked separately
+	c.Assert(limiter.AcquireConnection("token2"), IsNil)
+	c.Assert(warnings, HasLen, 1)
+
+	// the client warns again once it drops below the threshold and
+	// crosses it once more
+	for i := 0; i < 3; i++ {
+		limiter.ReleaseConnection("token1")
+	}
+	c.Assert(limiter.AcquireConnection("token1"), IsNil)
+	c.Assert(warnings, DeepEquals, []warning{{"token1", 3}, {"token1", 3}})
+
+	// warnings work without the hard limit
+	warnings = nil
+	limiter, err = NewLimiter(LimiterConfig{
+		WarnThreshold: 2,
+		OnWarn: func(token string, connections int64) {
+			warnings = append(warnings, warning{token, connections})
+		},
+	})
+	c.Assert(err, IsNil)
+	for i := 0; i < 10; i++ {
+		c.Assert(limiter.AcquireConnection("token1"), IsNil)
+	}
+	c.Assert(warnings, DeepEquals, []warning{{"token1", 2}})
+
+	// the threshold has to be below the hard limit
+	_, err = NewLimiter(LimiterConfig{MaxConnections: 5, WarnThreshold: 5})
+	c.Assert(err, NotNil)
+	_, err = NewLimiter(LimiterConfig{WarnThreshold: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *LimiterSuite) TestHandshakeLimiter(c *C) {
+	limiter, err := NewLimiter(LimiterConfig{MaxHandshakes: 2, MaxConnections: 1})
+	c.Assert(err, IsNil)
+
+	acquired := make(chan struct{}, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			limiter.AcquireHandshake()
+			acquired <- struct{}{}
+		}()
+	}
+	waitAcquired := func() bool {
+		select {
+		case <-acquired:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+	c.Assert(waitAcquired(), Equals, true)
+	c.Assert(waitAcquired(), Equals, true)
+	// the third handshake waits for a free slot
+	c.Assert(waitAcquired(), Equals, false)
+	limiter.ReleaseHandshake()
+	c.Assert(waitAcquired(), Equals, true)
+
+	// handshakes don't count towards the connection limit
+	c.Assert(limiter.AcquireConnection("token1"), IsNil)
+	c.Assert(limiter.AcquireConnection("token1"), NotNil)
+
+	// no limit by default or with disabled limiter
+	for _, config := range []LimiterConfig{{}, {MaxHandshakes: 1, Disabled: true}} {
+		limiter, err = NewLimiter(config)
+		c.Assert(err, IsNil)
+		for i := 0; i < 10; i++ {
+			limiter.AcquireHandshake()
+		}
+	}
+
+	_, err = NewLimiter(LimiterConfig{MaxHandshakes: -1})
+	c.Assert(err, NotNil)
+}
+
+func (s *LimiterSuite) TestDisabledLimiter(c *C) {
+	config := LimiterConfig{
+		MaxConnections: 2,
+		Rates: []Rate{
+			Rate{
+				Period:  time.Minute,
+				Average: 1,
+				Burst:   1,
+			},
+		},
+	}
+	enabled, err := NewLimiter(config)
+	c.Assert(err, IsNil)
+	config.Disabled = true
+	disabled, err := NewLimiter(config)
+	c.Assert(err, IsNil)
+
+	// enabled limiter throttles connections and requests
+	for i := 0; i < 2; i++ {
+		c.Assert(enabled.AcquireConnection("token1"), IsNil)
+	}
+	c.Assert(enabled.AcquireConnection("token1"), NotNil)
+	c.Assert(enabled.RegisterRequest("token1"), IsNil)
+	c.Assert(enabled.RegisterRequest("token1"), NotNil)
+
+	// disabled one accepts everything
+	for i := 0; i < 100; i++ {
+		c.Assert(disabled.AcquireConnection("token1"), IsNil)
+		c.Assert(disabled.RegisterRequest("token1"), IsNil)
+	}
+	for i := 0; i < 100; i++ {
+		disabled.ReleaseConnection("token1")
+	}
+
+	// nil handler is rejected by both
+	c.Assert(teleport.IsBadParameter(enabled.WrapHandle(nil)), Equals, true)
+	c.Assert(teleport.IsBadParameter(disabled.WrapHandle(nil)), Equals, true)
+
+	// disabled limiter passes HTTP requests through
+	err = disabled.WrapHandle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	c.Assert(err, IsNil)
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		disabled.ServeHTTP(w, &http.Request{RemoteAddr: "127.0.0.1:5000"})
+		c.Assert(w.Code, Equals, http.StatusTeapot)
+	}
+}
+
 func (s *LimiterSuite) TestRateLimiter(c *C) {
 	// TODO: this test fails
 	clock := &timetools.FreezedTime{
@@ -163,3 +323,20 @@ func (s *LimiterSuite) TestRateLimiter(c *C) {
 	}
 	c.Assert(err, NotNil)
 }
+
+func (s *LimiterSuite) TestEffectiveConfig(c *C) {
+	config := LimiterConfig{MaxConnections: 10, Clock: &timetools.RealTime{}}
+	effective := config.Effective()
+	c.Assert(effective, DeepEquals, LimiterConfig{
+		MaxConnections:   10,
+		MaxNumberOfUsers: DefaultMaxNumberOfUsers,
+		Rates:            []Rate{{Period: time.Second, Average: DefaultRate, Burst: DefaultRate}},
+	})
+
+	// effective config is encoded the same way SetEnv reads it
+	data, err := json.Marshal(effective)
+	c.Assert(err, IsNil)
+	var out LimiterConfig
+	c.Assert(out.SetEnv(string(data)), IsNil)
+	c.Assert(out, DeepEquals, effective)
+}
@@ -128,6 +128,20 @@ func (l *RateLimiter) WrapHandle(h http.Handler) {
 	l.TokenLimiter.Wrap(h)
 }
 
+// MarshalJSON encodes the rate with the period as a duration string,
+// the same way UnmarshalJSON expects it
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Period  string
+		Average int64
+		Burst   int64
+	}{
+		Period:  r.Period.String(),
+		Average: r.Average,
+		Burst:   r.Burst,
+	})
+}
+
 func (r *Rate) UnmarshalJSON(value []byte) error {
 	type rate struct {
 		Period  string
@@ -0,0 +1,225 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics implements a minimal registry of gauges that teleport
+// services update as connections come and go. The registry renders its
+// contents in Prometheus text exposition format and is served on the
+// diagnostic address
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// ContentType is the content type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4"
+
+var (
+	// SSHSessions counts active SSH connections served by nodes
+	SSHSessions = NewGauge("teleport_ssh_sessions_active",
+		"Number of active SSH connections", "role")
+	// AuthRequests counts auth API requests being served, labeled
+	// with the role of the caller
+	AuthRequests = NewGauge("teleport_auth_requests_in_flight",
+		"Number of auth API requests in flight", "role")
+	// ProxyConnections counts active SSH and web connections served by proxies
+	ProxyConnections = NewGauge("teleport_proxy_connections_active",
+		"Number of active proxy connections", "role")
+
+	// DefaultRegistry is a registry with all standard teleport metrics
+	DefaultRegistry = MustRegistry(SSHSessions, AuthRequests, ProxyConnections)
+)
+
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Gauge is a metric with a set of values partitioned by a single label,
+// e.g. number of connections per role
+type Gauge struct {
+	sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]int64
+}
+
+// NewGauge returns a new gauge with the given name, help string and
+// the name of the label used to partition values
+func NewGauge(name, help, label string) *Gauge {
+	return &Gauge{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]int64),
+	}
+}
+
+// Name returns the metric name
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+// Inc increments the value for the given label value
+func (g *Gauge) Inc(labelValue string) {
+	g.Add(labelValue, 1)
+}
+
+// Dec decrements the value for the given label value
+func (g *Gauge) Dec(labelValue string) {
+	g.Add(labelValue, -1)
+}
+
+// Add adds delta to the value for the given label value
+func (g *Gauge) Add(labelValue string, delta int64) {
+	g.Lock()
+	defer g.Unlock()
+	g.values[labelValue] += delta
+}
+
+// Value returns the current value for the given label value
+func (g *Gauge) Value(labelValue string) int64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.values[labelValue]
+}
+
+// Total returns the sum of values across all label values
+func (g *Gauge) Total() int64 {
+	g.Lock()
+	defer g.Unlock()
+	var total int64
+	for _, v := range g.values {
+		total += v
+	}
+	return total
+}
+
+// writeTo renders gauge in Prometheus text format
+func (g *Gauge) writeTo(w io.Writer) error {
+	g.Lock()
+	defer g.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", g.name, escapeHelp(g.help), g.name); err != nil {
+		return trace.Wrap(err)
+	}
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, err := fmt.Fprintf(w, "%v{%v=\"%v\"} %v\n", g.name, g.label, escapeLabel(k), g.values[k])
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Registry is a set of metrics rendered together
+type Registry struct {
+	sync.Mutex
+	gauges []*Gauge
+}
+
+// NewRegistry returns a new registry with the gauges registered
+func NewRegistry(gauges ...*Gauge) (*Registry, error) {
+	r := &Registry{}
+	if err := r.Register(gauges...); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return r, nil
+}
+
+// MustRegistry is like NewRegistry, but panics on invalid gauges
+func MustRegistry(gauges ...*Gauge) *Registry {
+	r, err := NewRegistry(gauges...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Register adds gauges to the registry
+func (r *Registry) Register(gauges ...*Gauge) error {
+	r.Lock()
+	defer r.Unlock()
+	for _, g := range gauges {
+		if !metricName.MatchString(g.name) {
+			return trace.Wrap(teleport.BadParameter("name", fmt.Sprintf("invalid metric name: '%v'", g.name)))
+		}
+		if !metricName.MatchString(g.label) || strings.HasPrefix(g.label, "__") {
+			return trace.Wrap(teleport.BadParameter("label", fmt.Sprintf("invalid label name: '%v'", g.label)))
+		}
+		for _, existing := range r.gauges {
+			if existing.name == g.name {
+				return trace.Wrap(teleport.AlreadyExists(fmt.Sprintf("metric '%v' is already registered", g.name)))
+			}
+		}
+		r.gauges = append(r.gauges, g)
+	}
+	return nil
+}
+
+// Write renders all metrics in Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.Lock()
+	defer r.Unlock()
+	for _, g := range r.gauges {
+		if err := g.writeTo(w); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves metrics in Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(buf.Bytes())
+}
+
+// InstrumentHandler returns a handler that tracks requests being served
+// by h in the gauge under the given label value
+func InstrumentHandler(g *Gauge, labelValue string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Inc(labelValue)
+		defer g.Dec(labelValue)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
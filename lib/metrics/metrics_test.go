@@ -0,0 +1,122 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/utils"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestMetrics(t *testing.T) { TestingT(t) }
+
+type MetricsSuite struct {
+}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) SetUpSuite(c *C) {
+	utils.InitLoggerForTests()
+}
+
+func (s *MetricsSuite) TestGauges(c *C) {
+	g := NewGauge("test_connections", "Test connections", "role")
+	r, err := NewRegistry(g)
+	c.Assert(err, IsNil)
+
+	// simulate connections coming and going for several roles
+	for i := 0; i < 3; i++ {
+		g.Inc("node")
+	}
+	g.Inc("proxy")
+	g.Dec("node")
+	c.Assert(g.Value("node"), Equals, int64(2))
+	c.Assert(g.Value("proxy"), Equals, int64(1))
+	c.Assert(g.Total(), Equals, int64(3))
+
+	// same metric can't be registered twice
+	err = r.Register(g)
+	c.Assert(teleport.IsAlreadyExists(err), Equals, true)
+
+	_, err = NewRegistry(NewGauge("bad-name", "", "role"))
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	_, err = NewRegistry(NewGauge("good_name", "", "bad label"))
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
+func (s *MetricsSuite) TestEndpoint(c *C) {
+	g := NewGauge("test_requests_in_flight", "Test requests\nin flight", "role")
+	r, err := NewRegistry(g)
+	c.Assert(err, IsNil)
+
+	// block the instrumented handler to observe in-flight requests
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := InstrumentHandler(g, `pro"xy`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		re, err := http.Get(srv.URL)
+		if err == nil {
+			re.Body.Close()
+		}
+	}()
+	<-entered
+	c.Assert(g.Value(`pro"xy`), Equals, int64(1))
+
+	msrv := httptest.NewServer(r)
+	defer msrv.Close()
+	re, err := http.Get(msrv.URL)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.Header.Get("Content-Type"), Equals, ContentType)
+	data, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+
+	expected := `# HELP test_requests_in_flight Test requests\nin flight
+# TYPE test_requests_in_flight gauge
+test_requests_in_flight{role="pro\"xy"} 1
+`
+	c.Assert(string(data), Equals, expected)
+
+	// every line should be either a comment or a valid sample
+	sample := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*"\})? -?[0-9]+$`)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		c.Assert(sample.MatchString(line), Equals, true, Commentf("invalid line: %v", line))
+	}
+
+	close(release)
+	<-done
+	c.Assert(g.Value(`pro"xy`), Equals, int64(0))
+}
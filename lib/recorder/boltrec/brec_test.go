@@ -54,3 +54,7 @@ func (s *BoltRecSuite) TearDownTest(c *C) {
 func (s *BoltRecSuite) TestRecorder(c *C) {
 	s.suite.Recorder(c)
 }
+
+func (s *BoltRecSuite) TestSizeLimit(c *C) {
+	s.suite.SizeLimit(c)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package recorder
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// sizeIdleTimeout is a time after the last write when a session size is
+// forgotten, it is counted again from the stored chunks on the next write
+const sizeIdleTimeout = time.Hour
+
+// NewSizeLimiter returns a recorder that records at most maxSize bytes
+// of terminal data per session. The chunk that crosses the limit is cut,
+// a marker chunk is appended and onLimit is called once, the rest of the
+// session is dropped while writes keep succeeding, so the session goes on
+func NewSizeLimiter(r Recorder, maxSize int64, onLimit func(id string, maxSize int64)) Recorder {
+	return &sizeLimiter{
+		Recorder: r,
+		maxSize:  maxSize,
+		onLimit:  onLimit,
+		sizes:    make(map[string]*recordingSize),
+	}
+}
+
+// LimitMarker returns data of the chunk appended to a recording that
+// reached maxSize bytes
+func LimitMarker(maxSize int64) []byte {
+	return []byte(fmt.Sprintf(
+		"\r\n[session recording stopped: exceeded %v bytes]\r\n", maxSize))
+}
+
+type sizeLimiter struct {
+	sync.Mutex
+	Recorder
+	maxSize int64
+	onLimit func(id string, maxSize int64)
+	// sizes are sizes of active sessions, guarded by the mutex
+	sizes map[string]*recordingSize
+}
+
+// recordingSize is the recorded size of a session, it is read from the
+// stored chunks on the first write and tracked incrementally after that
+type recordingSize struct {
+	sync.Mutex
+	loaded   bool
+	bytes    int64
+	exceeded bool
+	// lastWrite is a time of the last write in unix nanoseconds, it's
+	// accessed atomically, so idle sessions are found without waiting
+	// for the session lock
+	lastWrite int64
+}
+
+func (l *sizeLimiter) GetChunkWriter(id string) (ChunkWriteCloser, error) {
+	w, err := l.Recorder.GetChunkWriter(id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &limitedWriter{ChunkWriteCloser: w, id: id, l: l}, nil
+}
+
+// sessionSize returns the size of the session, forgetting sessions idle
+// for longer than sizeIdleTimeout
+func (l *sizeLimiter) sessionSize(id string) *recordingSize {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for sid, size := range l.sizes {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&size.lastWrite))) > sizeIdleTimeout {
+			delete(l.sizes, sid)
+		}
+	}
+	size, ok := l.sizes[id]
+	if !ok {
+		size = &recordingSize{}
+		l.sizes[id] = size
+	}
+	atomic.StoreInt64(&size.lastWrite, now.UnixNano())
+	return size
+}
+
+// reserve returns chunks that fit in the session limit and accounts them,
+// the last returned chunk is the marker if the limit was reached by this call
+func (l *sizeLimiter) reserve(id string, chunks []Chunk) ([]Chunk, bool, error) {
+	// only writes to the same session wait for the stored chunks to be
+	// counted, other sessions keep recording
+	size := l.sessionSize(id)
+	size.Lock()
+	defer size.Unlock()
+
+	if !size.loaded {
+		stored, err := l.storedSize(id)
+		if err != nil {
+			return nil, false, trace.Wrap(err)
+		}
+		size.bytes, size.exceeded, size.loaded = stored, stored > l.maxSize, true
+	}
+	if size.exceeded {
+		return nil, false, nil
+	}
+	out := make([]Chunk, 0, len(chunks))
+	for _, ch := range chunks {
+		if size.bytes+int64(len(ch.Data)) <= l.maxSize {
+			size.bytes += int64(len(ch.Data))
+			out = append(out, ch)
+			continue
+		}
+		ch.Data = ch.Data[:l.maxSize-size.bytes]
+		out = append(out, ch)
+		marker := Chunk{
+			Data:           LimitMarker(l.maxSize),
+			ServerID:       ch.ServerID,
+			TerminalParams: ch.TerminalParams,
+		}
+		out = append(out, marker)
+		size.bytes = l.maxSize + int64(len(marker.Data))
+		size.exceeded = true
+		return out, true, nil
+	}
+	return out, false, nil
+}
+
+// storedSizeBatch is a number of chunks read at once to count the size
+// of a stored recording
+const storedSizeBatch = 1000
+
+// storedSize counts bytes already recorded for the session, so the limit
+// holds across restarts and forgotten idle sessions
+func (l *sizeLimiter) storedSize(id string) (int64, error) {
+	r, err := l.Recorder.GetChunkReader(id)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	defer r.Close()
+	count, err := r.GetChunksCount()
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	var size int64
+	for start := 1; start <= int(count); start += storedSizeBatch {
+		chunks, err := r.ReadChunks(start, start+storedSizeBatch)
+		if err != nil {
+			return 0, trace.Wrap(err)
+		}
+		for _, ch := range chunks {
+			size += int64(len(ch.Data))
+		}
+	}
+	return size, nil
+}
+
+type limitedWriter struct {
+	ChunkWriteCloser
+	id string
+	l  *sizeLimiter
+}
+
+func (w *limitedWriter) WriteChunks(chunks []Chunk) error {
+	out, exceeded, err := w.l.reserve(w.id, chunks)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(out) != 0 {
+		if err := w.ChunkWriteCloser.WriteChunks(out); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if exceeded && w.l.onLimit != nil {
+		w.l.onLimit(w.id, w.l.maxSize)
+	}
+	return nil
+}
@@ -75,3 +75,88 @@ func (s *RecorderSuite) Recorder(c *C) {
 	c.Assert(r1.Close(), IsNil)
 	c.Assert(r2.Close(), IsNil)
 }
+
+func (s *RecorderSuite) SizeLimit(c *C) {
+	var limited []string
+	r := recorder.NewSizeLimiter(s.R, 10, func(id string, maxSize int64) {
+		c.Assert(maxSize, Equals, int64(10))
+		limited = append(limited, id)
+	})
+
+	w, err := r.GetChunkWriter("recs2")
+	c.Assert(err, IsNil)
+
+	c1 := recorder.Chunk{Data: []byte("chunk1"), ServerID: "id1"}
+	c2 := recorder.Chunk{Data: []byte("chunk2"), ServerID: "id1"}
+	c3 := recorder.Chunk{Data: []byte("chunk3"), ServerID: "id1"}
+
+	c.Assert(w.WriteChunks([]recorder.Chunk{c1}), IsNil)
+	c.Assert(len(limited), Equals, 0)
+	// the session goes on, but only 4 bytes of c2 fit in the limit
+	c.Assert(w.WriteChunks([]recorder.Chunk{c2}), IsNil)
+	c.Assert(limited, DeepEquals, []string{"recs2"})
+	c.Assert(w.WriteChunks([]recorder.Chunk{c3}), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	// a new writer for the same session does not record either
+	w, err = r.GetChunkWriter("recs2")
+	c.Assert(err, IsNil)
+	c.Assert(w.WriteChunks([]recorder.Chunk{c3}), IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Assert(limited, DeepEquals, []string{"recs2"})
+
+	rd, err := s.R.GetChunkReader("recs2")
+	c.Assert(err, IsNil)
+	count, err := rd.GetChunksCount()
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, uint64(3))
+	o, err := rd.ReadChunks(1, 4)
+	c.Assert(err, IsNil)
+	c.Assert(o, DeepEquals, []recorder.Chunk{
+		c1,
+		recorder.Chunk{Data: []byte("chun"), ServerID: "id1"},
+		recorder.Chunk{Data: recorder.LimitMarker(10), ServerID: "id1"},
+	})
+	c.Assert(rd.Close(), IsNil)
+
+	// the limit holds for a limiter that only sees the stored recording
+	r = recorder.NewSizeLimiter(s.R, 10, func(id string, maxSize int64) {
+		limited = append(limited, id)
+	})
+	w, err = r.GetChunkWriter("recs2")
+	c.Assert(err, IsNil)
+	c.Assert(w.WriteChunks([]recorder.Chunk{c3}), IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Assert(limited, DeepEquals, []string{"recs2"})
+
+	// other sessions have their own budget
+	w, err = r.GetChunkWriter("recs3")
+	c.Assert(err, IsNil)
+	c.Assert(w.WriteChunks([]recorder.Chunk{c1}), IsNil)
+	c.Assert(w.Close(), IsNil)
+	c.Assert(limited, DeepEquals, []string{"recs2"})
+
+	// the stored recording is read once per session, later writes are
+	// accounted incrementally
+	counting := &countingRecorder{Recorder: s.R}
+	r = recorder.NewSizeLimiter(counting, 100, nil)
+	for i := 0; i < 3; i++ {
+		w, err = r.GetChunkWriter("recs4")
+		c.Assert(err, IsNil)
+		c.Assert(w.WriteChunks([]recorder.Chunk{c1}), IsNil)
+		c.Assert(w.WriteChunks([]recorder.Chunk{c2}), IsNil)
+		c.Assert(w.Close(), IsNil)
+	}
+	c.Assert(counting.readers, Equals, 1)
+}
+
+// countingRecorder counts readers requested from the recorder
+type countingRecorder struct {
+	recorder.Recorder
+	readers int
+}
+
+func (r *countingRecorder) GetChunkReader(id string) (recorder.ChunkReadCloser, error) {
+	r.readers++
+	return r.Recorder.GetChunkReader(id)
+}
@@ -79,12 +79,16 @@ type server struct {
 	sync.RWMutex
 
 	localAuth       auth.ClientI
-	hostCertChecker ssh.CertChecker
-	userCertChecker ssh.CertChecker
+	hostCertChecker sshutils.CertChecker
+	userCertChecker sshutils.CertChecker
+	clockSkew       time.Duration
 	l               net.Listener
 	srv             *sshutils.Server
 	timeout         time.Duration
 	limiter         *limiter.Limiter
+	reusePort       bool
+	logConnections  bool
+	recoverPanics   bool
 
 	tunnelSites []*tunnelSite
 	directSites []*directSite
@@ -114,6 +118,37 @@ func SetLimiter(limiter *limiter.Limiter) ServerOption {
 	}
 }
 
+// SetReusePort binds the listening socket with SO_REUSEPORT, so another
+// process can listen on the same address
+func SetReusePort(reusePort bool) ServerOption {
+	return func(s *server) {
+		s.reusePort = reusePort
+	}
+}
+
+// SetConnectionLogging turns on logging of accepted, authenticated and
+// closed connections with the source IP and principal
+func SetConnectionLogging(enabled bool) ServerOption {
+	return func(s *server) {
+		s.logConnections = enabled
+	}
+}
+
+// SetPanicRecovery turns on recovery from panics in connection and
+// request handlers, a panic closes the channel it happened in
+func SetPanicRecovery(enabled bool) ServerOption {
+	return func(s *server) {
+		s.recoverPanics = enabled
+	}
+}
+
+// SetClockSkew sets a tolerated clock skew for certificate validity checks
+func SetClockSkew(skew time.Duration) ServerOption {
+	return func(s *server) {
+		s.clockSkew = skew
+	}
+}
+
 // NewServer returns an unstarted server
 func NewServer(addr utils.NetAddr, hostSigners []ssh.Signer,
 	clt auth.ClientI, opts ...ServerOption) (Server, error) {
@@ -122,6 +157,7 @@ func NewServer(addr utils.NetAddr, hostSigners []ssh.Signer,
 		directSites: []*directSite{},
 		tunnelSites: []*tunnelSite{},
 		localAuth:   clt,
+		clockSkew:   defaults.ClockSkew,
 	}
 	var err error
 	srv.limiter, err = limiter.NewLimiter(limiter.LimiterConfig{})
@@ -132,10 +168,23 @@ func NewServer(addr utils.NetAddr, hostSigners []ssh.Signer,
 	for _, o := range opts {
 		o(srv)
 	}
+	if srv.clockSkew < 0 {
+		return nil, trace.Wrap(teleport.BadParameter("clock_skew", "clock skew can't be negative"))
+	}
 	if srv.timeout == 0 {
 		srv.timeout = teleport.DefaultTimeout
 	}
 
+	serverOpts := []sshutils.ServerOption{
+		sshutils.SetLimiter(srv.limiter),
+		sshutils.SetReusePort(srv.reusePort),
+	}
+	if srv.logConnections {
+		serverOpts = append(serverOpts, sshutils.SetConnectionLogging(teleport.ComponentReverseTunnel))
+	}
+	if srv.recoverPanics {
+		serverOpts = append(serverOpts, sshutils.SetPanicRecovery(teleport.ComponentReverseTunnel))
+	}
 	s, err := sshutils.NewServer(
 		addr,
 		srv,
@@ -143,13 +192,19 @@ func NewServer(addr utils.NetAddr, hostSigners []ssh.Signer,
 		sshutils.AuthMethods{
 			PublicKey: srv.keyAuth,
 		},
-		sshutils.SetLimiter(srv.limiter),
+		serverOpts...,
 	)
 	if err != nil {
 		return nil, err
 	}
-	srv.hostCertChecker = ssh.CertChecker{IsAuthority: srv.isHostAuthority}
-	srv.userCertChecker = ssh.CertChecker{IsAuthority: srv.isUserAuthority}
+	srv.hostCertChecker = sshutils.CertChecker{
+		CertChecker: ssh.CertChecker{IsAuthority: srv.isHostAuthority},
+		ClockSkew:   srv.clockSkew,
+	}
+	srv.userCertChecker = sshutils.CertChecker{
+		CertChecker: ssh.CertChecker{IsAuthority: srv.isUserAuthority},
+		ClockSkew:   srv.clockSkew,
+	}
 	srv.srv = s
 	return srv, nil
 }
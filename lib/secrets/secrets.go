@@ -0,0 +1,146 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package secrets resolves references to secrets kept outside of the
+// configuration, e.g. "secret://env/TELEPORT_TOKEN", using providers
+// registered by name
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// Scheme is a prefix of secret references
+const Scheme = "secret://"
+
+// Provider fetches secrets from an external store, like Vault
+type Provider interface {
+	// GetSecret returns the value of a secret at a given path
+	GetSecret(path string) ([]byte, error)
+}
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{
+		"env":  EnvProvider{},
+		"file": FileProvider{},
+	}
+)
+
+// Register makes a provider available under a given name, e.g. "vault"
+// resolves references like "secret://vault/teleport/token"
+func Register(name string, p Provider) error {
+	if name == "" || strings.Contains(name, "/") {
+		return trace.Wrap(teleport.BadParameter("name", fmt.Sprintf("invalid secret provider name: %q", name)))
+	}
+	if p == nil {
+		return trace.Wrap(teleport.BadParameter("provider", "missing secret provider"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	providers[name] = p
+	return nil
+}
+
+// Unregister removes a provider registered under a given name
+func Unregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(providers, name)
+}
+
+// IsReference returns true if a value is a secret reference
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, Scheme)
+}
+
+// Resolve returns the value of a secret a given value refers to, values
+// that are not secret references are returned as is
+func Resolve(value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+	data, err := Fetch(value)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Fetch returns raw contents of a secret a reference points to
+func Fetch(ref string) ([]byte, error) {
+	name, path, err := parseReference(ref)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	mu.RLock()
+	p, ok := providers[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, trace.Wrap(teleport.NotFound(fmt.Sprintf("secret provider %q is not registered", name)))
+	}
+	data, err := p.GetSecret(path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return data, nil
+}
+
+func parseReference(ref string) (name, path string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(ref, Scheme), "/", 2)
+	if !IsReference(ref) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", teleport.BadParameter("secret",
+			fmt.Sprintf("expected secret reference in the form %vprovider/path, got %q", Scheme, ref))
+	}
+	return parts[0], parts[1], nil
+}
+
+// EnvProvider reads secrets from environment variables,
+// e.g. "secret://env/TELEPORT_TOKEN"
+type EnvProvider struct {
+}
+
+// GetSecret returns the value of an environment variable
+func (EnvProvider) GetSecret(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, trace.Wrap(teleport.NotFound(fmt.Sprintf("environment variable %v is not set", name)))
+	}
+	return []byte(value), nil
+}
+
+// FileProvider reads secrets from files, paths are absolute,
+// e.g. "secret://file/etc/teleport/token" reads /etc/teleport/token
+type FileProvider struct {
+}
+
+// GetSecret returns contents of a file
+func (FileProvider) GetSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/", path))
+	if err != nil {
+		return nil, trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	return data, nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravitational/teleport"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestSecrets(t *testing.T) { TestingT(t) }
+
+type SecretsSuite struct {
+}
+
+var _ = Suite(&SecretsSuite{})
+
+type stubProvider map[string]string
+
+func (p stubProvider) GetSecret(path string) ([]byte, error) {
+	value, ok := p[path]
+	if !ok {
+		return nil, teleport.NotFound(path)
+	}
+	return []byte(value), nil
+}
+
+func (s *SecretsSuite) TestResolve(c *C) {
+	c.Assert(Register("stub", stubProvider{"teleport/token": "secret-token\n"}), IsNil)
+	defer Unregister("stub")
+
+	value, err := Resolve("secret://stub/teleport/token")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "secret-token")
+
+	// plain values are returned as is
+	value, err = Resolve("plain-token")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "plain-token")
+
+	_, err = Resolve("secret://stub/missing")
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+
+	_, err = Resolve("secret://vault/teleport/token")
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+
+	for _, ref := range []string{"secret://", "secret://stub", "secret://stub/", "secret:///path"} {
+		_, err = Resolve(ref)
+		c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf(ref))
+	}
+
+	c.Assert(teleport.IsBadParameter(Register("a/b", stubProvider{})), Equals, true)
+}
+
+func (s *SecretsSuite) TestDefaultProviders(c *C) {
+	os.Setenv("TELEPORT_TEST_SECRET", "from-env")
+	defer os.Unsetenv("TELEPORT_TEST_SECRET")
+	value, err := Resolve("secret://env/TELEPORT_TEST_SECRET")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "from-env")
+
+	_, err = Resolve("secret://env/TELEPORT_TEST_SECRET_MISSING")
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+
+	path := filepath.Join(c.MkDir(), "token")
+	c.Assert(ioutil.WriteFile(path, []byte("from-file\n"), 0600), IsNil)
+	value, err = Resolve("secret://file" + path)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "from-file")
+}
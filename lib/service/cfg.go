@@ -17,16 +17,26 @@ limitations under the License.
 package service
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth"
 	"github.com/gravitational/teleport/lib/backend/etcdbk"
 	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events/webhook"
+	"github.com/gravitational/teleport/lib/httplib"
 	"github.com/gravitational/teleport/lib/limiter"
 	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/utils"
@@ -43,14 +53,102 @@ type Config struct {
 	DataDir  string
 	Hostname string
 
+	// RequireExistingDataDir makes teleport fail to start if the parent
+	// of DataDir does not exist instead of creating the whole path
+	RequireExistingDataDir bool
+
+	// RequirePersistentDataDir makes teleport fail to start if DataDir
+	// is on tmpfs or ramfs instead of only warning about it
+	RequirePersistentDataDir bool
+
+	// KeyPassphrase encrypts private keys of host identities stored
+	// in DataDir, keys are stored in plain text if it's empty
+	KeyPassphrase string
+
 	// AuthServers is a list of auth servers nodes, proxies and peer auth servers
 	// connect to
 	AuthServers NetAddrSlice
 
+	// AuthServerStrategy defines the order in which auth servers are tried
+	AuthServerStrategy auth.AuthServerStrategy
+
+	// MaxAuthServers is a maximum number of auth servers in AuthServers
+	MaxAuthServers int
+
+	// AuthServerHostKey is a public key or its SHA256 fingerprint auth
+	// servers have to present, any host key is accepted if it's empty
+	AuthServerHostKey string
+
+	// HeartbeatTTL is a TTL of presence records that nodes, proxies
+	// and auth servers send to the auth server
+	HeartbeatTTL time.Duration
+
+	// AuthServersRefreshPeriod is a period for clients to refresh
+	// the list of auth servers
+	AuthServersRefreshPeriod time.Duration
+
+	// StartMode defines what happens when one of the enabled roles
+	// fails to start
+	StartMode StartMode
+
+	// MinKeySize is a minimum size in bits of RSA host keys in the data
+	// dir, smaller keys are rejected. Key size is not checked if it's zero
+	MinKeySize int
+
+	// RegisterRetries is a number of attempts to join the cluster when
+	// the auth server is unreachable, it retries forever if it's zero.
+	// A token rejected by the auth server is never retried
+	RegisterRetries int
+
+	// HostCertCheck defines what happens when the host certificate on disk
+	// is not valid for the advertise IP
+	HostCertCheck HostCertCheck
+
+	// AuthCacheTTL is a time nodes and proxies cache cert authorities
+	// and nodes fetched from the auth server, caching is off if it's zero
+	AuthCacheTTL time.Duration
+
+	// ShutdownTimeout is a time the process waits for active sessions
+	// and tunnels to drain on shutdown before it exits anyway
+	ShutdownTimeout time.Duration
+
+	// ClockSkew is a tolerated difference between clocks of cluster hosts
+	// when certificate validity periods are checked
+	ClockSkew time.Duration
+
+	// ReusePort binds listeners of all roles with SO_REUSEPORT, so a new
+	// process can take over the ports before the old one exits
+	ReusePort bool
+
+	// ConnectionLogging logs accepted, authenticated and closed SSH
+	// connections of all roles with the source IP and principal
+	ConnectionLogging bool
+
+	// PanicRecovery recovers from panics in request handlers of all
+	// roles, so a panic in one role doesn't crash the process
+	PanicRecovery bool
+
+	// AuditConfigLoad emits an event with the hash of the configuration
+	// every time the process loads it
+	AuditConfigLoad bool
+
+	// ConfigSource is where the configuration was loaded from
+	ConfigSource string
+
+	// ConfigSHA256 is a hex encoded SHA256 of the canonical configuration
+	ConfigSHA256 string
+
+	// PostStart is a command run once all enabled roles have started
+	PostStart PostStartConfig
+
 	// AdvertiseIP is used to "publish" an alternative IP address this node
 	// can be reached on, if running behind NAT
 	AdvertiseIP net.IP
 
+	// AdvertiseIPCheck makes roles dial the advertise IP on their ports
+	// once they have started and warn if the address is not reachable
+	AdvertiseIPCheck bool
+
 	// SSH role an SSH endpoint server
 	SSH SSHConfig
 
@@ -67,6 +165,66 @@ type Config struct {
 
 	// Console writer to speak to a user
 	Console io.Writer
+
+	// DiagnosticAddr is an address of the diagnostic HTTP endpoint that
+	// serves metrics, it is disabled if empty
+	DiagnosticAddr utils.NetAddr
+}
+
+// PostStartConfig is a command teleport runs once all enabled roles
+// have started, e.g. to register the host in a service discovery system
+type PostStartConfig struct {
+	// Command is a command with arguments, the hook is disabled if empty
+	Command []string
+	// Timeout is a time the command has to complete before it is killed
+	Timeout time.Duration
+	// AbortOnError stops teleport if the command fails,
+	// otherwise the failure is only logged
+	AbortOnError bool
+}
+
+// StartMode defines how the process reacts to a role that fails to start
+type StartMode string
+
+const (
+	// StartAllOrNothing aborts the process if any enabled role fails to start
+	StartAllOrNothing StartMode = "all-or-nothing"
+	// StartBestEffort logs and skips a role that failed to start and
+	// keeps running the rest of enabled roles
+	StartBestEffort StartMode = "best-effort"
+)
+
+// Check returns error if start mode is not supported
+func (m StartMode) Check() error {
+	switch m {
+	case StartAllOrNothing, StartBestEffort:
+		return nil
+	}
+	return trace.Wrap(teleport.BadParameter("start_mode",
+		fmt.Sprintf("unsupported start mode: '%v', supported are %v and %v",
+			m, StartAllOrNothing, StartBestEffort)))
+}
+
+// HostCertCheck defines how the process reacts to a host certificate
+// that is not valid for the configured advertise IP
+type HostCertCheck string
+
+const (
+	// HostCertCheckWarn logs a warning about the host certificate
+	HostCertCheckWarn HostCertCheck = "warn"
+	// HostCertCheckOff turns the check off
+	HostCertCheckOff HostCertCheck = "off"
+)
+
+// Check returns error if host cert check mode is not supported
+func (c HostCertCheck) Check() error {
+	switch c {
+	case HostCertCheckWarn, HostCertCheckOff:
+		return nil
+	}
+	return trace.Wrap(teleport.BadParameter("host_cert_check",
+		fmt.Sprintf("unsupported host cert check: '%v', supported are %v and %v",
+			c, HostCertCheckWarn, HostCertCheckOff)))
 }
 
 // ApplyToken assigns a given token to all internal services but only if token
@@ -83,6 +241,112 @@ func (cfg *Config) ApplyToken(token string) bool {
 	return false
 }
 
+// Validate makes sure the config is consistent as a whole, it is called
+// once all sources of settings are merged, as a setting coming from one
+// source can contradict a setting coming from another one
+func (cfg *Config) Validate() error {
+	if !cfg.Auth.Enabled && !cfg.SSH.Enabled && !cfg.Proxy.Enabled {
+		return trace.Wrap(
+			teleport.BadParameter(
+				"config", "supply at least one of Auth, SSH or Proxy roles"))
+	}
+	if cfg.DataDir == "" {
+		return trace.Wrap(teleport.BadParameter("config", "please supply data directory"))
+	}
+	if cfg.StartMode != "" {
+		if err := cfg.StartMode.Check(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if cfg.HostCertCheck != "" {
+		if err := cfg.HostCertCheck.Check(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if (cfg.Proxy.TLSKey == "" && cfg.Proxy.TLSCert != "") || (cfg.Proxy.TLSKey != "" && cfg.Proxy.TLSCert == "") {
+		return trace.Wrap(teleport.BadParameter("config", "please supply both TLS key and certificate"))
+	}
+	if cfg.Proxy.Enabled && cfg.Proxy.RequireProvidedTLS && cfg.Proxy.TLSKey == "" {
+		return trace.Wrap(teleport.BadParameter("require_provided_tls",
+			"self-signed certificates are disabled, please supply https_key_file and https_cert_file"))
+	}
+	if len(cfg.AuthServers) == 0 {
+		return trace.Wrap(teleport.BadParameter("proxy", "please supply a proxy server"))
+	}
+	if cfg.Auth.Enabled {
+		if err := cfg.Auth.CheckStorage(); err != nil {
+			return trace.Wrap(err)
+		}
+		if err := cfg.Auth.CheckListeners(); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if cfg.SSH.Enabled {
+		if err := CheckLabelCollisions(cfg.SSH.Labels, cfg.SSH.CmdLabels); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// CanonicalizeAddrs brings every network address in the config to the
+// canonical form, see utils.NetAddr.Canonical, so addresses parsed from
+// different sources compare equal, and makes sure the addresses enabled
+// roles listen on and connect to are set
+func (cfg *Config) CanonicalizeAddrs() error {
+	type setting struct {
+		field    string
+		addr     *utils.NetAddr
+		port     int
+		required bool
+	}
+	addrs := []setting{
+		{"teleport.diag_addr", &cfg.DiagnosticAddr, defaults.DiagnosticListenPort, false},
+	}
+	add := func(field string, addr *utils.NetAddr, port int, required bool) {
+		addrs = append(addrs, setting{field, addr, port, required})
+	}
+	if cfg.Auth.Enabled {
+		add("auth_service.listen_addr", &cfg.Auth.SSHAddr, defaults.AuthListenPort, true)
+		add("auth_service.http_listen_addr", &cfg.Auth.HTTPAddr, defaults.AuthHTTPListenPort, false)
+	}
+	if cfg.SSH.Enabled {
+		add("ssh_service.listen_addr", &cfg.SSH.Addr, defaults.SSHServerListenPort, true)
+	}
+	if cfg.Proxy.Enabled {
+		add("proxy_service.listen_addr", &cfg.Proxy.SSHAddr, defaults.SSHProxyListenPort, true)
+		add("proxy_service.web_listen_addr", &cfg.Proxy.WebAddr, defaults.HTTPListenPort, true)
+		add("proxy_service.tunnel_listen_addr", &cfg.Proxy.ReverseTunnelListenAddr,
+			defaults.SSHProxyTunnelListenPort, cfg.Proxy.ReverseTunnelEnabled)
+	}
+	for i := range cfg.AuthServers {
+		add("teleport.auth_servers", &cfg.AuthServers[i], defaults.AuthListenPort, true)
+	}
+	for _, a := range addrs {
+		if a.addr.IsEmpty() {
+			if a.required {
+				return trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.field,
+					"address is missing"))
+			}
+			continue
+		}
+		canonical, err := a.addr.Canonical(a.port)
+		if err != nil {
+			return trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.field,
+				fmt.Sprintf("invalid address '%v': %v", a.addr.Addr, utils.UserMessageFromError(err))))
+		}
+		*a.addr = *canonical
+	}
+	// auth servers are dialed, they can't stand for all interfaces
+	for _, addr := range cfg.AuthServers {
+		if host, _, err := net.SplitHostPort(addr.Addr); err == nil && host == "" {
+			return trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, "teleport.auth_servers",
+				fmt.Sprintf("auth server address '%v' has no host", addr.Addr)))
+		}
+	}
+	return nil
+}
+
 // ConfigureBolt configures Bolt back-ends with a data dir.
 func (cfg *Config) ConfigureBolt(dataDir string) {
 	a := &cfg.Auth
@@ -101,6 +365,10 @@ func (cfg *Config) ConfigureBolt(dataDir string) {
 // ConfigureETCD configures ETCD backend (still uses BoltDB for some cases)
 func (cfg *Config) ConfigureETCD(dataDir string, etcdCfg etcdbk.Config) error {
 	a := &cfg.Auth
+	// refuse to override backends explicitly set to unsupported types
+	if err := a.CheckStorage(); err != nil {
+		return trace.Wrap(err)
+	}
 
 	params, err := etcdParams(etcdCfg)
 	if err != nil {
@@ -150,13 +418,18 @@ type ProxyConfig struct {
 	// ReverseTunnelListenAddr is address where reverse tunnel dialers connect to
 	ReverseTunnelListenAddr utils.NetAddr
 
+	// ReverseTunnelEnabled turns the reverse tunnel listener on or off,
+	// web and SSH proxies keep working for the local cluster when it's off
+	ReverseTunnelEnabled bool
+
 	// WebAddr is address for web portal of the proxy
 	WebAddr utils.NetAddr
 
 	// SSHAddr is address of ssh proxy
 	SSHAddr utils.NetAddr
 
-	// AssetsDir is a directory with proxy website assets
+	// AssetsDir is a directory with proxy website assets, it's empty
+	// if the assets could not be located
 	AssetsDir string
 
 	// TLSKey is a base64 encoded private key used by web portal
@@ -165,6 +438,19 @@ type ProxyConfig struct {
 	// TLSCert is a base64 encoded certificate used by web portal
 	TLSCert string
 
+	// RequireProvidedTLS makes the proxy fail to start without TLSKey and
+	// TLSCert instead of generating a self-signed certificate
+	RequireProvidedTLS bool
+
+	// TLSMinVersion is a minimum TLS version accepted by web portal
+	TLSMinVersion uint16
+
+	// TLSCipherSuites is a list of cipher suites accepted by web portal
+	TLSCipherSuites []uint16
+
+	// SecurityHeaders configures security headers sent by web portal
+	SecurityHeaders httplib.SecurityHeaders
+
 	Limiter limiter.LimiterConfig
 }
 
@@ -175,6 +461,22 @@ type AuthConfig struct {
 	// SSHAddr is the listening address of SSH tunnel to HTTP service
 	SSHAddr utils.NetAddr
 
+	// TunnelEnabled serves the auth API over the SSH tunnel on SSHAddr
+	TunnelEnabled bool
+
+	// HTTPAddr is an address the auth API is served on over HTTP(S)
+	// directly, without the SSH tunnel, the listener is off if it's empty
+	HTTPAddr utils.NetAddr
+
+	// HTTPTLSCert and HTTPTLSKey are HTTPS certificate and key of HTTPAddr
+	HTTPTLSCert string
+	HTTPTLSKey  string
+
+	// HTTPClientCAFile is a PEM bundle of CAs HTTPAddr verifies client
+	// certificates with, requests get the role and the host identity
+	// from the organization and the common name of the client certificate
+	HTTPClientCAFile string
+
 	// Token is a provisioning token for an additonal auth server joining the cluster
 	Token string
 
@@ -185,6 +487,10 @@ type AuthConfig struct {
 	// AllowedTokens is a set of tokens that will be added as trusted
 	AllowedTokens KeyVal
 
+	// AllowedTokenSources restricts allowed tokens to source networks,
+	// it is keyed by the same tokens as AllowedTokens
+	AllowedTokenSources map[string][]net.IPNet
+
 	// TrustedAuthorities is a set of trusted user certificate authorities
 	TrustedAuthorities CertificateAuthorities
 
@@ -228,7 +534,68 @@ type AuthConfig struct {
 		Params string
 	}
 
+	// MaxSessionSize is a maximum number of bytes recorded per session,
+	// sessions are not limited if it's 0
+	MaxSessionSize int64
+
+	// EventWebhook delivers audit events to an HTTP endpoint, it's
+	// off if the URL is not set
+	EventWebhook webhook.Config
+
+	// BackendCheckTimeout is a time the auth server waits for the keys
+	// backend to pass a read-write check on start before reporting ready
+	BackendCheckTimeout time.Duration
+
 	Limiter limiter.LimiterConfig
+
+	// AllowedSourceCIDRs restricts source IPs of connections accepted
+	// by the auth server, any source is allowed if it's empty
+	AllowedSourceCIDRs []net.IPNet
+}
+
+// CheckStorage makes sure the combination of storage backends is supported:
+// keys can be stored in bolt or etcd, while events and session recordings
+// can only be stored in bolt
+func (a *AuthConfig) CheckStorage() error {
+	switch a.KeysBackend.Type {
+	case teleport.BoltBackendType, teleport.ETCDBackendType:
+	default:
+		return trace.Wrap(teleport.BadParameterWithCode(teleport.CodeUnsupportedBackend,
+			"keys_backend", fmt.Sprintf("unsupported keys backend type '%v', use %v or %v",
+				a.KeysBackend.Type, teleport.BoltBackendType, teleport.ETCDBackendType)))
+	}
+	if a.EventsBackend.Type != teleport.BoltBackendType {
+		return trace.Wrap(teleport.BadParameterWithCode(teleport.CodeUnsupportedBackend,
+			"events_backend", fmt.Sprintf("events can't be stored in '%v' backend, only %v is supported for events, "+
+				"even when keys are stored in %v", a.EventsBackend.Type, teleport.BoltBackendType, teleport.ETCDBackendType)))
+	}
+	if a.RecordsBackend.Type != teleport.BoltBackendType {
+		return trace.Wrap(teleport.BadParameterWithCode(teleport.CodeUnsupportedBackend,
+			"records_backend", fmt.Sprintf("session recordings can't be stored in '%v' backend, only %v is supported for recordings, "+
+				"even when keys are stored in %v", a.RecordsBackend.Type, teleport.BoltBackendType, teleport.ETCDBackendType)))
+	}
+	return nil
+}
+
+// CheckListeners makes sure the auth API is served on at least one
+// listener and the HTTP(S) listener is configured consistently
+func (a *AuthConfig) CheckListeners() error {
+	if !a.TunnelEnabled && a.HTTPAddr.IsEmpty() {
+		return trace.Wrap(teleport.BadParameter("enable_ssh_tunnel",
+			"the SSH tunnel is disabled and http_listen_addr is not set, the auth API would be unreachable"))
+	}
+	if a.HTTPAddr.IsEmpty() {
+		return nil
+	}
+	if a.HTTPTLSKey == "" || a.HTTPTLSCert == "" {
+		return trace.Wrap(teleport.BadParameter("http_listen_addr",
+			"the auth API is not served over plain HTTP, please supply both HTTPS key and certificate"))
+	}
+	if a.HTTPClientCAFile == "" {
+		return trace.Wrap(teleport.BadParameter("http_listen_addr",
+			"please supply https_client_ca_file to verify client certificates with"))
+	}
+	return nil
 }
 
 // SSHConfig configures SSH server node role
@@ -240,10 +607,160 @@ type SSHConfig struct {
 	Limiter   limiter.LimiterConfig
 	Labels    map[string]string
 	CmdLabels services.CommandLabels
+
+	// VersionString is an SSH version string reported to clients,
+	// the default of the SSH library is used if it's empty
+	VersionString string
+
+	// MOTD is a message of the day template shown after the shell starts
+	MOTD string
+
+	// KeepAliveInterval is a period between keepalive requests sent
+	// to clients, zero disables keepalives
+	KeepAliveInterval time.Duration
+	// KeepAliveCountMax is a number of unanswered keepalive requests
+	// after which the connection is closed
+	KeepAliveCountMax int
+
+	// HandshakeTimeout is a time clients have to complete the SSH
+	// handshake before the connection is dropped
+	HandshakeTimeout time.Duration
+
+	// LabelJitter is a maximum random delay before the first run of
+	// command labels
+	LabelJitter time.Duration
+
+	// HostKeyRotationPeriod is a period between regenerations of the
+	// host identity of the node, keys are not rotated if it's zero
+	HostKeyRotationPeriod time.Duration
+
+	// UseLoginShell makes sessions use the shell from the user's passwd
+	// entry, Shell is used if the lookup fails or this is false
+	UseLoginShell bool
+
+	// RecordSessions turns session recording on or off for this node,
+	// audit events are emitted either way
+	RecordSessions bool
+
+	// LabelPolicy sets patterns labels of this node have to match
+	LabelPolicy LabelPolicy
+}
+
+// LabelPolicy is a naming convention for labels, patterns are regular
+// expressions that have to match the whole label key or value, empty
+// patterns match anything
+type LabelPolicy struct {
+	// KeyPattern is a pattern of label keys, e.g. "[a-z][a-z0-9_]*"
+	KeyPattern string
+	// ValuePattern is a pattern of static label values
+	ValuePattern string
+	// MaxCount is a maximum number of static and command labels,
+	// 0 means no limit
+	MaxCount int
+	// MaxSize is a maximum total size in bytes of label keys and static
+	// label values, 0 means no limit
+	MaxSize int
+}
+
+// Check makes sure labels match the policy and fit into its budget.
+// Command labels get their values at runtime, so only their keys are checked
+func (p LabelPolicy) Check(labels map[string]string, cmdLabels services.CommandLabels) error {
+	if err := p.checkBudget(labels, cmdLabels); err != nil {
+		return trace.Wrap(err)
+	}
+	keyRe, err := compileLabelPattern("key_pattern", p.KeyPattern)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	valueRe, err := compileLabelPattern("value_pattern", p.ValuePattern)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	keys := make([]string, 0, len(labels)+len(cmdLabels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	for key := range cmdLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if keyRe != nil && !keyRe.MatchString(key) {
+			return trace.Wrap(teleport.BadParameter("labels",
+				fmt.Sprintf("label key %q does not match the label policy pattern %q", key, p.KeyPattern)))
+		}
+		value, ok := labels[key]
+		if ok && valueRe != nil && !valueRe.MatchString(value) {
+			return trace.Wrap(teleport.BadParameter("labels",
+				fmt.Sprintf("value %q of label %q does not match the label policy pattern %q", value, key, p.ValuePattern)))
+		}
+	}
+	return nil
+}
+
+// checkBudget makes sure the number and the total size of labels don't
+// exceed the maximums, huge label sets bloat heartbeats and the backend
+func (p LabelPolicy) checkBudget(labels map[string]string, cmdLabels services.CommandLabels) error {
+	if p.MaxCount < 0 {
+		return trace.Wrap(teleport.BadParameter("max_count",
+			fmt.Sprintf("maximum number of labels can't be negative: %v", p.MaxCount)))
+	}
+	if p.MaxSize < 0 {
+		return trace.Wrap(teleport.BadParameter("max_size",
+			fmt.Sprintf("maximum size of labels can't be negative: %v", p.MaxSize)))
+	}
+	if count := len(labels) + len(cmdLabels); p.MaxCount > 0 && count > p.MaxCount {
+		return trace.Wrap(teleport.BadParameter("labels",
+			fmt.Sprintf("node has %v labels, the label policy allows at most %v", count, p.MaxCount)))
+	}
+	size := 0
+	for key, value := range labels {
+		size += len(key) + len(value)
+	}
+	for key := range cmdLabels {
+		size += len(key)
+	}
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return trace.Wrap(teleport.BadParameter("labels",
+			fmt.Sprintf("labels take %v bytes, the label policy allows at most %v", size, p.MaxSize)))
+	}
+	return nil
+}
+
+// CheckLabelCollisions makes sure no key is used by both a static and
+// a command label, it's not defined which of the two the node would report
+func CheckLabelCollisions(labels map[string]string, cmdLabels services.CommandLabels) error {
+	var keys []string
+	for key := range cmdLabels {
+		if _, ok := labels[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return trace.Wrap(teleport.BadParameter("labels",
+		fmt.Sprintf("labels %q are set both as static labels and as commands, remove one of them", keys)))
+}
+
+// compileLabelPattern compiles the pattern anchored to match whole strings
+func compileLabelPattern(name, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, trace.Wrap(teleport.BadParameter(name,
+			fmt.Sprintf("invalid label policy pattern %q: %v", pattern, err)))
+	}
+	return re, nil
 }
 
 type NetAddrSlice []utils.NetAddr
 
+// Set accepts a JSON array of addresses, e.g. `["tcp://auth1:3025"]`,
+// empty entries are rejected and duplicates are dropped keeping the order
 func (s *NetAddrSlice) Set(val string) error {
 	values := make([]string, 0)
 	err := json.Unmarshal([]byte(val), &values)
@@ -251,13 +768,24 @@ func (s *NetAddrSlice) Set(val string) error {
 		return trace.Wrap(err)
 	}
 
-	out := make([]utils.NetAddr, len(values))
+	out := make([]utils.NetAddr, 0, len(values))
+	seen := make(map[string]bool, len(values))
 	for i, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return trace.Wrap(teleport.BadParameter(
+				fmt.Sprintf("addr[%v]", i), "address is empty"))
+		}
 		a, err := utils.ParseAddr(v)
 		if err != nil {
-			return trace.Wrap(err)
+			return trace.Wrap(teleport.BadParameter(
+				fmt.Sprintf("addr[%v]", i), fmt.Sprintf("failed to parse %q: %v", v, err)))
 		}
-		out[i] = *a
+		if seen[a.FullAddress()] {
+			continue
+		}
+		seen[a.FullAddress()] = true
+		out = append(out, *a)
 	}
 	*s = out
 	return nil
@@ -335,12 +863,14 @@ func ApplyDefaults(cfg *Config) {
 	// defaults for the auth service:
 	cfg.Auth.Enabled = true
 	cfg.Auth.SSHAddr = *defaults.AuthListenAddr()
+	cfg.Auth.TunnelEnabled = true
 	cfg.Auth.EventsBackend.Type = defaults.BackendType
 	cfg.Auth.EventsBackend.Params = boltParams(defaults.DataDir, defaults.EventsBoltFile)
 	cfg.Auth.KeysBackend.Type = defaults.BackendType
 	cfg.Auth.KeysBackend.Params = boltParams(defaults.DataDir, defaults.KeysBoltFile)
 	cfg.Auth.RecordsBackend.Type = defaults.BackendType
 	cfg.Auth.RecordsBackend.Params = boltParams(defaults.DataDir, defaults.RecordsBoltFile)
+	cfg.Auth.BackendCheckTimeout = defaults.BackendCheckTimeout
 	defaults.ConfigureLimiter(&cfg.Auth.Limiter)
 
 	// defaults for the SSH proxy service:
@@ -349,16 +879,38 @@ func ApplyDefaults(cfg *Config) {
 	cfg.Proxy.SSHAddr = *defaults.ProxyListenAddr()
 	cfg.Proxy.WebAddr = *defaults.ProxyWebListenAddr()
 	cfg.Proxy.ReverseTunnelListenAddr = *defaults.ReverseTunnellListenAddr()
+	cfg.Proxy.ReverseTunnelEnabled = true
+	cfg.Proxy.TLSMinVersion = tls.VersionTLS12
+	cfg.Proxy.TLSCipherSuites = utils.DefaultCipherSuites()
+	cfg.Proxy.SecurityHeaders = httplib.DefaultSecurityHeaders()
 	defaults.ConfigureLimiter(&cfg.Proxy.Limiter)
 
 	// defaults for the SSH service:
 	cfg.SSH.Enabled = true
 	cfg.SSH.Addr = *defaults.SSHServerListenAddr()
 	cfg.SSH.Shell = defaults.DefaultShell
+	cfg.SSH.UseLoginShell = true
+	cfg.SSH.RecordSessions = true
+	cfg.SSH.KeepAliveInterval = defaults.KeepAliveInterval
+	cfg.SSH.KeepAliveCountMax = defaults.KeepAliveCountMax
+	cfg.SSH.HandshakeTimeout = defaults.HandshakeTimeout
+	cfg.SSH.LabelJitter = defaults.CommandLabelJitter
+	cfg.SSH.LabelPolicy.MaxCount = defaults.MaxLabels
+	cfg.SSH.LabelPolicy.MaxSize = defaults.MaxLabelsSize
 	defaults.ConfigureLimiter(&cfg.SSH.Limiter)
 
 	// global defaults
 	cfg.Hostname = hostname
+	cfg.AuthServerStrategy = auth.StrategyOrdered
+	cfg.StartMode = StartAllOrNothing
+	cfg.HostCertCheck = HostCertCheckWarn
+	cfg.PostStart.Timeout = defaults.PostStartTimeout
+	cfg.ShutdownTimeout = defaults.ShutdownTimeout
+	cfg.ClockSkew = defaults.ClockSkew
+	cfg.PanicRecovery = true
+	cfg.MaxAuthServers = defaults.MaxAuthServers
+	cfg.HeartbeatTTL = defaults.ServerHeartbeatTTL
+	cfg.AuthServersRefreshPeriod = defaults.AuthServersRefreshPeriod
 	cfg.DataDir = defaults.DataDir
 	if cfg.Auth.Enabled {
 		cfg.AuthServers = []utils.NetAddr{cfg.Auth.SSHAddr}
@@ -366,6 +918,58 @@ func ApplyDefaults(cfg *Config) {
 	cfg.Console = os.Stdout
 }
 
+// UserDataDir returns a data dir of the user running teleport:
+// $XDG_DATA_HOME/teleport if XDG_DATA_HOME is set, ~/.teleport otherwise
+func UserDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "teleport"), nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return filepath.Join(u.HomeDir, ".teleport"), nil
+}
+
+// FallbackDataDir returns a user data dir to use instead of dataDir when
+// teleport runs as a non-root user (euid is not 0) who can't write to
+// dataDir, it returns an empty string if dataDir can be used as is
+func FallbackDataDir(euid int, dataDir string) (string, error) {
+	if euid == 0 || isWritableDir(dataDir) {
+		return "", nil
+	}
+	dir, err := UserDataDir()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return dir, nil
+}
+
+// isWritableDir returns true if files can be created in dir or, if dir
+// does not exist yet, in its closest existing parent
+func isWritableDir(dir string) bool {
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return false
+			}
+			f, err := ioutil.TempFile(dir, ".probe")
+			if err != nil {
+				return false
+			}
+			f.Close()
+			os.Remove(f.Name())
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
 // Generates a string accepted by the BoltDB driver, like this:
 // `{"path": "/var/lib/teleport/records.db"}`
 func boltParams(storagePath, dbFile string) string {
@@ -16,9 +16,14 @@ limitations under the License.
 package service
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/backend/etcdbk"
 	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/utils"
 
 	. "gopkg.in/check.v1"
@@ -81,3 +86,121 @@ func (s *ConfigSuite) TestDefaultConfig(c *C) {
 	c.Assert(proxy.Limiter.MaxConnections, Equals, int64(defaults.LimiterMaxConnections))
 	c.Assert(proxy.Limiter.MaxNumberOfUsers, Equals, defaults.LimiterMaxConcurrentUsers)
 }
+
+func (s *ConfigSuite) TestConfigDiff(c *C) {
+	old := MakeDefaultConfig()
+	new := MakeDefaultConfig()
+	c.Assert(ConfigDiff(old, new), HasLen, 0)
+
+	old.SSH.Labels = map[string]string{"env": "prod", "role": "db"}
+	new.SSH.Labels = map[string]string{"env": "staging", "zone": "us-east"}
+	new.SSH.Addr = utils.NetAddr{AddrNetwork: "tcp", Addr: "10.0.0.1:3022"}
+	new.AuthServers = NetAddrSlice{
+		{AddrNetwork: "tcp", Addr: "auth1:3025"},
+		{AddrNetwork: "tcp", Addr: "auth2:3025"},
+	}
+	new.Proxy.Limiter.MaxConnections = old.Proxy.Limiter.MaxConnections + 10
+	new.SSH.Limiter.Disabled = true
+	new.Auth.SecretKey = "new-secret"
+	new.SSH.Token = "new-token"
+
+	c.Assert(ConfigDiff(old, new), DeepEquals, []FieldChange{
+		{Path: "AuthServers", Old: "[0.0.0.0:3025]", New: "[auth1:3025 auth2:3025]"},
+		{Path: "SSH.Token", Old: Redacted, New: Redacted},
+		{Path: "SSH.Addr", Old: "0.0.0.0:3022", New: "10.0.0.1:3022"},
+		{Path: "SSH.Limiter.Disabled", Old: "false", New: "true"},
+		{Path: "SSH.Labels[env]", Old: "prod", New: "staging"},
+		{Path: "SSH.Labels[role]", Old: "db", New: ""},
+		{Path: "SSH.Labels[zone]", Old: "", New: "us-east"},
+		{Path: "Auth.SecretKey", Old: Redacted, New: Redacted},
+		{Path: "Proxy.Limiter.MaxConnections",
+			Old: fmt.Sprintf("%v", old.Proxy.Limiter.MaxConnections),
+			New: fmt.Sprintf("%v", new.Proxy.Limiter.MaxConnections)},
+	})
+
+	// the passphrase of host keys is never printed
+	old = MakeDefaultConfig()
+	new = MakeDefaultConfig()
+	new.KeyPassphrase = "new-passphrase"
+	c.Assert(ConfigDiff(old, new), DeepEquals, []FieldChange{
+		{Path: "KeyPassphrase", Old: Redacted, New: Redacted},
+	})
+}
+
+func (s *ConfigSuite) TestCheckStorage(c *C) {
+	config := MakeDefaultConfig()
+	c.Assert(config.Auth.CheckStorage(), IsNil)
+
+	// etcd for keys is fine, events and records stay in bolt
+	c.Assert(config.ConfigureETCD(c.MkDir(), etcdbk.Config{
+		Nodes: []string{"http://localhost:4001"},
+		Key:   "/teleport",
+	}), IsNil)
+	c.Assert(config.Auth.CheckStorage(), IsNil)
+
+	// events can't be stored in etcd
+	config = MakeDefaultConfig()
+	config.Auth.EventsBackend.Type = teleport.ETCDBackendType
+	err := config.Auth.CheckStorage()
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(teleport.ErrorCode(err), Equals, teleport.CodeUnsupportedBackend)
+	c.Assert(err.Error(), Matches, ".*events can't be stored in 'etcd'.*")
+
+	// and it is not silently overridden when etcd is configured for keys
+	err = config.ConfigureETCD(c.MkDir(), etcdbk.Config{
+		Nodes: []string{"http://localhost:4001"},
+		Key:   "/teleport",
+	})
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(config.Auth.EventsBackend.Type, Equals, teleport.ETCDBackendType)
+
+	// same for session recordings
+	config = MakeDefaultConfig()
+	config.Auth.RecordsBackend.Type = teleport.ETCDBackendType
+	c.Assert(teleport.IsBadParameter(config.Auth.CheckStorage()), Equals, true)
+
+	config = MakeDefaultConfig()
+	config.Auth.KeysBackend.Type = "mysql"
+	c.Assert(teleport.IsBadParameter(config.Auth.CheckStorage()), Equals, true)
+}
+
+func (s *ConfigSuite) TestLabelCollisions(c *C) {
+	cmdLabels := services.CommandLabels{
+		"arch":   services.CommandLabel{Period: time.Hour, Command: []string{"uname", "-m"}},
+		"kernel": services.CommandLabel{Period: time.Hour, Command: []string{"uname", "-r"}},
+	}
+	c.Assert(CheckLabelCollisions(map[string]string{"env": "prod"}, cmdLabels), IsNil)
+	c.Assert(CheckLabelCollisions(nil, cmdLabels), IsNil)
+
+	err := CheckLabelCollisions(map[string]string{"env": "prod", "kernel": "4.4", "arch": "x86_64"}, cmdLabels)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(err.Error(), Matches, `.*\["arch" "kernel"\].*`)
+
+	// the whole config is checked as well
+	config := MakeDefaultConfig()
+	config.SSH.Labels = map[string]string{"arch": "x86_64"}
+	config.SSH.CmdLabels = cmdLabels
+	c.Assert(teleport.IsBadParameter(config.Validate()), Equals, true)
+}
+
+func (s *ConfigSuite) TestNetAddrSlice(c *C) {
+	var addrs NetAddrSlice
+	c.Assert(addrs.Set(`["auth1:3025", "tcp://auth2:3025", " auth1:3025 "]`), IsNil)
+	c.Assert(addrs, DeepEquals, NetAddrSlice{
+		{AddrNetwork: "tcp", Addr: "auth1:3025"},
+		{AddrNetwork: "tcp", Addr: "auth2:3025"},
+	})
+
+	err := addrs.Set(`["auth1:3025", ""]`)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(err, ErrorMatches, `.*addr\[1\].*empty.*`)
+
+	err = addrs.Set(`["auth1:3025", "auth2:3025", "auth3"]`)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+	c.Assert(err, ErrorMatches, `.*addr\[2\].*"auth3".*`)
+
+	// failed parse keeps the previous value
+	c.Assert(addrs, HasLen, 2)
+
+	c.Assert(addrs.Set(`"auth1:3025"`), NotNil)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Redacted replaces values of secret fields in config diffs
+const Redacted = "<redacted>"
+
+// FieldChange is a single difference between two configs
+type FieldChange struct {
+	// Path is a dot separated path to the field, e.g. SSH.Addr or
+	// SSH.Labels[env] for map entries
+	Path string
+	// Old is a formatted value in the old config
+	Old string
+	// New is a formatted value in the new config
+	New string
+}
+
+// String returns a human readable description of the change
+func (c FieldChange) String() string {
+	return fmt.Sprintf("%v: %q -> %q", c.Path, c.Old, c.New)
+}
+
+// secretFields are names of config fields with values that should
+// never appear in logs
+var secretFields = map[string]bool{
+	"Token":               true,
+	"SecretKey":           true,
+	"AllowedTokens":       true,
+	"AllowedTokenSources": true,
+	"TLSKey":              true,
+	"PrivateKey":          true,
+	"SigningKeys":         true,
+	"AuthHeader":          true,
+	"KeyPassphrase":       true,
+}
+
+// ConfigDiff returns fields that differ between the old and the new config,
+// ordered as they appear in the Config structure. Values of secret fields,
+// like tokens and private keys, are redacted. Fields that don't hold
+// configuration values, like Console, are not compared
+func ConfigDiff(old, new *Config) []FieldChange {
+	var changes []FieldChange
+	diffValues("", reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), false, &changes)
+	return changes
+}
+
+func diffValues(path string, old, new reflect.Value, secret bool, changes *[]FieldChange) {
+	switch {
+	case old.Kind() == reflect.Interface, old.Kind() == reflect.Func, old.Kind() == reflect.Chan:
+		return
+	case isStringer(old):
+		// values with custom formatting are compared as a whole
+	case old.Kind() == reflect.Struct:
+		for i := 0; i < old.NumField(); i++ {
+			field := old.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			diffValues(joinPath(path, field.Name), old.Field(i), new.Field(i),
+				secret || secretFields[field.Name], changes)
+		}
+		return
+	case old.Kind() == reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, k := range append(old.MapKeys(), new.MapKeys()...) {
+			keys[fmt.Sprintf("%v", k.Interface())] = k
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			k := keys[name]
+			diffLeaf(fmt.Sprintf("%v[%v]", path, name), old.MapIndex(k), new.MapIndex(k), secret, changes)
+		}
+		return
+	case old.Kind() == reflect.Ptr && !old.IsNil() && !new.IsNil():
+		diffValues(path, old.Elem(), new.Elem(), secret, changes)
+		return
+	}
+	diffLeaf(path, old, new, secret, changes)
+}
+
+func diffLeaf(path string, old, new reflect.Value, secret bool, changes *[]FieldChange) {
+	if old.IsValid() && new.IsValid() && reflect.DeepEqual(old.Interface(), new.Interface()) {
+		return
+	}
+	change := FieldChange{Path: path, Old: formatValue(old), New: formatValue(new)}
+	if secret {
+		change.Old, change.New = Redacted, Redacted
+	}
+	*changes = append(*changes, change)
+}
+
+// formatValue formats value for humans, using String method when
+// the type has one
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return ""
+	}
+	if s, ok := stringer(v); ok {
+		return s.String()
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatValue(v.Index(i))
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+func isStringer(v reflect.Value) bool {
+	_, ok := stringer(v)
+	return ok
+}
+
+// stringer returns value as fmt.Stringer if either the value or
+// the pointer to it implements it
+func stringer(v reflect.Value) (fmt.Stringer, bool) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, false
+	}
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s, true
+	}
+	if v.CanAddr() {
+		if s, ok := v.Addr().Interface().(fmt.Stringer); ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
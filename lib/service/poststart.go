@@ -0,0 +1,97 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"bytes"
+	"os/exec"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+)
+
+// expectRole marks the role as initialized, the process becomes
+// ready once all expected roles have started serving
+func (process *TeleportProcess) expectRole(role teleport.Role) {
+	process.Lock()
+	defer process.Unlock()
+	process.pendingRoles[role] = true
+}
+
+// roleReady is called by the role once it has started serving
+func (process *TeleportProcess) roleReady(role teleport.Role) {
+	process.Lock()
+	defer process.Unlock()
+	if !process.pendingRoles[role] {
+		return
+	}
+	delete(process.pendingRoles, role)
+	if len(process.pendingRoles) == 0 {
+		log.Infof("all roles have started")
+		close(process.readyC)
+	}
+}
+
+// runPostStart waits until all roles have started and runs the post start
+// command, its failure stops the process only if AbortOnError is set
+func (process *TeleportProcess) runPostStart() error {
+	<-process.readyC
+	err := runPostStartCommand(process.Config.PostStart)
+	if err == nil {
+		return nil
+	}
+	if process.Config.PostStart.AbortOnError {
+		return trace.Wrap(err)
+	}
+	log.Warningf("post start command failed: %v", err)
+	return nil
+}
+
+func runPostStartCommand(cfg PostStartConfig) error {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaults.PostStartTimeout
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(cfg.Command[0], cfg.Command[1:]...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return trace.Wrap(err)
+	}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-errC:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-errC
+		err = trace.Errorf("timed out after %v", timeout)
+	}
+	log.Infof("post start command %v output: %q", cfg.Command, out.String())
+	if err != nil {
+		return trace.Errorf("post start command %v failed: %v", cfg.Command, err)
+	}
+	return nil
+}
@@ -24,8 +24,11 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,7 +41,9 @@ import (
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/events/boltlog"
+	"github.com/gravitational/teleport/lib/events/webhook"
 	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/metrics"
 	"github.com/gravitational/teleport/lib/recorder"
 	"github.com/gravitational/teleport/lib/recorder/boltrec"
 	"github.com/gravitational/teleport/lib/reversetunnel"
@@ -80,13 +85,38 @@ type TeleportProcess struct {
 	// localAuth has local auth server listed in case if this process
 	// has started with auth server role enabled
 	localAuth *auth.AuthServer
+	// authBackend is a storage backend of the local auth server
+	authBackend backend.Backend
+	// sshServer is the SSH server of the node role
+	sshServer *srv.Server
+	// startedAt is the time this process has been created
+	startedAt time.Time
+	// proxyCerts holds the web proxy TLS certificate, it is reloaded
+	// from disk by ReloadTLS
+	proxyCerts *utils.CertificateHolder
+	// pendingRoles are roles that have been initialized but have not
+	// started serving yet
+	pendingRoles map[teleport.Role]bool
+	// readyC is closed once all pending roles have started serving
+	readyC chan struct{}
+	// shutdownFuncs stop services gracefully on shutdown
+	shutdownFuncs []func() error
+	// authClients are clients roles use to talk to the auth server
+	authClients map[teleport.Role]*auth.TunClient
+	// usageMutex guards dataDirUsage and dataDirUsageAt, it's held
+	// while the data dir is walked, so concurrent requests share a walk
+	usageMutex sync.Mutex
+	// dataDirUsage is the data dir usage measured at dataDirUsageAt
+	dataDirUsage   map[string]int64
+	dataDirUsageAt time.Time
 }
 
 // loginIntoAuthService attempts to login into the auth servers specified in the
 // configuration. Returns 'true' if successful
 func (process *TeleportProcess) connectToAuthService(role teleport.Role) (*connector, error) {
 	identity, err := auth.ReadIdentity(
-		process.Config.DataDir, auth.IdentityID{HostUUID: process.Config.HostUUID, Role: role})
+		process.Config.DataDir, auth.IdentityID{HostUUID: process.Config.HostUUID, Role: role},
+		process.identityOptions()...)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -100,13 +130,22 @@ func (process *TeleportProcess) connectToAuthService(role teleport.Role) (*conne
 		authServers = process.Config.AuthServers
 	}
 
+	hostKeyOpts, err := process.authHostKeyOptions()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
 	log.Infof("connecting to auth servers: %v", authServers)
 	authUser := identity.Cert.ValidPrincipals[0]
 	authClient, err := auth.NewTunClient(
 		authServers,
 		authUser,
 		[]ssh.AuthMethod{ssh.PublicKeys(identity.KeySigner)},
-		auth.TunClientStorage(storage),
+		append([]auth.TunClientOption{
+			auth.TunClientStorage(storage),
+			auth.TunClientStrategy(process.Config.AuthServerStrategy),
+			auth.TunClientRefreshPeriod(process.Config.AuthServersRefreshPeriod),
+		}, hostKeyOpts...)...,
 	)
 	// success?
 	if err != nil {
@@ -119,6 +158,7 @@ func (process *TeleportProcess) connectToAuthService(role teleport.Role) (*conne
 	}
 	// success ? we're logged in!
 	log.Infof("%s connected to the cluster", authUser)
+	process.setAuthClient(role, authClient)
 	return &connector{client: authClient, identity: identity}, nil
 }
 
@@ -130,12 +170,15 @@ func NewTeleport(cfg *Config) (Supervisor, error) {
 	}
 
 	// create the data directory if it's missing
-	_, err := os.Stat(cfg.DataDir)
-	if os.IsNotExist(err) {
-		err := os.MkdirAll(cfg.DataDir, os.ModeDir|0777)
-		if err != nil {
-			return nil, trace.Wrap(err)
-		}
+	err := utils.EnsureDataDir(cfg.DataDir, cfg.RequireExistingDataDir)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := checkDataDir(cfg); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := checkShell(cfg); err != nil {
+		return nil, trace.Wrap(err)
 	}
 
 	// read or generate a host UUID for this node
@@ -144,6 +187,21 @@ func NewTeleport(cfg *Config) (Supervisor, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	// fill in static label templates with the facts about this host
+	facts := HostFacts{Hostname: cfg.Hostname, HostUUID: cfg.HostUUID, OS: runtime.GOOS}
+	if cfg.AdvertiseIP != nil {
+		facts.AdvertiseIP = cfg.AdvertiseIP.String()
+	}
+	cfg.SSH.Labels, err = ExpandLabels(cfg.SSH.Labels, facts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// without the auth service there is no events backend, log the config load
+	if cfg.AuditConfigLoad && !cfg.Auth.Enabled {
+		logConfigLoad(cfg, nil)
+	}
+
 	// if user started auth and another service (without providing the auth address for
 	// that service, the address of the in-process auth will be used
 	if cfg.Auth.Enabled && len(cfg.AuthServers) == 0 {
@@ -154,45 +212,166 @@ func NewTeleport(cfg *Config) (Supervisor, error) {
 	if cfg.Auth.Enabled && cfg.Auth.DomainName == "" {
 		cfg.Auth.DomainName = cfg.HostUUID
 	}
+	if cfg.Auth.Enabled {
+		cfg.Auth.DomainName, err = utils.NormalizeDomainName(cfg.Auth.DomainName)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
 
 	// try to login into the auth service:
 
 	// if there are no certificates, use self signed
 	process := &TeleportProcess{
-		Supervisor: NewSupervisor(),
-		Config:     cfg,
+		Supervisor:   NewSupervisor(),
+		Config:       cfg,
+		startedAt:    time.Now(),
+		pendingRoles: make(map[teleport.Role]bool),
+		readyC:       make(chan struct{}),
 	}
 
 	serviceStarted := false
 
-	if cfg.Auth.Enabled {
-		if err := process.initAuthService(); err != nil {
-			return nil, trace.Wrap(err)
+	roles := []struct {
+		enabled bool
+		role    teleport.Role
+		init    func() error
+	}{
+		{cfg.Auth.Enabled, teleport.RoleAuth, process.initAuthService},
+		{cfg.SSH.Enabled, teleport.RoleNode, process.initSSH},
+		{cfg.Proxy.Enabled, teleport.RoleProxy, process.initProxy},
+	}
+	for _, r := range roles {
+		if !r.enabled {
+			continue
 		}
+		if err := r.init(); err != nil {
+			if cfg.StartMode != StartBestEffort {
+				return nil, trace.Wrap(err)
+			}
+			log.Errorf("[%v] failed to start, skipping it: %v", r.role, err)
+			continue
+		}
+		process.expectRole(r.role)
 		serviceStarted = true
 	}
 
-	if cfg.SSH.Enabled {
-		if err := process.initSSH(); err != nil {
-			return nil, err
-		}
-		serviceStarted = true
+	if !serviceStarted {
+		return nil, trace.Errorf("all services failed to start")
 	}
 
-	if cfg.Proxy.Enabled {
-		if err := process.initProxy(); err != nil {
-			return nil, err
+	if !cfg.DiagnosticAddr.IsEmpty() {
+		if err := process.initDiagnosticService(); err != nil {
+			return nil, trace.Wrap(err)
 		}
-		serviceStarted = true
 	}
 
-	if !serviceStarted {
-		return nil, trace.Errorf("all services failed to start")
+	if len(cfg.PostStart.Command) != 0 {
+		process.RegisterFunc(process.runPostStart)
 	}
 
 	return process, nil
 }
 
+// registerRoleFunc registers a service of the role, in best-effort mode
+// an error of the service stops the role only, not the whole process
+func (process *TeleportProcess) registerRoleFunc(role teleport.Role, fn ServiceFunc) {
+	if process.Config.StartMode != StartBestEffort {
+		process.RegisterFunc(fn)
+		return
+	}
+	process.RegisterFunc(func() error {
+		if err := fn(); err != nil {
+			log.Errorf("[%v] service failed, other roles keep running: %v", role, err)
+		}
+		return nil
+	})
+}
+
+// onShutdown registers a function that stops a service gracefully,
+// e.g. waits until all active sessions are over
+func (process *TeleportProcess) onShutdown(fn func() error) {
+	process.Lock()
+	defer process.Unlock()
+	process.shutdownFuncs = append(process.shutdownFuncs, fn)
+}
+
+// Shutdown stops all services and waits until they drain, it returns
+// an error if services did not stop within the timeout
+func (process *TeleportProcess) Shutdown(timeout time.Duration) error {
+	process.Lock()
+	funcs := process.shutdownFuncs
+	process.Unlock()
+
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		var wg sync.WaitGroup
+		for _, fn := range funcs {
+			wg.Add(1)
+			go func(fn func() error) {
+				defer wg.Done()
+				if err := fn(); err != nil {
+					log.Warningf("failed to stop service: %v", err)
+				}
+			}(fn)
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-doneC:
+		return nil
+	case <-time.After(timeout):
+		return trace.Errorf("services did not stop in %v", timeout)
+	}
+}
+
+// authHostKeyOptions returns tunnel client options that pin
+// the auth server host key if it's configured
+func (process *TeleportProcess) authHostKeyOptions() ([]auth.TunClientOption, error) {
+	if process.Config.AuthServerHostKey == "" {
+		return nil, nil
+	}
+	pin, err := utils.ParseHostKeyPin(process.Config.AuthServerHostKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return []auth.TunClientOption{auth.TunClientHostKey(pin)}, nil
+}
+
+// identityOptions returns options for reading and writing identities
+// of this process in the data dir
+func (process *TeleportProcess) identityOptions() []auth.IdentityOption {
+	return []auth.IdentityOption{
+		auth.IdentityPassphrase([]byte(process.Config.KeyPassphrase)),
+		auth.IdentityMinKeySize(process.Config.MinKeySize),
+	}
+}
+
+func (process *TeleportProcess) setAuthClient(role teleport.Role, clt *auth.TunClient) {
+	process.Lock()
+	defer process.Unlock()
+	if process.authClients == nil {
+		process.authClients = make(map[teleport.Role]*auth.TunClient)
+	}
+	process.authClients[role] = clt
+}
+
+// getAuthServers returns the auth server every role is connected to
+func (process *TeleportProcess) getAuthServers() map[string]string {
+	process.Lock()
+	defer process.Unlock()
+	if len(process.authClients) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(process.authClients))
+	for role, clt := range process.authClients {
+		out[strings.ToLower(string(role))] = clt.CurrentAuthServer().Addr
+	}
+	return out
+}
+
 func (process *TeleportProcess) setLocalAuth(a *auth.AuthServer) {
 	process.Lock()
 	defer process.Unlock()
@@ -205,6 +384,53 @@ func (process *TeleportProcess) getLocalAuth() *auth.AuthServer {
 	return process.localAuth
 }
 
+func (process *TeleportProcess) setAuthBackend(b backend.Backend) {
+	process.Lock()
+	defer process.Unlock()
+	process.authBackend = b
+}
+
+func (process *TeleportProcess) setSSHServer(s *srv.Server) {
+	process.Lock()
+	defer process.Unlock()
+	process.sshServer = s
+}
+
+func (process *TeleportProcess) getSSHServer() *srv.Server {
+	process.Lock()
+	defer process.Unlock()
+	return process.sshServer
+}
+
+func (process *TeleportProcess) setProxyCerts(certs *utils.CertificateHolder) {
+	process.Lock()
+	defer process.Unlock()
+	process.proxyCerts = certs
+}
+
+func (process *TeleportProcess) getProxyCerts() *utils.CertificateHolder {
+	process.Lock()
+	defer process.Unlock()
+	return process.proxyCerts
+}
+
+// ReloadTLS reloads the web proxy TLS certificate and key from disk,
+// new connections are served with the reloaded certificate while the
+// existing ones are not interrupted
+func (process *TeleportProcess) ReloadTLS() error {
+	certs := process.getProxyCerts()
+	if certs == nil {
+		return trace.Wrap(teleport.NotFound("proxy TLS certificate is not configured"))
+	}
+	return trace.Wrap(certs.Reload())
+}
+
+func (process *TeleportProcess) getAuthBackend() backend.Backend {
+	process.Lock()
+	defer process.Unlock()
+	return process.authBackend
+}
+
 // initAuthService can be called to initialize auth server service
 func (process *TeleportProcess) initAuthService() error {
 	cfg := process.Config
@@ -213,26 +439,59 @@ func (process *TeleportProcess) initAuthService() error {
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	process.setAuthBackend(b)
+	err = process.checkHostCert(auth.IdentityID{Role: teleport.RoleAuth, HostUUID: cfg.HostUUID})
+	if err != nil {
+		return trace.Wrap(err)
+	}
 	elog, err := initEventStorage(
 		cfg.Auth.EventsBackend.Type, cfg.Auth.EventsBackend.Params)
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	if cfg.Auth.EventWebhook.Enabled() {
+		hook, err := webhook.New(elog, cfg.Auth.EventWebhook)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		// deliver queued events before exiting instead of dropping them
+		process.onShutdown(func() error {
+			return hook.Shutdown(defaults.EventWebhookShutdownTimeout)
+		})
+		elog = hook
+	}
 	rec, err := initRecordStorage(
 		cfg.Auth.RecordsBackend.Type, cfg.Auth.RecordsBackend.Params)
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	if cfg.Auth.MaxSessionSize > 0 {
+		rec = recorder.NewSizeLimiter(rec, cfg.Auth.MaxSessionSize, func(id string, maxSize int64) {
+			log.Warningf("[AUTH] session %v exceeded %v bytes, stopped recording", id, maxSize)
+			elog.Log(lunk.NewRootEventID(), &events.SessionRecordingLimit{
+				SessionID: id,
+				MaxSize:   maxSize,
+			})
+		})
+	}
+	if cfg.AuditConfigLoad {
+		logConfigLoad(cfg, elog)
+	}
 
 	acfg := auth.InitConfig{
-		Backend:         b,
-		Authority:       authority.New(),
-		DomainName:      cfg.Auth.DomainName,
-		AuthServiceName: cfg.Hostname,
-		DataDir:         cfg.DataDir,
-		SecretKey:       cfg.Auth.SecretKey,
-		AllowedTokens:   cfg.Auth.AllowedTokens,
-		HostUUID:        cfg.HostUUID,
+		Backend:             b,
+		Authority:           authority.New(),
+		DomainName:          cfg.Auth.DomainName,
+		AuthServiceName:     cfg.Hostname,
+		DataDir:             cfg.DataDir,
+		SecretKey:           cfg.Auth.SecretKey,
+		AllowedTokens:       cfg.Auth.AllowedTokens,
+		AllowedTokenSources: cfg.Auth.AllowedTokenSources,
+		HostUUID:            cfg.HostUUID,
+
+		RequireExistingDataDir: cfg.RequireExistingDataDir,
+		KeyPassphrase:          []byte(cfg.KeyPassphrase),
+		MinKeySize:             cfg.MinKeySize,
 	}
 	authServer, identity, err := auth.Init(acfg)
 	if err != nil {
@@ -254,51 +513,52 @@ func (process *TeleportProcess) initAuthService() error {
 		PermissionChecker: auth.NewStandardPermissions(),
 		Roles:             auth.StandardRoles,
 	})
-	process.RegisterFunc(func() error {
+	process.registerRoleFunc(teleport.RoleAuth, func() error {
 		apiServer.Serve()
 		return nil
 	})
 
-	limiter, err := limiter.NewLimiter(cfg.Auth.Limiter)
+	limiter, err := limiter.NewLimiter(warnThresholdEvents(cfg.Auth.Limiter, teleport.ComponentAuth, cfg.Hostname, elog))
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
-	// Register an SSH endpoint which is used to create an SSH tunnel to send HTTP
-	// requests to the Auth API
-	process.RegisterFunc(func() error {
-		utils.Consolef(cfg.Console, "[AUTH]  Auth service is starting on %v", cfg.Auth.SSHAddr.Addr)
-		tsrv, err := auth.NewTunnel(
-			cfg.Auth.SSHAddr, []ssh.Signer{identity.KeySigner},
-			apiServer,
-			authServer,
-			auth.SetLimiter(limiter),
-		)
-		if err != nil {
-			utils.Consolef(cfg.Console, "[PROXY] Error: %v", err)
-			return trace.Wrap(err)
-		}
-		if err := tsrv.Start(); err != nil {
-			utils.Consolef(cfg.Console, "[PROXY] Error: %v", err)
+	if !cfg.Auth.HTTPAddr.IsEmpty() {
+		if err := process.initAuthHTTPListener(apiServer, limiter, b); err != nil {
 			return trace.Wrap(err)
 		}
-		return nil
-	})
+	}
+	if cfg.Auth.TunnelEnabled {
+		process.initAuthTunnel(apiServer, authServer, identity, limiter, b)
+	} else {
+		utils.Consolef(cfg.Console, "[AUTH]  SSH tunnel is disabled")
+	}
 
 	// Heart beat auth server presence, this is not the best place for this
 	// logic, consolidate it into auth package later
-	process.RegisterFunc(func() error {
-		authClient, err := auth.NewTunClient(
-			[]utils.NetAddr{cfg.Auth.SSHAddr},
-			identity.Cert.ValidPrincipals[0],
-			[]ssh.AuthMethod{ssh.PublicKeys(identity.KeySigner)})
-		// success?
-		if err != nil {
-			return trace.Wrap(err)
+	process.registerRoleFunc(teleport.RoleAuth, func() error {
+		// without the tunnel the auth server announces the HTTPS API
+		// and writes to the backend directly
+		var announcer interface {
+			UpsertAuthServer(services.Server, time.Duration) error
+		} = authServer
+		addr := cfg.Auth.HTTPAddr
+		if cfg.Auth.TunnelEnabled {
+			authClient, err := auth.NewTunClient(
+				[]utils.NetAddr{cfg.Auth.SSHAddr},
+				identity.Cert.ValidPrincipals[0],
+				[]ssh.AuthMethod{ssh.PublicKeys(identity.KeySigner)},
+				auth.TunClientRefreshPeriod(process.Config.AuthServersRefreshPeriod))
+			// success?
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			announcer = authClient
+			addr = cfg.Auth.SSHAddr
 		}
 		srv := services.Server{
 			ID:       process.Config.HostUUID,
-			Addr:     cfg.Auth.SSHAddr.Addr,
+			Addr:     addr.Addr,
 			Hostname: process.Config.Hostname,
 		}
 		if process.Config.AdvertiseIP != nil {
@@ -306,14 +566,18 @@ func (process *TeleportProcess) initAuthService() error {
 			if err != nil {
 				return trace.Wrap(err)
 			}
-			srv.Addr = fmt.Sprintf("%v:%v", process.Config.AdvertiseIP.String(), port)
+			srv.Addr = net.JoinHostPort(process.Config.AdvertiseIP.String(), port)
+		}
+		heartbeatTTL := process.Config.HeartbeatTTL
+		if heartbeatTTL <= 0 {
+			heartbeatTTL = defaults.ServerHeartbeatTTL
 		}
 		for {
-			err := authClient.UpsertAuthServer(srv, defaults.ServerHeartbeatTTL)
+			err := announcer.UpsertAuthServer(srv, heartbeatTTL)
 			if err != nil {
 				log.Warningf("failed to announce presence: %v", err)
 			}
-			sleepTime := defaults.ServerHeartbeatTTL/2 + utils.RandomDuration(defaults.ServerHeartbeatTTL/10)
+			sleepTime := heartbeatTTL/2 + utils.RandomDuration(heartbeatTTL/10)
 			//log.Infof("[AUTH] will ping auth service in %v", sleepTime)
 			time.Sleep(sleepTime)
 		}
@@ -321,16 +585,95 @@ func (process *TeleportProcess) initAuthService() error {
 	return nil
 }
 
+// initAuthTunnel registers an SSH endpoint which is used to create an SSH
+// tunnel to send HTTP requests to the Auth API
+func (process *TeleportProcess) initAuthTunnel(apiServer *auth.APIWithRoles, authServer *auth.AuthServer, identity *auth.Identity, limiter *limiter.Limiter, b backend.Backend) {
+	cfg := process.Config
+	process.registerRoleFunc(teleport.RoleAuth, func() error {
+		utils.Consolef(cfg.Console, "[AUTH]  Auth service is starting on %v", cfg.Auth.SSHAddr.Addr)
+		tsrv, err := auth.NewTunnel(
+			cfg.Auth.SSHAddr, []ssh.Signer{identity.KeySigner},
+			apiServer,
+			authServer,
+			auth.SetLimiter(limiter),
+			auth.SetAllowedSources(cfg.Auth.AllowedSourceCIDRs),
+			auth.SetClockSkew(cfg.ClockSkew),
+			auth.SetReusePort(cfg.ReusePort),
+			auth.SetConnectionLogging(cfg.ConnectionLogging),
+			auth.SetPanicRecovery(cfg.PanicRecovery),
+		)
+		if err != nil {
+			utils.Consolef(cfg.Console, "[PROXY] Error: %v", err)
+			return trace.Wrap(err)
+		}
+		if err := tsrv.Start(); err != nil {
+			utils.Consolef(cfg.Console, "[PROXY] Error: %v", err)
+			return trace.Wrap(err)
+		}
+		process.onShutdown(tsrv.Close)
+		process.checkAdvertiseAddr(teleport.ComponentAuth, cfg.Auth.SSHAddr)
+		waitForBackend(b, cfg.HostUUID, cfg.Auth.BackendCheckTimeout, defaults.BackendCheckPeriod)
+		process.roleReady(teleport.RoleAuth)
+		return nil
+	})
+}
+
+// initAuthHTTPListener serves the auth API over HTTPS without the SSH
+// tunnel. Clients have to present certificates signed by one of the CAs
+// from Auth.HTTPClientCAFile, requests get the role from the certificate
+func (process *TeleportProcess) initAuthHTTPListener(apiServer *auth.APIWithRoles, limiter *limiter.Limiter, b backend.Backend) error {
+	cfg := process.Config
+	if err := limiter.WrapHandle(apiServer.ClientCertHandler()); err != nil {
+		return trace.Wrap(err)
+	}
+	process.registerRoleFunc(teleport.RoleAuth, func() error {
+		utils.Consolef(cfg.Console, "[AUTH]  Auth HTTPS API is starting on %v", cfg.Auth.HTTPAddr.Addr)
+		listener, err := utils.Listen(cfg.Auth.HTTPAddr.AddrNetwork, cfg.Auth.HTTPAddr.Addr, cfg.ReusePort)
+		if err != nil {
+			utils.Consolef(cfg.Console, "[AUTH]  Error: %v", err)
+			return trace.Wrap(err)
+		}
+		process.checkAdvertiseAddr(teleport.ComponentAuth, cfg.Auth.HTTPAddr)
+		// the tunnel reports readiness if it's enabled
+		if !cfg.Auth.TunnelEnabled {
+			waitForBackend(b, cfg.HostUUID, cfg.Auth.BackendCheckTimeout, defaults.BackendCheckPeriod)
+			process.roleReady(teleport.RoleAuth)
+		}
+		err = utils.ServeTLS(listener, limiter, cfg.Auth.HTTPTLSCert, cfg.Auth.HTTPTLSKey,
+			utils.SetTLSClientCA(cfg.Auth.HTTPClientCAFile))
+		if err != nil {
+			utils.Consolef(cfg.Console, "[AUTH]  Error: %v", err)
+			return trace.Wrap(err)
+		}
+		return nil
+	})
+	return nil
+}
+
 func (process *TeleportProcess) initSSH() error {
 	return process.RegisterWithAuthServer(
 		process.Config.SSH.Token, teleport.RoleNode,
 		process.initSSHEndpoint)
 }
 
+// newAccessPoint returns the access point to the auth server for SSH
+// servers, it caches the auth server responses if AuthCacheTTL is set
+func (process *TeleportProcess) newAccessPoint(clt *auth.TunClient) (auth.AccessPoint, error) {
+	if process.Config.AuthCacheTTL == 0 {
+		return clt, nil
+	}
+	return auth.NewCachingAccessPoint(clt, process.Config.AuthCacheTTL)
+}
+
 func (process *TeleportProcess) initSSHEndpoint(conn *connector) error {
 	cfg := process.Config
 
-	limiter, err := limiter.NewLimiter(cfg.SSH.Limiter)
+	limiter, err := limiter.NewLimiter(warnThresholdEvents(cfg.SSH.Limiter, teleport.ComponentNode, cfg.Hostname, conn.client))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	accessPoint, err := process.newAccessPoint(conn.client)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -338,43 +681,99 @@ func (process *TeleportProcess) initSSHEndpoint(conn *connector) error {
 	s, err := srv.New(cfg.SSH.Addr,
 		cfg.Hostname,
 		[]ssh.Signer{conn.identity.KeySigner},
-		conn.client,
+		accessPoint,
 		cfg.DataDir,
 		cfg.AdvertiseIP,
 		srv.SetLimiter(limiter),
 		srv.SetShell(cfg.SSH.Shell),
+		srv.SetHeartbeatTTL(cfg.HeartbeatTTL),
+		srv.SetUseLoginShell(cfg.SSH.UseLoginShell),
 		srv.SetEventLogger(conn.client),
 		srv.SetSessionServer(conn.client),
 		srv.SetRecorder(conn.client),
+		srv.SetRecordSessions(cfg.SSH.RecordSessions),
 		srv.SetLabels(cfg.SSH.Labels, cfg.SSH.CmdLabels),
+		srv.SetVersion(cfg.SSH.VersionString),
+		srv.SetMOTD(cfg.SSH.MOTD),
+		srv.SetKeepAlive(cfg.SSH.KeepAliveInterval, cfg.SSH.KeepAliveCountMax),
+		srv.SetHandshakeTimeout(cfg.SSH.HandshakeTimeout),
+		srv.SetLabelJitter(cfg.SSH.LabelJitter),
+		srv.SetClockSkew(cfg.ClockSkew),
+		srv.SetReusePort(cfg.ReusePort),
+		srv.SetConnectionLogging(cfg.ConnectionLogging),
+		srv.SetPanicRecovery(cfg.PanicRecovery),
 	)
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	process.setSSHServer(s)
 
-	process.RegisterFunc(func() error {
+	process.registerRoleFunc(teleport.RoleNode, func() error {
 		utils.Consolef(cfg.Console, "[SSH]   Service is starting on %v", cfg.SSH.Addr.Addr)
 		if err := s.Start(); err != nil {
 			utils.Consolef(cfg.Console, "[SSH]   Error: %v", err)
 			return trace.Wrap(err)
 		}
+		process.onShutdown(s.Drain)
+		process.checkAdvertiseAddr(teleport.ComponentNode, cfg.SSH.Addr)
+		process.roleReady(teleport.RoleNode)
+		stopC := make(chan struct{})
+		if cfg.SSH.HostKeyRotationPeriod > 0 {
+			go process.rotateHostKeys(conn.client, s.SetHostSigner, stopC)
+		}
 		s.Wait()
+		close(stopC)
 		return nil
 	})
 	return nil
 }
 
+// rotateHostKeys regenerates the node identity every HostKeyRotationPeriod,
+// the new key is signed by the auth server before it replaces the old one
+// on disk and in the SSH server
+func (process *TeleportProcess) rotateHostKeys(renewer auth.HostCertRenewer, setSigner func(ssh.Signer) error, stopC <-chan struct{}) {
+	cfg := process.Config
+	if localAuth := process.getLocalAuth(); localAuth != nil {
+		renewer = localAuth
+	}
+	identityID := auth.IdentityID{Role: teleport.RoleNode, HostUUID: cfg.HostUUID}
+	ticker := time.NewTicker(cfg.SSH.HostKeyRotationPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+		}
+		keygen := authority.New()
+		identity, err := auth.RegenerateHostKeys(cfg.DataDir, identityID, keygen, renewer, process.identityOptions()...)
+		keygen.Close()
+		if err != nil {
+			log.Warningf("[SSH] failed to rotate host keys, will retry in %v: %v", cfg.SSH.HostKeyRotationPeriod, err)
+			continue
+		}
+		if err := setSigner(identity.KeySigner); err != nil {
+			log.Warningf("[SSH] failed to use the new host key: %v", err)
+			continue
+		}
+		log.Infof("[SSH] rotated host keys of %v", cfg.HostUUID)
+	}
+}
+
 // RegisterWithAuthServer uses one time provisioning token obtained earlier
 // from the server to get a pair of SSH keys signed by Auth server host
 // certificate authority
 func (process *TeleportProcess) RegisterWithAuthServer(token string, role teleport.Role, callback func(conn *connector) error) error {
 	cfg := process.Config
 	identityID := auth.IdentityID{Role: role, HostUUID: cfg.HostUUID}
+	if err := process.checkHostCert(identityID); err != nil {
+		return trace.Wrap(err)
+	}
 
 	// this means the server has not been initialized yet, we are starting
 	// the registering client that attempts to connect to the auth server
 	// and provision the keys
-	process.RegisterFunc(func() error {
+	process.registerRoleFunc(role, func() error {
 		for {
 			conn, err := process.connectToAuthService(role)
 			if err == nil {
@@ -389,44 +788,93 @@ func (process *TeleportProcess) RegisterWithAuthServer(token string, role telepo
 				return trace.Wrap(err)
 			}
 			//  we haven't connected yet, so we expect the token to exist
+			var register func() error
 			if process.getLocalAuth() != nil {
 				// Auth service is on the same host, no need to go though the invitation
 				// procedure
 				log.Infof("this server has local Auth server started, using it to add role to the cluster")
-				err = auth.LocalRegister(cfg.DataDir, identityID, process.getLocalAuth())
+				register = func() error {
+					return auth.LocalRegister(cfg.DataDir, identityID, process.getLocalAuth(), process.identityOptions()...)
+				}
 			} else {
 				// Auth server is remote, so we need a provisioning token
 				if token == "" {
 					return trace.Wrap(teleport.BadParameter(role.String(), "role has no identity and no provisioning token"))
 				}
 				log.Infof("%v joining the cluster with a token %v", role, token)
-				err = auth.Register(cfg.DataDir, token, identityID, cfg.AuthServers)
+				hostKeyOpts, err := process.authHostKeyOptions()
+				if err != nil {
+					return trace.Wrap(err)
+				}
+				register = func() error {
+					return auth.Register(cfg.DataDir, token, identityID, cfg.AuthServers,
+						append(hostKeyOpts, auth.TunClientIdentityOptions(process.identityOptions()...))...)
+				}
 			}
+			err = retryRegister(role, register, cfg.RegisterRetries,
+				defaults.RegisterRetryPeriod, defaults.MaxRegisterRetryPeriod)
 			if err != nil {
-				log.Errorf("[%v] failed to join the cluster: %v", role, err)
-				time.Sleep(time.Second)
-			} else {
-				utils.Consolef(os.Stdout, "[%v] Successfully registered with the cluster", role)
-				continue
+				return trace.Wrap(err)
 			}
+			utils.Consolef(os.Stdout, "[%v] Successfully registered with the cluster", role)
 		}
 	})
 	return nil
 }
 
+// retryRegister calls register until it succeeds. A token rejected by
+// the auth server won't fix itself, so it fails right away, while other
+// errors, e.g. unreachable auth server or a dropped handshake, are retried with a delay growing
+// from period to maxPeriod. It gives up after retries attempts unless
+// retries is zero
+func retryRegister(role teleport.Role, register func() error, retries int, period, maxPeriod time.Duration) error {
+	for attempt := 1; ; attempt++ {
+		err := register()
+		if err == nil {
+			return nil
+		}
+		if teleport.IsAccessDenied(err) {
+			log.Errorf("[%v] auth server rejected the token, check that it is valid and not expired: %v", role, err)
+			return trace.Wrap(err)
+		}
+		if retries > 0 && attempt >= retries {
+			log.Errorf("[%v] failed to join the cluster after %v attempts: %v", role, attempt, err)
+			return trace.Wrap(err)
+		}
+		log.Errorf("[%v] failed to join the cluster: %v, retrying in %v", role, err, period)
+		time.Sleep(period)
+		period *= 2
+		if period > maxPeriod {
+			period = maxPeriod
+		}
+	}
+}
+
 // initProxy gets called if teleport runs with 'proxy' role enabled.
 // this means it will do two things:
 //    1. serve a web UI
 //    2. proxy SSH connections to nodes running with 'node' role
 //    3. take care of revse tunnels
 func (process *TeleportProcess) initProxy() (err error) {
+	if process.Config.Proxy.AssetsDir == "" {
+		return trace.Wrap(teleport.NotFound("web assets not found"))
+	}
 	// if no TLS key was provided for the web UI, generate a self signed cert
 	if process.Config.Proxy.TLSKey == "" {
+		if process.Config.Proxy.RequireProvidedTLS {
+			return trace.Wrap(teleport.BadParameter("require_provided_tls",
+				"self-signed certificates are disabled, please supply https_key_file and https_cert_file"))
+		}
 		err = initSelfSignedHTTPSCert(process.Config)
 		if err != nil {
 			return trace.Wrap(err)
 		}
 	}
+	certs, err := utils.NewCertificateHolder(process.Config.Proxy.TLSCert, process.Config.Proxy.TLSKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	process.setProxyCerts(certs)
 	return process.RegisterWithAuthServer(
 		process.Config.Proxy.Token, teleport.RoleProxy,
 		process.initProxyEndpoint)
@@ -434,12 +882,12 @@ func (process *TeleportProcess) initProxy() (err error) {
 
 func (process *TeleportProcess) initProxyEndpoint(conn *connector) error {
 	cfg := process.Config
-	proxyLimiter, err := limiter.NewLimiter(cfg.Proxy.Limiter)
+	proxyLimiter, err := limiter.NewLimiter(warnThresholdEvents(cfg.Proxy.Limiter, teleport.ComponentProxy, cfg.Hostname, conn.client))
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
-	reverseTunnelLimiter, err := limiter.NewLimiter(cfg.Proxy.Limiter)
+	reverseTunnelLimiter, err := limiter.NewLimiter(warnThresholdEvents(cfg.Proxy.Limiter, teleport.ComponentReverseTunnel, cfg.Hostname, conn.client))
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -449,21 +897,35 @@ func (process *TeleportProcess) initProxyEndpoint(conn *connector) error {
 		[]ssh.Signer{conn.identity.KeySigner},
 		conn.client,
 		reversetunnel.SetLimiter(reverseTunnelLimiter),
+		reversetunnel.SetClockSkew(cfg.ClockSkew),
+		reversetunnel.SetReusePort(cfg.ReusePort),
+		reversetunnel.SetConnectionLogging(cfg.ConnectionLogging),
+		reversetunnel.SetPanicRecovery(cfg.PanicRecovery),
 		reversetunnel.DirectSite(conn.identity.Cert.Extensions[utils.CertExtensionAuthority], conn.client),
 	)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
+	accessPoint, err := process.newAccessPoint(conn.client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
 	SSHProxy, err := srv.New(cfg.Proxy.SSHAddr,
 		cfg.Hostname,
 		[]ssh.Signer{conn.identity.KeySigner},
-		conn.client,
+		accessPoint,
 		cfg.DataDir,
 		nil,
 		srv.SetLimiter(proxyLimiter),
 		srv.SetProxyMode(tsrv),
+		srv.SetHeartbeatTTL(cfg.HeartbeatTTL),
+		srv.SetClockSkew(cfg.ClockSkew),
 		srv.SetSessionServer(conn.client),
+		srv.SetReusePort(cfg.ReusePort),
+		srv.SetConnectionLogging(cfg.ConnectionLogging),
+		srv.SetPanicRecovery(cfg.PanicRecovery),
 	)
 	if err != nil {
 		return trace.Wrap(err)
@@ -476,40 +938,42 @@ func (process *TeleportProcess) initProxyEndpoint(conn *connector) error {
 		HostSigners: []ssh.Signer{conn.identity.KeySigner},
 	})
 
-	// register SSH reverse tunnel server that accepts connections
-	// from remote teleport nodes
-	process.RegisterFunc(func() error {
-		utils.Consolef(cfg.Console, "[PROXY] Reverse tunnel service is starting on %v", cfg.Proxy.ReverseTunnelListenAddr.Addr)
-		if err := tsrv.Start(); err != nil {
-			utils.Consolef(cfg.Console, "[PROXY] Error: %v", err)
-			return trace.Wrap(err)
-		}
-		tsrv.Wait()
-		return nil
-	})
+	process.initReverseTunnelListener(tsrv)
 
 	// Register web proxy server
-	process.RegisterFunc(func() error {
+	process.registerRoleFunc(teleport.RoleProxy, func() error {
 		utils.Consolef(cfg.Console, "[PROXY] Web proxy service is starting on %v", cfg.Proxy.WebAddr.Addr)
 		webHandler, err := web.NewHandler(
 			web.Config{
-				Proxy:       tsrv,
-				AssetsDir:   cfg.Proxy.AssetsDir,
-				AuthServers: cfg.AuthServers[0],
-				DomainName:  cfg.Hostname})
+				Proxy:           tsrv,
+				AssetsDir:       cfg.Proxy.AssetsDir,
+				AuthServers:     cfg.AuthServers[0],
+				DomainName:      cfg.Hostname,
+				SecurityHeaders: cfg.Proxy.SecurityHeaders})
 		if err != nil {
 			log.Errorf("failed to launch web server: %v", err)
 			return err
 		}
 
-		proxyLimiter.WrapHandle(webHandler)
+		err = proxyLimiter.WrapHandle(metrics.InstrumentHandler(
+			metrics.ProxyConnections, "web", webHandler))
+		if err != nil {
+			return trace.Wrap(err)
+		}
 
 		log.Infof("[PROXY] init TLS listeners")
-		err = utils.ListenAndServeTLS(
-			cfg.Proxy.WebAddr.Addr,
+		listener, err := utils.Listen("tcp", cfg.Proxy.WebAddr.Addr, cfg.ReusePort)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		err = utils.ServeTLS(
+			listener,
 			proxyLimiter,
 			cfg.Proxy.TLSCert,
-			cfg.Proxy.TLSKey)
+			cfg.Proxy.TLSKey,
+			utils.SetTLSMinVersion(cfg.Proxy.TLSMinVersion),
+			utils.SetTLSCipherSuites(cfg.Proxy.TLSCipherSuites),
+			utils.SetTLSCertificateHolder(process.getProxyCerts()))
 		if err != nil {
 			return trace.Wrap(err)
 		}
@@ -518,16 +982,19 @@ func (process *TeleportProcess) initProxyEndpoint(conn *connector) error {
 	})
 
 	// Register ssh proxy server
-	process.RegisterFunc(func() error {
+	process.registerRoleFunc(teleport.RoleProxy, func() error {
 		utils.Consolef(cfg.Console, "[PROXY] SSH proxy service is starting on %v", cfg.Proxy.SSHAddr.Addr)
 		if err := SSHProxy.Start(); err != nil {
 			utils.Consolef(cfg.Console, "[PROXY] Error: %v", err)
 			return trace.Wrap(err)
 		}
+		process.onShutdown(SSHProxy.Drain)
+		process.checkAdvertiseAddr(teleport.ComponentProxy, cfg.Proxy.SSHAddr)
+		process.roleReady(teleport.RoleProxy)
 		return nil
 	})
 
-	process.RegisterFunc(func() error {
+	process.registerRoleFunc(teleport.RoleProxy, func() error {
 		log.Infof("[PROXY] starting reverse tunnel agent pool")
 		if err := agentPool.Start(); err != nil {
 			log.Fatalf("failed to start: %v", err)
@@ -539,6 +1006,81 @@ func (process *TeleportProcess) initProxyEndpoint(conn *connector) error {
 	return nil
 }
 
+// initReverseTunnelListener registers SSH reverse tunnel server that accepts
+// connections from remote teleport nodes, unless the listener is disabled.
+// The server itself is still used by the proxy to reach the local cluster
+func (process *TeleportProcess) initReverseTunnelListener(tsrv reversetunnel.Server) {
+	cfg := process.Config
+	if !cfg.Proxy.ReverseTunnelEnabled {
+		utils.Consolef(cfg.Console, "[PROXY] Reverse tunnel service is disabled")
+		return
+	}
+	process.registerRoleFunc(teleport.RoleProxy, func() error {
+		utils.Consolef(cfg.Console, "[PROXY] Reverse tunnel service is starting on %v", cfg.Proxy.ReverseTunnelListenAddr.Addr)
+		if err := tsrv.Start(); err != nil {
+			utils.Consolef(cfg.Console, "[PROXY] Error: %v", err)
+			return trace.Wrap(err)
+		}
+		process.checkAdvertiseAddr(teleport.ComponentReverseTunnel, cfg.Proxy.ReverseTunnelListenAddr)
+		tsrv.Wait()
+		return nil
+	})
+}
+
+// checkAdvertiseAddr dials the advertise IP on the port of the listener
+// of a role that has just started and warns if the connection fails, the
+// check runs in the background and is off unless AdvertiseIPCheck is set
+func (process *TeleportProcess) checkAdvertiseAddr(component string, listenAddr utils.NetAddr) {
+	cfg := process.Config
+	if !cfg.AdvertiseIPCheck || cfg.AdvertiseIP == nil {
+		return
+	}
+	go func() {
+		err := CheckAdvertiseAddr(cfg.AdvertiseIP, listenAddr, defaults.AdvertiseIPCheckTimeout)
+		if err != nil {
+			log.Warningf("[%v] advertised address is not reachable from this host: %v", component, err)
+			return
+		}
+		log.Infof("[%v] advertise IP %v is reachable on the port of %v", component, cfg.AdvertiseIP, listenAddr.Addr)
+	}()
+}
+
+// CheckAdvertiseAddr makes sure a TCP connection to the advertise IP on
+// the port of the listen address can be established within the timeout
+func CheckAdvertiseAddr(advertiseIP net.IP, listenAddr utils.NetAddr, timeout time.Duration) error {
+	_, port, err := net.SplitHostPort(listenAddr.Addr)
+	if err != nil {
+		return trace.Wrap(teleport.BadParameter("listen_addr",
+			fmt.Sprintf("failed to parse listen address %q: %v", listenAddr.Addr, err)))
+	}
+	addr := net.JoinHostPort(advertiseIP.String(), port)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return trace.Wrap(teleport.ConnectionProblem(
+			fmt.Sprintf("failed to connect to advertised address %v", addr), err))
+	}
+	conn.Close()
+	return nil
+}
+
+// initDiagnosticService starts an HTTP endpoint that serves metrics
+// in Prometheus text format and process status in JSON format
+func (process *TeleportProcess) initDiagnosticService() error {
+	cfg := process.Config
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry)
+	mux.HandleFunc("/status", process.serveStatus)
+	process.RegisterFunc(func() error {
+		utils.Consolef(cfg.Console, "[DIAG]  Diagnostic service is starting on %v", cfg.DiagnosticAddr.Addr)
+		if err := http.ListenAndServe(cfg.DiagnosticAddr.Addr, mux); err != nil {
+			utils.Consolef(cfg.Console, "[DIAG]  Error: %v", err)
+			return trace.Wrap(err)
+		}
+		return nil
+	})
+	return nil
+}
+
 // initAuthStorage initializes the storage backend for the auth. service
 func (process *TeleportProcess) initAuthStorage() (backend.Backend, error) {
 	cfg := &process.Config.Auth
@@ -547,11 +1089,19 @@ func (process *TeleportProcess) initAuthStorage() (backend.Backend, error) {
 
 	switch cfg.KeysBackend.Type {
 	case teleport.ETCDBackendType:
-		bk, err = etcdbk.FromJSON(cfg.KeysBackend.Params)
+		var etcdCfg *etcdbk.Config
+		etcdCfg, err = etcdbk.ParseConfig(cfg.KeysBackend.Params)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		// mark the prefix as owned by this cluster
+		etcdCfg.ClusterName = cfg.DomainName
+		bk, err = etcdbk.New(*etcdCfg)
 	case teleport.BoltBackendType:
 		bk, err = boltbk.FromJSON(cfg.KeysBackend.Params)
 	default:
-		return nil, trace.Errorf("unsupported backend type: %v", cfg.KeysBackend.Type)
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeUnsupportedBackend,
+			"type", fmt.Sprintf("unsupported backend type: %v", cfg.KeysBackend.Type)))
 	}
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -560,12 +1110,97 @@ func (process *TeleportProcess) initAuthStorage() (backend.Backend, error) {
 	return bk, nil
 }
 
+// waitForBackend repeats the read-write check of the backend every period
+// until it passes or the timeout elapses, so the auth server does not
+// report ready before it can reach the backend
+func waitForBackend(b backend.Backend, key string, timeout, period time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := backend.CheckReadWrite(b, key)
+		if err == nil {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			log.Warningf("backend did not pass the read-write check in %v: %v", timeout, err)
+			return
+		}
+		log.Warningf("backend read-write check failed, will retry in %v: %v", period, err)
+		time.Sleep(period)
+	}
+}
+
+// checkHostCert compares principals of the host certificate on disk with
+// the advertise IP and reports a certificate that doesn't cover it. The
+// certificate is never removed, the host would need a new token to join
+// again. It's a no-op if the role has no identity yet
+func (process *TeleportProcess) checkHostCert(id auth.IdentityID) error {
+	cfg := process.Config
+	if cfg.AdvertiseIP == nil || cfg.HostCertCheck == HostCertCheckOff {
+		return nil
+	}
+	exists, err := auth.HaveHostKeys(cfg.DataDir, id)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !exists {
+		return nil
+	}
+	identity, err := auth.ReadIdentity(cfg.DataDir, id, process.identityOptions()...)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	advertiseIP := cfg.AdvertiseIP.String()
+	if identity.HasPrincipal(advertiseIP) {
+		return nil
+	}
+	log.Warningf("[%v] host certificate principals %v don't include advertise IP %v, clients may reject this host",
+		id.Role, identity.Cert.ValidPrincipals, advertiseIP)
+	return nil
+}
+
+// warnThresholdEvents returns a copy of the limiter config that records
+// an event to elog when a client reaches the connection warn threshold
+func warnThresholdEvents(cfg limiter.LimiterConfig, component, hostname string, elog events.Log) limiter.LimiterConfig {
+	if cfg.WarnThreshold == 0 {
+		return cfg
+	}
+	maxConnections := cfg.MaxConnections
+	cfg.OnWarn = func(token string, connections int64) {
+		// the event log can be remote, don't hold back the connection
+		go elog.Log(lunk.NewRootEventID(), &events.ConnectionWarnThreshold{
+			Component:      component,
+			Hostname:       hostname,
+			RemoteAddr:     token,
+			Connections:    connections,
+			MaxConnections: maxConnections,
+		})
+	}
+	return cfg
+}
+
+// logConfigLoad records the config load event to the events backend,
+// or to the log if elog is nil
+func logConfigLoad(cfg *Config, elog events.Log) {
+	e := &events.ConfigLoad{
+		Hostname: cfg.Hostname,
+		HostUUID: cfg.HostUUID,
+		Source:   cfg.ConfigSource,
+		SHA256:   cfg.ConfigSHA256,
+	}
+	if elog == nil {
+		log.Infof("[%v] source: %v, sha256: %v", e.Schema(), e.Source, e.SHA256)
+		return
+	}
+	elog.Log(lunk.NewRootEventID(), e)
+}
+
 func initEventStorage(btype string, params string) (events.Log, error) {
 	switch btype {
 	case "bolt":
 		return boltlog.FromJSON(params)
 	}
-	return nil, trace.Errorf("unsupported backend type: %v", btype)
+	return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeUnsupportedBackend,
+		"type", fmt.Sprintf("unsupported backend type: %v", btype)))
 }
 
 func initRecordStorage(btype string, params string) (recorder.Recorder, error) {
@@ -573,35 +1208,62 @@ func initRecordStorage(btype string, params string) (recorder.Recorder, error) {
 	case "bolt":
 		return boltrec.FromJSON(params)
 	}
-	return nil, trace.Errorf("unsupported backend type: %v", btype)
+	return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeUnsupportedBackend,
+		"type", fmt.Sprintf("unsupported backend type: %v", btype)))
 }
 
 func validateConfig(cfg *Config) error {
-	if !cfg.Auth.Enabled && !cfg.SSH.Enabled && !cfg.Proxy.Enabled {
-		return trace.Wrap(
-			teleport.BadParameter(
-				"config", "supply at least one of Auth, SSH or Proxy roles"))
-	}
-
-	if cfg.DataDir == "" {
-		return trace.Wrap(teleport.BadParameter("config", "please supply data directory"))
-	}
-
 	if cfg.Console == nil {
 		cfg.Console = ioutil.Discard
 	}
 
-	if (cfg.Proxy.TLSKey == "" && cfg.Proxy.TLSCert != "") || (cfg.Proxy.TLSKey != "" && cfg.Proxy.TLSCert == "") {
-		return trace.Wrap(teleport.BadParameter("config", "please supply both TLS key and certificate"))
+	if cfg.StartMode == "" {
+		cfg.StartMode = StartAllOrNothing
 	}
 
-	if len(cfg.AuthServers) == 0 {
-		return trace.Wrap(teleport.BadParameter("proxy", "please supply a proxy server"))
+	if cfg.HostCertCheck == "" {
+		cfg.HostCertCheck = HostCertCheckWarn
 	}
 
+	return trace.Wrap(cfg.Validate())
+}
+
+// checkDataDir warns if the data directory is on a filesystem that loses
+// its contents on reboot, or fails if RequirePersistentDataDir is set
+func checkDataDir(cfg *Config) error {
+	volatile, err := utils.IsVolatileFS(cfg.DataDir)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !volatile {
+		return nil
+	}
+	msg := fmt.Sprintf("data dir '%v' is on tmpfs, keys and identity of this host will be lost on reboot", cfg.DataDir)
+	if cfg.RequirePersistentDataDir {
+		return trace.Wrap(teleport.BadParameter("data_dir", msg))
+	}
+	log.Warningf("[CONFIG] %v", msg)
 	return nil
 }
 
+// checkShell makes sure the shell of the SSH service can be started. With
+// UseLoginShell sessions use login shells of users and the shell is only
+// a fallback, so a bad shell is reported, but does not stop the node
+func checkShell(cfg *Config) error {
+	if !cfg.SSH.Enabled || cfg.SSH.Shell == "" {
+		return nil
+	}
+	err := srv.CheckShell(cfg.SSH.Shell)
+	if err == nil {
+		return nil
+	}
+	if cfg.SSH.UseLoginShell {
+		log.Warningf("[CONFIG] %v, it will fail sessions of users without a login shell", err)
+		return nil
+	}
+	return trace.Wrap(err)
+}
+
 // initSelfSignedHTTPSCert generates and self-signs a TLS key+cert pair for https connection
 // to the proxy server.
 func initSelfSignedHTTPSCert(cfg *Config) (err error) {
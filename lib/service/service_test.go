@@ -16,8 +16,43 @@ limitations under the License.
 package service
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/auth/testauthority"
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/backend/boltbk"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/metrics"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codahale/lunk"
+	"github.com/gravitational/roundtrip"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/check.v1"
 )
 
@@ -46,3 +81,972 @@ func (s *ServiceTestSuite) TestSelfSignedHTTPS(c *check.C) {
 	c.Assert(fileExists(cfg.Proxy.TLSCert), check.Equals, true)
 	c.Assert(fileExists(cfg.Proxy.TLSKey), check.Equals, true)
 }
+
+func (s *ServiceTestSuite) TestRequireProvidedTLS(c *check.C) {
+	cfg := MakeDefaultConfig()
+	cfg.DataDir = c.MkDir()
+	cfg.Proxy.RequireProvidedTLS = true
+	process := &TeleportProcess{Config: cfg, Supervisor: NewSupervisor()}
+
+	// self-signed certificate is not generated
+	err := process.initProxy()
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(cfg.Proxy.TLSKey, check.Equals, "")
+	_, err = os.Stat(filepath.Join(cfg.DataDir, defaults.SelfSignedCertPath))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	// provided certificate is used
+	creds, err := utils.GenerateSelfSignedCert([]string{"example.com"})
+	c.Assert(err, check.IsNil)
+	cfg.Proxy.TLSKey = filepath.Join(cfg.DataDir, "proxy.key")
+	cfg.Proxy.TLSCert = filepath.Join(cfg.DataDir, "proxy.cert")
+	c.Assert(ioutil.WriteFile(cfg.Proxy.TLSKey, creds.PrivateKey, 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(cfg.Proxy.TLSCert, creds.Cert, 0600), check.IsNil)
+	c.Assert(process.initProxy(), check.IsNil)
+	c.Assert(process.getProxyCerts(), check.NotNil)
+}
+
+func (s *ServiceTestSuite) TestReloadTLS(c *check.C) {
+	cfg := &Config{
+		DataDir:  c.MkDir(),
+		Hostname: "example.com",
+	}
+	process := &TeleportProcess{Config: cfg}
+	c.Assert(teleport.IsNotFound(process.ReloadTLS()), check.Equals, true)
+
+	c.Assert(initSelfSignedHTTPSCert(cfg), check.IsNil)
+	certs, err := utils.NewCertificateHolder(cfg.Proxy.TLSCert, cfg.Proxy.TLSKey)
+	c.Assert(err, check.IsNil)
+	process.setProxyCerts(certs)
+	servedNames := func() []string {
+		cert, err := certs.GetCertificate(nil)
+		c.Assert(err, check.IsNil)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		c.Assert(err, check.IsNil)
+		return parsed.DNSNames
+	}
+	c.Assert(servedNames()[0], check.Equals, "example.com")
+
+	// renewed certificate is picked up on reload
+	creds, err := utils.GenerateSelfSignedCert([]string{"renewed.example.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(cfg.Proxy.TLSKey, creds.PrivateKey, 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(cfg.Proxy.TLSCert, creds.Cert, 0600), check.IsNil)
+	c.Assert(process.ReloadTLS(), check.IsNil)
+	c.Assert(servedNames()[0], check.Equals, "renewed.example.com")
+}
+
+func (s *ServiceTestSuite) TestStatus(c *check.C) {
+	bk, err := boltbk.New(filepath.Join(c.MkDir(), "keys.db"))
+	c.Assert(err, check.IsNil)
+	defer bk.Close()
+
+	cfg := &Config{HostUUID: "host-uuid", Hostname: "example.com"}
+	cfg.Auth.Enabled = true
+	cfg.Proxy.Enabled = true
+	cfg.Auth.KeysBackend.Type = teleport.BoltBackendType
+	process := &TeleportProcess{Config: cfg, startedAt: time.Now().Add(-time.Minute)}
+	process.setAuthBackend(bk)
+
+	metrics.SSHSessions.Inc("node")
+	defer metrics.SSHSessions.Dec("node")
+
+	status := process.GetStatus()
+	c.Assert(status.HostUUID, check.Equals, "host-uuid")
+	c.Assert(status.Roles, check.DeepEquals, []string{"auth", "proxy"})
+	c.Assert(status.Uptime >= 60, check.Equals, true)
+	c.Assert(status.Connections[metrics.SSHSessions.Name()], check.Equals, int64(1))
+	c.Assert(status.Backend, check.DeepEquals, &BackendStatus{Type: "bolt", Healthy: true})
+
+	// backend that rejects writes is reported as read-only
+	process.setAuthBackend(&noQuorumBackend{Backend: bk})
+	status = process.GetStatus()
+	c.Assert(status.Backend, check.DeepEquals, &BackendStatus{
+		Type:     "bolt",
+		Healthy:  true,
+		ReadOnly: true,
+		Error:    "no quorum",
+	})
+}
+
+func (s *ServiceTestSuite) TestStatusCARotation(c *check.C) {
+	bk, err := boltbk.New(filepath.Join(c.MkDir(), "keys.db"))
+	c.Assert(err, check.IsNil)
+	defer bk.Close()
+
+	cfg := &Config{HostUUID: "host-uuid", Hostname: "example.com"}
+	cfg.Auth.Enabled = true
+	process := &TeleportProcess{Config: cfg, startedAt: time.Now()}
+	c.Assert(process.GetStatus().CARotation, check.IsNil)
+
+	a := auth.NewAuthServer(&auth.InitConfig{
+		Backend:    bk,
+		Authority:  testauthority.New(),
+		DomainName: "localhost",
+	})
+	process.setLocalAuth(a)
+
+	// the host authority still trusts a key it no longer signs with
+	_, pub, err := testauthority.New().GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	ca := services.NewTestCA(services.HostCA, "localhost")
+	ca.CheckingKeys = append(ca.CheckingKeys, pub)
+	c.Assert(a.UpsertCertAuthority(*ca, backend.Forever), check.IsNil)
+
+	// the user authority does not exist and is omitted
+	rotation := process.GetStatus().CARotation
+	c.Assert(len(rotation), check.Equals, 1)
+	c.Assert(rotation[services.HostCA].InProgress, check.Equals, true)
+	c.Assert(len(rotation[services.HostCA].CheckingOnlyKeys), check.Equals, 1)
+}
+
+type noQuorumBackend struct {
+	backend.Backend
+}
+
+func (b *noQuorumBackend) Degraded() error {
+	return &teleport.ReadonlyError{Message: "no quorum"}
+}
+
+func (s *ServiceTestSuite) TestFallbackDataDir(c *check.C) {
+	dir := c.MkDir()
+	xdgDataHome := os.Getenv("XDG_DATA_HOME")
+	defer os.Setenv("XDG_DATA_HOME", xdgDataHome)
+	c.Assert(os.Setenv("XDG_DATA_HOME", dir), check.IsNil)
+
+	// writable data dir, existing or not, is used by everyone
+	for _, dataDir := range []string{dir, filepath.Join(dir, "a", "b")} {
+		fallback, err := FallbackDataDir(1000, dataDir)
+		c.Assert(err, check.IsNil)
+		c.Assert(fallback, check.Equals, "")
+	}
+
+	file := filepath.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(file, nil, 0644), check.IsNil)
+	unwritable := filepath.Join(file, "teleport")
+
+	fallback, err := FallbackDataDir(0, unwritable)
+	c.Assert(err, check.IsNil)
+	c.Assert(fallback, check.Equals, "")
+
+	fallback, err = FallbackDataDir(1000, unwritable)
+	c.Assert(err, check.IsNil)
+	c.Assert(fallback, check.Equals, filepath.Join(dir, "teleport"))
+
+	// without XDG_DATA_HOME the data dir is in the home dir
+	c.Assert(os.Unsetenv("XDG_DATA_HOME"), check.IsNil)
+	fallback, err = FallbackDataDir(1000, unwritable)
+	c.Assert(err, check.IsNil)
+	c.Assert(filepath.Base(fallback), check.Equals, ".teleport")
+}
+
+func (s *ServiceTestSuite) TestCheckShell(c *check.C) {
+	cfg := MakeDefaultConfig()
+	cfg.SSH.Enabled = true
+	cfg.SSH.Shell = filepath.Join(c.MkDir(), "missing")
+
+	// the shell is only a fallback for login shells
+	cfg.SSH.UseLoginShell = true
+	c.Assert(checkShell(cfg), check.IsNil)
+
+	cfg.SSH.UseLoginShell = false
+	c.Assert(teleport.IsNotFound(checkShell(cfg)), check.Equals, true)
+
+	// shell is not used without the SSH service
+	cfg.SSH.Enabled = false
+	c.Assert(checkShell(cfg), check.IsNil)
+}
+
+func (s *ServiceTestSuite) TestCheckAdvertiseAddr(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	advertiseIP := net.ParseIP("127.0.0.1")
+
+	// roles listen on all interfaces, the port is taken from the listen address
+	listenAddr := utils.NetAddr{AddrNetwork: "tcp", Addr: net.JoinHostPort("0.0.0.0", port)}
+	c.Assert(CheckAdvertiseAddr(advertiseIP, listenAddr, time.Second), check.IsNil)
+
+	// nothing listens on the port anymore
+	c.Assert(listener.Close(), check.IsNil)
+	err = CheckAdvertiseAddr(advertiseIP, listenAddr, time.Second)
+	c.Assert(teleport.IsConnectionProblem(err), check.Equals, true, check.Commentf("%v", err))
+
+	err = CheckAdvertiseAddr(advertiseIP, utils.NetAddr{Addr: "localhost"}, time.Second)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *ServiceTestSuite) TestStatusLimiters(c *check.C) {
+	cfg := &Config{HostUUID: "host-uuid", Hostname: "example.com"}
+	cfg.SSH.Enabled = true
+	cfg.SSH.Limiter = limiter.LimiterConfig{
+		MaxConnections: 50,
+		MaxHandshakes:  5,
+		Rates:          []limiter.Rate{{Period: time.Minute, Average: 10, Burst: 20}},
+	}
+	cfg.Proxy.Enabled = true
+	cfg.Proxy.Limiter = limiter.LimiterConfig{MaxNumberOfUsers: 7}
+	process := &TeleportProcess{Config: cfg, startedAt: time.Now()}
+
+	w := httptest.NewRecorder()
+	process.serveStatus(w, &http.Request{})
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+
+	var status Status
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &status), check.IsNil)
+	c.Assert(status.Limiters, check.DeepEquals, map[string]limiter.LimiterConfig{
+		"node": {
+			MaxConnections:   50,
+			MaxHandshakes:    5,
+			MaxNumberOfUsers: limiter.DefaultMaxNumberOfUsers,
+			Rates:            []limiter.Rate{{Period: time.Minute, Average: 10, Burst: 20}},
+		},
+		"proxy": {
+			MaxNumberOfUsers: 7,
+			Rates: []limiter.Rate{{
+				Period:  time.Second,
+				Average: limiter.DefaultRate,
+				Burst:   limiter.DefaultRate,
+			}},
+		},
+	})
+}
+
+func (s *ServiceTestSuite) TestDataDirUsage(c *check.C) {
+	dataDir := c.MkDir()
+	writeFile := func(path string, size int) {
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0700), check.IsNil)
+		c.Assert(ioutil.WriteFile(path, make([]byte, size), 0600), check.IsNil)
+	}
+	writeFile(filepath.Join(dataDir, "events.db"), 100)
+	writeFile(filepath.Join(dataDir, "keys.db"), 20)
+	writeFile(filepath.Join(dataDir, "host_uuid"), 3)
+	writeFile(filepath.Join(dataDir, "sessions", "a"), 5)
+
+	usage, err := DataDirUsage(dataDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(usage, check.DeepEquals, map[string]int64{
+		"events.db": 100,
+		"keys.db":   20,
+		"total":     128,
+	})
+
+	writeFile(filepath.Join(dataDir, "records.db"), 1000)
+	cfg := &Config{DataDir: dataDir}
+	process := &TeleportProcess{Config: cfg, startedAt: time.Now()}
+	status := process.GetStatus()
+	c.Assert(status.DataDirUsage, check.DeepEquals, map[string]int64{
+		"events.db":  100,
+		"keys.db":    20,
+		"records.db": 1000,
+		"total":      1128,
+	})
+
+	// usage is cached, so files written since the last check are not
+	// reported until the cached value expires
+	writeFile(filepath.Join(dataDir, "sessions", "b"), 10)
+	c.Assert(process.GetStatus().DataDirUsage[DataDirUsageTotal], check.Equals, int64(1128))
+	process.dataDirUsageAt = time.Now().Add(-defaults.DataDirUsageTTL)
+	c.Assert(process.GetStatus().DataDirUsage[DataDirUsageTotal], check.Equals, int64(1138))
+
+	_, err = DataDirUsage(filepath.Join(dataDir, "missing"))
+	c.Assert(err, check.NotNil)
+}
+
+type capturingEventLog struct {
+	*events.NOPEventLogger
+	events []lunk.Event
+}
+
+func (l *capturingEventLog) Log(id lunk.EventID, e lunk.Event) {
+	l.events = append(l.events, e)
+}
+
+func (s *ServiceTestSuite) TestLogConfigLoad(c *check.C) {
+	cfg := MakeDefaultConfig()
+	cfg.Hostname = "node"
+	cfg.HostUUID = "uuid"
+	cfg.ConfigSource = "/etc/teleport.yaml"
+	cfg.ConfigSHA256 = "hash"
+
+	elog := &capturingEventLog{NOPEventLogger: events.NullEventLogger}
+	logConfigLoad(cfg, elog)
+	c.Assert(elog.events, check.DeepEquals, []lunk.Event{&events.ConfigLoad{
+		Hostname: "node",
+		HostUUID: "uuid",
+		Source:   "/etc/teleport.yaml",
+		SHA256:   "hash",
+	}})
+	c.Assert(elog.events[0].Schema(), check.Equals, events.ConfigLoadEvent)
+
+	// without the events backend the event goes to the log
+	logConfigLoad(cfg, nil)
+	c.Assert(elog.events, check.HasLen, 1)
+}
+
+// channelEventLog sends logged events to the channel
+type channelEventLog struct {
+	*events.NOPEventLogger
+	eventsC chan lunk.Event
+}
+
+func (l *channelEventLog) Log(id lunk.EventID, e lunk.Event) {
+	l.eventsC <- e
+}
+
+func (s *ServiceTestSuite) TestWarnThresholdEvents(c *check.C) {
+	elog := &channelEventLog{NOPEventLogger: events.NullEventLogger, eventsC: make(chan lunk.Event, 1)}
+	cfg := limiter.LimiterConfig{MaxConnections: 3}
+	c.Assert(warnThresholdEvents(cfg, teleport.ComponentNode, "node", elog).OnWarn, check.IsNil)
+
+	cfg.WarnThreshold = 2
+	l, err := limiter.NewLimiter(warnThresholdEvents(cfg, teleport.ComponentNode, "node", elog))
+	c.Assert(err, check.IsNil)
+	c.Assert(l.AcquireConnection("10.0.0.1"), check.IsNil)
+	c.Assert(l.AcquireConnection("10.0.0.1"), check.IsNil)
+	select {
+	case e := <-elog.eventsC:
+		c.Assert(e, check.DeepEquals, &events.ConnectionWarnThreshold{
+			Component:      teleport.ComponentNode,
+			Hostname:       "node",
+			RemoteAddr:     "10.0.0.1",
+			Connections:    2,
+			MaxConnections: 3,
+		})
+		c.Assert(e.Schema(), check.Equals, events.ConnectionWarnThresholdEvent)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for the warn threshold event")
+	}
+}
+
+func (s *ServiceTestSuite) TestCheckHostCert(c *check.C) {
+	bk, err := boltbk.New(filepath.Join(c.MkDir(), "keys.db"))
+	c.Assert(err, check.IsNil)
+	defer bk.Close()
+	authServer := auth.NewAuthServer(&auth.InitConfig{
+		Backend:    bk,
+		Authority:  testauthority.New(),
+		DomainName: "example.com",
+	})
+	c.Assert(authServer.UpsertCertAuthority(
+		*services.NewTestCA(services.HostCA, "example.com"), backend.Forever), check.IsNil)
+
+	id := auth.IdentityID{Role: teleport.RoleNode, HostUUID: "uuid"}
+	makeProcess := func(mode HostCertCheck) *TeleportProcess {
+		cfg := MakeDefaultConfig()
+		cfg.DataDir = c.MkDir()
+		cfg.AdvertiseIP = net.ParseIP("10.0.0.1")
+		cfg.HostCertCheck = mode
+		return &TeleportProcess{Config: cfg}
+	}
+	haveKeys := func(process *TeleportProcess) bool {
+		exists, err := auth.HaveHostKeys(process.Config.DataDir, id)
+		c.Assert(err, check.IsNil)
+		return exists
+	}
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.WarnLevel)
+
+	// certificates issued on registration don't cover the advertise IP,
+	// it's reported on every start but the node keeps its identity
+	process := makeProcess(HostCertCheckWarn)
+	c.Assert(auth.LocalRegister(process.Config.DataDir, id, authServer), check.IsNil)
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		c.Assert(process.checkHostCert(id), check.IsNil)
+		c.Assert(haveKeys(process), check.Equals, true)
+		c.Assert(buf.String(), check.Matches, `(?s).*don't include advertise IP 10.0.0.1.*`)
+	}
+
+	// the check can be turned off
+	process.Config.HostCertCheck = HostCertCheckOff
+	buf.Reset()
+	c.Assert(process.checkHostCert(id), check.IsNil)
+	c.Assert(buf.String(), check.Equals, "")
+
+	// certificate valid for the advertise IP passes
+	process = makeProcess(HostCertCheckWarn)
+	priv, pub, err := authServer.GenerateKeyPair("")
+	c.Assert(err, check.IsNil)
+	cert, err := authServer.GenerateHostCert(pub, "10.0.0.1", "example.com", teleport.RoleNode, 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(process.Config.DataDir, fmt.Sprintf("host.uuid.%v.key", string(teleport.RoleNode))), priv, 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(process.Config.DataDir, fmt.Sprintf("host.uuid.%v.cert", string(teleport.RoleNode))), cert, 0600), check.IsNil)
+	buf.Reset()
+	c.Assert(process.checkHostCert(id), check.IsNil)
+	c.Assert(buf.String(), check.Equals, "")
+
+	// missing identity is not an error
+	c.Assert(makeProcess(HostCertCheckWarn).checkHostCert(id), check.IsNil)
+}
+
+func (s *ServiceTestSuite) TestStartMode(c *check.C) {
+	makeConfig := func(mode StartMode) *Config {
+		cfg := MakeDefaultConfig()
+		cfg.DataDir = c.MkDir()
+		cfg.Console = ioutil.Discard
+		cfg.Auth.Enabled = false
+		cfg.AuthServers = []utils.NetAddr{{AddrNetwork: "tcp", Addr: "localhost:3025"}}
+		cfg.SSH.Enabled = true
+		cfg.Proxy.Enabled = true
+		// proxy fails to start because web assets could not be located
+		cfg.Proxy.AssetsDir = ""
+		cfg.StartMode = mode
+		return cfg
+	}
+
+	_, err := NewTeleport(makeConfig(StartAllOrNothing))
+	c.Assert(teleport.IsNotFound(err), check.Equals, true, check.Commentf("%v", err))
+	c.Assert(err, check.ErrorMatches, ".*web assets not found.*")
+
+	supervisor, err := NewTeleport(makeConfig(StartBestEffort))
+	c.Assert(err, check.IsNil)
+	process := supervisor.(*TeleportProcess)
+	// only SSH service has been registered
+	c.Assert(process.Supervisor.(*LocalSupervisor).services, check.HasLen, 1)
+
+	// best effort still fails if no role could start
+	cfg := makeConfig(StartBestEffort)
+	cfg.SSH.Enabled = false
+	_, err = NewTeleport(cfg)
+	c.Assert(err, check.ErrorMatches, ".*all services failed to start.*")
+
+	cfg = makeConfig("some-mode")
+	_, err = NewTeleport(cfg)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*unsupported start mode.*")
+}
+
+func (s *ServiceTestSuite) TestRoleServiceFailure(c *check.C) {
+	cfg := MakeDefaultConfig()
+	cfg.StartMode = StartBestEffort
+	process := &TeleportProcess{Supervisor: NewSupervisor(), Config: cfg}
+
+	// a failed proxy service doesn't exit the process in best-effort mode,
+	// the supervisor would call os.Exit otherwise
+	servedC := make(chan struct{})
+	process.registerRoleFunc(teleport.RoleProxy, func() error {
+		return trace.Wrap(teleport.NotFound("web assets not found"))
+	})
+	process.registerRoleFunc(teleport.RoleNode, func() error {
+		close(servedC)
+		return nil
+	})
+	c.Assert(process.Start(), check.IsNil)
+	c.Assert(process.Wait(), check.IsNil)
+	select {
+	case <-servedC:
+	default:
+		c.Fatalf("node service has not run")
+	}
+}
+
+func (s *ServiceTestSuite) TestReverseTunnelDisabled(c *check.C) {
+	makeProcess := func(enabled bool) *TeleportProcess {
+		cfg := MakeDefaultConfig()
+		cfg.Console = ioutil.Discard
+		cfg.Proxy.ReverseTunnelEnabled = enabled
+		return &TeleportProcess{Config: cfg, Supervisor: NewSupervisor()}
+	}
+
+	process := makeProcess(true)
+	process.initReverseTunnelListener(nil)
+	c.Assert(process.Supervisor.(*LocalSupervisor).services, check.HasLen, 1)
+
+	// listener is not registered when the tunnel is explicitly disabled
+	process = makeProcess(false)
+	process.initReverseTunnelListener(nil)
+	c.Assert(process.Supervisor.(*LocalSupervisor).services, check.HasLen, 0)
+}
+
+// readOnlyBackend rejects writes until writable is set
+type readOnlyBackend struct {
+	backend.Backend
+	writable int32
+}
+
+func (b *readOnlyBackend) UpsertVal(bucket []string, key string, val []byte, ttl time.Duration) error {
+	if atomic.LoadInt32(&b.writable) == 0 {
+		return trace.Errorf("backend is read only")
+	}
+	return b.Backend.UpsertVal(bucket, key, val, ttl)
+}
+
+func (s *ServiceTestSuite) TestWaitForBackend(c *check.C) {
+	bk, err := boltbk.New(filepath.Join(c.MkDir(), "keys.db"))
+	c.Assert(err, check.IsNil)
+	defer bk.Close()
+
+	// healthy backend passes the check right away
+	start := time.Now()
+	waitForBackend(bk, "uuid", time.Minute, time.Minute)
+	c.Assert(time.Now().Sub(start) < time.Minute, check.Equals, true)
+
+	// backend rejecting writes delays readiness
+	process := &TeleportProcess{
+		Config:       &Config{},
+		pendingRoles: make(map[teleport.Role]bool),
+		readyC:       make(chan struct{}),
+	}
+	process.expectRole(teleport.RoleAuth)
+	b := &readOnlyBackend{Backend: bk}
+	go func() {
+		waitForBackend(b, "uuid", time.Minute, 10*time.Millisecond)
+		process.roleReady(teleport.RoleAuth)
+	}()
+	select {
+	case <-process.readyC:
+		c.Fatalf("process is ready before the backend accepts writes")
+	case <-time.After(100 * time.Millisecond):
+	}
+	atomic.StoreInt32(&b.writable, 1)
+	select {
+	case <-process.readyC:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("process is not ready after the backend accepts writes")
+	}
+
+	// the wait is bounded by the timeout
+	start = time.Now()
+	waitForBackend(&readOnlyBackend{Backend: bk}, "uuid", 50*time.Millisecond, 10*time.Millisecond)
+	elapsed := time.Now().Sub(start)
+	c.Assert(elapsed >= 50*time.Millisecond && elapsed < 5*time.Second, check.Equals, true)
+}
+
+func (s *ServiceTestSuite) TestPostStart(c *check.C) {
+	marker := filepath.Join(c.MkDir(), "started")
+	cfg := &Config{PostStart: PostStartConfig{
+		Command: []string{"/bin/sh", "-c", "touch " + marker},
+		Timeout: time.Second,
+	}}
+	process := &TeleportProcess{
+		Config:       cfg,
+		pendingRoles: make(map[teleport.Role]bool),
+		readyC:       make(chan struct{}),
+	}
+	process.expectRole(teleport.RoleNode)
+	process.expectRole(teleport.RoleProxy)
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- process.runPostStart()
+	}()
+
+	// the hook waits for all roles to start
+	process.roleReady(teleport.RoleNode)
+	select {
+	case err := <-errC:
+		c.Fatalf("post start command ran before all roles started: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err := os.Stat(marker)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	process.roleReady(teleport.RoleProxy)
+	select {
+	case err := <-errC:
+		c.Assert(err, check.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for post start command")
+	}
+	_, err = os.Stat(marker)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *ServiceTestSuite) TestPostStartFailure(c *check.C) {
+	process := &TeleportProcess{
+		Config:       &Config{PostStart: PostStartConfig{Command: []string{"/bin/false"}}},
+		pendingRoles: make(map[teleport.Role]bool),
+		readyC:       make(chan struct{}),
+	}
+	process.expectRole(teleport.RoleNode)
+	process.roleReady(teleport.RoleNode)
+
+	// failure is only logged by default
+	c.Assert(process.runPostStart(), check.IsNil)
+
+	process.Config.PostStart.AbortOnError = true
+	c.Assert(process.runPostStart(), check.ErrorMatches, ".*post start command.*failed.*")
+
+	// slow command is killed after the timeout
+	process.Config.PostStart = PostStartConfig{
+		Command:      []string{"/bin/sleep", "10"},
+		Timeout:      100 * time.Millisecond,
+		AbortOnError: true,
+	}
+	c.Assert(process.runPostStart(), check.ErrorMatches, ".*timed out after 100ms.*")
+}
+
+func (s *ServiceTestSuite) TestShutdownTimeout(c *check.C) {
+	process := &TeleportProcess{Config: &Config{}}
+	stopped := make(chan struct{})
+	process.onShutdown(func() error {
+		close(stopped)
+		return nil
+	})
+	c.Assert(process.Shutdown(time.Second), check.IsNil)
+	<-stopped
+
+	// session that refuses to end does not block shutdown forever
+	process = &TeleportProcess{Config: &Config{}}
+	process.onShutdown(func() error {
+		select {}
+	})
+	timeout := 100 * time.Millisecond
+	start := time.Now()
+	err := process.Shutdown(timeout)
+	c.Assert(err, check.ErrorMatches, ".*did not stop in 100ms.*")
+	elapsed := time.Now().Sub(start)
+	c.Assert(elapsed >= timeout, check.Equals, true)
+	c.Assert(elapsed < 10*timeout, check.Equals, true)
+}
+
+func (s *ServiceTestSuite) TestExpandLabels(c *check.C) {
+	facts := HostFacts{Hostname: "node1", AdvertiseIP: "10.0.0.1", HostUUID: "uuid1", OS: "linux"}
+	labels, err := ExpandLabels(map[string]string{
+		"hostname": "{{.Hostname}}",
+		"addr":     "{{.AdvertiseIP}}:3022",
+		"id":       "{{.OS}}-{{.HostUUID}}",
+		"role":     "db",
+		"braces":   "a}}b",
+	}, facts)
+	c.Assert(err, check.IsNil)
+	c.Assert(labels, check.DeepEquals, map[string]string{
+		"hostname": "node1",
+		"addr":     "10.0.0.1:3022",
+		"id":       "linux-uuid1",
+		"role":     "db",
+		"braces":   "a}}b",
+	})
+
+	_, err = ExpandLabels(map[string]string{"bogus": "{{.Bogus}}"}, facts)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*label 'bogus'.*")
+
+	_, err = ExpandLabels(map[string]string{"broken": "{{.Hostname"}, facts)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	labels, err = ExpandLabels(nil, facts)
+	c.Assert(err, check.IsNil)
+	c.Assert(labels, check.IsNil)
+}
+
+func (s *ServiceTestSuite) TestRetryRegister(c *check.C) {
+	// rejected token fails without retries
+	attempts := 0
+	err := retryRegister(teleport.RoleNode, func() error {
+		attempts++
+		return teleport.AccessDenied("access denied to 'node': bad username or credentials")
+	}, 0, time.Millisecond, time.Millisecond)
+	c.Assert(teleport.IsAccessDenied(err), check.Equals, true)
+	c.Assert(attempts, check.Equals, 1)
+
+	// unreachable auth server is retried until it comes back
+	attempts = 0
+	err = retryRegister(teleport.RoleNode, func() error {
+		attempts++
+		if attempts < 3 {
+			return teleport.ConnectionProblem("failed to connect to remote API", nil)
+		}
+		return nil
+	}, 0, time.Millisecond, 2*time.Millisecond)
+	c.Assert(err, check.IsNil)
+	c.Assert(attempts, check.Equals, 3)
+
+	// or until the retry budget runs out, a connection dropped by the auth
+	// server during the handshake is retried as well
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	id := auth.IdentityID{HostUUID: "node", Role: teleport.RoleNode}
+	servers := []utils.NetAddr{{AddrNetwork: "tcp", Addr: listener.Addr().String()}}
+	attempts = 0
+	err = retryRegister(teleport.RoleNode, func() error {
+		attempts++
+		return auth.Register(c.MkDir(), "token", id, servers)
+	}, 4, time.Millisecond, 2*time.Millisecond)
+	c.Assert(teleport.IsConnectionProblem(err), check.Equals, true, check.Commentf("%v", err))
+	c.Assert(attempts, check.Equals, 4)
+}
+
+// testCertIssuer issues TLS certificates for the tests
+type testCertIssuer struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertIssuer(c *check.C) *testCertIssuer {
+	issuer := &testCertIssuer{dir: c.MkDir()}
+	issuer.cert, issuer.key = issuer.issue(c, "ca", "", nil)
+	return issuer
+}
+
+// issue returns a certificate with the organization signed by the issuer,
+// the issuer's own CA certificate is generated if it has none yet
+func (i *testCertIssuer) issue(c *check.C, name, organization string, ips []net.IP) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  ips,
+	}
+	if organization != "" {
+		template.Subject.Organization = []string{organization}
+	}
+	parent, parentKey := i.cert, i.key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	c.Assert(err, check.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, check.IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(i.dir, name+".crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(i.dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), check.IsNil)
+	return cert, key
+}
+
+// client returns the auth API client authenticated with a certificate
+// issued for the role
+func (i *testCertIssuer) client(c *check.C, addr string, role teleport.Role) *auth.Client {
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+	tlsConfig.RootCAs.AddCert(i.cert)
+	if role != "" {
+		name := "client-" + string(role)
+		i.issue(c, name, string(role), nil)
+		cert, err := tls.LoadX509KeyPair(i.path(name+".crt"), i.path(name+".key"))
+		c.Assert(err, check.IsNil)
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	clt, err := auth.NewClient("https://"+addr, roundtrip.HTTPClient(&http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}))
+	c.Assert(err, check.IsNil)
+	return clt
+}
+
+func (i *testCertIssuer) path(name string) string {
+	return filepath.Join(i.dir, name)
+}
+
+func (s *ServiceTestSuite) TestAuthHTTPListener(c *check.C) {
+	bk, err := boltbk.New(filepath.Join(c.MkDir(), "keys.db"))
+	c.Assert(err, check.IsNil)
+	defer bk.Close()
+	authServer := auth.NewAuthServer(&auth.InitConfig{
+		Backend:    bk,
+		Authority:  testauthority.New(),
+		DomainName: "example.com",
+	})
+	apiServer := auth.NewAPIWithRoles(auth.APIConfig{
+		AuthServer:        authServer,
+		PermissionChecker: auth.NewStandardPermissions(),
+		Roles:             auth.StandardRoles,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	addr := listener.Addr().String()
+	c.Assert(listener.Close(), check.IsNil)
+
+	issuer := newTestCertIssuer(c)
+	issuer.issue(c, "server", "", []net.IP{net.ParseIP("127.0.0.1")})
+
+	cfg := MakeDefaultConfig()
+	cfg.Console = ioutil.Discard
+	cfg.HostUUID = "uuid"
+	cfg.Auth.TunnelEnabled = false
+	cfg.Auth.HTTPAddr = utils.NetAddr{AddrNetwork: "tcp", Addr: addr}
+	cfg.Auth.HTTPTLSCert = issuer.path("server.crt")
+	cfg.Auth.HTTPTLSKey = issuer.path("server.key")
+	cfg.Auth.HTTPClientCAFile = issuer.path("ca.crt")
+	c.Assert(cfg.Auth.CheckListeners(), check.IsNil)
+	process := &TeleportProcess{
+		Config:       cfg,
+		Supervisor:   NewSupervisor(),
+		pendingRoles: make(map[teleport.Role]bool),
+		readyC:       make(chan struct{}),
+	}
+	process.expectRole(teleport.RoleAuth)
+	lim, err := limiter.NewLimiter(cfg.Auth.Limiter)
+	c.Assert(err, check.IsNil)
+	c.Assert(process.initAuthHTTPListener(apiServer, lim, bk), check.IsNil)
+	c.Assert(process.Start(), check.IsNil)
+
+	// without the tunnel the listener reports the auth role ready
+	select {
+	case <-process.readyC:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("auth role is not ready")
+	}
+
+	// requests get the role from the client certificate
+	clt := issuer.client(c, addr, teleport.RoleNode)
+	domain, err := clt.GetLocalDomain()
+	c.Assert(err, check.IsNil)
+	c.Assert(domain, check.Equals, "example.com")
+	_, err = clt.GenerateToken(teleport.RoleNode, time.Minute)
+	c.Assert(teleport.IsAccessDenied(err), check.Equals, true, check.Commentf("%#v", err))
+
+	// admin and auth roles are never granted by client certificates
+	for _, role := range []teleport.Role{teleport.RoleAdmin, teleport.RoleAuth} {
+		_, err = issuer.client(c, addr, role).GetLocalDomain()
+		c.Assert(teleport.IsAccessDenied(err), check.Equals, true, check.Commentf("%v: %#v", role, err))
+	}
+
+	// clients without certificates can't connect
+	_, err = issuer.client(c, addr, "").GetLocalDomain()
+	c.Assert(err, check.NotNil)
+
+	// neither can clients with certificates of other CAs
+	_, err = newTestCertIssuer(c).client(c, addr, teleport.RoleNode).GetLocalDomain()
+	c.Assert(err, check.NotNil)
+
+	// nor plain HTTP clients
+	plain, err := auth.NewClient("http://" + addr)
+	c.Assert(err, check.IsNil)
+	_, err = plain.GetLocalDomain()
+	c.Assert(err, check.NotNil)
+}
+
+func (s *ServiceTestSuite) TestAuthWithoutTunnel(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	addr := listener.Addr().String()
+	c.Assert(listener.Close(), check.IsNil)
+
+	issuer := newTestCertIssuer(c)
+	issuer.issue(c, "server", "", []net.IP{net.ParseIP("127.0.0.1")})
+
+	cfg := MakeDefaultConfig()
+	cfg.DataDir = c.MkDir()
+	cfg.ConfigureBolt(cfg.DataDir)
+	cfg.Console = ioutil.Discard
+	cfg.SSH.Enabled = false
+	cfg.Proxy.Enabled = false
+	cfg.Auth.TunnelEnabled = false
+	cfg.Auth.HTTPAddr = utils.NetAddr{AddrNetwork: "tcp", Addr: addr}
+	cfg.Auth.HTTPTLSCert = issuer.path("server.crt")
+	cfg.Auth.HTTPTLSKey = issuer.path("server.key")
+	cfg.Auth.HTTPClientCAFile = issuer.path("ca.crt")
+	supervisor, err := NewTeleport(cfg)
+	c.Assert(err, check.IsNil)
+	process := supervisor.(*TeleportProcess)
+	c.Assert(process.Start(), check.IsNil)
+
+	// the auth server still announces itself, with the HTTPS address
+	presence := services.NewPresenceService(process.getAuthBackend())
+	for i := 0; ; i++ {
+		servers, err := presence.GetAuthServers()
+		c.Assert(err, check.IsNil)
+		if len(servers) == 1 {
+			c.Assert(servers[0].ID, check.Equals, cfg.HostUUID)
+			c.Assert(servers[0].Addr, check.Equals, addr)
+			break
+		}
+		if i == 50 {
+			c.Fatalf("auth server did not announce itself")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *ServiceTestSuite) TestRotateHostKeys(c *check.C) {
+	dataDir := c.MkDir()
+	bk, err := boltbk.New(filepath.Join(dataDir, "keys.db"))
+	c.Assert(err, check.IsNil)
+	defer bk.Close()
+	authServer, _, err := auth.Init(auth.InitConfig{
+		Backend:    bk,
+		Authority:  testauthority.New(),
+		DomainName: "example.com",
+		HostUUID:   "auth",
+		DataDir:    dataDir,
+	})
+	c.Assert(err, check.IsNil)
+
+	cfg := MakeDefaultConfig()
+	cfg.DataDir = dataDir
+	cfg.HostUUID = "node"
+	cfg.SSH.HostKeyRotationPeriod = 10 * time.Millisecond
+	id := auth.IdentityID{Role: teleport.RoleNode, HostUUID: cfg.HostUUID}
+	c.Assert(auth.LocalRegister(dataDir, id, authServer), check.IsNil)
+	old, err := auth.ReadIdentity(dataDir, id)
+	c.Assert(err, check.IsNil)
+
+	process := &TeleportProcess{Config: cfg, Supervisor: NewSupervisor()}
+	signersC := make(chan ssh.Signer, 10)
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go process.rotateHostKeys(authServer, func(signer ssh.Signer) error {
+		signersC <- signer
+		return nil
+	}, stopC)
+
+	var signer ssh.Signer
+	select {
+	case signer = <-signersC:
+	case <-time.After(10 * time.Second):
+		c.Fatalf("host keys were not rotated")
+	}
+
+	// the SSH server gets the key that is on disk now
+	identity, err := auth.ReadIdentity(dataDir, id)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(identity.KeyBytes), check.Not(check.Equals), string(old.KeyBytes))
+	c.Assert(signer.PublicKey().Marshal(), check.DeepEquals, identity.KeySigner.PublicKey().Marshal())
+
+	ca, err := authServer.GetCertAuthority(services.CertAuthID{Type: services.HostCA, DomainName: "example.com"}, false)
+	c.Assert(err, check.IsNil)
+	checkers, err := ca.Checkers()
+	c.Assert(err, check.IsNil)
+	checker := ssh.CertChecker{IsAuthority: func(key ssh.PublicKey) bool {
+		return len(checkers) == 1 && string(checkers[0].Marshal()) == string(key.Marshal())
+	}}
+	c.Assert(checker.CheckCert("node.example.com", identity.Cert), check.IsNil)
+}
+
+func (s *ServiceTestSuite) TestCheckAuthListeners(c *check.C) {
+	cfg := MakeDefaultConfig()
+	c.Assert(cfg.Auth.CheckListeners(), check.IsNil)
+
+	// the API has to be reachable one way or another
+	cfg.Auth.TunnelEnabled = false
+	c.Assert(teleport.IsBadParameter(cfg.Auth.CheckListeners()), check.Equals, true)
+	cfg.Auth.HTTPAddr = utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:3026"}
+
+	// the HTTP listener is served only over HTTPS with client certificates
+	c.Assert(teleport.IsBadParameter(cfg.Auth.CheckListeners()), check.Equals, true)
+	cfg.Auth.HTTPTLSCert = "/etc/teleport/auth.crt"
+	c.Assert(teleport.IsBadParameter(cfg.Auth.CheckListeners()), check.Equals, true)
+	cfg.Auth.HTTPTLSKey = "/etc/teleport/auth.key"
+	c.Assert(teleport.IsBadParameter(cfg.Auth.CheckListeners()), check.Equals, true)
+	cfg.Auth.HTTPClientCAFile = "/etc/teleport/clients.crt"
+	c.Assert(cfg.Auth.CheckListeners(), check.IsNil)
+}
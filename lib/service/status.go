@@ -0,0 +1,224 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/metrics"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/srv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/roundtrip"
+	"github.com/gravitational/trace"
+)
+
+// Status is an operational state of a running teleport process
+// reported by the diagnostic endpoint
+type Status struct {
+	// HostUUID is a unique ID of this host
+	HostUUID string `json:"host_uuid"`
+	// Hostname is a name of this host
+	Hostname string `json:"hostname"`
+	// Roles is a list of roles this process runs
+	Roles []string `json:"roles"`
+	// StartedAt is the time the process has started
+	StartedAt time.Time `json:"started_at"`
+	// Uptime is a number of seconds since the process has started
+	Uptime int64 `json:"uptime"`
+	// Connections is a number of active connections per metric
+	Connections map[string]int64 `json:"connections"`
+	// Backend is a state of the storage backend, set only if
+	// this process runs auth service
+	Backend *BackendStatus `json:"backend,omitempty"`
+	// AuthServers is the auth server each role is currently
+	// connected to, e.g. {"node": "10.0.0.1:3025"}
+	AuthServers map[string]string `json:"auth_servers,omitempty"`
+	// DataDirUsage is a size in bytes of databases in the data dir
+	// and of the whole data dir, see DataDirUsage
+	DataDirUsage map[string]int64 `json:"data_dir_usage,omitempty"`
+	// CommandLabels are command labels of the node with their last
+	// results and schedule, set only if this process runs a node
+	CommandLabels []srv.CommandLabelStatus `json:"command_labels,omitempty"`
+	// Limiters are the effective connection and rate limits of each role
+	// with the defaults applied, e.g. {"node": {"MaxConnections": 100, ...}}
+	Limiters map[string]limiter.LimiterConfig `json:"limiters,omitempty"`
+	// CARotation is a rotation state of each local certificate
+	// authority, set only if this process runs auth service
+	CARotation map[services.CertAuthType]*auth.RotationStatus `json:"ca_rotation,omitempty"`
+}
+
+// DataDirUsageTotal is a key of the data dir size in the usage report
+const DataDirUsageTotal = "total"
+
+// DataDirUsage returns sizes in bytes of bolt databases in the data dir,
+// databases that don't exist are omitted, and the total size of all files
+// in the data dir under DataDirUsageTotal key
+func DataDirUsage(dataDir string) (map[string]int64, error) {
+	usage := map[string]int64{DataDirUsageTotal: 0}
+	for _, name := range []string{defaults.EventsBoltFile, defaults.KeysBoltFile, defaults.RecordsBoltFile} {
+		fi, err := os.Stat(filepath.Join(dataDir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, trace.Wrap(err)
+		}
+		usage[name] = fi.Size()
+	}
+	err := filepath.Walk(dataDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if fi.Mode().IsRegular() {
+			usage[DataDirUsageTotal] += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return usage, nil
+}
+
+// BackendStatus is a state of the storage backend
+type BackendStatus struct {
+	// Type is a backend type, e.g. bolt or etcd
+	Type string `json:"type"`
+	// Healthy is true if backend has responded to a request
+	Healthy bool `json:"healthy"`
+	// ReadOnly is true if backend serves reads, but rejects writes,
+	// e.g. etcd that has lost quorum
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Error is set if backend is not healthy
+	Error string `json:"error,omitempty"`
+}
+
+// GetStatus returns the current status of this process
+func (process *TeleportProcess) GetStatus() Status {
+	cfg := process.Config
+	status := Status{
+		HostUUID:  cfg.HostUUID,
+		Hostname:  cfg.Hostname,
+		Roles:     []string{},
+		StartedAt: process.startedAt,
+		Uptime:    int64(time.Now().Sub(process.startedAt) / time.Second),
+		Connections: map[string]int64{
+			metrics.SSHSessions.Name():      metrics.SSHSessions.Total(),
+			metrics.AuthRequests.Name():     metrics.AuthRequests.Total(),
+			metrics.ProxyConnections.Name(): metrics.ProxyConnections.Total(),
+		},
+	}
+	status.Limiters = make(map[string]limiter.LimiterConfig)
+	if cfg.Auth.Enabled {
+		status.Roles = append(status.Roles, defaults.RoleAuthService)
+		status.Limiters[defaults.RoleAuthService] = cfg.Auth.Limiter.Effective()
+	}
+	if cfg.SSH.Enabled {
+		status.Roles = append(status.Roles, defaults.RoleNode)
+		status.Limiters[defaults.RoleNode] = cfg.SSH.Limiter.Effective()
+	}
+	if cfg.Proxy.Enabled {
+		status.Roles = append(status.Roles, defaults.RoleProxy)
+		status.Limiters[defaults.RoleProxy] = cfg.Proxy.Limiter.Effective()
+	}
+	status.AuthServers = process.getAuthServers()
+	if b := process.getAuthBackend(); b != nil {
+		status.Backend = checkBackend(cfg.Auth.KeysBackend.Type, b)
+	}
+	if a := process.getLocalAuth(); a != nil {
+		status.CARotation = caRotationStatus(a)
+	}
+	if s := process.getSSHServer(); s != nil {
+		status.CommandLabels = s.GetCommandLabelsStatus()
+	}
+	if cfg.DataDir != "" {
+		usage, err := process.getDataDirUsage()
+		if err != nil {
+			log.Warningf("failed to get usage of data dir %v: %v", cfg.DataDir, err)
+		} else {
+			status.DataDirUsage = usage
+		}
+	}
+	return status
+}
+
+// getDataDirUsage returns the data dir usage measured at most
+// defaults.DataDirUsageTTL ago, walking a large data dir on every
+// status request would be too expensive
+func (process *TeleportProcess) getDataDirUsage() (map[string]int64, error) {
+	process.usageMutex.Lock()
+	defer process.usageMutex.Unlock()
+	if process.dataDirUsage == nil || time.Now().Sub(process.dataDirUsageAt) >= defaults.DataDirUsageTTL {
+		usage, err := DataDirUsage(process.Config.DataDir)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		process.dataDirUsage = usage
+		process.dataDirUsageAt = time.Now()
+	}
+	usage := make(map[string]int64, len(process.dataDirUsage))
+	for name, size := range process.dataDirUsage {
+		usage[name] = size
+	}
+	return usage, nil
+}
+
+// caRotationStatus returns rotation state of the local certificate
+// authorities, authorities that failed to report it are omitted
+func caRotationStatus(a *auth.AuthServer) map[services.CertAuthType]*auth.RotationStatus {
+	rotation := make(map[services.CertAuthType]*auth.RotationStatus)
+	for _, caType := range []services.CertAuthType{services.HostCA, services.UserCA} {
+		status, err := a.CARotationStatus(caType)
+		if err != nil {
+			log.Warningf("failed to get rotation status of %v authority: %v", caType, err)
+			continue
+		}
+		rotation[caType] = status
+	}
+	return rotation
+}
+
+// checkBackend makes a read request to the backend to see if it's healthy
+func checkBackend(backendType string, b backend.Backend) *BackendStatus {
+	status := &BackendStatus{Type: backendType, Healthy: true}
+	if _, err := b.GetKeys([]string{"tokens"}); err != nil {
+		status.Healthy = false
+		status.Error = err.Error()
+		return status
+	}
+	if checker, ok := b.(backend.HealthChecker); ok {
+		if err := checker.Degraded(); err != nil {
+			status.ReadOnly = true
+			status.Error = err.Error()
+		}
+	}
+	return status
+}
+
+// serveStatus serves process status in JSON format
+func (process *TeleportProcess) serveStatus(w http.ResponseWriter, r *http.Request) {
+	roundtrip.ReplyJSON(w, http.StatusOK, process.GetStatus())
+}
@@ -23,9 +23,51 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/gravitational/teleport"
+
 	"github.com/gravitational/trace"
 )
 
+// HostFacts are the values available to static label templates,
+// e.g. "{{.Hostname}}"
+type HostFacts struct {
+	// Hostname is a name of this host
+	Hostname string
+	// AdvertiseIP is an IP address this host advertises, if set
+	AdvertiseIP string
+	// HostUUID is a unique ID of this host in the cluster
+	HostUUID string
+	// OS is an operating system of this host, e.g. "linux"
+	OS string
+}
+
+// ExpandLabels renders static label values that are Go templates with
+// the host facts, values without "{{" are returned as is
+func ExpandLabels(labels map[string]string, facts HostFacts) (map[string]string, error) {
+	if labels == nil {
+		return nil, nil
+	}
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if !strings.Contains(v, "{{") {
+			out[k] = v
+			continue
+		}
+		t, err := template.New(k).Parse(v)
+		if err != nil {
+			return nil, trace.Wrap(teleport.BadParameter("labels",
+				fmt.Sprintf("failed to parse label '%v': %v", k, err)))
+		}
+		buf := &bytes.Buffer{}
+		if err := t.Execute(buf, facts); err != nil {
+			return nil, trace.Wrap(teleport.BadParameter("labels",
+				fmt.Sprintf("failed to expand label '%v': %v", k, err)))
+		}
+		out[k] = buf.String()
+	}
+	return out, nil
+}
+
 func renderTemplate(data []byte) ([]byte, error) {
 	t, err := template.New("tpl").Parse(string(data))
 	if err != nil {
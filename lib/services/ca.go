@@ -111,6 +111,36 @@ func (s *CAService) UpsertCertAuthority(ca CertAuthority, ttl time.Duration) err
 	return nil
 }
 
+// ReplaceCertAuthorities replaces all certificate authorities of the
+// given type with cas in a single transaction, so authorities missing
+// from cas are removed. The backend has to implement backend.BucketReplacer
+func (s *CAService) ReplaceCertAuthorities(caType CertAuthType, cas []CertAuthority) error {
+	if err := caType.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	replacer, ok := s.backend.(backend.BucketReplacer)
+	if !ok {
+		return trace.Wrap(teleport.BadParameter("backend",
+			fmt.Sprintf("%T does not support replacing authorities", s.backend)))
+	}
+	vals := make(map[string][]byte, len(cas))
+	for _, ca := range cas {
+		if err := ca.Check(); err != nil {
+			return trace.Wrap(err)
+		}
+		if ca.Type != caType {
+			return trace.Wrap(teleport.BadParameter("type",
+				fmt.Sprintf("expected %v authority, got %v for %v", caType, ca.Type, ca.DomainName)))
+		}
+		out, err := json.Marshal(ca)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		vals[ca.DomainName] = out
+	}
+	return trace.Wrap(replacer.ReplaceBucket([]string{"authorities", string(caType)}, vals, backend.Forever))
+}
+
 // DeleteCertAuthority deletes particular certificate authority
 func (s *CAService) DeleteCertAuthority(id CertAuthID) error {
 	if err := id.Check(); err != nil {
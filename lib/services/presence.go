@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -206,6 +207,45 @@ type CommandLabel struct {
 	Command []string `json:"command"` //["/usr/bin/hostname", "--long"]
 	// Result captures standard output
 	Result string `json:"result"`
+	// User is an OS user to run the command as, the command runs
+	// as the teleport process user if it's empty
+	User string `json:"user,omitempty"`
+	// ExitCodes maps command exit codes to label values, "*" matches
+	// any code. Stdout is used as a value if it's empty
+	ExitCodes map[string]string `json:"exit_codes,omitempty"`
+	// CaptureStderr merges standard error into the captured output
+	CaptureStderr bool `json:"capture_stderr,omitempty"`
+	// StableRuns is a number of consecutive runs a changed value has
+	// to be produced by before it replaces the current one, every
+	// change is published right away if it's 0 or 1
+	StableRuns int `json:"stable_runs,omitempty"`
+}
+
+// AnyExitCode matches any exit code in CommandLabel.ExitCodes
+const AnyExitCode = "*"
+
+// CheckExitCodes checks that exit code mapping keys are either
+// integer exit codes or "*"
+func (c *CommandLabel) CheckExitCodes() error {
+	for code := range c.ExitCodes {
+		if code == AnyExitCode {
+			continue
+		}
+		if _, err := strconv.Atoi(code); err != nil {
+			return trace.Wrap(teleport.BadParameter("exit_codes",
+				fmt.Sprintf("expected an exit code or %q, got %q", AnyExitCode, code)))
+		}
+	}
+	return nil
+}
+
+// ExitCodeResult returns a label value mapped to the exit code
+func (c *CommandLabel) ExitCodeResult(code int) (string, bool) {
+	if value, ok := c.ExitCodes[strconv.Itoa(code)]; ok {
+		return value, true
+	}
+	value, ok := c.ExitCodes[AnyExitCode]
+	return value, ok
 }
 
 // CommandLabels is a set of command labels
@@ -60,3 +60,21 @@ func (s *PresenceSuite) TestServerLabels(c *check.C) {
 	c.Assert(server.MatchAgainst(map[string]string{"time": "now"}), check.Equals, true)
 	c.Assert(server.MatchAgainst(map[string]string{"time": "now", "role": "database"}), check.Equals, true)
 }
+
+func (s *PresenceSuite) TestCommandLabelExitCodes(c *check.C) {
+	label := CommandLabel{ExitCodes: map[string]string{"0": "healthy", "2": "degraded", "*": "unhealthy"}}
+	c.Assert(label.CheckExitCodes(), check.IsNil)
+	for code, expected := range map[int]string{0: "healthy", 2: "degraded", 1: "unhealthy", 127: "unhealthy"} {
+		value, ok := label.ExitCodeResult(code)
+		c.Assert(ok, check.Equals, true)
+		c.Assert(value, check.Equals, expected)
+	}
+
+	// no wildcard leaves unmapped codes alone
+	label = CommandLabel{ExitCodes: map[string]string{"0": "healthy"}}
+	_, ok := label.ExitCodeResult(1)
+	c.Assert(ok, check.Equals, false)
+
+	label = CommandLabel{ExitCodes: map[string]string{"ok": "healthy"}}
+	c.Assert(label.CheckExitCodes(), check.NotNil)
+}
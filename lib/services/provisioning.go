@@ -19,11 +19,14 @@ package services
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"sort"
 	"time"
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/lib/backend"
 	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/gravitational/trace"
 )
@@ -40,12 +43,32 @@ func NewProvisioningService(backend backend.Backend) *ProvisioningService {
 
 // UpsertToken adds provisioning tokens for the auth server
 func (s *ProvisioningService) UpsertToken(token, role string, ttl time.Duration) error {
+	return s.UpsertTokenWithUses(token, role, ttl, 0)
+}
+
+// UpsertTokenWithUses adds provisioning token that can be used to register
+// up to maxUses servers, zero means the token can be used only once
+func (s *ProvisioningService) UpsertTokenWithUses(token, role string, ttl time.Duration, maxUses int) error {
+	return s.UpsertTokenWithSources(token, role, ttl, maxUses, nil)
+}
+
+// UpsertTokenWithSources adds provisioning token that can only be used
+// from the given networks, the token can be used from anywhere if sources
+// is empty
+func (s *ProvisioningService) UpsertTokenWithSources(token, role string, ttl time.Duration, maxUses int, sources []net.IPNet) error {
 	if ttl < time.Second || ttl > defaults.MaxProvisioningTokenTTL {
 		ttl = defaults.MaxProvisioningTokenTTL
 	}
+	if maxUses < 0 {
+		return trace.Wrap(teleport.BadParameter("maxUses", "max uses can't be negative"))
+	}
 
 	t := ProvisionToken{
-		Role: role,
+		Role:    role,
+		MaxUses: maxUses,
+	}
+	for _, network := range sources {
+		t.AllowedSources = append(t.AllowedSources, network.String())
 	}
 	out, err := json.Marshal(t)
 	if err != nil {
@@ -74,6 +97,72 @@ func (s *ProvisioningService) GetToken(token string) (*ProvisionToken, error) {
 	return t, nil
 }
 
+// GetTokens returns all provisioning tokens that haven't expired yet,
+// Token field of every returned token is set to its id
+func (s *ProvisioningService) GetTokens() ([]ProvisionToken, error) {
+	keys, err := s.backend.GetKeys([]string{"tokens"})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sort.Strings(keys)
+	tokens := make([]ProvisionToken, 0, len(keys))
+	for _, key := range keys {
+		t, err := s.GetToken(key)
+		if err != nil {
+			// token could have expired since we've got the keys
+			if teleport.IsNotFound(err) {
+				continue
+			}
+			return nil, trace.Wrap(err)
+		}
+		t.Token = key
+		tokens = append(tokens, *t)
+	}
+	return tokens, nil
+}
+
+// UseToken registers one use of the token and returns the token as it was
+// before the use. The token is deleted once all its uses are exhausted.
+// Uses are counted with compare and swap, so concurrent registrations
+// can't use the token more times than it allows
+func (s *ProvisioningService) UseToken(token string) (*ProvisionToken, error) {
+	for {
+		prev, ttl, err := s.backend.GetValAndTTL([]string{"tokens"}, token)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		var t ProvisionToken
+		if err := json.Unmarshal(prev, &t); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		t.TTL = ttl
+		if t.Uses >= t.maxUses() {
+			return nil, trace.Wrap(teleport.NotFound("token has been used up"))
+		}
+		used := t
+		used.Uses++
+		out, err := json.Marshal(used)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		_, err = s.backend.CompareAndSwap([]string{"tokens"}, token, out, ttl, prev)
+		if err != nil {
+			if teleport.IsCompareFailed(err) {
+				// somebody else has used the token, try again
+				continue
+			}
+			return nil, trace.Wrap(err)
+		}
+		if used.Uses >= used.maxUses() {
+			err := s.DeleteToken(token)
+			if err != nil && !teleport.IsNotFound(err) {
+				return nil, trace.Wrap(err)
+			}
+		}
+		return &t, nil
+	}
+}
+
 func (s *ProvisioningService) DeleteToken(token string) error {
 	err := s.backend.DeleteKey([]string{"tokens"}, token)
 	return err
@@ -104,8 +193,42 @@ func SplitTokenRole(outputToken string) (token, role string, e error) {
 
 // ProvisionToken stores metadata about some provisioning token
 type ProvisionToken struct {
-	Role string        `json:"role"`
-	TTL  time.Duration `json:"-"`
+	// Token is a token id, it is only set when listing tokens
+	Token string        `json:"token,omitempty"`
+	Role  string        `json:"role"`
+	TTL   time.Duration `json:"-"`
+	// MaxUses is a number of servers the token can register,
+	// zero means the token can be used only once
+	MaxUses int `json:"max_uses,omitempty"`
+	// Uses is a number of servers registered with this token so far
+	Uses int `json:"uses,omitempty"`
+	// AllowedSources is a list of networks in CIDR notation the token
+	// can be used from, it can be used from anywhere if it's empty
+	AllowedSources []string `json:"allowed_sources,omitempty"`
+}
+
+// CheckSource returns AccessDenied if the token is restricted to some
+// networks and the address is not in any of them
+func (t *ProvisionToken) CheckSource(addr net.Addr) error {
+	if len(t.AllowedSources) == 0 {
+		return nil
+	}
+	networks, err := utils.ParseCIDRs(t.AllowedSources)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if addr == nil || !utils.AddrInNetworks(addr, networks) {
+		return trace.Wrap(teleport.AccessDenied(
+			fmt.Sprintf("token can't be used from %v", addr)))
+	}
+	return nil
+}
+
+func (t *ProvisionToken) maxUses() int {
+	if t.MaxUses == 0 {
+		return 1
+	}
+	return t.MaxUses
 }
 
 const (
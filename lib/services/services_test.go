@@ -91,3 +91,35 @@ func (s *BoltSuite) TestLocking(c *C) {
 func (s *BoltSuite) TestToken(c *C) {
 	s.suite.TokenCRUD(c)
 }
+
+func (s *BoltSuite) TestReplaceCertAuthorities(c *C) {
+	ca := NewCAService(s.bk)
+	a := *NewTestCA(HostCA, "a.example.com")
+	b := *NewTestCA(HostCA, "b.example.com")
+	user := *NewTestCA(UserCA, "a.example.com")
+	c.Assert(ca.UpsertCertAuthority(user, 0), IsNil)
+
+	c.Assert(ca.ReplaceCertAuthorities(HostCA, []CertAuthority{a, b}), IsNil)
+	cas, err := ca.GetCertAuthorities(HostCA)
+	c.Assert(err, IsNil)
+	c.Assert(cas, HasLen, 2)
+
+	// removed authority is forgotten
+	c.Assert(ca.ReplaceCertAuthorities(HostCA, []CertAuthority{b}), IsNil)
+	cas, err = ca.GetCertAuthorities(HostCA)
+	c.Assert(err, IsNil)
+	c.Assert(cas, HasLen, 1)
+	c.Assert(cas[0].DomainName, Equals, "b.example.com")
+
+	// other types are not affected
+	cas, err = ca.GetCertAuthorities(UserCA)
+	c.Assert(err, IsNil)
+	c.Assert(cas, HasLen, 1)
+
+	// authorities of a different type are rejected
+	err = ca.ReplaceCertAuthorities(HostCA, []CertAuthority{user})
+	c.Assert(err, NotNil)
+	cas, err = ca.GetCertAuthorities(HostCA)
+	c.Assert(err, IsNil)
+	c.Assert(cas, HasLen, 1)
+}
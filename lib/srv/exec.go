@@ -33,6 +33,7 @@ import (
 	"syscall"
 
 	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/trace"
 
@@ -100,7 +101,7 @@ func getLoginShell(username string) (string, error) {
 	}
 	// func to determine user shell on other unixes (linux)
 	forUnix := func() (string, error) {
-		f, err := os.Open("/etc/passwd")
+		f, err := os.Open(passwdFile)
 		if err != nil {
 			return "", trace.Wrap(err)
 		}
@@ -124,6 +125,57 @@ func getLoginShell(username string) (string, error) {
 	}
 }
 
+// passwdFile is a path to the passwd database, tests override it
+var passwdFile = "/etc/passwd"
+
+// getShell returns a shell for sessions of the given OS user: the login
+// shell if useLoginShell is set and the lookup succeeds, or the default
+// shell otherwise
+func getShell(username string, useLoginShell bool, defaultShell string) string {
+	if defaultShell == "" {
+		defaultShell = defaults.DefaultShell
+	}
+	if !useLoginShell {
+		return defaultShell
+	}
+	shell, err := getLoginShell(username)
+	if err != nil {
+		log.Warningf("failed to look up login shell of %v, using %v: %v", username, defaultShell, err)
+		return defaultShell
+	}
+	if shell == "" {
+		log.Warningf("%v has no login shell, using %v", username, defaultShell)
+		return defaultShell
+	}
+	return shell
+}
+
+// CheckShell makes sure the shell is an absolute path to an executable
+// regular file, so a bad shell is reported on start and not when the
+// first session fails
+func CheckShell(shell string) error {
+	if !filepath.IsAbs(shell) {
+		return trace.Wrap(teleport.BadParameter("shell",
+			fmt.Sprintf("shell '%v' should be an absolute path", shell)))
+	}
+	fi, err := os.Stat(shell)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return trace.Wrap(teleport.NotFound(fmt.Sprintf("shell '%v' does not exist", shell)))
+		}
+		return trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	if !fi.Mode().IsRegular() {
+		return trace.Wrap(teleport.BadParameter("shell",
+			fmt.Sprintf("shell '%v' is not a regular file", shell)))
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return trace.Wrap(teleport.BadParameter("shell",
+			fmt.Sprintf("shell '%v' is not executable", shell)))
+	}
+	return nil
+}
+
 // prepareOSCommand configures os.Cmd for executing a given command within an SSH
 // session.
 //
@@ -150,10 +202,11 @@ func prepareOSCommand(ctx *ctx, args ...string) (*exec.Cmd, error) {
 	}
 
 	// determine shell for the given OS user:
-	shellCommand, err := getLoginShell(osUserName)
-	if err != nil {
-		log.Error(err)
-		return nil, trace.Wrap(err)
+	var shellCommand string
+	if ctx.srv != nil {
+		shellCommand = getShell(osUserName, ctx.srv.useLoginShell, ctx.srv.shell)
+	} else {
+		shellCommand = getShell(osUserName, true, "")
 	}
 	// in test mode short-circuit to /bin/sh
 	if ctx.isTestStub {
@@ -18,9 +18,14 @@ package srv
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/user"
+	"path/filepath"
 
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/utils"
 	"gopkg.in/check.v1"
 	//	"golang.org/x/crypto/ssh"
@@ -59,6 +64,52 @@ func (s *ExecSuite) TestGetShell(c *check.C) {
 	c.Assert(err.Error(), check.Matches, ".*cannot determine shell for.*")
 }
 
+func (s *ExecSuite) TestUseLoginShell(c *check.C) {
+	path := filepath.Join(c.MkDir(), "passwd")
+	err := ioutil.WriteFile(path, []byte(
+		"alice:x:1001:1001:Alice:/home/alice:/bin/zsh\n"+
+			"daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin\n"), 0644)
+	c.Assert(err, check.IsNil)
+	orig := passwdFile
+	passwdFile = path
+	defer func() { passwdFile = orig }()
+
+	// login shell from the passwd entry
+	c.Assert(getShell("alice", true, "/bin/sh"), check.Equals, "/bin/zsh")
+
+	// accounts without a login shell don't get the default shell
+	c.Assert(getShell("daemon", true, "/bin/sh"), check.Equals, "/usr/sbin/nologin")
+
+	// login shell is ignored if not enabled
+	c.Assert(getShell("alice", false, "/bin/sh"), check.Equals, "/bin/sh")
+
+	// unknown user falls back to the default shell
+	c.Assert(getShell("bob", true, "/bin/sh"), check.Equals, "/bin/sh")
+	c.Assert(getShell("bob", true, ""), check.Equals, defaults.DefaultShell)
+}
+
+func (s *ExecSuite) TestCheckShell(c *check.C) {
+	dir := c.MkDir()
+	shell := filepath.Join(dir, "shell")
+	c.Assert(ioutil.WriteFile(shell, []byte("#!/bin/sh\n"), 0755), check.IsNil)
+	c.Assert(CheckShell(shell), check.IsNil)
+
+	err := CheckShell(filepath.Join(dir, "missing"))
+	c.Assert(teleport.IsNotFound(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*does not exist.*")
+
+	c.Assert(os.Chmod(shell, 0644), check.IsNil)
+	err = CheckShell(shell)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*not executable.*")
+
+	err = CheckShell(dir)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*not a regular file.*")
+
+	c.Assert(teleport.IsBadParameter(CheckShell("bash")), check.Equals, true)
+}
+
 func (s *ExecSuite) TestOSCommandPrep(c *check.C) {
 	expectedEnv := []string{
 		"TERM=xterm",
@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"os"
+	"os/user"
+	"sync"
+
+	"github.com/gravitational/teleport/lib/services"
+
+	. "gopkg.in/check.v1"
+)
+
+type LabelsSuite struct {
+}
+
+var _ = Suite(&LabelsSuite{})
+
+func (s *LabelsSuite) TestCommandUser(c *C) {
+	if os.Geteuid() != 0 {
+		c.Skip("dropping privileges requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		c.Skip("no 'nobody' user on this host")
+	}
+
+	srv := &Server{cmdLabels: map[string]services.CommandLabel{}, labelsMutex: &sync.Mutex{}}
+	srv.updateLabel("uid", services.CommandLabel{Command: []string{"id", "-u"}, User: "nobody"})
+	c.Assert(srv.getCommandLabels()["uid"].Result, Equals, nobody.Uid)
+
+	srv.updateLabel("gid", services.CommandLabel{Command: []string{"id", "-g"}, User: "nobody"})
+	c.Assert(srv.getCommandLabels()["gid"].Result, Equals, nobody.Gid)
+
+	// the command doesn't get the environment of the process
+	c.Assert(os.Setenv("TELEPORT_KEY_PASSPHRASE", "secret"), IsNil)
+	defer os.Unsetenv("TELEPORT_KEY_PASSPHRASE")
+	srv.updateLabel("env", services.CommandLabel{Command: []string{"/usr/bin/env"}, User: "nobody"})
+	env := srv.getCommandLabels()["env"].Result
+	c.Assert(env, Not(Matches), "(?s).*TELEPORT_KEY_PASSPHRASE.*")
+	c.Assert(env, Matches, "(?s).*USER=nobody.*")
+	c.Assert(env, Matches, "(?s).*PATH=.*")
+
+	srv.updateLabel("pwd", services.CommandLabel{Command: []string{"/bin/pwd"}, User: "nobody"})
+	dir := nobody.HomeDir
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		dir = "/"
+	}
+	c.Assert(srv.getCommandLabels()["pwd"].Result, Equals, dir)
+
+	// without a user the command runs as the process user
+	srv.updateLabel("uid", services.CommandLabel{Command: []string{"id", "-u"}})
+	c.Assert(srv.getCommandLabels()["uid"].Result, Equals, "0")
+
+	// unknown user is reported in the label
+	srv.updateLabel("uid", services.CommandLabel{Command: []string{"id", "-u"}, User: "no-such-user-xyz"})
+	c.Assert(srv.getCommandLabels()["uid"].Result, Matches, ".*no-such-user-xyz.*")
+}
@@ -276,9 +276,17 @@ func (s *session) startShell(sconn *ssh.ServerConn, ch ssh.Channel, ctx *ctx) er
 		ctx.Errorf("shell command failed: %v", err)
 		return teleport.ConvertSystemError(trace.Wrap(err))
 	}
+	if s.registry.srv.motd != nil {
+		motd, err := s.registry.srv.renderMOTD(ctx.login)
+		if err != nil {
+			ctx.Errorf("failed to render motd: %v", err)
+		} else if _, err := io.WriteString(ch, motd); err != nil {
+			ctx.Errorf("failed to write motd: %v", err)
+		}
+	}
 	// start recording the session (if enabled)
 	sessionRecorder := s.registry.srv.rec
-	if sessionRecorder != nil {
+	if sessionRecorder != nil && s.registry.srv.recordSessions {
 		w, err := newChunkWriter(string(s.id), s, sessionRecorder)
 		if err != nil {
 			p.ctx.Errorf("failed to create recorder: %v", err)
@@ -23,9 +23,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/gravitational/teleport"
@@ -33,6 +39,7 @@ import (
 	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/metrics"
 	"github.com/gravitational/teleport/lib/recorder"
 	"github.com/gravitational/teleport/lib/reversetunnel"
 	"github.com/gravitational/teleport/lib/services"
@@ -55,27 +62,71 @@ type Server struct {
 
 	addr          utils.NetAddr
 	hostname      string
-	certChecker   ssh.CertChecker
+	certChecker   sshutils.CertChecker
 	resolver      resolver
 	elog          events.Log
 	srv           *sshutils.Server
 	hostSigner    ssh.Signer
 	shell         string
+	useLoginShell bool
 	authService   auth.AccessPoint
 	reg           *sessionRegistry
 	sessionServer rsession.Service
 	rec           recorder.Recorder
 	limiter       *limiter.Limiter
 
+	// recordSessions turns writing of session recordings on or off
+	recordSessions bool
+
 	labels      map[string]string                //static server labels
 	cmdLabels   map[string]services.CommandLabel //dymanic server labels
 	labelsMutex *sync.Mutex
+	// labelRuns is a schedule of command labels, guarded by labelsMutex
+	labelRuns map[string]labelRun
 
 	proxyMode bool
 	proxyTun  reversetunnel.Server
 
 	advertiseIP net.IP
 
+	// version is an SSH version string sent to clients
+	version string
+
+	// motd is a message of the day template written to the terminal
+	// after the shell starts
+	motd *template.Template
+
+	// keepAliveInterval and keepAliveCountMax control keepalive
+	// requests sent to clients
+	keepAliveInterval time.Duration
+	keepAliveCountMax int
+
+	// heartbeatTTL is a TTL of presence records sent to the auth server
+	heartbeatTTL time.Duration
+
+	// handshakeTimeout is a time clients have to complete the SSH handshake
+	handshakeTimeout time.Duration
+
+	// clockSkew is a tolerated clock skew for certificate validity checks
+	clockSkew time.Duration
+
+	// reusePort binds the listening socket with SO_REUSEPORT
+	reusePort bool
+
+	// logConnections turns on logging of connection lifecycle events
+	logConnections bool
+
+	// recoverPanics turns on recovery from panics in request handlers
+	recoverPanics bool
+
+	// labelJitter is a maximum random delay before the first run of
+	// command labels
+	labelJitter time.Duration
+
+	// closeC is closed when the server is closed to stop label updates
+	closeC    chan struct{}
+	closeOnce sync.Once
+
 	// server UUID gets generated once on the first start and never changes
 	// usually stored in a file inside the data dir
 	uuid string
@@ -104,6 +155,91 @@ func SetShell(shell string) ServerOption {
 	}
 }
 
+// SetUseLoginShell makes sessions use the login shell of the OS user
+// from the passwd entry instead of the default shell, it's on by default.
+// The default shell is used if the login shell can't be determined
+func SetUseLoginShell(use bool) ServerOption {
+	return func(s *Server) error {
+		s.useLoginShell = use
+		return nil
+	}
+}
+
+// SetHeartbeatTTL sets a TTL of presence records sent to the auth server,
+// heartbeats are sent every half of the TTL. Zero keeps the default
+func SetHeartbeatTTL(ttl time.Duration) ServerOption {
+	return func(s *Server) error {
+		if ttl < 0 {
+			return trace.Wrap(teleport.BadParameter("heartbeat_ttl",
+				fmt.Sprintf("heartbeat TTL should be positive: %v", ttl)))
+		}
+		if ttl > 0 {
+			s.heartbeatTTL = ttl
+		}
+		return nil
+	}
+}
+
+// SetLabelJitter sets a maximum random delay before the first run
+// of command labels, zero disables the delay
+func SetLabelJitter(jitter time.Duration) ServerOption {
+	return func(s *Server) error {
+		if jitter < 0 {
+			return trace.Wrap(teleport.BadParameter("label_jitter",
+				fmt.Sprintf("label jitter can't be negative: %v", jitter)))
+		}
+		s.labelJitter = jitter
+		return nil
+	}
+}
+
+// SetHandshakeTimeout sets a time clients have to complete the SSH
+// handshake before the connection is dropped, zero keeps the default
+func SetHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) error {
+		s.handshakeTimeout = timeout
+		return nil
+	}
+}
+
+// SetReusePort binds the listening socket with SO_REUSEPORT, so another
+// process can listen on the same address
+func SetReusePort(reusePort bool) ServerOption {
+	return func(s *Server) error {
+		s.reusePort = reusePort
+		return nil
+	}
+}
+
+// SetConnectionLogging turns on logging of accepted, authenticated and
+// closed connections with the source IP and principal
+func SetConnectionLogging(enabled bool) ServerOption {
+	return func(s *Server) error {
+		s.logConnections = enabled
+		return nil
+	}
+}
+
+// SetPanicRecovery turns on recovery from panics in connection and
+// request handlers, a panic closes the channel it happened in
+func SetPanicRecovery(enabled bool) ServerOption {
+	return func(s *Server) error {
+		s.recoverPanics = enabled
+		return nil
+	}
+}
+
+// SetClockSkew sets a tolerated clock skew for certificate validity checks
+func SetClockSkew(skew time.Duration) ServerOption {
+	return func(s *Server) error {
+		if skew < 0 {
+			return trace.Wrap(teleport.BadParameter("clock_skew", "clock skew can't be negative"))
+		}
+		s.clockSkew = skew
+		return nil
+	}
+}
+
 // SetSessionServer represents realtime session registry server
 func SetSessionServer(srv rsession.Service) ServerOption {
 	return func(s *Server) error {
@@ -120,6 +256,15 @@ func SetRecorder(rec recorder.Recorder) ServerOption {
 	}
 }
 
+// SetRecordSessions turns session recording on or off, audit events
+// are emitted either way
+func SetRecordSessions(record bool) ServerOption {
+	return func(s *Server) error {
+		s.recordSessions = record
+		return nil
+	}
+}
+
 // SetProxyMode starts this server in SSH proxying mode
 func SetProxyMode(tsrv reversetunnel.Server) ServerOption {
 	return func(s *Server) error {
@@ -156,6 +301,61 @@ func SetLimiter(limiter *limiter.Limiter) ServerOption {
 	}
 }
 
+// SetVersion sets SSH version string this server reports to clients
+func SetVersion(version string) ServerOption {
+	return func(s *Server) error {
+		s.version = version
+		return nil
+	}
+}
+
+// SetKeepAlive makes the server send keepalive requests to clients every
+// interval and close connections after countMax requests left unanswered
+func SetKeepAlive(interval time.Duration, countMax int) ServerOption {
+	return func(s *Server) error {
+		s.keepAliveInterval = interval
+		s.keepAliveCountMax = countMax
+		return nil
+	}
+}
+
+// MOTDParams are the values available to the message of the day template
+type MOTDParams struct {
+	// Hostname is a name of this server
+	Hostname string
+	// Username is an OS login of the user
+	Username string
+}
+
+// SetMOTD sets a message of the day written to the terminal after the
+// shell starts. The message is a Go template rendered with MOTDParams
+func SetMOTD(motd string) ServerOption {
+	return func(s *Server) error {
+		if motd == "" {
+			s.motd = nil
+			return nil
+		}
+		t, err := template.New("motd").Parse(motd)
+		if err != nil {
+			return trace.Wrap(teleport.BadParameter("motd", fmt.Sprintf("failed to parse template: %v", err)))
+		}
+		s.motd = t
+		return nil
+	}
+}
+
+// renderMOTD renders the message of the day for the login, line endings
+// are converted to CRLF as the message bypasses the terminal
+func (s *Server) renderMOTD(login string) (string, error) {
+	buf := &bytes.Buffer{}
+	err := s.motd.Execute(buf, MOTDParams{Hostname: s.hostname, Username: login})
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	out := strings.Replace(buf.String(), "\r\n", "\n", -1)
+	return strings.Replace(out, "\n", "\r\n", -1), nil
+}
+
 // New returns an unstarted server
 func New(addr utils.NetAddr,
 	hostname string,
@@ -177,30 +377,67 @@ func New(addr utils.NetAddr,
 		resolver:    &backendResolver{authService: authService},
 		hostname:    hostname,
 		labelsMutex: &sync.Mutex{},
+		labelRuns:   make(map[string]labelRun),
 		advertiseIP: advertiseIP,
 		uuid:        uuid,
+
+		heartbeatTTL:   defaults.ServerHeartbeatTTL,
+		clockSkew:      defaults.ClockSkew,
+		recordSessions: true,
+		useLoginShell:  true,
+		labelJitter:    defaults.CommandLabelJitter,
+		closeC:         make(chan struct{}),
 	}
 	s.limiter, err = limiter.NewLimiter(limiter.LimiterConfig{})
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	s.certChecker = ssh.CertChecker{IsAuthority: s.isAuthority}
-
 	for _, o := range options {
 		if err := o(s); err != nil {
 			return nil, trace.Wrap(err)
 		}
 	}
+	s.certChecker = sshutils.CertChecker{
+		CertChecker: ssh.CertChecker{IsAuthority: s.isAuthority},
+		ClockSkew:   s.clockSkew,
+	}
 	s.reg = newSessionRegistry(s)
 	if s.elog == nil {
 		s.elog = events.NullEventLogger
 	}
 
+	// proxies and nodes report active connections in separate metrics
+	connGauge, connLabel := metrics.SSHSessions, teleport.RoleNode.String()
+	if s.proxyMode {
+		connGauge, connLabel = metrics.ProxyConnections, teleport.RoleProxy.String()
+	}
+
+	serverOpts := []sshutils.ServerOption{
+		sshutils.SetLimiter(s.limiter),
+		sshutils.SetRequestHandler(s),
+		sshutils.SetConnectionGauge(connGauge, connLabel),
+		sshutils.SetReusePort(s.reusePort),
+	}
+	if s.version != "" {
+		serverOpts = append(serverOpts, sshutils.SetVersion(s.version))
+	}
+	if s.keepAliveInterval > 0 {
+		serverOpts = append(serverOpts, sshutils.SetKeepAlive(s.keepAliveInterval, s.keepAliveCountMax))
+	}
+	if s.handshakeTimeout != 0 {
+		serverOpts = append(serverOpts, sshutils.SetHandshakeTimeout(s.handshakeTimeout))
+	}
+	if s.logConnections {
+		serverOpts = append(serverOpts, sshutils.SetConnectionLogging(s.component()))
+	}
+	if s.recoverPanics {
+		serverOpts = append(serverOpts, sshutils.SetPanicRecovery(s.component()))
+	}
+
 	srv, err := sshutils.NewServer(
 		addr, s, signers,
 		sshutils.AuthMethods{PublicKey: s.keyAuth},
-		sshutils.SetLimiter(s.limiter),
-		sshutils.SetRequestHandler(s))
+		serverOpts...)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -208,15 +445,17 @@ func New(addr utils.NetAddr,
 	return s, nil
 }
 
-func (s *Server) logFields(fields map[string]interface{}) log.Fields {
-	var component string
+// component returns the name of this server in logs
+func (s *Server) component() string {
 	if s.proxyMode {
-		component = teleport.ComponentProxy
-	} else {
-		component = teleport.ComponentNode
+		return teleport.ComponentProxy
 	}
+	return teleport.ComponentNode
+}
+
+func (s *Server) logFields(fields map[string]interface{}) log.Fields {
 	return log.Fields{
-		teleport.Component:       component,
+		teleport.Component:       s.component(),
 		teleport.ComponentFields: fields,
 	}
 }
@@ -264,9 +503,9 @@ func (s *Server) registerServer() error {
 		CmdLabels: s.getCommandLabels(),
 	}
 	if !s.proxyMode {
-		return trace.Wrap(s.authService.UpsertNode(srv, defaults.ServerHeartbeatTTL))
+		return trace.Wrap(s.authService.UpsertNode(srv, s.heartbeatTTL))
 	}
-	return trace.Wrap(s.authService.UpsertProxy(srv, defaults.ServerHeartbeatTTL))
+	return trace.Wrap(s.authService.UpsertProxy(srv, s.heartbeatTTL))
 }
 
 // heartbeatPresence periodically calls into the auth server to let everyone
@@ -276,7 +515,7 @@ func (s *Server) heartbeatPresence() {
 		if err := s.registerServer(); err != nil {
 			log.Warningf("failed to announce %#v presence: %v", s, err)
 		}
-		sleepTime := defaults.ServerHeartbeatTTL/2 + utils.RandomDuration(defaults.ServerHeartbeatTTL/10)
+		sleepTime := s.heartbeatTTL/2 + utils.RandomDuration(s.heartbeatTTL/10)
 		//log.Infof("[SSH] will ping auth service in %v", sleepTime)
 		time.Sleep(sleepTime)
 	}
@@ -284,7 +523,7 @@ func (s *Server) heartbeatPresence() {
 
 func (s *Server) updateLabels() {
 	for name, label := range s.cmdLabels {
-		go s.periodicUpdateLabel(name, label)
+		go s.periodicUpdateLabel(name, label, s.closeC)
 	}
 }
 
@@ -295,23 +534,210 @@ func (s *Server) syncUpdateLabels() {
 }
 
 func (s *Server) updateLabel(name string, label services.CommandLabel) {
-	out, err := exec.Command(label.Command[0], label.Command[1:]...).Output()
+	label.Result = runLabel(label)
+	s.setCommandLabel(name, label)
+}
+
+// refreshLabel runs the label command and publishes the value
+// that passed the label's hysteresis
+func (s *Server) refreshLabel(name string, label services.CommandLabel, h *labelHysteresis) {
+	label.Result = h.update(runLabel(label))
+	s.setCommandLabel(name, label)
+}
+
+// runLabel runs the label command and returns the label value
+func runLabel(label services.CommandLabel) string {
+	cmd, err := labelCommand(label)
 	if err != nil {
-		log.Errorf(err.Error())
-		label.Result = err.Error() + " output: " + string(out)
+		log.Errorf("%v", err)
+		return err.Error()
+	}
+	var out []byte
+	if label.CaptureStderr {
+		out, err = cmd.CombinedOutput()
 	} else {
-		label.Result = strings.TrimSpace(string(out))
+		out, err = cmd.Output()
 	}
-	s.setCommandLabel(name, label)
+	if len(label.ExitCodes) != 0 {
+		if result, statusErr := collectStatus(cmd, err); statusErr == nil {
+			if value, ok := label.ExitCodeResult(result.code); ok {
+				return value
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf(err.Error())
+		return err.Error() + " output: " + string(out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// labelHysteresis holds back changes of a label value until the new
+// value is produced by a number of consecutive runs, so flapping
+// commands don't change the label every period
+type labelHysteresis struct {
+	// runs is a number of consecutive runs a new value has to survive
+	runs int
+	// published is set once the first value is published
+	published bool
+	// value is the published value
+	value string
+	// candidate is a new value waiting to be published
+	candidate string
+	// count is a number of consecutive runs that produced the candidate
+	count int
+}
+
+// update records the result of a run and returns the value to publish,
+// the first result is published right away
+func (h *labelHysteresis) update(result string) string {
+	if !h.published || h.runs <= 1 || result == h.value {
+		h.published, h.value, h.count = true, result, 0
+		return h.value
+	}
+	if result != h.candidate {
+		h.candidate, h.count = result, 0
+	}
+	h.count++
+	if h.count >= h.runs {
+		h.value, h.count = result, 0
+	}
+	return h.value
+}
+
+// labelCommand returns a command for the label, it drops privileges
+// to the label's user if one is set. Such commands start in the user's
+// home with a minimal environment, so they don't get the secrets from
+// the environment of the teleport process
+func labelCommand(label services.CommandLabel) (*exec.Cmd, error) {
+	cmd := exec.Command(label.Command[0], label.Command[1:]...)
+	if label.User == "" {
+		return cmd, nil
+	}
+	osUser, err := user.Lookup(label.User)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	uid, err := strconv.Atoi(osUser.Uid)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	gid, err := strconv.Atoi(osUser.Gid)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	shell, err := getLoginShell(label.User)
+	if err != nil || shell == "" {
+		shell = defaults.DefaultShell
+	}
+	cmd.Env = []string{
+		"PATH=" + defaults.LabelCommandPath,
+		"HOME=" + osUser.HomeDir,
+		"USER=" + label.User,
+		"SHELL=" + shell,
+	}
+	// service users often have no home directory, e.g. /nonexistent
+	cmd.Dir = "/"
+	if fi, err := os.Stat(osUser.HomeDir); err == nil && fi.IsDir() {
+		cmd.Dir = osUser.HomeDir
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	return cmd, nil
 }
 
-func (s *Server) periodicUpdateLabel(name string, label services.CommandLabel) {
+// labelStartDelay returns a random delay before the first run of a label
+// with the given period, it's never longer than the period
+func (s *Server) labelStartDelay(period time.Duration) time.Duration {
+	max := s.labelJitter
+	if max > period {
+		max = period
+	}
+	if max <= 0 {
+		return 0
+	}
+	return utils.RandomDuration(max)
+}
+
+// periodicUpdateLabel runs the label command every period until stopC
+// is closed
+func (s *Server) periodicUpdateLabel(name string, label services.CommandLabel, stopC <-chan struct{}) {
+	delay := s.labelStartDelay(label.Period)
+	s.setLabelRun(name, labelRun{next: time.Now().Add(delay)})
+	select {
+	case <-time.After(delay):
+	case <-stopC:
+		return
+	}
+	h := &labelHysteresis{runs: label.StableRuns}
 	for {
-		s.updateLabel(name, label)
-		time.Sleep(label.Period)
+		s.refreshLabel(name, label, h)
+		now := time.Now()
+		s.setLabelRun(name, labelRun{last: now, next: now.Add(label.Period)})
+		select {
+		case <-time.After(label.Period):
+		case <-stopC:
+			return
+		}
 	}
 }
 
+// labelRun is the time of the last and of the next run of a command label
+type labelRun struct {
+	last time.Time
+	next time.Time
+}
+
+func (s *Server) setLabelRun(name string, run labelRun) {
+	s.labelsMutex.Lock()
+	defer s.labelsMutex.Unlock()
+	s.labelRuns[name] = run
+}
+
+// CommandLabelStatus is a state of a command label reported by
+// the diagnostic endpoint
+type CommandLabelStatus struct {
+	// Name is a label name
+	Name string `json:"name"`
+	// Command is a command the label runs
+	Command []string `json:"command"`
+	// Period is a time between runs, e.g. "1m0s"
+	Period string `json:"period"`
+	// Result is the current label value
+	Result string `json:"result"`
+	// LastRun is the time of the last run, it's zero before the first one
+	LastRun time.Time `json:"last_run"`
+	// NextRun is the time the label is scheduled to run next, it's zero
+	// if the label is not scheduled
+	NextRun time.Time `json:"next_run"`
+}
+
+// GetCommandLabelsStatus returns command labels with their last results
+// and schedule sorted by name
+func (s *Server) GetCommandLabelsStatus() []CommandLabelStatus {
+	s.labelsMutex.Lock()
+	defer s.labelsMutex.Unlock()
+	names := make([]string, 0, len(s.cmdLabels))
+	for name := range s.cmdLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]CommandLabelStatus, 0, len(names))
+	for _, name := range names {
+		label, run := s.cmdLabels[name], s.labelRuns[name]
+		out = append(out, CommandLabelStatus{
+			Name:    name,
+			Command: label.Command,
+			Period:  label.Period.String(),
+			Result:  label.Result,
+			LastRun: run.last,
+			NextRun: run.next,
+		})
+	}
+	return out
+}
+
 func (s *Server) setCommandLabel(name string, value services.CommandLabel) {
 	s.labelsMutex.Lock()
 	defer s.labelsMutex.Unlock()
@@ -476,9 +902,24 @@ func (s *Server) keyAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permiss
 
 // Close closes listening socket and stops accepting connections
 func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeC)
+	})
 	return s.srv.Close()
 }
 
+// SetHostSigner replaces the host key of the server, e.g. after the host
+// identity was rotated, active connections keep using the old key
+func (s *Server) SetHostSigner(signer ssh.Signer) error {
+	return s.srv.SetHostSigners([]ssh.Signer{signer})
+}
+
+// Drain stops accepting connections and waits until active
+// sessions are over
+func (s *Server) Drain() error {
+	return s.srv.Drain()
+}
+
 // Start starts server
 func (s *Server) Start() error {
 	if len(s.cmdLabels) > 0 {
@@ -538,6 +979,7 @@ func (s *Server) HandleNewChan(nc net.Conn, sconn *ssh.ServerConn, nch ssh.NewCh
 }
 
 func (s *Server) handleDirectTCPIPRequest(sconn *ssh.ServerConn, ch ssh.Channel, req *sshutils.DirectTCPIPReq) {
+	defer utils.RecoverPanic(s.recoverPanics, s.component(), "direct-tcpip handler")
 	// ctx holds the session context and all associated resources
 	ctx := newCtx(s, sconn)
 	ctx.isTestStub = s.isTestStub
@@ -545,7 +987,7 @@ func (s *Server) handleDirectTCPIPRequest(sconn *ssh.ServerConn, ch ssh.Channel,
 	defer ctx.Close()
 
 	ctx.Infof("opened direct-tcpip channel: %#v", req)
-	addr := fmt.Sprintf("%v:%d", req.Host, req.Port)
+	addr := net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port)))
 	ctx.Infof("connecting to %v", addr)
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -577,6 +1019,7 @@ func (s *Server) handleDirectTCPIPRequest(sconn *ssh.ServerConn, ch ssh.Channel,
 // handleSessionRequests handles out of band session requests once the session channel has been created
 // this function's loop handles all the "exec", "subsystem" and "shell" requests.
 func (s *Server) handleSessionRequests(sconn *ssh.ServerConn, ch ssh.Channel, in <-chan *ssh.Request) {
+	defer utils.RecoverPanic(s.recoverPanics, s.component(), "session handler")
 	// ctx holds the session context and all associated resources
 	ctx := newCtx(s, sconn)
 	ctx.isTestStub = s.isTestStub
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os/user"
 	"path/filepath"
@@ -34,8 +35,11 @@ import (
 	authority "github.com/gravitational/teleport/lib/auth/testauthority"
 	"github.com/gravitational/teleport/lib/backend"
 	"github.com/gravitational/teleport/lib/backend/boltbk"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/events/boltlog"
 	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/recorder"
 	"github.com/gravitational/teleport/lib/recorder/boltrec"
 	"github.com/gravitational/teleport/lib/reversetunnel"
 	"github.com/gravitational/teleport/lib/services"
@@ -44,6 +48,7 @@ import (
 	"github.com/gravitational/teleport/lib/utils"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/codahale/lunk"
 	"github.com/gravitational/trace"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -106,6 +111,7 @@ func (s *SrvSuite) SetUpTest(c *C) {
 		eventsLog,
 		sessionServer,
 		teleport.RoleAdmin,
+		"",
 		nil)
 
 	c.Assert(s.a.UpsertCertAuthority(*services.NewTestCA(services.UserCA, s.domainName), backend.Forever), IsNil)
@@ -220,6 +226,241 @@ func (s *SrvSuite) TestShell(c *C) {
 	c.Assert(se.Close(), IsNil)
 }
 
+func (s *SrvSuite) TestMOTD(c *C) {
+	c.Assert(SetMOTD("{{.Hostname}")(s.srv), NotNil)
+
+	c.Assert(SetMOTD("Welcome to {{.Hostname}}, {{.Username}}!\nBe nice.\n")(s.srv), IsNil)
+	out, err := s.srv.renderMOTD("bob")
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, "Welcome to localhost, bob!\r\nBe nice.\r\n")
+
+	se, err := s.clt.NewSession()
+	c.Assert(err, IsNil)
+	defer se.Close()
+
+	stdoutPipe, err := se.StdoutPipe()
+	c.Assert(err, IsNil)
+	reader := bufio.NewReader(stdoutPipe)
+	c.Assert(se.Shell(), IsNil)
+
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, fmt.Sprintf("Welcome to %v, %v!\r\n", s.domainName, s.user))
+}
+
+// countingRecorder counts writers requested for session recordings
+type countingRecorder struct {
+	recorder.Recorder
+	writers chan string
+}
+
+func (r *countingRecorder) GetChunkWriter(id string) (recorder.ChunkWriteCloser, error) {
+	r.writers <- id
+	return r.Recorder.GetChunkWriter(id)
+}
+
+// shellSessionLog captures shell session audit events
+type shellSessionLog struct {
+	*events.NOPEventLogger
+	sessions chan *events.ShellSession
+}
+
+func (l *shellSessionLog) Log(id lunk.EventID, e lunk.Event) {
+	if sess, ok := e.(*events.ShellSession); ok {
+		l.sessions <- sess
+	}
+}
+
+func (s *SrvSuite) TestRecordSessions(c *C) {
+	c.Assert(s.srv.recordSessions, Equals, true)
+
+	rec, err := boltrec.New(s.dir)
+	c.Assert(err, IsNil)
+	counter := &countingRecorder{Recorder: rec, writers: make(chan string, 10)}
+	elog := &shellSessionLog{NOPEventLogger: &events.NOPEventLogger{}, sessions: make(chan *events.ShellSession, 10)}
+	c.Assert(SetRecorder(counter)(s.srv), IsNil)
+	c.Assert(SetEventLogger(elog)(s.srv), IsNil)
+
+	startShell := func() *events.ShellSession {
+		se, err := s.clt.NewSession()
+		c.Assert(err, IsNil)
+		defer se.Close()
+		c.Assert(se.Shell(), IsNil)
+		select {
+		case sess := <-elog.sessions:
+			return sess
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timeout waiting for shell session event")
+		}
+		return nil
+	}
+
+	sess := startShell()
+	c.Assert(sess.RecordID, Not(Equals), "")
+	c.Assert(<-counter.writers, Equals, sess.RecordID)
+
+	// with recording off the event is still emitted, but nothing is written
+	c.Assert(SetRecordSessions(false)(s.srv), IsNil)
+	sess = startShell()
+	c.Assert(sess.RecordID, Equals, "")
+	c.Assert(counter.writers, HasLen, 0)
+}
+
+func (s *SrvSuite) TestLabelExitCodes(c *C) {
+	c.Assert(SetLabels(nil, services.CommandLabels{})(s.srv), IsNil)
+	exitCodes := map[string]string{"0": "healthy", "*": "unhealthy"}
+	s.srv.updateLabel("health", services.CommandLabel{
+		Command: []string{"/bin/sh", "-c", "echo ok"}, ExitCodes: exitCodes})
+	c.Assert(s.srv.getCommandLabels()["health"].Result, Equals, "healthy")
+
+	s.srv.updateLabel("health", services.CommandLabel{
+		Command: []string{"/bin/sh", "-c", "echo failed; exit 3"}, ExitCodes: exitCodes})
+	c.Assert(s.srv.getCommandLabels()["health"].Result, Equals, "unhealthy")
+
+	// unmapped codes fall back to the command output
+	s.srv.updateLabel("health", services.CommandLabel{
+		Command: []string{"/bin/sh", "-c", "echo failed; exit 3"}, ExitCodes: map[string]string{"0": "healthy"}})
+	c.Assert(s.srv.getCommandLabels()["health"].Result, Equals, "exit status 3 output: failed\n")
+}
+
+func (s *SrvSuite) TestLabelCaptureStderr(c *C) {
+	c.Assert(SetLabels(nil, services.CommandLabels{})(s.srv), IsNil)
+	command := []string{"/bin/sh", "-c", "echo out; echo err 1>&2"}
+
+	s.srv.updateLabel("health", services.CommandLabel{Command: command})
+	c.Assert(s.srv.getCommandLabels()["health"].Result, Equals, "out")
+
+	s.srv.updateLabel("health", services.CommandLabel{Command: command, CaptureStderr: true})
+	c.Assert(s.srv.getCommandLabels()["health"].Result, Equals, "out\nerr")
+}
+
+func (s *SrvSuite) TestLabelHysteresis(c *C) {
+	c.Assert(SetLabels(nil, services.CommandLabels{})(s.srv), IsNil)
+	valueFile := filepath.Join(c.MkDir(), "value")
+	label := services.CommandLabel{Command: []string{"/bin/cat", valueFile}, StableRuns: 3}
+	h := &labelHysteresis{runs: label.StableRuns}
+	run := func(value string) string {
+		c.Assert(ioutil.WriteFile(valueFile, []byte(value), 0600), IsNil)
+		s.srv.refreshLabel("health", label, h)
+		return s.srv.getCommandLabels()["health"].Result
+	}
+
+	// the first value is published right away
+	c.Assert(run("ok"), Equals, "ok")
+
+	// flapping value is never published
+	for i := 0; i < 5; i++ {
+		c.Assert(run("fail"), Equals, "ok")
+		c.Assert(run("fail"), Equals, "ok")
+		c.Assert(run("ok"), Equals, "ok")
+	}
+
+	// stable change is published after the required number of runs
+	c.Assert(run("fail"), Equals, "ok")
+	c.Assert(run("fail"), Equals, "ok")
+	c.Assert(run("fail"), Equals, "fail")
+	c.Assert(run("fail"), Equals, "fail")
+
+	// without hysteresis every change is published
+	h = &labelHysteresis{}
+	c.Assert(run("ok"), Equals, "ok")
+	c.Assert(run("fail"), Equals, "fail")
+	c.Assert(run("ok"), Equals, "ok")
+}
+
+func (s *SrvSuite) TestLabelJitter(c *C) {
+	c.Assert(s.srv.labelJitter, Equals, defaults.CommandLabelJitter)
+	c.Assert(SetLabelJitter(-time.Second)(s.srv), NotNil)
+
+	// delay is within the jitter and never longer than the period
+	c.Assert(SetLabelJitter(time.Second)(s.srv), IsNil)
+	for i := 0; i < 100; i++ {
+		delay := s.srv.labelStartDelay(time.Minute)
+		c.Assert(delay >= 0 && delay < time.Second, Equals, true)
+		delay = s.srv.labelStartDelay(100 * time.Millisecond)
+		c.Assert(delay >= 0 && delay < 100*time.Millisecond, Equals, true)
+	}
+
+	c.Assert(SetLabelJitter(0)(s.srv), IsNil)
+	c.Assert(s.srv.labelStartDelay(time.Minute), Equals, time.Duration(0))
+
+	// first run of the label happens within the jitter
+	jitter := 200 * time.Millisecond
+	c.Assert(SetLabelJitter(jitter)(s.srv), IsNil)
+	c.Assert(SetLabels(nil, services.CommandLabels{})(s.srv), IsNil)
+	start := time.Now()
+	stopLabel := startLabel(s.srv, "date", services.CommandLabel{
+		Command: []string{"/bin/echo", "ok"}, Period: time.Hour})
+	defer stopLabel()
+	for s.srv.getCommandLabels()["date"].Result == "" {
+		c.Assert(time.Now().Sub(start) < 5*time.Second, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(time.Now().Sub(start) < jitter+time.Second, Equals, true)
+}
+
+// startLabel starts periodic updates of the label and returns a function
+// that stops them and waits until the updates are over
+func startLabel(srv *Server, name string, label services.CommandLabel) func() {
+	stopC, doneC := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(doneC)
+		srv.periodicUpdateLabel(name, label, stopC)
+	}()
+	return func() {
+		close(stopC)
+		<-doneC
+	}
+}
+
+func (s *SrvSuite) TestLabelSchedule(c *C) {
+	c.Assert(SetLabelJitter(0)(s.srv), IsNil)
+	label := services.CommandLabel{Command: []string{"/bin/date", "+%N"}, Period: 100 * time.Millisecond}
+	c.Assert(SetLabels(nil, services.CommandLabels{"date": label})(s.srv), IsNil)
+	status := func() CommandLabelStatus {
+		labels := s.srv.GetCommandLabelsStatus()
+		c.Assert(labels, HasLen, 1)
+		return labels[0]
+	}
+	c.Assert(status().NextRun.IsZero(), Equals, true)
+
+	stopLabel := startLabel(s.srv, "date", label)
+	defer stopLabel()
+	waitRun := func(after time.Time) CommandLabelStatus {
+		start := time.Now()
+		for {
+			label := status()
+			if label.LastRun.After(after) {
+				return label
+			}
+			c.Assert(time.Now().Sub(start) < 5*time.Second, Equals, true)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	first := waitRun(time.Time{})
+	c.Assert(first.Name, Equals, "date")
+	c.Assert(first.Period, Equals, "100ms")
+	c.Assert(first.Result, Not(Equals), "")
+	c.Assert(first.NextRun, Equals, first.LastRun.Add(100*time.Millisecond))
+
+	// next run time advances after the execution
+	second := waitRun(first.LastRun)
+	c.Assert(second.NextRun.After(first.NextRun), Equals, true)
+	c.Assert(second.LastRun.Before(first.NextRun), Equals, false)
+}
+
+func (s *SrvSuite) TestHeartbeatTTL(c *C) {
+	c.Assert(s.srv.heartbeatTTL, Equals, defaults.ServerHeartbeatTTL)
+	c.Assert(SetHeartbeatTTL(-time.Second)(s.srv), NotNil)
+
+	c.Assert(SetHeartbeatTTL(time.Minute)(s.srv), IsNil)
+	c.Assert(s.srv.heartbeatTTL, Equals, time.Minute)
+
+	// zero keeps the current value
+	c.Assert(SetHeartbeatTTL(0)(s.srv), IsNil)
+	c.Assert(s.srv.heartbeatTTL, Equals, time.Minute)
+}
+
 func (s *SrvSuite) TestAllowedUsers(c *C) {
 	up, err := newUpack(s.user, []string{s.user}, s.a)
 	c.Assert(err, IsNil)
@@ -0,0 +1,78 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertChecker is ssh.CertChecker that tolerates a clock skew between
+// the host that issued a certificate and this host when checking
+// certificate validity period
+type CertChecker struct {
+	ssh.CertChecker
+	// ClockSkew is a maximum difference between clocks of hosts,
+	// certificates are valid ClockSkew before ValidAfter and after ValidBefore
+	ClockSkew time.Duration
+}
+
+// CheckCert checks certificate like ssh.CertChecker but tolerates clock skew
+func (c *CertChecker) CheckCert(principal string, cert *ssh.Certificate) error {
+	return c.forCert(cert).CheckCert(principal, cert)
+}
+
+// Authenticate checks a user certificate like ssh.CertChecker
+// but tolerates clock skew
+func (c *CertChecker) Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, _ := key.(*ssh.Certificate)
+	return c.forCert(cert).Authenticate(conn, key)
+}
+
+// CheckHostKey checks a host certificate like ssh.CertChecker
+// but tolerates clock skew
+func (c *CertChecker) CheckHostKey(addr string, remote net.Addr, key ssh.PublicKey) error {
+	cert, _ := key.(*ssh.Certificate)
+	return c.forCert(cert).CheckHostKey(addr, remote, key)
+}
+
+// forCert returns a copy of the embedded checker with the clock moved
+// within the skew tolerance towards the validity period of the cert
+func (c *CertChecker) forCert(cert *ssh.Certificate) *ssh.CertChecker {
+	checker := c.CertChecker
+	clock := checker.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	if cert == nil || c.ClockSkew <= 0 {
+		return &checker
+	}
+	now := clock()
+	skew := int64(c.ClockSkew / time.Second)
+	unixNow := now.Unix()
+	if after := int64(cert.ValidAfter); after >= 0 && unixNow < after && after-unixNow <= skew {
+		now = time.Unix(after, 0)
+	}
+	if before := int64(cert.ValidBefore); cert.ValidBefore != ssh.CertTimeInfinity && before >= 0 &&
+		unixNow >= before && unixNow-before < skew {
+		now = time.Unix(before-1, 0)
+	}
+	checker.Clock = func() time.Time { return now }
+	return &checker
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/gravitational/teleport/lib/services/suite"
+
+	"golang.org/x/crypto/ssh"
+	. "gopkg.in/check.v1"
+)
+
+type CertsSuite struct {
+	ca   ssh.Signer
+	user ssh.Signer
+}
+
+var _ = Suite(&CertsSuite{})
+
+func (s *CertsSuite) SetUpSuite(c *C) {
+	var err error
+	s.ca, err = ssh.ParsePrivateKey(suite.PEMBytes["ecdsa"])
+	c.Assert(err, IsNil)
+	s.user, err = ssh.ParsePrivateKey(suite.PEMBytes["user"])
+	c.Assert(err, IsNil)
+}
+
+func (s *CertsSuite) newCert(c *C, validAfter, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             s.user.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	c.Assert(cert.SignCert(rand.Reader, s.ca), IsNil)
+	return cert
+}
+
+func (s *CertsSuite) TestClockSkew(c *C) {
+	now := time.Date(2016, time.June, 1, 12, 0, 0, 0, time.UTC)
+	checker := func(skew time.Duration) *CertChecker {
+		return &CertChecker{
+			CertChecker: ssh.CertChecker{
+				IsAuthority: func(key ssh.PublicKey) bool {
+					return KeysEqual(key, s.ca.PublicKey())
+				},
+				Clock: func() time.Time { return now },
+			},
+			ClockSkew: skew,
+		}
+	}
+
+	for i, t := range []struct {
+		cert  *ssh.Certificate
+		skew  time.Duration
+		valid bool
+	}{
+		// issued by a host with the clock 30 seconds ahead
+		{cert: s.newCert(c, now.Add(30*time.Second), now.Add(time.Hour)), skew: 0, valid: false},
+		{cert: s.newCert(c, now.Add(30*time.Second), now.Add(time.Hour)), skew: time.Minute, valid: true},
+		{cert: s.newCert(c, now.Add(2*time.Minute), now.Add(time.Hour)), skew: time.Minute, valid: false},
+		// expired 30 seconds ago by the local clock
+		{cert: s.newCert(c, now.Add(-time.Hour), now.Add(-30*time.Second)), skew: 0, valid: false},
+		{cert: s.newCert(c, now.Add(-time.Hour), now.Add(-30*time.Second)), skew: time.Minute, valid: true},
+		{cert: s.newCert(c, now.Add(-time.Hour), now.Add(-2*time.Minute)), skew: time.Minute, valid: false},
+		// valid certs are not affected
+		{cert: s.newCert(c, now.Add(-time.Hour), now.Add(time.Hour)), skew: 0, valid: true},
+	} {
+		comment := Commentf("test case %v", i)
+		err := checker(t.skew).CheckCert("alice", t.cert)
+		c.Assert(err == nil, Equals, t.valid, comment)
+		_, err = checker(t.skew).Authenticate(&connMetadata{user: "alice"}, t.cert)
+		c.Assert(err == nil, Equals, t.valid, comment)
+	}
+}
+
+type connMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (m *connMetadata) User() string {
+	return m.user
+}
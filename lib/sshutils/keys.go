@@ -0,0 +1,71 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// EncryptPrivateKey encrypts a PEM encoded private key with a passphrase,
+// the result is a PEM block with the usual Proc-Type and DEK-Info headers
+func EncryptPrivateKey(keyPEM, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, trace.Wrap(teleport.BadParameter("passphrase", "missing passphrase"))
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, trace.Wrap(teleport.BadParameter("key", "expected PEM encoded private key"))
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		return nil, trace.Wrap(teleport.BadParameter("key", "private key is already encrypted"))
+	}
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, passphrase, x509.PEMCipherAES256)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return pem.EncodeToMemory(encrypted), nil
+}
+
+// DecryptPrivateKey returns a plain PEM encoded private key decrypted with
+// a passphrase, keys that are not encrypted are returned as is
+func DecryptPrivateKey(keyPEM, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, trace.Wrap(teleport.BadParameter("key", "expected PEM encoded private key"))
+	}
+	if !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, trace.Wrap(teleport.BadParameter("passphrase", "private key is encrypted, supply a passphrase"))
+	}
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err != nil {
+		if err == x509.IncorrectPasswordError {
+			return nil, trace.Wrap(teleport.BadParameter("passphrase", "incorrect private key passphrase"))
+		}
+		return nil, trace.Wrap(teleport.BadParameter("key", fmt.Sprintf("failed to decrypt private key: %v", err)))
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
@@ -43,4 +43,8 @@ const (
 	SetEnvReq       = "env"
 	WindowChangeReq = "window-change"
 	PTYReq          = "pty-req"
+
+	// KeepAliveRequest is a global request the server sends to check
+	// if the client is alive, named after the OpenSSH one
+	KeepAliveRequest = "keepalive@openssh.com"
 )
@@ -18,12 +18,16 @@ package sshutils
 
 import (
 	"crypto/subtle"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/defaults"
 	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/metrics"
 	"github.com/gravitational/teleport/lib/utils"
 
 	log "github.com/Sirupsen/logrus"
@@ -40,6 +44,42 @@ type Server struct {
 	reqHandler     RequestHandler
 	cfg            ssh.ServerConfig
 	limiter        *limiter.Limiter
+
+	// connGauge tracks active connections under connLabel
+	connGauge *metrics.Gauge
+	connLabel string
+
+	// keepAliveInterval is a period between keepalive requests,
+	// keepalives are disabled if it's zero
+	keepAliveInterval time.Duration
+	// keepAliveCountMax is a number of missed keepalive responses
+	// after which the connection is closed
+	keepAliveCountMax int
+
+	// handshakeTimeout is a deadline for clients to complete the handshake
+	handshakeTimeout time.Duration
+
+	// conns tracks active connections, it is used to drain the server
+	conns sync.WaitGroup
+
+	// allowedSources restricts source IPs of accepted connections,
+	// connections from any source are accepted if it's empty
+	allowedSources []net.IPNet
+
+	// reusePort binds the listening socket with SO_REUSEPORT
+	reusePort bool
+
+	// hostSigners are host keys presented to clients, guarded by signersMutex
+	signersMutex sync.RWMutex
+	hostSigners  []ssh.Signer
+
+	// connLogRole is a role of this server in connection log entries,
+	// connections are not logged if it's empty
+	connLogRole string
+
+	// panicRole is a role of this server in logs of recovered panics,
+	// panics in handlers are not recovered if it's empty
+	panicRole string
 }
 
 // ServerOption is a functional argument for server
@@ -52,6 +92,83 @@ func SetLimiter(limiter *limiter.Limiter) ServerOption {
 	}
 }
 
+// SetConnectionGauge sets a gauge that tracks active connections
+// to this server under the given label value, e.g. role name
+func SetConnectionGauge(g *metrics.Gauge, label string) ServerOption {
+	return func(s *Server) error {
+		s.connGauge = g
+		s.connLabel = label
+		return nil
+	}
+}
+
+// SetReusePort binds the listening socket with SO_REUSEPORT, so another
+// process can listen on the same address, it's supported on Linux only
+func SetReusePort(reusePort bool) ServerOption {
+	return func(s *Server) error {
+		s.reusePort = reusePort
+		return nil
+	}
+}
+
+// SetKeepAlive makes the server send keepalive requests to clients every
+// interval and close connections after countMax requests left unanswered
+func SetKeepAlive(interval time.Duration, countMax int) ServerOption {
+	return func(s *Server) error {
+		if interval < 0 {
+			return trace.Wrap(teleport.BadParameter("keepalive_interval", "keepalive interval can't be negative"))
+		}
+		if countMax < 1 {
+			return trace.Wrap(teleport.BadParameter("keepalive_count_max", "keepalive count max should be at least 1"))
+		}
+		s.keepAliveInterval = interval
+		s.keepAliveCountMax = countMax
+		return nil
+	}
+}
+
+// SetHandshakeTimeout sets a time clients have to complete the SSH
+// handshake before the connection is dropped
+func SetHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return trace.Wrap(teleport.BadParameter("handshake_timeout",
+				fmt.Sprintf("handshake timeout should be positive: %v", timeout)))
+		}
+		s.handshakeTimeout = timeout
+		return nil
+	}
+}
+
+// SetConnectionLogging makes the server log when connections are
+// accepted, authenticated and closed with the source IP, principal and
+// the given role of this server, e.g. teleport.ComponentNode
+func SetConnectionLogging(role string) ServerOption {
+	return func(s *Server) error {
+		s.connLogRole = role
+		return nil
+	}
+}
+
+// SetPanicRecovery makes the server recover from panics in connection,
+// channel and request handlers and log them under the given role, so a
+// panic drops a single connection or channel instead of the process
+func SetPanicRecovery(role string) ServerOption {
+	return func(s *Server) error {
+		s.panicRole = role
+		return nil
+	}
+}
+
+// SetAllowedSources makes the server close connections from source IPs
+// outside of the given networks before the SSH handshake
+func SetAllowedSources(networks []net.IPNet) ServerOption {
+	return func(s *Server) error {
+		s.allowedSources = networks
+		return nil
+	}
+}
+
 func NewServer(a utils.NetAddr,
 	h NewChanHandler,
 	hostSigners []ssh.Signer,
@@ -66,6 +183,8 @@ func NewServer(a utils.NetAddr,
 		addr:           a,
 		newChanHandler: h,
 		closeC:         make(chan struct{}),
+
+		handshakeTimeout: defaults.HandshakeTimeout,
 	}
 	s.limiter, err = limiter.NewLimiter(limiter.LimiterConfig{})
 	if err != nil {
@@ -77,9 +196,7 @@ func NewServer(a utils.NetAddr,
 			return nil, err
 		}
 	}
-	for _, signer := range hostSigners {
-		(&s.cfg).AddHostKey(signer)
-	}
+	s.hostSigners = hostSigners
 	s.cfg.PublicKeyCallback = ah.PublicKey
 	s.cfg.PasswordCallback = ah.Password
 	s.cfg.NoClientAuth = ah.NoClient
@@ -93,6 +210,33 @@ func SetSSHConfig(cfg ssh.ServerConfig) ServerOption {
 	}
 }
 
+// VersionPrefix is a prefix every SSH-2.0 version string must start with
+const VersionPrefix = "SSH-2.0-"
+
+// CheckVersion makes sure version string is valid per RFC 4253
+func CheckVersion(version string) error {
+	if !strings.HasPrefix(version, VersionPrefix) || len(version) == len(VersionPrefix) {
+		return trace.Wrap(teleport.BadParameter("version_string",
+			fmt.Sprintf("version string '%v' should start with '%v' followed by software version", version, VersionPrefix)))
+	}
+	if len(version) > 253 || strings.ContainsAny(version, " \r\n") {
+		return trace.Wrap(teleport.BadParameter("version_string",
+			fmt.Sprintf("version string '%v' should be shorter than 254 characters with no spaces", version)))
+	}
+	return nil
+}
+
+// SetVersion sets the version string the server sends to clients
+func SetVersion(version string) ServerOption {
+	return func(s *Server) error {
+		if err := CheckVersion(version); err != nil {
+			return trace.Wrap(err)
+		}
+		s.cfg.ServerVersion = version
+		return nil
+	}
+}
+
 func SetRequestHandler(req RequestHandler) ServerOption {
 	return func(s *Server) error {
 		s.reqHandler = req
@@ -100,12 +244,35 @@ func SetRequestHandler(req RequestHandler) ServerOption {
 	}
 }
 
+// SetHostSigners replaces host keys of the server, connections that are
+// already established keep using the old keys
+func (s *Server) SetHostSigners(hostSigners []ssh.Signer) error {
+	if len(hostSigners) == 0 {
+		return trace.Wrap(teleport.BadParameter("hostSigners", "supply at least one host signer"))
+	}
+	s.signersMutex.Lock()
+	defer s.signersMutex.Unlock()
+	s.hostSigners = hostSigners
+	return nil
+}
+
+// serverConfig returns SSH server config with the current host keys
+func (s *Server) serverConfig() *ssh.ServerConfig {
+	s.signersMutex.RLock()
+	defer s.signersMutex.RUnlock()
+	cfg := s.cfg
+	for _, signer := range s.hostSigners {
+		cfg.AddHostKey(signer)
+	}
+	return &cfg
+}
+
 func (s *Server) Addr() string {
 	return s.listener.Addr().String()
 }
 
 func (s *Server) Start() error {
-	socket, err := net.Listen(s.addr.AddrNetwork, s.addr.Addr)
+	socket, err := utils.Listen(s.addr.AddrNetwork, s.addr.Addr, s.reusePort)
 	if err != nil {
 		return err
 	}
@@ -128,6 +295,17 @@ func (s *Server) Close() error {
 	return s.listener.Close()
 }
 
+// Drain closes listening socket and waits until all active
+// connections are closed by clients
+func (s *Server) Drain() error {
+	if err := s.Close(); err != nil {
+		return trace.Wrap(err)
+	}
+	s.Wait()
+	s.conns.Wait()
+	return nil
+}
+
 func (s *Server) acceptConnections() {
 	defer s.notifyClosed()
 	log.Infof("%v ready to accept connections", s.Addr())
@@ -142,36 +320,79 @@ func (s *Server) acceptConnections() {
 			log.Infof("accept error: %T %v", err, err)
 			return
 		}
+		if len(s.allowedSources) != 0 && !utils.AddrInNetworks(conn.RemoteAddr(), s.allowedSources) {
+			log.Warningf("%v rejected connection from %v: source is not allowed", s.Addr(), conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 		log.Infof("%v accepted connection from %v", s.Addr(), conn.RemoteAddr())
 
-		go s.handleConnection(conn)
+		// bound the number of connections in the middle of the handshake,
+		// the loop stops accepting until one of them is over
+		s.limiter.AcquireHandshake()
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			defer utils.RecoverPanic(s.panicRole != "", s.panicRole, "connection handler")
+			s.handleConnection(conn)
+		}()
 	}
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
+	// the connection is over once the handlers return, closing it again
+	// makes sure it's not left open if a handler panics
+	defer conn.Close()
+	// release the handshake slot taken by the accept loop as soon as
+	// the handshake is over
+	var releaseOnce sync.Once
+	releaseHandshake := func() { releaseOnce.Do(s.limiter.ReleaseHandshake) }
+	defer releaseHandshake()
+
 	// initiate an SSH connection, note that we don't need to close the conn here
 	// in case of error as ssh server takes care of this
 	remoteAddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
 		log.Errorf(err.Error())
 	}
+	var principal string
+	if s.connLogRole != "" {
+		start := time.Now()
+		s.logConnection("connect", remoteAddr, "", nil)
+		defer func() {
+			s.logConnection("disconnect", remoteAddr, principal, log.Fields{
+				"duration": time.Now().Sub(start).String(),
+			})
+		}()
+	}
 	if err := s.limiter.AcquireConnection(remoteAddr); err != nil {
 		log.Errorf(err.Error())
 		conn.Close()
 		return
 	}
 	defer s.limiter.ReleaseConnection(remoteAddr)
+	if s.connGauge != nil {
+		s.connGauge.Inc(s.connLabel)
+		defer s.connGauge.Dec(s.connLabel)
+	}
 
 	// setting waiting deadline in case of connection freezing
-	err = conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	err = conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
 	if err != nil {
 		log.Errorf(err.Error())
+		conn.Close()
 		return
 	}
-	sconn, chans, reqs, err := ssh.NewServerConn(conn, &s.cfg)
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.serverConfig())
+	releaseHandshake()
 	if err != nil {
-		log.Infof("failed to initiate connection, err: %v", err)
-		conn.SetDeadline(time.Time{})
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Warningf("%v did not complete handshake in %v, dropping connection",
+				conn.RemoteAddr(), s.handshakeTimeout)
+		} else {
+			log.Infof("failed to initiate connection, err: %v", err)
+		}
+		conn.Close()
 		return
 	}
 	err = conn.SetDeadline(time.Time{})
@@ -179,6 +400,10 @@ func (s *Server) handleConnection(conn net.Conn) {
 		log.Errorf(err.Error())
 		return
 	}
+	principal = sconn.User()
+	if s.connLogRole != "" {
+		s.logConnection("authenticated", remoteAddr, principal, nil)
+	}
 
 	user := sconn.User()
 	if err := s.limiter.RegisterRequest(user); err != nil {
@@ -191,6 +416,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 	log.Infof("new ssh connection %v -> %v vesion: %v",
 		sconn.RemoteAddr(), sconn.LocalAddr(), string(sconn.ClientVersion()))
 
+	if s.keepAliveInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.keepAlive(sconn, done)
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
@@ -208,25 +439,100 @@ func (s *Server) handleConnection(conn net.Conn) {
 	wg.Wait()
 }
 
+// logConnection logs a connection lifecycle event with the source IP of
+// the client and the principal it has authenticated as, if known
+func (s *Server) logConnection(event, sourceIP, principal string, extra log.Fields) {
+	fields := log.Fields{
+		teleport.Component: s.connLogRole,
+		"event":            event,
+		"role":             s.connLogRole,
+		"src_ip":           sourceIP,
+	}
+	if principal != "" {
+		fields["principal"] = principal
+	}
+	for k, v := range extra {
+		fields[k] = v
+	}
+	log.WithFields(fields).Infof("connection %v", event)
+}
+
+// keepAlive sends keepalive requests to the client until done is closed
+// and closes the connection if the client stops responding to them
+func (s *Server) keepAlive(sconn *ssh.ServerConn, done <-chan struct{}) {
+	ticker := time.NewTicker(s.keepAliveInterval)
+	defer ticker.Stop()
+
+	replyC := make(chan struct{})
+	pending, missed := false, 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-replyC:
+			pending, missed = false, 0
+		case <-ticker.C:
+			if pending {
+				missed++
+				if missed >= s.keepAliveCountMax {
+					log.Infof("%v missed %v keepalives, closing connection",
+						sconn.RemoteAddr(), missed)
+					sconn.Close()
+					return
+				}
+				continue
+			}
+			pending = true
+			go func() {
+				// any reply, even a failure, means the client is alive
+				_, _, err := sconn.SendRequest(KeepAliveRequest, true, nil)
+				if err != nil {
+					return
+				}
+				select {
+				case replyC <- struct{}{}:
+				case <-done:
+				}
+			}()
+		}
+	}
+}
+
 func (s *Server) handleRequests(reqs <-chan *ssh.Request) {
 	for req := range reqs {
 		log.Infof("recieved out-of-band request: %+v", req)
 		if s.reqHandler != nil {
-			s.reqHandler.HandleRequest(req)
+			s.handleRequest(req)
 		}
 	}
 }
 
+func (s *Server) handleRequest(req *ssh.Request) {
+	defer utils.RecoverPanic(s.panicRole != "", s.panicRole, "request handler", func() {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	})
+	s.reqHandler.HandleRequest(req)
+}
+
 func (s *Server) handleChannels(conn net.Conn, sconn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
 	for nch := range chans {
 		if nch == nil {
 			log.Warningf("nil channel: %v", nch)
 			continue
 		}
-		s.newChanHandler.HandleNewChan(conn, sconn, nch)
+		s.handleNewChan(conn, sconn, nch)
 	}
 }
 
+func (s *Server) handleNewChan(conn net.Conn, sconn *ssh.ServerConn, nch ssh.NewChannel) {
+	// the client may be waiting for an answer to the channel request,
+	// so the connection is closed after a panic
+	defer utils.RecoverPanic(s.panicRole != "", s.panicRole, "channel handler", func() { sconn.Close() })
+	s.newChanHandler.HandleNewChan(conn, sconn, nch)
+}
+
 type RequestHandler interface {
 	HandleRequest(r *ssh.Request)
 }
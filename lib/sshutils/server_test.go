@@ -16,14 +16,21 @@ limitations under the License.
 package sshutils
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/limiter"
 	"github.com/gravitational/teleport/lib/services/suite"
 	"github.com/gravitational/teleport/lib/utils"
 
+	log "github.com/Sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	. "gopkg.in/check.v1"
 )
@@ -72,6 +79,255 @@ func (s *ServerSuite) TestStartStop(c *C) {
 	c.Assert(called, Equals, true)
 }
 
+func (s *ServerSuite) TestHandshakeTimeout(c *C) {
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+	timeout := 100 * time.Millisecond
+	srv, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn,
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+		SetHandshakeTimeout(timeout),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Close()
+
+	// client that never sends anything is disconnected after the timeout
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	start := time.Now()
+	closed := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(conn)
+		closed <- err
+	}()
+	select {
+	case <-closed:
+		c.Assert(time.Now().Sub(start) >= timeout, Equals, true)
+	case <-time.After(20 * timeout):
+		c.Fatalf("stalled connection was not closed")
+	}
+
+	// client completing the handshake in time is not affected
+	clt, err := ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.Password("abc123")}})
+	c.Assert(err, IsNil)
+	defer clt.Close()
+	time.Sleep(2 * timeout)
+	_, _, err = clt.OpenChannel("session", nil)
+	_, rejected := err.(*ssh.OpenChannelError)
+	c.Assert(rejected, Equals, true, Commentf("unexpected error: %v", err))
+
+	_, err = NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn, s.signers, AuthMethods{Password: pass("abc123")},
+		SetHandshakeTimeout(0))
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
+func (s *ServerSuite) TestHandshakeLimit(c *C) {
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+	limiter, err := limiter.NewLimiter(limiter.LimiterConfig{MaxHandshakes: 1, MaxConnections: 2})
+	c.Assert(err, IsNil)
+	srv, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn,
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+		SetLimiter(limiter),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Close()
+
+	config := &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.Password("abc123")}}
+	dial := func() <-chan error {
+		errC := make(chan error, 1)
+		go func() {
+			clt, err := ssh.Dial("tcp", srv.Addr(), config)
+			if err == nil {
+				// keep the connection established until the server closes
+				go clt.Wait()
+			}
+			errC <- err
+		}()
+		return errC
+	}
+
+	// half-open connection takes the only handshake slot
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	errC := dial()
+	select {
+	case err := <-errC:
+		c.Fatalf("handshake completed while the slot was taken: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	c.Assert(conn.Close(), IsNil)
+	select {
+	case err := <-errC:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("handshake did not complete after the slot was freed")
+	}
+
+	// established connections don't hold handshake slots, they're
+	// limited by the connection limit
+	select {
+	case err := <-dial():
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("second connection was not established")
+	}
+	select {
+	case err := <-dial():
+		c.Assert(err, NotNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("connection over the limit was not rejected")
+	}
+}
+
+func (s *ServerSuite) TestDrain(c *C) {
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+	srv, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn,
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+	)
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+
+	clt, err := ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.Password("abc123")}})
+	c.Assert(err, IsNil)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- srv.Drain()
+	}()
+
+	// active connection keeps the server from draining
+	select {
+	case err := <-drained:
+		c.Fatalf("server drained with active connection: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// and no new connections are accepted
+	_, err = net.Dial("tcp", srv.Addr())
+	c.Assert(err, NotNil)
+
+	c.Assert(clt.Close(), IsNil)
+	select {
+	case err := <-drained:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("server did not drain after the connection was closed")
+	}
+}
+
+func (s *ServerSuite) TestAllowedSources(c *C) {
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+	newServer := func(cidrs ...string) *Server {
+		networks, err := utils.ParseCIDRs(cidrs)
+		c.Assert(err, IsNil)
+		srv, err := NewServer(
+			utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:0"},
+			fn,
+			s.signers,
+			AuthMethods{Password: pass("abc123")},
+			SetAllowedSources(networks),
+		)
+		c.Assert(err, IsNil)
+		c.Assert(srv.Start(), IsNil)
+		return srv
+	}
+	config := &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.Password("abc123")}}
+
+	// allowed network connects
+	srv := newServer("10.0.0.0/8", "127.0.0.0/8")
+	defer srv.Close()
+	clt, err := ssh.Dial("tcp", srv.Addr(), config)
+	c.Assert(err, IsNil)
+	c.Assert(clt.Close(), IsNil)
+
+	// other networks are rejected before the handshake
+	srv = newServer("10.0.0.0/8", "fd00::/8")
+	defer srv.Close()
+	_, err = ssh.Dial("tcp", srv.Addr(), config)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestKeepAlive(c *C) {
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+	interval := 50 * time.Millisecond
+	srv, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn,
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+		SetKeepAlive(interval, 2),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewClientConn(conn, srv.Addr(),
+		&ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.Password("abc123")}})
+	c.Assert(err, IsNil)
+	go func() {
+		for nch := range chans {
+			nch.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	// client answering keepalives stays connected
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		select {
+		case req := <-reqs:
+			c.Assert(req.Type, Equals, KeepAliveRequest)
+			c.Assert(req.Reply(false, nil), IsNil)
+		case <-time.After(10 * interval):
+			c.Fatalf("timeout waiting for keepalive")
+		}
+	}
+	c.Assert(time.Now().Sub(start) >= 2*interval, Equals, true)
+
+	// client that stops answering gets disconnected
+	closed := make(chan error, 1)
+	go func() {
+		closed <- sconn.Wait()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(20 * interval):
+		c.Fatalf("connection was not closed after missed keepalives")
+	}
+
+	// invalid settings are rejected
+	_, err = NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn, s.signers, AuthMethods{Password: pass("abc123")},
+		SetKeepAlive(interval, 0),
+	)
+	c.Assert(err, NotNil)
+}
+
 func wait(c *C, srv *Server) {
 	s := make(chan struct{})
 	go func() {
@@ -93,3 +349,184 @@ func pass(need string) PasswordFunc {
 		return nil, fmt.Errorf("passwords don't match")
 	}
 }
+
+func (s *ServerSuite) TestVersion(c *C) {
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+
+	srv, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn,
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+		SetVersion("SSH-2.0-Custom_1.0"),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Close()
+
+	clt, err := ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.Password("abc123")}})
+	c.Assert(err, IsNil)
+	defer clt.Close()
+	c.Assert(string(clt.ServerVersion()), Equals, "SSH-2.0-Custom_1.0")
+
+	// version string without the required prefix is rejected
+	for _, version := range []string{"Custom_1.0", "SSH-1.99-Custom", "SSH-2.0-", "SSH-2.0-with space"} {
+		_, err = NewServer(
+			utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+			fn,
+			s.signers,
+			AuthMethods{Password: pass("abc123")},
+			SetVersion(version),
+		)
+		c.Assert(err, NotNil, Commentf(version))
+	}
+}
+
+func (s *ServerSuite) TestSetHostSigners(c *C) {
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+	srv, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		fn,
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+	)
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+	defer srv.Close()
+
+	hostKey := func() []byte {
+		var key ssh.PublicKey
+		clt, err := ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{
+			Auth: []ssh.AuthMethod{ssh.Password("abc123")},
+			HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+				key = k
+				return nil
+			},
+		})
+		c.Assert(err, IsNil)
+		c.Assert(clt.Close(), IsNil)
+		return key.Marshal()
+	}
+	c.Assert(hostKey(), DeepEquals, s.signers[0].PublicKey().Marshal())
+
+	// new connections get the new key
+	signer, err := ssh.ParsePrivateKey(suite.PEMBytes["user"])
+	c.Assert(err, IsNil)
+	c.Assert(srv.SetHostSigners([]ssh.Signer{signer}), IsNil)
+	c.Assert(hostKey(), DeepEquals, signer.PublicKey().Marshal())
+
+	c.Assert(srv.SetHostSigners(nil), NotNil)
+}
+
+func (s *ServerSuite) TestConnectionLogging(c *C) {
+	buf := &bytes.Buffer{}
+	logger := log.StandardLogger()
+	out, level, formatter := logger.Out, logger.Level, logger.Formatter
+	log.SetOutput(buf)
+	log.SetLevel(log.InfoLevel)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+		log.SetFormatter(formatter)
+	}()
+
+	fn := NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+		nch.Reject(ssh.Prohibited, "nothing to see here")
+	})
+	srv, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:0"},
+		fn,
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+		SetConnectionLogging(teleport.ComponentNode),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(srv.Start(), IsNil)
+
+	clt, err := ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("abc123")},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(clt.Close(), IsNil)
+	c.Assert(srv.Drain(), IsNil)
+
+	entries := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(line), &entry), IsNil)
+		if event, ok := entry["event"].(string); ok {
+			entries[event] = entry
+		}
+	}
+	c.Assert(entries["connect"], NotNil)
+	c.Assert(entries["connect"]["src_ip"], Equals, "127.0.0.1")
+	c.Assert(entries["connect"]["role"], Equals, teleport.ComponentNode)
+	c.Assert(entries["connect"]["principal"], IsNil)
+
+	c.Assert(entries["authenticated"], NotNil)
+	c.Assert(entries["authenticated"]["src_ip"], Equals, "127.0.0.1")
+	c.Assert(entries["authenticated"]["role"], Equals, teleport.ComponentNode)
+	c.Assert(entries["authenticated"]["principal"], Equals, "alice")
+
+	c.Assert(entries["disconnect"], NotNil)
+	c.Assert(entries["disconnect"]["principal"], Equals, "alice")
+}
+
+func (s *ServerSuite) TestPanicRecovery(c *C) {
+	// the proxy panics on "panic" channels and both roles accept the rest
+	proxy, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+			if nch.ChannelType() == "panic" {
+				panic("proxy handler failure")
+			}
+			nch.Reject(ssh.Prohibited, "nothing to see here")
+		}),
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+		SetPanicRecovery(teleport.ComponentProxy),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(proxy.Start(), IsNil)
+	defer proxy.Close()
+
+	node, err := NewServer(
+		utils.NetAddr{AddrNetwork: "tcp", Addr: "localhost:0"},
+		NewChanHandlerFunc(func(_ net.Conn, conn *ssh.ServerConn, nch ssh.NewChannel) {
+			nch.Reject(ssh.Prohibited, "nothing to see here")
+		}),
+		s.signers,
+		AuthMethods{Password: pass("abc123")},
+		SetPanicRecovery(teleport.ComponentNode),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(node.Start(), IsNil)
+	defer node.Close()
+
+	cfg := &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.Password("abc123")}}
+	clt, err := ssh.Dial("tcp", proxy.Addr(), cfg)
+	c.Assert(err, IsNil)
+	defer clt.Close()
+
+	// the connection with the panicking channel is closed
+	_, _, err = clt.OpenChannel("panic", nil)
+	c.Assert(err, NotNil)
+	_, rejected := err.(*ssh.OpenChannelError)
+	c.Assert(rejected, Equals, false, Commentf("unexpected error: %v", err))
+
+	// both roles keep serving
+	for _, srv := range []*Server{proxy, node} {
+		clt, err := ssh.Dial("tcp", srv.Addr(), cfg)
+		c.Assert(err, IsNil)
+		_, _, err = clt.OpenChannel("session", nil)
+		_, rejected := err.(*ssh.OpenChannelError)
+		c.Assert(rejected, Equals, true, Commentf("unexpected error: %v", err))
+		clt.Close()
+	}
+}
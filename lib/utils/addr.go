@@ -104,13 +104,14 @@ func ParseAddr(a string) (*NetAddr, error) {
 	if !strings.Contains(a, "://") {
 		host, port, err := net.SplitHostPort(a)
 		if err != nil {
-			return nil, trace.Wrap(teleport.BadParameter(a, "bad address, expected host:port"))
+			return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a, "bad address, expected host:port"))
 		}
-		return &NetAddr{Addr: fmt.Sprintf("%v:%v", host, port), AddrNetwork: "tcp"}, nil
+		return &NetAddr{Addr: net.JoinHostPort(host, port), AddrNetwork: "tcp"}, nil
 	}
 	u, err := url.Parse(a)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse '%v':%v", a, err)
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a,
+			fmt.Sprintf("failed to parse: %v", err)))
 	}
 	switch u.Scheme {
 	case "tcp":
@@ -118,28 +119,94 @@ func ParseAddr(a string) (*NetAddr, error) {
 	case "unix":
 		return &NetAddr{Addr: u.Path, AddrNetwork: u.Scheme}, nil
 	default:
-		return nil, trace.Wrap(teleport.BadParameter(a, fmt.Sprintf("unsupported scheme: '%v'", u.Scheme)))
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a, fmt.Sprintf("unsupported scheme: '%v'", u.Scheme)))
 	}
 }
 
 // ParseHostPortAddr takes strings like "host:port" and returns
 // *NetAddr or an error
 //
-// If defaultPort == -1 it expects 'hostport' string to have it
+// If defaultPort == -1 it expects 'hostport' string to have it.
+// IPv6 hosts should be enclosed in brackets when the port is
+// specified, e.g. "[::1]:3022", brackets are optional otherwise
 func ParseHostPortAddr(hostport string, defaultPort int) (*NetAddr, error) {
 	host, port, err := net.SplitHostPort(hostport)
 	if err != nil {
 		if defaultPort > 0 {
 			host, port, err = net.SplitHostPort(
-				net.JoinHostPort(hostport, strconv.Itoa(defaultPort)))
+				net.JoinHostPort(trimBrackets(hostport), strconv.Itoa(defaultPort)))
 		}
 		if err != nil {
-			return nil, trace.Errorf("failed to parse '%v': %v", hostport, err)
+			return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, hostport,
+				fmt.Sprintf("failed to parse: %v", err)))
 		}
 	}
+	// only IPv6 addresses can have colons in the host part
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, hostport,
+			"bad address, expected host:port"))
+	}
 	return ParseAddr(fmt.Sprintf("tcp://%s", net.JoinHostPort(host, port)))
 }
 
+// Canonical returns the canonical form of the address: the network is
+// explicit, "tcp" if it's not set, IP hosts are in their shortest form and
+// IPv6 hosts are enclosed in brackets, other hosts are lower case without
+// the trailing dot, and the port is explicit, defaultPort is used if the
+// address has none. Empty host, e.g. ":3022", stands for all interfaces
+// and is kept as is. Unix socket addresses are returned unchanged
+func (a NetAddr) Canonical(defaultPort int) (*NetAddr, error) {
+	switch a.AddrNetwork {
+	case "unix":
+		if a.Addr == "" {
+			return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.FullAddress(),
+				"unix socket path is missing"))
+		}
+		return &a, nil
+	case "", "tcp":
+	default:
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.FullAddress(),
+			fmt.Sprintf("unsupported network: '%v'", a.AddrNetwork)))
+	}
+	if a.Addr == "" {
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.Addr,
+			"address is missing"))
+	}
+	host, port, err := net.SplitHostPort(a.Addr)
+	if err != nil {
+		if defaultPort <= 0 {
+			return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.Addr,
+				"bad address, expected host:port"))
+		}
+		host, port = trimBrackets(a.Addr), strconv.Itoa(defaultPort)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.Addr,
+			fmt.Sprintf("bad port '%v', expected a number between 1 and 65535", port)))
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else if strings.Contains(host, ":") {
+		return nil, trace.Wrap(teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, a.Addr,
+			"bad address, expected host:port"))
+	} else {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	return &NetAddr{
+		Addr:        net.JoinHostPort(host, port),
+		AddrNetwork: "tcp",
+		Path:        a.Path,
+	}, nil
+}
+
+// trimBrackets removes brackets around IPv6 address without a port
+func trimBrackets(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
 func NewNetAddrVal(defaultVal NetAddr, val *NetAddr) *NetAddrVal {
 	*val = defaultVal
 	return (*NetAddrVal)(val)
@@ -226,13 +293,12 @@ func IsLocalhost(host string) bool {
 // IsLoopback returns 'true' if a given hostname resolves to local
 // host's loopback interface
 func IsLoopback(host string) bool {
-	if strings.Contains(host, ":") {
-		var err error
-		host, _, err = net.SplitHostPort(host)
-		if err != nil {
-			return false
-		}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if net.ParseIP(trimBrackets(host)) == nil && strings.Contains(host, ":") {
+		return false
 	}
+	host = trimBrackets(host)
 	ips, err := net.LookupIP(host)
 	if err != nil {
 		return false
@@ -244,3 +310,37 @@ func IsLoopback(host string) bool {
 	}
 	return false
 }
+
+// ParseCIDRs parses a list of IPv4 or IPv6 networks in CIDR notation,
+// e.g. "10.0.0.0/8" or "fd00::/8"
+func ParseCIDRs(cidrs []string) ([]net.IPNet, error) {
+	out := make([]net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, trace.Wrap(teleport.BadParameter("cidr",
+				fmt.Sprintf("invalid network %q: %v", cidr, err)))
+		}
+		out = append(out, *ipNet)
+	}
+	return out, nil
+}
+
+// AddrInNetworks returns true if the IP of a given address belongs
+// to any of the networks
+func AddrInNetworks(addr net.Addr, networks []net.IPNet) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(trimBrackets(host))
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -17,8 +17,12 @@ limitations under the License.
 package utils
 
 import (
-	. "gopkg.in/check.v1"
+	"net"
 	"testing"
+
+	"github.com/gravitational/teleport"
+
+	. "gopkg.in/check.v1"
 )
 
 func TestAddrSturct(t *testing.T) { TestingT(t) }
@@ -45,6 +49,41 @@ func (s *AddrTestSuite) TestParseHostPort(c *C) {
 	addr, err = ParseHostPortAddr("localhost", -1)
 	c.Assert(err, NotNil)
 	c.Assert(addr, IsNil)
+	c.Assert(teleport.ErrorCode(err), Equals, teleport.CodeInvalidListenAddr)
+}
+
+func (s *AddrTestSuite) TestParseIPv6(c *C) {
+	testCases := []struct {
+		in       string
+		port     int
+		expected string
+	}{
+		{in: "[::1]:3022", port: -1, expected: "[::1]:3022"},
+		{in: "[::]:3022", port: 1111, expected: "[::]:3022"},
+		{in: "[fe80::1]", port: 1111, expected: "[fe80::1]:1111"},
+		{in: "::1", port: 1111, expected: "[::1]:1111"},
+	}
+	for i, testCase := range testCases {
+		addr, err := ParseHostPortAddr(testCase.in, testCase.port)
+		c.Assert(err, IsNil, Commentf("test case %v", i))
+		c.Assert(addr.Addr, Equals, testCase.expected, Commentf("test case %v", i))
+	}
+
+	addr, err := ParseAddr("[::1]:3022")
+	c.Assert(err, IsNil)
+	c.Assert(addr.Addr, Equals, "[::1]:3022")
+	c.Assert(addr.FullAddress(), Equals, "tcp://[::1]:3022")
+	c.Assert(addr.IsLocal(), Equals, true)
+
+	addr, err = ParseAddr("tcp://[::1]:3022")
+	c.Assert(err, IsNil)
+	c.Assert(addr.Addr, Equals, "[::1]:3022")
+
+	// port is required with brackets off to tell it from the address
+	_, err = ParseHostPortAddr("::1", -1)
+	c.Assert(teleport.ErrorCode(err), Equals, teleport.CodeInvalidListenAddr)
+
+	c.Assert(ReplaceLocalhost("[::]:22", "[fe80::1]:399"), Equals, "[fe80::1]:22")
 }
 
 func (s *AddrTestSuite) TestEmpty(c *C) {
@@ -71,6 +110,44 @@ func (s *AddrTestSuite) TestParseDefaults(c *C) {
 	c.Assert(addr.IsEmpty(), Equals, false)
 }
 
+func (s *AddrTestSuite) TestCanonical(c *C) {
+	testCases := []struct {
+		in       NetAddr
+		expected NetAddr
+	}{
+		{NetAddr{Addr: "Host.Example.COM."}, NetAddr{Addr: "host.example.com:3022", AddrNetwork: "tcp"}},
+		{NetAddr{Addr: "10.0.0.1:22", AddrNetwork: "tcp"}, NetAddr{Addr: "10.0.0.1:22", AddrNetwork: "tcp"}},
+		{NetAddr{Addr: "[0:0:0:0:0:0:0:1]:22"}, NetAddr{Addr: "[::1]:22", AddrNetwork: "tcp"}},
+		{NetAddr{Addr: "::1"}, NetAddr{Addr: "[::1]:3022", AddrNetwork: "tcp"}},
+		{NetAddr{Addr: "[::ffff:10.0.0.1]"}, NetAddr{Addr: "10.0.0.1:3022", AddrNetwork: "tcp"}},
+		{NetAddr{Addr: ":22"}, NetAddr{Addr: ":22", AddrNetwork: "tcp"}},
+		{NetAddr{Addr: "host:22", AddrNetwork: "tcp", Path: "/v1"}, NetAddr{Addr: "host:22", AddrNetwork: "tcp", Path: "/v1"}},
+		{NetAddr{Addr: "/var/run/teleport.sock", AddrNetwork: "unix"}, NetAddr{Addr: "/var/run/teleport.sock", AddrNetwork: "unix"}},
+	}
+	for _, tc := range testCases {
+		out, err := tc.in.Canonical(3022)
+		c.Assert(err, IsNil, Commentf("%v", tc.in))
+		c.Assert(*out, DeepEquals, tc.expected, Commentf("%v", tc.in))
+		// canonical form is stable
+		again, err := out.Canonical(3022)
+		c.Assert(err, IsNil)
+		c.Assert(again, DeepEquals, out)
+	}
+
+	for _, in := range []NetAddr{
+		{},
+		{Addr: "host"},
+		{Addr: "host:0"},
+		{Addr: "host:65536"},
+		{Addr: "host:ssh"},
+		{Addr: "host:22", AddrNetwork: "udp"},
+		{AddrNetwork: "unix"},
+	} {
+		_, err := in.Canonical(0)
+		c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf("%v", in))
+	}
+}
+
 func (s *AddrTestSuite) TestReplaceLocalhost(c *C) {
 	var result string
 	result = ReplaceLocalhost("10.10.1.1", "192.168.1.100:399")
@@ -111,6 +188,8 @@ func (s *AddrTestSuite) TestLoopbackAddrs(c *C) {
 		{in: "localhost", expected: true},
 		{in: "localhost:5000", expected: true},
 		{in: "127.0.0.2:4003", expected: true},
+		{in: "::1", expected: true},
+		{in: "[::1]:5000", expected: true},
 		{in: "", expected: false},
 		{in: "bad-host.example.com", expected: false},
 		{in: "bad-host.example.com:443", expected: false},
@@ -120,3 +199,22 @@ func (s *AddrTestSuite) TestLoopbackAddrs(c *C) {
 			Commentf("test case %v, %v should be loopback(%v)", i, testCase.in, testCase.expected))
 	}
 }
+
+func (s *AddrTestSuite) TestCIDRs(c *C) {
+	networks, err := ParseCIDRs([]string{"10.0.0.0/8", " fd00::/8"})
+	c.Assert(err, IsNil)
+	c.Assert(networks, HasLen, 2)
+
+	addr := func(hostport string) net.Addr {
+		a, err := net.ResolveTCPAddr("tcp", hostport)
+		c.Assert(err, IsNil)
+		return a
+	}
+	c.Assert(AddrInNetworks(addr("10.1.2.3:3025"), networks), Equals, true)
+	c.Assert(AddrInNetworks(addr("[fd00::1]:3025"), networks), Equals, true)
+	c.Assert(AddrInNetworks(addr("192.168.1.1:3025"), networks), Equals, false)
+	c.Assert(AddrInNetworks(addr("[fe80::1]:3025"), networks), Equals, false)
+
+	_, err = ParseCIDRs([]string{"10.0.0.1"})
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
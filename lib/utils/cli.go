@@ -72,6 +72,49 @@ func InitLoggerForTests() {
 	log.SetOutput(ioutil.Discard)
 }
 
+// TagHook is a logrus hook that tags every log entry to tell apart logs
+// of many processes: JSON entries get a "tag" field and entries in other
+// formats are prefixed with the tag
+type TagHook struct {
+	Tag string
+}
+
+// Levels returns levels the hook fires on, all of them
+func (h *TagHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel, log.FatalLevel, log.ErrorLevel,
+		log.WarnLevel, log.InfoLevel, log.DebugLevel,
+	}
+}
+
+// Fire adds the tag to the entry
+func (h *TagHook) Fire(e *log.Entry) error {
+	if _, ok := e.Logger.Formatter.(*log.JSONFormatter); ok {
+		e.Data["tag"] = h.Tag
+		return nil
+	}
+	e.Message = fmt.Sprintf("[%v] %v", h.Tag, e.Message)
+	return nil
+}
+
+// SetLogTag tags all log entries of the standard logger, it replaces
+// the tag set before, an empty tag removes it
+func SetLogTag(tag string) {
+	logger := log.StandardLogger()
+	hooks := make(log.LevelHooks)
+	for level, levelHooks := range logger.Hooks {
+		for _, hook := range levelHooks {
+			if _, ok := hook.(*TagHook); !ok {
+				hooks[level] = append(hooks[level], hook)
+			}
+		}
+	}
+	logger.Hooks = hooks
+	if tag != "" {
+		logger.Hooks.Add(&TagHook{Tag: tag})
+	}
+}
+
 // FatalError is for CLI front-ends: it detects gravitational.Trace debugging
 // information, sends it to the logger, strips it off and prints a clean message to stderr
 func FatalError(err error) {
@@ -0,0 +1,49 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"syscall"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// magic numbers of filesystems that keep data in memory only,
+// from linux/magic.h
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// statfs is replaced in tests
+var statfs = syscall.Statfs
+
+// IsVolatileFS returns true if a given path is on a filesystem that
+// loses its contents on reboot, like tmpfs or ramfs
+func IsVolatileFS(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := statfs(path, &st); err != nil {
+		return false, trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	switch uint32(st.Type) {
+	case tmpfsMagic, ramfsMagic:
+		return true, nil
+	}
+	return false, nil
+}
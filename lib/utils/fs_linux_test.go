@@ -0,0 +1,73 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"reflect"
+	"syscall"
+
+	"github.com/gravitational/teleport"
+
+	. "gopkg.in/check.v1"
+)
+
+type FSSuite struct {
+}
+
+var _ = Suite(&FSSuite{})
+
+func (s *FSSuite) TearDownTest(c *C) {
+	statfs = syscall.Statfs
+}
+
+func (s *FSSuite) TestVolatileFS(c *C) {
+	fsType := uint32(0)
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		setFSType(st, fsType)
+		return nil
+	}
+	for _, t := range []struct {
+		fsType   uint32
+		volatile bool
+	}{
+		{fsType: tmpfsMagic, volatile: true},
+		{fsType: ramfsMagic, volatile: true},
+		{fsType: 0xEF53, volatile: false},     // ext4
+		{fsType: 0x58465342, volatile: false}, // xfs
+	} {
+		fsType = t.fsType
+		volatile, err := IsVolatileFS("/var/lib/teleport")
+		c.Assert(err, IsNil)
+		c.Assert(volatile, Equals, t.volatile, Commentf("fs type %x", t.fsType))
+	}
+
+	statfs = syscall.Statfs
+	_, err := IsVolatileFS("/path/does/not/exist")
+	c.Assert(teleport.IsNotFound(err), Equals, true)
+}
+
+// setFSType sets the filesystem type of st, Statfs_t.Type is int64,
+// int32 or uint32 depending on the architecture
+func setFSType(st *syscall.Statfs_t, fsType uint32) {
+	v := reflect.ValueOf(&st.Type).Elem()
+	switch v.Kind() {
+	case reflect.Int32, reflect.Int64:
+		v.SetInt(int64(fsType))
+	default:
+		v.SetUint(uint64(fsType))
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyPin is an SSH host key a server is expected to present
+type HostKeyPin struct {
+	fingerprint string
+}
+
+// ParseHostKeyPin parses the pinned host key, either a public key in
+// authorized_keys format or its SHA256 fingerprint as printed by
+// ssh-keygen -l, e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+func ParseHostKeyPin(pin string) (*HostKeyPin, error) {
+	pin = strings.TrimSpace(pin)
+	if strings.HasPrefix(pin, fingerprintPrefix) {
+		encoded := strings.TrimRight(strings.TrimPrefix(pin, fingerprintPrefix), "=")
+		hash, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, trace.Wrap(teleport.BadParameter("auth_server_host_key",
+				fmt.Sprintf("'%v' is not a valid SHA256 fingerprint", pin)))
+		}
+		return &HostKeyPin{fingerprint: fingerprintPrefix + encoded}, nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pin))
+	if err != nil {
+		return nil, trace.Wrap(teleport.BadParameter("auth_server_host_key",
+			fmt.Sprintf("expected a public key or a SHA256 fingerprint: %v", err)))
+	}
+	return &HostKeyPin{fingerprint: Fingerprint(key)}, nil
+}
+
+// Check returns an error if the key does not match the pin, certificates
+// match if they certify the pinned key
+func (p *HostKeyPin) Check(key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if fingerprint := Fingerprint(key); fingerprint != p.fingerprint {
+		return trace.Wrap(teleport.AccessDenied(
+			fmt.Sprintf("host key %v does not match the pinned key %v", fingerprint, p.fingerprint)))
+	}
+	return nil
+}
+
+// HostKeyCallback checks the key presented by the server in SSH handshake
+func (p *HostKeyPin) HostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	return p.Check(key)
+}
+
+// Fingerprint returns SHA256 fingerprint of the key in OpenSSH format
+func Fingerprint(key ssh.PublicKey) string {
+	hash := sha256.Sum256(key.Marshal())
+	return fingerprintPrefix + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+const fingerprintPrefix = "SHA256:"
@@ -0,0 +1,66 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+
+	"github.com/gravitational/teleport"
+
+	"golang.org/x/crypto/ssh"
+	. "gopkg.in/check.v1"
+)
+
+type HostKeySuite struct {
+}
+
+var _ = Suite(&HostKeySuite{})
+
+func (s *HostKeySuite) TestHostKeyPin(c *C) {
+	newKey := func() ssh.PublicKey {
+		priv, err := rsa.GenerateKey(rand.Reader, 1024)
+		c.Assert(err, IsNil)
+		pub, err := ssh.NewPublicKey(&priv.PublicKey)
+		c.Assert(err, IsNil)
+		return pub
+	}
+	key, other := newKey(), newKey()
+
+	for _, pin := range []string{
+		string(ssh.MarshalAuthorizedKey(key)),
+		Fingerprint(key),
+		Fingerprint(key) + "=",
+	} {
+		hostKeyPin, err := ParseHostKeyPin(pin)
+		c.Assert(err, IsNil, Commentf(pin))
+		c.Assert(hostKeyPin.Check(key), IsNil)
+		err = hostKeyPin.Check(other)
+		c.Assert(teleport.IsAccessDenied(err), Equals, true)
+	}
+
+	// certificate matches the pin of the certified key
+	hostKeyPin, err := ParseHostKeyPin(Fingerprint(key))
+	c.Assert(err, IsNil)
+	c.Assert(hostKeyPin.Check(&ssh.Certificate{Key: key}), IsNil)
+	c.Assert(hostKeyPin.Check(&ssh.Certificate{Key: other}), NotNil)
+
+	for _, pin := range []string{"", "SHA256:short", "MD5:aa:bb", "ssh-rsa garbage"} {
+		_, err := ParseHostKeyPin(pin)
+		c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf(pin))
+	}
+}
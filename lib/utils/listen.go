@@ -0,0 +1,41 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"net"
+
+	"github.com/gravitational/trace"
+)
+
+// Listen announces on the local network address like net.Listen does,
+// if reusePort is set TCP sockets are bound with SO_REUSEPORT, so a new
+// process can bind the same address before the old one exits
+func Listen(network, address string, reusePort bool) (net.Listener, error) {
+	if !reusePort || network == "unix" {
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return listener, nil
+	}
+	listener, err := listenReusePort(network, address)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// ReusePortSupported is true if listeners can be bound with SO_REUSEPORT
+const ReusePortSupported = true
+
+// soReusePort is SO_REUSEPORT from asm-generic/socket.h, the syscall
+// package doesn't define it
+const soReusePort = 0xf
+
+// listenReusePort creates a TCP socket with SO_REUSEPORT set before it's
+// bound and turns it into a listener
+func listenReusePort(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, trace.Wrap(teleport.BadParameter("network",
+			fmt.Sprintf("reuse_port is not supported for network '%v'", network)))
+	}
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	family, sockaddr := tcpSockaddr(network, addr)
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err == syscall.EAFNOSUPPORT && family == syscall.AF_INET6 && addr.IP == nil {
+		// no IPv6 on this host, listen on all IPv4 addresses instead
+		family, sockaddr = syscall.AF_INET, &syscall.SockaddrInet4{Port: addr.Port}
+		fd, err = syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	}
+	if err != nil {
+		return nil, trace.Wrap(os.NewSyscallError("socket", err))
+	}
+	// the file owns the descriptor from now on, net.FileListener
+	// makes a copy of it
+	file := os.NewFile(uintptr(fd), "reuseport:"+address)
+	defer file.Close()
+	if err = setReusePortOptions(fd, family, network == "tcp6"); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err = syscall.Bind(fd, sockaddr); err != nil {
+		return nil, trace.Wrap(os.NewSyscallError("bind", err))
+	}
+	if err = syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, trace.Wrap(os.NewSyscallError("listen", err))
+	}
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return listener, nil
+}
+
+// setReusePortOptions sets the options net.Listen sets on TCP sockets
+// and SO_REUSEPORT
+func setReusePortOptions(fd, family int, v6only bool) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return trace.Wrap(os.NewSyscallError("setsockopt", err))
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+		return trace.Wrap(os.NewSyscallError("setsockopt", err))
+	}
+	if family != syscall.AF_INET6 {
+		return nil
+	}
+	value := 0
+	if v6only {
+		value = 1
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, value); err != nil {
+		return trace.Wrap(os.NewSyscallError("setsockopt", err))
+	}
+	return nil
+}
+
+// tcpSockaddr returns the socket family and address to bind, addresses
+// without a host on "tcp" network accept both IPv4 and IPv6 like
+// net.Listen does
+func tcpSockaddr(network string, addr *net.TCPAddr) (int, syscall.Sockaddr) {
+	ip4 := addr.IP.To4()
+	if network == "tcp4" || (ip4 != nil && network != "tcp6") {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		if ip4 != nil {
+			copy(sa.Addr[:], ip4)
+		}
+		return syscall.AF_INET, sa
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	if addr.IP != nil {
+		copy(sa.Addr[:], addr.IP.To16())
+	}
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return syscall.AF_INET6, sa
+}
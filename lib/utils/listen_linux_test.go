@@ -0,0 +1,85 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ListenSuite struct {
+}
+
+var _ = Suite(&ListenSuite{})
+
+func (s *ListenSuite) TestReusePort(c *C) {
+	first, err := Listen("tcp", "127.0.0.1:0", true)
+	c.Assert(err, IsNil)
+	defer first.Close()
+	addr := first.Addr().String()
+
+	// another listener can bind the same port
+	second, err := Listen("tcp", addr, true)
+	c.Assert(err, IsNil)
+	defer second.Close()
+	c.Assert(second.Addr().String(), Equals, addr)
+
+	// but not without the option
+	_, err = Listen("tcp", addr, false)
+	c.Assert(err, NotNil)
+
+	// the listeners accept connections, the kernel picks either one
+	acceptedC := make(chan error, 2)
+	for _, listener := range []net.Listener{first, second} {
+		go func(listener net.Listener) {
+			conn, err := listener.Accept()
+			if err == nil {
+				conn.Close()
+			}
+			acceptedC <- err
+		}(listener)
+	}
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	select {
+	case err := <-acceptedC:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("connection was not accepted")
+	}
+}
+
+func (s *ListenSuite) TestReusePortAllAddresses(c *C) {
+	listener, err := Listen("tcp", ":0", true)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	c.Assert(err, IsNil)
+
+	go func() {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	c.Assert(err, IsNil)
+	conn.Close()
+}
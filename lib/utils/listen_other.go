@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"net"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// ReusePortSupported is true if listeners can be bound with SO_REUSEPORT
+const ReusePortSupported = false
+
+// listenReusePort fails as SO_REUSEPORT is only supported on Linux
+func listenReusePort(network, address string) (net.Listener, error) {
+	return nil, trace.Wrap(teleport.BadParameter("reuse_port", "SO_REUSEPORT is only supported on Linux"))
+}
@@ -24,10 +24,13 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravitational/teleport"
@@ -36,26 +39,124 @@ import (
 	"github.com/gravitational/trace"
 )
 
+// TLSOption is a functional option that modifies TLS configuration
+type TLSOption func(config *tls.Config) error
+
+// SetTLSMinVersion sets the minimum TLS version accepted by the server
+func SetTLSMinVersion(version uint16) TLSOption {
+	return func(config *tls.Config) error {
+		if version == 0 {
+			return nil
+		}
+		config.MinVersion = version
+		return nil
+	}
+}
+
+// SetTLSCipherSuites sets the list of cipher suites accepted by the server
+func SetTLSCipherSuites(suites []uint16) TLSOption {
+	return func(config *tls.Config) error {
+		if len(suites) == 0 {
+			return nil
+		}
+		config.CipherSuites = suites
+		return nil
+	}
+}
+
+// SetTLSCertificateHolder makes the server get certificates from the holder
+// on every handshake, so certificates reloaded into the holder are served
+// to new connections without restarting the listener
+func SetTLSCertificateHolder(holder *CertificateHolder) TLSOption {
+	return func(config *tls.Config) error {
+		config.Certificates = nil
+		config.GetCertificate = holder.GetCertificate
+		return nil
+	}
+}
+
+// SetTLSClientCA makes the server require client certificates signed
+// by one of the CAs from the PEM file and reject connections without them
+func SetTLSClientCA(caFile string) TLSOption {
+	return func(config *tls.Config) error {
+		bytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bytes) {
+			return trace.Wrap(teleport.BadParameter("client_ca",
+				fmt.Sprintf("no PEM certificates found in '%v'", caFile)))
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		return nil
+	}
+}
+
+// CertificateHolder holds a TLS certificate loaded from a pair of files
+// and allows to atomically replace it with the updated files' contents
+type CertificateHolder struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value
+}
+
+// NewCertificateHolder returns a holder with the certificate loaded
+// from the cert and key files
+func NewCertificateHolder(certFile, keyFile string) (*CertificateHolder, error) {
+	h := &CertificateHolder{certFile: certFile, keyFile: keyFile}
+	if err := h.Reload(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return h, nil
+}
+
+// Reload loads the certificate from the files again, the current
+// certificate is kept if the files can't be loaded
+func (h *CertificateHolder) Reload() error {
+	cert, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	h.cert.Store(&cert)
+	log.Infof("[PROXY] loaded TLS cert=%v key=%v", h.certFile, h.keyFile)
+	return nil
+}
+
+// GetCertificate returns the current certificate, it is used
+// as a tls.Config GetCertificate callback
+func (h *CertificateHolder) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.cert.Load().(*tls.Certificate), nil
+}
+
 // ListenAndServeTLS sets up TLS listener for the http handler
 // and blocks in listening and serving requests
 func ListenAndServeTLS(address string, handler http.Handler,
-	certFile, keyFile string) error {
+	certFile, keyFile string, opts ...TLSOption) error {
 
-	tlsConfig, err := CreateTLSConfiguration(certFile, keyFile)
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return trace.Wrap(err)
 	}
+	return ServeTLS(listener, handler, certFile, keyFile, opts...)
+}
+
+// ServeTLS serves HTTPS requests on the listener, it closes the listener
+// if TLS configuration is invalid
+func ServeTLS(listener net.Listener, handler http.Handler,
+	certFile, keyFile string, opts ...TLSOption) error {
 
-	listener, err := tls.Listen("tcp", address, tlsConfig)
+	tlsConfig, err := CreateTLSConfiguration(certFile, keyFile, opts...)
 	if err != nil {
+		listener.Close()
 		return trace.Wrap(err)
 	}
-
-	return http.Serve(listener, handler)
+	return http.Serve(tls.NewListener(listener, tlsConfig), handler)
 }
 
 // CreateTLSConfiguration sets up default TLS configuration
-func CreateTLSConfiguration(certFile, keyFile string) (*tls.Config, error) {
+func CreateTLSConfiguration(certFile, keyFile string, opts ...TLSOption) (*tls.Config, error) {
 	config := &tls.Config{}
 
 	if _, err := os.Stat(certFile); err != nil {
@@ -73,26 +174,117 @@ func CreateTLSConfiguration(certFile, keyFile string) (*tls.Config, error) {
 
 	config.Certificates = []tls.Certificate{cert}
 
-	config.CipherSuites = []uint16{
+	config.CipherSuites = DefaultCipherSuites()
+
+	config.MinVersion = tls.VersionTLS12
+	config.SessionTicketsDisabled = false
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(
+		DefaultLRUCapacity)
+
+	for _, o := range opts {
+		if err := o(config); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+
+	return config, nil
+}
+
+// DefaultCipherSuites returns a list of modern cipher suites
+// with forward secrecy and authenticated encryption
+func DefaultCipherSuites() []uint16 {
+	return []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+}
 
-		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+// tlsVersions maps supported TLS version names to their values
+var tlsVersions = map[string]uint16{
+	"tls1.0": tls.VersionTLS10,
+	"tls1.1": tls.VersionTLS11,
+	"tls1.2": tls.VersionTLS12,
+}
 
-		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+// cipherSuites maps cipher suite names as they appear in Go's crypto/tls
+// package to their values
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
 
-		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+// ParseTLSVersion parses TLS version name, e.g. "tls1.2"
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[strings.ToLower(name)]
+	if !ok {
+		return 0, trace.Wrap(teleport.BadParameter("tls_min_version",
+			fmt.Sprintf("unsupported TLS version: '%v', supported versions are tls1.0, tls1.1 and tls1.2", name)))
 	}
+	return version, nil
+}
 
-	config.MinVersion = tls.VersionTLS12
-	config.SessionTicketsDisabled = false
-	config.ClientSessionCache = tls.NewLRUClientSessionCache(
-		DefaultLRUCapacity)
+// ParseCipherSuites parses a list of cipher suite names, e.g.
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	out := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suite, ok := cipherSuites[strings.ToUpper(name)]
+		if !ok {
+			return nil, trace.Wrap(teleport.BadParameter("tls_cipher_suites",
+				fmt.Sprintf("unsupported cipher suite: '%v'", name)))
+		}
+		out = append(out, suite)
+	}
+	return out, nil
+}
 
-	return config, nil
+// TLSVersionName returns a name of the TLS version, e.g. "tls1.2"
+func TLSVersionName(version uint16) (string, error) {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name, nil
+		}
+	}
+	return "", trace.Wrap(teleport.BadParameter("tls_min_version",
+		fmt.Sprintf("unsupported TLS version: %#x", version)))
+}
+
+// CipherSuiteNames returns names of the cipher suites as they appear
+// in Go's crypto/tls package
+func CipherSuiteNames(suites []uint16) ([]string, error) {
+	out := make([]string, 0, len(suites))
+	for _, suite := range suites {
+		found := false
+		for name, s := range cipherSuites {
+			if s == suite {
+				out = append(out, name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, trace.Wrap(teleport.BadParameter("tls_cipher_suites",
+				fmt.Sprintf("unsupported cipher suite: %#x", suite)))
+		}
+	}
+	return out, nil
 }
 
 // TLSCredentials keeps the typical 3 components of a proper HTTPS configuration
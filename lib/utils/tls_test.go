@@ -0,0 +1,154 @@
+/*
+Copyright 2016 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/gravitational/teleport"
+
+	. "gopkg.in/check.v1"
+)
+
+type TLSSuite struct {
+}
+
+var _ = Suite(&TLSSuite{})
+
+func (s *TLSSuite) TestParseTLSVersion(c *C) {
+	version, err := ParseTLSVersion("tls1.2")
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, uint16(tls.VersionTLS12))
+
+	version, err = ParseTLSVersion("TLS1.1")
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, uint16(tls.VersionTLS11))
+
+	for _, name := range []string{"", "ssl3", "tls2.0", "1.2"} {
+		_, err = ParseTLSVersion(name)
+		c.Assert(teleport.IsBadParameter(err), Equals, true, Commentf(name))
+	}
+
+	name, err := TLSVersionName(tls.VersionTLS11)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "tls1.1")
+	_, err = TLSVersionName(0x0300)
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
+func (s *TLSSuite) TestParseCipherSuites(c *C) {
+	suites, err := ParseCipherSuites([]string{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"tls_ecdhe_ecdsa_with_aes_256_gcm_sha384",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(suites, DeepEquals, []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	})
+
+	_, err = ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NULL_WITH_NULL_NULL"})
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+
+	names, err := CipherSuiteNames(suites)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	})
+	_, err = CipherSuiteNames([]uint16{0})
+	c.Assert(teleport.IsBadParameter(err), Equals, true)
+}
+
+func (s *TLSSuite) TestCreateTLSConfiguration(c *C) {
+	creds, err := GenerateSelfSignedCert([]string{"localhost"})
+	c.Assert(err, IsNil)
+	dir := c.MkDir()
+	keyFile, certFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "cert.pem")
+	c.Assert(ioutil.WriteFile(keyFile, creds.PrivateKey, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(certFile, creds.Cert, 0600), IsNil)
+
+	// defaults
+	config, err := CreateTLSConfiguration(certFile, keyFile)
+	c.Assert(err, IsNil)
+	c.Assert(config.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Assert(config.CipherSuites, DeepEquals, DefaultCipherSuites())
+
+	// overrides
+	config, err = CreateTLSConfiguration(certFile, keyFile,
+		SetTLSMinVersion(tls.VersionTLS11),
+		SetTLSCipherSuites([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}))
+	c.Assert(err, IsNil)
+	c.Assert(config.MinVersion, Equals, uint16(tls.VersionTLS11))
+	c.Assert(config.CipherSuites, DeepEquals, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+}
+
+func (s *TLSSuite) TestCertificateHolder(c *C) {
+	dir := c.MkDir()
+	keyFile, certFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "cert.pem")
+	writeCert := func(hostname string) {
+		creds, err := GenerateSelfSignedCert([]string{hostname})
+		c.Assert(err, IsNil)
+		c.Assert(ioutil.WriteFile(keyFile, creds.PrivateKey, 0600), IsNil)
+		c.Assert(ioutil.WriteFile(certFile, creds.Cert, 0600), IsNil)
+	}
+	writeCert("old.example.com")
+
+	holder, err := NewCertificateHolder(certFile, keyFile)
+	c.Assert(err, IsNil)
+	config, err := CreateTLSConfiguration(certFile, keyFile, SetTLSCertificateHolder(holder))
+	c.Assert(err, IsNil)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	servedName := func() string {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		certs := conn.ConnectionState().PeerCertificates
+		c.Assert(certs, Not(HasLen), 0)
+		c.Assert(certs[0].DNSNames, HasLen, 1)
+		return certs[0].DNSNames[0]
+	}
+	c.Assert(servedName(), Equals, "old.example.com")
+
+	// renewed files are served after reload
+	writeCert("new.example.com")
+	c.Assert(servedName(), Equals, "old.example.com")
+	c.Assert(holder.Reload(), IsNil)
+	c.Assert(servedName(), Equals, "new.example.com")
+
+	// broken files keep the current certificate
+	c.Assert(ioutil.WriteFile(certFile, []byte("garbage"), 0600), IsNil)
+	c.Assert(holder.Reload(), NotNil)
+	c.Assert(servedName(), Equals, "new.example.com")
+}
@@ -23,6 +23,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 
@@ -79,6 +80,12 @@ func IsHandshakeFailedError(err error) bool {
 	return strings.Contains(err.Error(), "ssh: handshake failed")
 }
 
+// IsAuthenticationFailedError specifies whether this error indicates
+// that the server rejected the credentials during the handshake
+func IsAuthenticationFailedError(err error) bool {
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
 // IsShellFailedError specifies whether this error indicates
 // failed attempt to start shell
 func IsShellFailedError(err error) bool {
@@ -145,6 +152,67 @@ func ReadOrMakeHostUUID(dataDir string) (string, error) {
 	return string(bytes), nil
 }
 
+// EnsureDataDir creates the data directory if it's missing. If requireParent
+// is set, only the directory itself is created and its parent has to exist,
+// so a mistyped path is reported instead of silently creating a new tree
+func EnsureDataDir(dir string, requireParent bool) error {
+	if !requireParent {
+		return trace.Wrap(teleport.ConvertSystemError(os.MkdirAll(dir, os.ModeDir|0777)))
+	}
+	parent := filepath.Dir(filepath.Clean(dir))
+	fi, err := os.Stat(parent)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return trace.Wrap(teleport.NotFound(
+				fmt.Sprintf("parent directory '%v' of data dir '%v' does not exist", parent, dir)))
+		}
+		return trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	if !fi.IsDir() {
+		return trace.Wrap(teleport.BadParameter("data_dir",
+			fmt.Sprintf("parent of data dir '%v' is not a directory", dir)))
+	}
+	if err := os.Mkdir(dir, os.ModeDir|0777); err != nil && !os.IsExist(err) {
+		return trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	return nil
+}
+
+// NormalizeDomainName returns the canonical form of the cluster domain
+// name: lower case without the trailing dot. Domain names are compared
+// case-insensitively, but they are used as-is in authority IDs and backend
+// keys, so "Example.com" and "example.com" would not match otherwise
+func NormalizeDomainName(name string) (string, error) {
+	out := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if out == "" {
+		return "", trace.Wrap(teleport.BadParameter("domain_name", "domain name can't be empty"))
+	}
+	return out, nil
+}
+
+// CheckDomainName checks that the normalized domain name is a valid DNS
+// name. Clusters created before the check was introduced may have names
+// that fail it, so it is enforced for new clusters only
+func CheckDomainName(name string) error {
+	if len(name) > 253 {
+		return trace.Wrap(teleport.BadParameter("domain_name",
+			fmt.Sprintf("domain name '%v' is longer than 253 characters", name)))
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return trace.Wrap(teleport.BadParameter("domain_name",
+				fmt.Sprintf("domain name '%v' should have non-empty labels of at most 63 characters", name)))
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+				return trace.Wrap(teleport.BadParameter("domain_name",
+					fmt.Sprintf("domain name '%v' has invalid character %q", name, r)))
+			}
+		}
+	}
+	return nil
+}
+
 // PrintVersion prints human readable version
 func PrintVersion() {
 	ver := version.Get()
@@ -166,3 +234,21 @@ const (
 	// HostUUIDFile is the file name where the host UUID file is stored
 	HostUUIDFile = "host_uuid"
 )
+
+// RecoverPanic recovers from a panic in a request handler of a role and
+// logs it with the stack trace, so the process keeps serving requests of
+// this and other roles, cleanup functions are called after the panic is
+// recovered. It has to be deferred by the handler, panics are not
+// recovered if enabled is false
+func RecoverPanic(enabled bool, component, handler string, cleanup ...func()) {
+	if !enabled {
+		return
+	}
+	if r := recover(); r != nil {
+		log.WithFields(log.Fields{teleport.Component: component}).Errorf(
+			"recovered from panic in %v: %v\n%s", handler, r, debug.Stack())
+		for _, fn := range cleanup {
+			fn()
+		}
+	}
+}
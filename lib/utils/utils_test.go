@@ -16,8 +16,12 @@ limitations under the License.
 package utils
 
 import (
-	"gopkg.in/check.v1"
+	"strings"
 	"time"
+
+	"github.com/gravitational/teleport"
+
+	"gopkg.in/check.v1"
 )
 
 type UtilsSuite struct {
@@ -60,3 +64,30 @@ func (s *UtilsSuite) TestRandomDuration(c *check.C) {
 		c.Assert(dur < expectedMax, check.Equals, true)
 	}
 }
+
+func (s *UtilsSuite) TestNormalizeDomainName(c *check.C) {
+	for _, name := range []string{"example.com", "Example.COM", " example.com. ", "EXAMPLE.com."} {
+		out, err := NormalizeDomainName(name)
+		c.Assert(err, check.IsNil, check.Commentf(name))
+		c.Assert(out, check.Equals, "example.com", check.Commentf(name))
+	}
+	// host UUIDs are used as domain names by default
+	out, err := NormalizeDomainName("5B9E0A5C-7A8B-4C9D-8E1F-2A3B4C5D6E7F")
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, "5b9e0a5c-7a8b-4c9d-8e1f-2a3b4c5d6e7f")
+
+	for _, name := range []string{"", " ", "."} {
+		_, err := NormalizeDomainName(name)
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf(name))
+	}
+}
+
+func (s *UtilsSuite) TestCheckDomainName(c *check.C) {
+	for _, name := range []string{"example.com", "localhost", "5b9e0a5c-7a8b-4c9d-8e1f-2a3b4c5d6e7f", "a_b.example.com"} {
+		c.Assert(CheckDomainName(name), check.IsNil, check.Commentf(name))
+	}
+	for _, name := range []string{"example..com", "exa mple.com", "example.com/a", strings.Repeat("a", 64) + ".com"} {
+		err := CheckDomainName(name)
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf(name))
+	}
+}
@@ -85,6 +85,8 @@ type Config struct {
 	AuthServers utils.NetAddr
 	// DomainName is a domain name served by web handler
 	DomainName string
+	// SecurityHeaders configures security headers sent with responses
+	SecurityHeaders httplib.SecurityHeaders
 }
 
 // Version is a current webapi version
@@ -154,6 +156,7 @@ func NewHandler(cfg Config, opts ...HandlerOption) (http.Handler, error) {
 	h.GET("/webapi/sites/:site/sessions/:sid/chunkscount", h.withSiteAuth(h.siteSessionGetChunksCount))
 
 	routingHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httplib.SetSecurityHeaders(w, cfg.SecurityHeaders)
 		if r.URL.Path == "/" {
 			http.Redirect(w, r, "/web", http.StatusFound)
 		} else if strings.HasPrefix(r.URL.Path, "/web/app") {
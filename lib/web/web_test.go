@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
@@ -39,6 +40,7 @@ import (
 	"github.com/gravitational/teleport/lib/backend/boltbk"
 	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/events/boltlog"
+	"github.com/gravitational/teleport/lib/httplib"
 	"github.com/gravitational/teleport/lib/recorder/boltrec"
 	"github.com/gravitational/teleport/lib/reversetunnel"
 	"github.com/gravitational/teleport/lib/services"
@@ -118,6 +120,7 @@ func (s *WebSuite) SetUpTest(c *C) {
 		eventsLog,
 		sessionServer,
 		teleport.RoleAdmin,
+		"",
 		recorder)
 
 	// set up host private key and certificate
@@ -225,6 +228,46 @@ func (s *WebSuite) TearDownTest(c *C) {
 	s.webServer.Close()
 }
 
+func (s *WebSuite) TestSecurityHeaders(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html></html>"), 0644), IsNil)
+
+	headers := httplib.DefaultSecurityHeaders()
+	headers.HSTSIncludeSubdomains = true
+	handler, err := NewHandler(Config{
+		AssetsDir:       dir,
+		AuthServers:     utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:0"},
+		SecurityHeaders: headers,
+	})
+	c.Assert(err, IsNil)
+	srv := httptest.NewTLSServer(handler)
+	defer srv.Close()
+
+	re, err := newInsecureClient().Get(srv.URL + "/web")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000; includeSubDomains")
+	c.Assert(re.Header.Get("X-Content-Type-Options"), Equals, "nosniff")
+	c.Assert(re.Header.Get("X-Frame-Options"), Equals, "DENY")
+	c.Assert(re.Header.Get("Content-Security-Policy"), Equals, headers.ContentSecurityPolicy)
+
+	// headers are not sent if turned off
+	handler, err = NewHandler(Config{
+		AssetsDir:   dir,
+		AuthServers: utils.NetAddr{AddrNetwork: "tcp", Addr: "127.0.0.1:0"},
+	})
+	c.Assert(err, IsNil)
+	srv2 := httptest.NewTLSServer(handler)
+	defer srv2.Close()
+
+	re, err = newInsecureClient().Get(srv2.URL + "/web")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "")
+	c.Assert(re.Header.Get("X-Frame-Options"), Equals, "")
+}
+
 func (s *WebSuite) TestNewUser(c *C) {
 	token, err := s.roleAuth.CreateSignupToken("bob", []string{s.user})
 	c.Assert(err, IsNil)
@@ -34,6 +34,7 @@ import (
 	"github.com/gravitational/teleport/lib/utils"
 	"github.com/gravitational/teleport/lib/web"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/buger/goterm"
 	"github.com/gravitational/trace"
 	"golang.org/x/crypto/ssh"
@@ -41,6 +42,8 @@ import (
 
 type CLIConfig struct {
 	Debug bool
+	// ConfigFile is a path to the teleport configuration file
+	ConfigFile string
 }
 
 type UserCommand struct {
@@ -51,6 +54,8 @@ type UserCommand struct {
 
 type NodeCommand struct {
 	config *service.Config
+	// count is a number of nodes the invite token can add
+	count int
 }
 
 type AuthCommand struct {
@@ -86,6 +91,9 @@ func main() {
 	app.Flag("debug", "Enable verbose logging to stderr").
 		Short('d').
 		BoolVar(&ccf.Debug)
+	app.Flag("config",
+		fmt.Sprintf("Path to a teleport configuration file [%v]", defaults.ConfigFilePath)).
+		Short('c').ExistingFileVar(&ccf.ConfigFile)
 
 	// commands:
 	ver := app.Command("version", "Print the version.")
@@ -111,6 +119,7 @@ func main() {
 	nodes := app.Command("nodes", "Issue invites for other nodes to join the cluster")
 	nodeAdd := nodes.Command("add", "Adds a new SSH node to join the cluster")
 	nodeAdd.Alias(AddNodeHelp)
+	nodeAdd.Flag("count", "Number of nodes that can join the cluster with the token").Default("1").IntVar(&cmdNodes.count)
 	nodeList := nodes.Command("ls", "Lists all active SSH nodes within the cluster")
 	nodeList.Alias(ListNodesHelp)
 
@@ -148,7 +157,7 @@ func main() {
 		utils.InitLoggerDebug()
 	}
 
-	validateConfig(cfg)
+	validateConfig(cfg, ccf.ConfigFile)
 
 	// connect to the teleport auth service:
 	client, err := connectToAuthService(cfg)
@@ -257,7 +266,7 @@ func (u *UserCommand) Delete(client *auth.TunClient) error {
 // Invite generates a token which can be used to add another SSH node
 // to a cluster
 func (u *NodeCommand) Invite(client *auth.TunClient) error {
-	token, err := client.GenerateToken(teleport.RoleNode, defaults.MaxProvisioningTokenTTL)
+	token, err := client.GenerateTokenWithUses(teleport.RoleNode, defaults.MaxProvisioningTokenTTL, u.count)
 	if err != nil {
 		return trace.Wrap(err)
 	}
@@ -425,7 +434,8 @@ func connectToAuthService(cfg *service.Config) (client *auth.TunClient, err erro
 	}
 
 	// read the host SSH keys and use them to open an SSH connection to the auth service
-	i, err := auth.ReadIdentity(cfg.DataDir, auth.IdentityID{Role: teleport.RoleAdmin, HostUUID: cfg.HostUUID})
+	i, err := auth.ReadIdentity(cfg.DataDir, auth.IdentityID{Role: teleport.RoleAdmin, HostUUID: cfg.HostUUID},
+		auth.IdentityPassphrase([]byte(cfg.KeyPassphrase)))
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -448,11 +458,70 @@ func connectToAuthService(cfg *service.Config) (client *auth.TunClient, err erro
 }
 
 // validateConfig updtes&validates tctl configuration
-func validateConfig(cfg *service.Config) {
-	var err error
+func validateConfig(cfg *service.Config, configPath string) {
+	fc, err := readConfigFile(configPath)
+	if err != nil {
+		utils.FatalError(err)
+	}
+	// the admin identity is in the data dir of the teleport process,
+	// pick it the same way teleport does
+	if fc == nil || fc.Storage.DirName == "" {
+		dir, err := service.FallbackDataDir(os.Geteuid(), cfg.DataDir)
+		if err != nil {
+			utils.FatalError(err)
+		}
+		if dir != "" {
+			cfg.DataDir = dir
+		}
+	}
+	// the admin identity is encrypted with the passphrase of the
+	// teleport process, read it the same way teleport does
+	cfg.KeyPassphrase, err = readKeyPassphrase(fc)
+	if err != nil {
+		utils.FatalError(err)
+	}
 	// read or generate a host UUID for this node
 	cfg.HostUUID, err = utils.ReadOrMakeHostUUID(cfg.DataDir)
 	if err != nil {
 		utils.FatalError(err)
 	}
 }
+
+// readConfigFile reads the teleport config file set with --config, it
+// falls back to /etc/teleport.yaml and returns nil if that one is
+// missing or can't be read
+func readConfigFile(configPath string) (*config.FileConfig, error) {
+	if configPath != "" {
+		fc, err := config.ReadFromFile(configPath)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return fc, nil
+	}
+	if _, err := os.Stat(defaults.ConfigFilePath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	fc, err := config.ReadFromFile(defaults.ConfigFilePath)
+	if err != nil {
+		log.Warningf("ignoring %v: %v", defaults.ConfigFilePath, err)
+		return nil, nil
+	}
+	return fc, nil
+}
+
+// readKeyPassphrase reads the passphrase of host identities from the
+// teleport config file, the environment variable takes precedence
+// over the file
+func readKeyPassphrase(fc *config.FileConfig) (string, error) {
+	if passphrase := os.Getenv(teleport.KeyPassphraseEnvVar); passphrase != "" {
+		return passphrase, nil
+	}
+	if fc == nil {
+		return "", nil
+	}
+	passphrase, err := fc.KeyPassphrase()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return passphrase, nil
+}
@@ -21,19 +21,26 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"time"
 	"unicode"
 
 	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth"
 	"github.com/gravitational/teleport/lib/backend/etcdbk"
 	"github.com/gravitational/teleport/lib/client"
 	"github.com/gravitational/teleport/lib/config"
 	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events/webhook"
 	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/secrets"
 	"github.com/gravitational/teleport/lib/service"
 	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/sshutils"
 	"github.com/gravitational/teleport/lib/utils"
 
 	log "github.com/Sirupsen/logrus"
@@ -55,6 +62,8 @@ type CommandLineFlags struct {
 	AdvertiseIP net.IP
 	// --config flag
 	ConfigFile string
+	// --config-dir flag
+	ConfigDir string
 	// --roles flag
 	Roles string
 	// -d flag
@@ -63,11 +72,14 @@ type CommandLineFlags struct {
 	Labels string
 	// --httpprofile hidden flag
 	HTTPProfileEndpoint bool
+	// --diag-addr flag
+	DiagnosticAddr string
 }
 
 // readConfigFile reads /etc/teleport.yaml (or whatever is passed via --config flag)
-// and overrides values in 'cfg' structure
-func readConfigFile(cliConfigPath string) (*config.FileConfig, error) {
+// and overrides values in 'cfg' structure. Fragments from --config-dir are
+// merged under it
+func readConfigFile(cliConfigPath, cliConfigDir string) (*config.FileConfig, error) {
 	configFilePath := defaults.ConfigFilePath
 	// --config tells us to use a specific conf. file:
 	if cliConfigPath != "" {
@@ -76,6 +88,16 @@ func readConfigFile(cliConfigPath string) (*config.FileConfig, error) {
 			return nil, trace.Errorf("file not found: %s", configFilePath)
 		}
 	}
+	if cliConfigDir != "" {
+		if fi, err := os.Stat(cliConfigDir); err != nil || !fi.IsDir() {
+			return nil, trace.Errorf("directory not found: %s", cliConfigDir)
+		}
+		if !fileExists(configFilePath) {
+			configFilePath = ""
+		}
+		log.Debugf("reading config dir: %v, config file: %v", cliConfigDir, configFilePath)
+		return config.ReadFromDir(cliConfigDir, configFilePath)
+	}
 	// default config doesn't exist? quietly return:
 	if !fileExists(configFilePath) {
 		log.Info("not using a config file")
@@ -92,26 +114,40 @@ func applyFileConfig(fc *config.FileConfig, cfg *service.Config) error {
 	if fc == nil {
 		return nil
 	}
+	// apply "default_roles" setting, "enabled" flags of the services
+	// and --roles flag take precedence over it
+	if len(fc.DefaultRoles) != 0 {
+		roles := strings.Join(fc.DefaultRoles, ",")
+		if err := validateRoles(roles); err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.SSH.Enabled = strings.Index(roles, defaults.RoleNode) != -1
+		cfg.Auth.Enabled = strings.Index(roles, defaults.RoleAuthService) != -1
+		cfg.Proxy.Enabled = strings.Index(roles, defaults.RoleProxy) != -1
+	}
 	// merge file-based config with defaults in 'cfg'
-	if fc.Auth.Disabled() {
-		cfg.Auth.Enabled = false
+	if fc.Auth.Configured() {
+		cfg.Auth.Enabled = fc.Auth.Enabled()
 	}
-	if fc.SSH.Disabled() {
-		cfg.SSH.Enabled = false
+	if fc.SSH.Configured() {
+		cfg.SSH.Enabled = fc.SSH.Enabled()
 	}
-	if fc.Proxy.Disabled() {
-		cfg.Proxy.Enabled = false
+	if fc.Proxy.Configured() {
+		cfg.Proxy.Enabled = fc.Proxy.Enabled()
 	}
 	applyString(fc.NodeName, &cfg.Hostname)
 
 	// apply "advertise_ip" setting:
 	advertiseIP := fc.AdvertiseIP
 	if advertiseIP != nil {
-		if err := validateAdvertiseIP(advertiseIP); err != nil {
+		if err := validateAdvertiseIP(advertiseIP, fc.RequireLocalAdvertiseIP()); err != nil {
 			return trace.Wrap(err)
 		}
 		cfg.AdvertiseIP = advertiseIP
 	}
+	if fc.AdvertiseIPCheck {
+		cfg.AdvertiseIPCheck = true
+	}
 
 	// config file has auth servers in there?
 	if len(fc.AuthServers) > 0 {
@@ -119,26 +155,201 @@ func applyFileConfig(fc *config.FileConfig, cfg *service.Config) error {
 		for _, as := range fc.AuthServers {
 			addr, err := utils.ParseAddr(as)
 			if err != nil {
-				return trace.Errorf("cannot parse auth server address: '%v'", as)
+				return trace.Wrap(invalidAddr("teleport.auth_servers", as))
 			}
 			cfg.AuthServers = append(cfg.AuthServers, *addr)
 		}
 	}
-	cfg.ApplyToken(fc.AuthToken)
-	cfg.Auth.DomainName = fc.Auth.DomainName
+	if fc.MaxAuthServers < 0 {
+		return trace.Wrap(teleport.BadParameter("max_auth_servers",
+			fmt.Sprintf("max auth servers can't be negative: %v", fc.MaxAuthServers)))
+	}
+	if fc.MaxAuthServers > 0 {
+		cfg.MaxAuthServers = fc.MaxAuthServers
+	}
+	if fc.AuthServerHostKey != "" {
+		if _, err := utils.ParseHostKeyPin(fc.AuthServerHostKey); err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.AuthServerHostKey = fc.AuthServerHostKey
+	}
+	if fc.AuthServerStrategy != "" {
+		strategy := auth.AuthServerStrategy(fc.AuthServerStrategy)
+		if err := strategy.Check(); err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.AuthServerStrategy = strategy
+	}
+	if fc.StartMode != "" {
+		mode := service.StartMode(fc.StartMode)
+		if err := mode.Check(); err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.StartMode = mode
+	}
+	if fc.HostCertCheck != "" {
+		check := service.HostCertCheck(fc.HostCertCheck)
+		if err := check.Check(); err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.HostCertCheck = check
+	}
+	if fc.MinKeySize < 0 {
+		return trace.Wrap(teleport.BadParameter("min_key_size",
+			fmt.Sprintf("min key size can't be negative: %v", fc.MinKeySize)))
+	}
+	if fc.MinKeySize > 0 {
+		cfg.MinKeySize = fc.MinKeySize
+	}
+	if fc.RegisterRetries < 0 {
+		return trace.Wrap(teleport.BadParameter("register_retries",
+			fmt.Sprintf("register retries can't be negative: %v", fc.RegisterRetries)))
+	}
+	if fc.RegisterRetries > 0 {
+		cfg.RegisterRetries = fc.RegisterRetries
+	}
+	if fc.AuthCacheTTL < 0 {
+		return trace.Wrap(teleport.BadParameter("auth_cache_ttl",
+			fmt.Sprintf("auth cache TTL can't be negative: %v", fc.AuthCacheTTL)))
+	}
+	if fc.AuthCacheTTL > 0 {
+		cfg.AuthCacheTTL = fc.AuthCacheTTL
+	}
+	if fc.ShutdownTimeout < 0 {
+		return trace.Wrap(teleport.BadParameter("shutdown_timeout",
+			fmt.Sprintf("shutdown timeout can't be negative: %v", fc.ShutdownTimeout)))
+	}
+	if fc.ShutdownTimeout > 0 {
+		cfg.ShutdownTimeout = fc.ShutdownTimeout
+	}
+	if fc.ClockSkew != nil {
+		if *fc.ClockSkew < 0 {
+			return trace.Wrap(teleport.BadParameter("clock_skew",
+				fmt.Sprintf("clock skew can't be negative: %v", *fc.ClockSkew)))
+		}
+		cfg.ClockSkew = *fc.ClockSkew
+	}
+	if fc.ReusePort {
+		if !utils.ReusePortSupported {
+			return trace.Wrap(teleport.BadParameter("reuse_port",
+				fmt.Sprintf("reuse_port is only supported on Linux, not on %v", runtime.GOOS)))
+		}
+		cfg.ReusePort = true
+	}
+	if fc.ConnectionLogging {
+		cfg.ConnectionLogging = true
+	}
+	if fc.PanicRecovery != nil {
+		cfg.PanicRecovery = *fc.PanicRecovery
+	}
+	if fc.AuditConfigLoad {
+		cfg.AuditConfigLoad = true
+	}
+	if fc.PostStartTimeout < 0 {
+		return trace.Wrap(teleport.BadParameter("post_start_timeout",
+			fmt.Sprintf("post start timeout can't be negative: %v", fc.PostStartTimeout)))
+	}
+	if len(fc.PostStartCommand) != 0 {
+		cfg.PostStart.Command = fc.PostStartCommand
+		if fc.PostStartTimeout > 0 {
+			cfg.PostStart.Timeout = fc.PostStartTimeout
+		}
+		cfg.PostStart.AbortOnError = fc.PostStartAbortOnError
+	}
+	if fc.HeartbeatTTL < 0 {
+		return trace.Wrap(teleport.BadParameter("heartbeat_ttl",
+			fmt.Sprintf("heartbeat TTL should be positive: %v", fc.HeartbeatTTL)))
+	}
+	if fc.HeartbeatTTL > 0 {
+		cfg.HeartbeatTTL = fc.HeartbeatTTL
+	}
+	if fc.AuthServersRefreshPeriod < 0 {
+		return trace.Wrap(teleport.BadParameter("auth_servers_refresh_period",
+			fmt.Sprintf("auth servers refresh period should be positive: %v", fc.AuthServersRefreshPeriod)))
+	}
+	if fc.AuthServersRefreshPeriod > 0 {
+		cfg.AuthServersRefreshPeriod = fc.AuthServersRefreshPeriod
+	}
+	if cfg.AuthServersRefreshPeriod >= cfg.HeartbeatTTL {
+		return trace.Wrap(teleport.BadParameter("auth_servers_refresh_period",
+			fmt.Sprintf("auth servers refresh period %v should be smaller than heartbeat TTL %v",
+				cfg.AuthServersRefreshPeriod, cfg.HeartbeatTTL)))
+	}
+	token, err := secrets.Resolve(fc.AuthToken)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	cfg.ApplyToken(token)
+	if fc.Auth.DomainName != "" {
+		cfg.Auth.DomainName, err = utils.NormalizeDomainName(fc.Auth.DomainName)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if len(fc.Auth.AllowedSourceCIDRs) != 0 {
+		networks, err := utils.ParseCIDRs(fc.Auth.AllowedSourceCIDRs)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.Auth.AllowedSourceCIDRs = networks
+	}
+	if err := applyAllowedTokens(fc.Auth.Tokens, cfg); err != nil {
+		return trace.Wrap(err)
+	}
+
+	// apply "diag_addr" setting:
+	if fc.DiagAddr != "" {
+		addr, err := parseAddr("teleport.diag_addr", fc.DiagAddr, int(defaults.DiagnosticListenPort))
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.DiagnosticAddr = *addr
+	}
 
 	// configure storage:
+	cfg.RequireExistingDataDir = fc.Storage.RequireExistingDataDir
+	cfg.RequirePersistentDataDir = fc.Storage.RequirePersistentDataDir
+	if fc.Storage.CheckTimeout < 0 {
+		return trace.Wrap(teleport.BadParameter("check_timeout",
+			fmt.Sprintf("storage check timeout can't be negative: %v", fc.Storage.CheckTimeout)))
+	}
+	if fc.Storage.CheckTimeout > 0 {
+		cfg.Auth.BackendCheckTimeout = fc.Storage.CheckTimeout
+	}
+	if fc.KeyPassphraseFile != "" {
+		cfg.KeyPassphrase, err = fc.KeyPassphrase()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if err := fc.Storage.Check(); err != nil {
+		return trace.Wrap(err)
+	}
+	// bolt files stay in the data dir picked before, possibly the
+	// user data dir, unless data_dir is set
+	dataDir := fc.Storage.DirName
+	if dataDir == "" {
+		dataDir = cfg.DataDir
+	}
 	switch fc.Storage.Type {
 	case teleport.BoltBackendType:
-		cfg.ConfigureBolt(fc.Storage.DirName)
+		cfg.ConfigureBolt(dataDir)
 	case teleport.ETCDBackendType:
+		if fc.Storage.QuorumCheckPeriod < 0 {
+			return trace.Wrap(teleport.BadParameter("quorum_check_period",
+				fmt.Sprintf("quorum check period can't be negative: %v", fc.Storage.QuorumCheckPeriod)))
+		}
 		if err := cfg.ConfigureETCD(
-			fc.Storage.DirName, etcdbk.Config{
+			dataDir, etcdbk.Config{
 				Nodes:       fc.Storage.Peers,
+				NodesFile:   fc.Storage.PeersFile,
 				Key:         fc.Storage.Prefix,
 				TLSKeyFile:  fc.Storage.TLSKeyFile,
 				TLSCertFile: fc.Storage.TLSCertFile,
 				TLSCAFile:   fc.Storage.TLSCAFile,
+
+				ForceClusterName:  fc.Storage.ForceClusterName,
+				QuorumCheckPeriod: fc.Storage.QuorumCheckPeriod,
 			}); err != nil {
 			return trace.Wrap(err)
 		}
@@ -148,6 +359,9 @@ func applyFileConfig(fc *config.FileConfig, cfg *service.Config) error {
 		return trace.Wrap(teleport.BadParameter(
 			"storage", fmt.Sprintf("unsupported storage type: '%v'", fc.Storage.Type)))
 	}
+	if err := cfg.Auth.CheckStorage(); err != nil {
+		return trace.Wrap(err)
+	}
 
 	// apply logger settings
 	switch fc.Logger.Output {
@@ -180,71 +394,203 @@ func applyFileConfig(fc *config.FileConfig, cfg *service.Config) error {
 		return trace.Errorf("unsupported logger severity: '%v'", fc.Logger.Severity)
 	}
 	// apply connection throttling:
-	limiters := []limiter.LimiterConfig{
-		cfg.SSH.Limiter,
-		cfg.Auth.Limiter,
-		cfg.Proxy.Limiter,
+	if err := applyConnectionLimits(fc.Limits, cfg); err != nil {
+		return trace.Wrap(err)
 	}
-	for _, l := range limiters {
-		if fc.Limits.MaxConnections > 0 {
-			l.MaxConnections = fc.Limits.MaxConnections
-		}
-		if fc.Limits.MaxUsers > 0 {
-			l.MaxNumberOfUsers = fc.Limits.MaxUsers
+	cfg.SSH.Limiter.Disabled = fc.SSH.Limits.Disabled
+	cfg.Auth.Limiter.Disabled = fc.Auth.Limits.Disabled
+	cfg.Proxy.Limiter.Disabled = fc.Proxy.Limits.Disabled
+	for _, l := range []struct {
+		service string
+		limits  config.ServiceLimits
+		limiter *limiter.LimiterConfig
+	}{
+		{"ssh_service", fc.SSH.Limits, &cfg.SSH.Limiter},
+		{"auth_service", fc.Auth.Limits, &cfg.Auth.Limiter},
+		{"proxy_service", fc.Proxy.Limits, &cfg.Proxy.Limiter},
+	} {
+		if l.limits.WarnThreshold < 0 {
+			return trace.Wrap(teleport.BadParameter("warn_threshold",
+				fmt.Sprintf("%v warn threshold can't be negative: %v", l.service, l.limits.WarnThreshold)))
 		}
-		for _, rate := range fc.Limits.Rates {
-			l.Rates = append(l.Rates, limiter.Rate{
-				Period:  rate.Period,
-				Average: rate.Average,
-				Burst:   rate.Burst,
-			})
+		if l.limiter.MaxConnections > 0 && l.limits.WarnThreshold >= l.limiter.MaxConnections {
+			return trace.Wrap(teleport.BadParameter("warn_threshold",
+				fmt.Sprintf("%v warn threshold %v should be below max_connections %v",
+					l.service, l.limits.WarnThreshold, l.limiter.MaxConnections)))
 		}
+		l.limiter.WarnThreshold = l.limits.WarnThreshold
 	}
+
 	// apply "proxy_service" section
 	if fc.Proxy.ListenAddress != "" {
-		addr, err := utils.ParseHostPortAddr(fc.Proxy.ListenAddress, int(defaults.SSHProxyListenPort))
+		addr, err := parseAddr("proxy_service.listen_addr", fc.Proxy.ListenAddress, int(defaults.SSHProxyListenPort))
 		if err != nil {
 			return trace.Wrap(err)
 		}
 		cfg.Proxy.SSHAddr = *addr
 	}
 	if fc.Proxy.WebAddr != "" {
-		addr, err := utils.ParseHostPortAddr(fc.Proxy.WebAddr, int(defaults.HTTPListenPort))
+		addr, err := parseAddr("proxy_service.web_listen_addr", fc.Proxy.WebAddr, int(defaults.HTTPListenPort))
 		if err != nil {
 			return trace.Wrap(err)
 		}
 		cfg.Proxy.WebAddr = *addr
 	}
+	// secret references are kept as is, they are fetched and saved
+	// in the data dir by writeSecretFiles on start
 	if fc.Proxy.KeyFile != "" {
-		if !fileExists(fc.Proxy.KeyFile) {
+		if !secrets.IsReference(fc.Proxy.KeyFile) && !fileExists(fc.Proxy.KeyFile) {
 			return trace.Errorf("https key does not exist: %s", fc.Proxy.KeyFile)
 		}
 		cfg.Proxy.TLSKey = fc.Proxy.KeyFile
 	}
 	if fc.Proxy.CertFile != "" {
-		if !fileExists(fc.Proxy.CertFile) {
+		if !secrets.IsReference(fc.Proxy.CertFile) && !fileExists(fc.Proxy.CertFile) {
 			return trace.Errorf("https cert does not exist: %s", fc.Proxy.CertFile)
 		}
 		cfg.Proxy.TLSCert = fc.Proxy.CertFile
 	}
+	if fc.Proxy.RequireProvidedTLS {
+		cfg.Proxy.RequireProvidedTLS = true
+	}
+	if fc.Proxy.EnableReverseTunnel != nil {
+		cfg.Proxy.ReverseTunnelEnabled = *fc.Proxy.EnableReverseTunnel
+	}
+	if fc.Proxy.TLSMinVersion != "" {
+		version, err := utils.ParseTLSVersion(fc.Proxy.TLSMinVersion)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.Proxy.TLSMinVersion = version
+	}
+	if len(fc.Proxy.TLSCipherSuites) != 0 {
+		suites, err := utils.ParseCipherSuites(fc.Proxy.TLSCipherSuites)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.Proxy.TLSCipherSuites = suites
+	}
+	headers := fc.Proxy.SecurityHeaders
+	cfg.Proxy.SecurityHeaders.Enabled = headers.Enabled()
+	if headers.HSTSMaxAge != 0 {
+		cfg.Proxy.SecurityHeaders.HSTSMaxAge = headers.HSTSMaxAge
+	}
+	if headers.HSTSIncludeSubdomains {
+		cfg.Proxy.SecurityHeaders.HSTSIncludeSubdomains = true
+	}
+	applyString(headers.FrameOptions, &cfg.Proxy.SecurityHeaders.FrameOptions)
+	applyString(headers.ContentSecurityPolicy, &cfg.Proxy.SecurityHeaders.ContentSecurityPolicy)
 
 	// apply "auth_service" section
 	if fc.Auth.ListenAddress != "" {
-		addr, err := utils.ParseHostPortAddr(fc.Auth.ListenAddress, int(defaults.AuthListenPort))
+		addr, err := parseAddr("auth_service.listen_addr", fc.Auth.ListenAddress, int(defaults.AuthListenPort))
 		if err != nil {
 			return trace.Wrap(err)
 		}
 		cfg.Auth.SSHAddr = *addr
 	}
+	if fc.Auth.EnableSSHTunnel != nil {
+		cfg.Auth.TunnelEnabled = *fc.Auth.EnableSSHTunnel
+	}
+	if fc.Auth.HTTPListenAddress != "" {
+		addr, err := parseAddr("auth_service.http_listen_addr", fc.Auth.HTTPListenAddress, int(defaults.AuthHTTPListenPort))
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.Auth.HTTPAddr = *addr
+	}
+	if fc.Auth.KeyFile != "" {
+		if !fileExists(fc.Auth.KeyFile) {
+			return trace.Errorf("https key does not exist: %s", fc.Auth.KeyFile)
+		}
+		cfg.Auth.HTTPTLSKey = fc.Auth.KeyFile
+	}
+	if fc.Auth.CertFile != "" {
+		if !fileExists(fc.Auth.CertFile) {
+			return trace.Errorf("https cert does not exist: %s", fc.Auth.CertFile)
+		}
+		cfg.Auth.HTTPTLSCert = fc.Auth.CertFile
+	}
+	if fc.Auth.ClientCAFile != "" {
+		if !fileExists(fc.Auth.ClientCAFile) {
+			return trace.Errorf("https client CA does not exist: %s", fc.Auth.ClientCAFile)
+		}
+		cfg.Auth.HTTPClientCAFile = fc.Auth.ClientCAFile
+	}
+	if fc.Auth.MaxSessionSize < 0 {
+		return trace.Wrap(teleport.BadParameter("max_session_size",
+			fmt.Sprintf("max session size can't be negative: %v", fc.Auth.MaxSessionSize)))
+	}
+	cfg.Auth.MaxSessionSize = fc.Auth.MaxSessionSize
+	if fc.Auth.EventWebhook != nil {
+		if err := applyEventWebhook(fc.Auth.EventWebhook, cfg); err != nil {
+			return trace.Wrap(err)
+		}
+	}
 
 	// apply "ssh_service" section
 	if fc.SSH.ListenAddress != "" {
-		addr, err := utils.ParseHostPortAddr(fc.SSH.ListenAddress, int(defaults.SSHServerListenPort))
+		addr, err := parseAddr("ssh_service.listen_addr", fc.SSH.ListenAddress, int(defaults.SSHServerListenPort))
 		if err != nil {
 			return trace.Wrap(err)
 		}
 		cfg.SSH.Addr = *addr
 	}
+	if fc.SSH.VersionString != "" {
+		if err := sshutils.CheckVersion(fc.SSH.VersionString); err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.SSH.VersionString = fc.SSH.VersionString
+	}
+	if fc.SSH.MOTD != "" {
+		motd, err := readTextOrFile(fc.SSH.MOTD)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		cfg.SSH.MOTD = motd
+	}
+	if fc.SSH.KeepAliveInterval != nil {
+		if *fc.SSH.KeepAliveInterval < 0 {
+			return trace.Wrap(teleport.BadParameter("keepalive_interval",
+				fmt.Sprintf("keepalive interval can't be negative: %v", *fc.SSH.KeepAliveInterval)))
+		}
+		cfg.SSH.KeepAliveInterval = *fc.SSH.KeepAliveInterval
+	}
+	if fc.SSH.LabelJitter != nil {
+		if *fc.SSH.LabelJitter < 0 {
+			return trace.Wrap(teleport.BadParameter("label_jitter",
+				fmt.Sprintf("label jitter can't be negative: %v", *fc.SSH.LabelJitter)))
+		}
+		cfg.SSH.LabelJitter = *fc.SSH.LabelJitter
+	}
+	if fc.SSH.KeepAliveCountMax < 0 {
+		return trace.Wrap(teleport.BadParameter("keepalive_count_max",
+			fmt.Sprintf("keepalive count max can't be negative: %v", fc.SSH.KeepAliveCountMax)))
+	}
+	if fc.SSH.KeepAliveCountMax > 0 {
+		cfg.SSH.KeepAliveCountMax = fc.SSH.KeepAliveCountMax
+	}
+	if fc.SSH.HandshakeTimeout < 0 {
+		return trace.Wrap(teleport.BadParameter("handshake_timeout",
+			fmt.Sprintf("handshake timeout should be positive: %v", fc.SSH.HandshakeTimeout)))
+	}
+	if fc.SSH.HandshakeTimeout > 0 {
+		cfg.SSH.HandshakeTimeout = fc.SSH.HandshakeTimeout
+	}
+	if fc.SSH.HostKeyRotationPeriod < 0 {
+		return trace.Wrap(teleport.BadParameter("host_key_rotation_period",
+			fmt.Sprintf("host key rotation period can't be negative: %v", fc.SSH.HostKeyRotationPeriod)))
+	}
+	cfg.SSH.HostKeyRotationPeriod = fc.SSH.HostKeyRotationPeriod
+	if fc.SSH.UseLoginShell != nil {
+		cfg.SSH.UseLoginShell = *fc.SSH.UseLoginShell
+	}
+	// the shell is checked on start, it's only a fallback with
+	// use_login_shell and is not used at all without the SSH service
+	applyString(fc.SSH.Shell, &cfg.SSH.Shell)
+	if fc.SSH.RecordSessions != nil {
+		cfg.SSH.RecordSessions = *fc.SSH.RecordSessions
+	}
 	if fc.SSH.Labels != nil {
 		cfg.SSH.Labels = make(map[string]string)
 		for k, v := range fc.SSH.Labels {
@@ -254,16 +600,151 @@ func applyFileConfig(fc *config.FileConfig, cfg *service.Config) error {
 	if fc.SSH.Commands != nil {
 		cfg.SSH.CmdLabels = make(services.CommandLabels)
 		for _, cmdLabel := range fc.SSH.Commands {
-			cfg.SSH.CmdLabels[cmdLabel.Name] = services.CommandLabel{
-				Period:  cmdLabel.Period,
-				Command: cmdLabel.Command,
-				Result:  "",
+			if cmdLabel.User != "" {
+				if _, err := user.Lookup(cmdLabel.User); err != nil {
+					return trace.Wrap(teleport.BadParameter("ssh_service.commands",
+						fmt.Sprintf("label %q: unknown user %q", cmdLabel.Name, cmdLabel.User)))
+				}
+			}
+			label := services.CommandLabel{
+				Period:        cmdLabel.Period,
+				Command:       cmdLabel.Command,
+				Result:        "",
+				User:          cmdLabel.User,
+				ExitCodes:     cmdLabel.ExitCodes,
+				CaptureStderr: cmdLabel.CaptureStderr,
+				StableRuns:    cmdLabel.StableRuns,
 			}
+			if cmdLabel.StableRuns < 0 {
+				return trace.Wrap(teleport.BadParameter("ssh_service.commands",
+					fmt.Sprintf("label %q: stable_runs can't be negative: %v", cmdLabel.Name, cmdLabel.StableRuns)))
+			}
+			if err := label.CheckExitCodes(); err != nil {
+				return trace.Wrap(teleport.BadParameter("ssh_service.commands",
+					fmt.Sprintf("label %q: %v", cmdLabel.Name, err)))
+			}
+			cfg.SSH.CmdLabels[cmdLabel.Name] = label
+		}
+	}
+	if fc.SSH.LabelPolicy != nil {
+		cfg.SSH.LabelPolicy.KeyPattern = fc.SSH.LabelPolicy.KeyPattern
+		cfg.SSH.LabelPolicy.ValuePattern = fc.SSH.LabelPolicy.ValuePattern
+		// the label budget keeps the defaults unless it's set
+		if fc.SSH.LabelPolicy.MaxCount != nil {
+			cfg.SSH.LabelPolicy.MaxCount = *fc.SSH.LabelPolicy.MaxCount
+		}
+		if fc.SSH.LabelPolicy.MaxSize != nil {
+			cfg.SSH.LabelPolicy.MaxSize = *fc.SSH.LabelPolicy.MaxSize
+		}
+	}
+	if err := service.CheckLabelCollisions(cfg.SSH.Labels, cfg.SSH.CmdLabels); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := cfg.SSH.LabelPolicy.Check(cfg.SSH.Labels, cfg.SSH.CmdLabels); err != nil {
+		return trace.Wrap(err)
+	}
+
+	// apply "bind_ip" setting to all listen addresses:
+	if fc.BindIP != nil {
+		applyListenIP(fc.BindIP, cfg)
+	}
+	return nil
+}
+
+// writeSecretFiles replaces secret references in proxy TLS settings with
+// paths of files the secrets are saved to, it's called on start only, so
+// other commands don't fetch secrets or write to the data dir
+func writeSecretFiles(cfg *service.Config) error {
+	keyFile, err := resolveSecretFile(cfg.Proxy.TLSKey, cfg, "proxy.secret.key")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	certFile, err := resolveSecretFile(cfg.Proxy.TLSCert, cfg, "proxy.secret.crt")
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	cfg.Proxy.TLSKey, cfg.Proxy.TLSCert = keyFile, certFile
+	return nil
+}
+
+// resolveSecretFile returns a path to a file with the secret a reference
+// points to, the secret is saved in the data dir under a given name.
+// Values that are not secret references are returned as is
+func resolveSecretFile(ref string, cfg *service.Config, name string) (string, error) {
+	if !secrets.IsReference(ref) {
+		return ref, nil
+	}
+	data, err := secrets.Fetch(ref)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	if err := utils.EnsureDataDir(cfg.DataDir, cfg.RequireExistingDataDir); err != nil {
+		return "", trace.Wrap(err)
+	}
+	path := filepath.Join(cfg.DataDir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	return path, nil
+}
+
+// applyAllowedTokens applies 'tokens' list of 'auth_service' section
+func applyAllowedTokens(tokens []config.AllowedToken, cfg *service.Config) error {
+	for _, t := range tokens {
+		token, err := secrets.Resolve(t.Token)
+		if err != nil {
+			return trace.Wrap(err)
 		}
+		if token == "" {
+			return trace.Wrap(teleport.BadParameter("tokens", "missing token"))
+		}
+		if cfg.Auth.AllowedTokens == nil {
+			cfg.Auth.AllowedTokens = make(service.KeyVal)
+		}
+		cfg.Auth.AllowedTokens[token] = cfg.Auth.DomainName
+		if len(t.Sources) == 0 {
+			continue
+		}
+		networks, err := utils.ParseCIDRs(t.Sources)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if cfg.Auth.AllowedTokenSources == nil {
+			cfg.Auth.AllowedTokenSources = make(map[string][]net.IPNet)
+		}
+		cfg.Auth.AllowedTokenSources[token] = networks
 	}
 	return nil
 }
 
+// applyEventWebhook applies 'event_webhook' section of 'auth_service',
+// the authorization header can be a secret reference
+func applyEventWebhook(fc *config.EventWebhook, cfg *service.Config) error {
+	authHeader, err := secrets.Resolve(fc.AuthHeader)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	hook := webhook.Config{
+		URL:         fc.URL,
+		AuthHeader:  authHeader,
+		QueueSize:   fc.QueueSize,
+		Retries:     defaults.EventWebhookRetries,
+		RetryPeriod: fc.RetryPeriod,
+		Timeout:     fc.Timeout,
+		OnFull:      fc.OnFull,
+	}
+	if fc.Retries != nil {
+		hook.Retries = *fc.Retries
+	}
+	// check a copy, so defaults are not written to the config
+	check := hook
+	if err := check.CheckAndSetDefaults(); err != nil {
+		return trace.Wrap(err)
+	}
+	cfg.Auth.EventWebhook = hook
+	return nil
+}
+
 // applyString takes 'src' and overwrites target with it, unless 'src' is empty
 // returns 'True' if 'src' was not empty
 func applyString(src string, target *string) bool {
@@ -274,6 +755,39 @@ func applyString(src string, target *string) bool {
 	return false
 }
 
+// applyLogTag tags log entries with teleport.log.tag or the node name
+// if a config file is used
+func applyLogTag(fc *config.FileConfig, cfg *service.Config) {
+	if fc == nil {
+		return
+	}
+	logTag := fc.Logger.Tag
+	if logTag == "" {
+		logTag = cfg.Hostname
+	}
+	utils.SetLogTag(logTag)
+}
+
+// applyDataDirFallback switches a non-root user who can't write to the
+// default data dir to the user data dir, unless data_dir is configured
+func applyDataDirFallback(fc *config.FileConfig, cfg *service.Config, euid int) error {
+	if fc != nil && fc.Storage.DirName != "" {
+		return nil
+	}
+	dir, err := service.FallbackDataDir(euid, cfg.DataDir)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if dir == "" {
+		return nil
+	}
+	log.Infof("data dir %v is not writable by the current user, using %v instead, set data_dir to override",
+		cfg.DataDir, dir)
+	cfg.DataDir = dir
+	cfg.ConfigureBolt(dir)
+	return nil
+}
+
 // configure merges command line arguments with what's in a configuration file
 // with CLI commands taking precedence
 func configure(clf *CommandLineFlags) (cfg *service.Config, err error) {
@@ -281,13 +795,19 @@ func configure(clf *CommandLineFlags) (cfg *service.Config, err error) {
 	cfg = service.MakeDefaultConfig()
 
 	// load /etc/teleport.yaml and apply it's values:
-	fileConf, err := readConfigFile(clf.ConfigFile)
+	fileConf, err := readConfigFile(clf.ConfigFile, clf.ConfigDir)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
+	// the data dir has to be final before the file config writes to it
+	if err = applyDataDirFallback(fileConf, cfg, os.Geteuid()); err != nil {
+		return nil, trace.Wrap(err)
+	}
 	if err = applyFileConfig(fileConf, cfg); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	// passphrase from the environment takes precedence over the config file
+	applyString(os.Getenv(teleport.KeyPassphraseEnvVar), &cfg.KeyPassphrase)
 	// apply --debug flag:
 	if clf.Debug {
 		cfg.Console = ioutil.Discard
@@ -299,62 +819,290 @@ func configure(clf *CommandLineFlags) (cfg *service.Config, err error) {
 		if err := validateRoles(clf.Roles); err != nil {
 			return cfg, trace.Wrap(err)
 		}
+		was := *cfg
 		cfg.SSH.Enabled = strings.Index(clf.Roles, defaults.RoleNode) != -1
 		cfg.Auth.Enabled = strings.Index(clf.Roles, defaults.RoleAuthService) != -1
 		cfg.Proxy.Enabled = strings.Index(clf.Roles, defaults.RoleProxy) != -1
+		logOverride("--roles", "ssh_service.enabled", was.SSH.Enabled, cfg.SSH.Enabled)
+		logOverride("--roles", "auth_service.enabled", was.Auth.Enabled, cfg.Auth.Enabled)
+		logOverride("--roles", "proxy_service.enabled", was.Proxy.Enabled, cfg.Proxy.Enabled)
 	}
 
 	// apply --auth-server flag:
+	authDisabledByFlag := false
 	if clf.AuthServerAddr != "" {
 		if cfg.Auth.Enabled {
+			authDisabledByFlag = true
 			log.Warnf("not starting the local auth service. --auth-server flag tells to connect to another auth server")
+			logOverride("--auth-server", "auth_service.enabled", true, false)
 			cfg.Auth.Enabled = false
 		}
-		addr, err := utils.ParseHostPortAddr(clf.AuthServerAddr, int(defaults.AuthListenPort))
+		addr, err := parseAddr("--auth-server", clf.AuthServerAddr, int(defaults.AuthListenPort))
 		if err != nil {
 			return cfg, trace.Wrap(err)
 		}
 		log.Infof("Using auth server: %v", addr.FullAddress())
+		logOverride("--auth-server", "teleport.auth_servers", addrList(cfg.AuthServers), addrList([]utils.NetAddr{*addr}))
 		cfg.AuthServers = []utils.NetAddr{*addr}
 	}
 
+	// settings of disabled roles are usually copy-paste errors
+	for _, setting := range orphanedSettings(fileConf, cfg) {
+		log.Warningf("%v is set but the service is disabled, the setting has no effect", setting)
+	}
+
 	// apply --name flag:
 	if clf.NodeName != "" {
+		logOverride("--name", "teleport.nodename", cfg.Hostname, clf.NodeName)
 		cfg.Hostname = clf.NodeName
 	}
+	// the log tag defaults to the node name, so it's set once --name is applied
+	applyLogTag(fileConf, cfg)
 
 	// apply --token flag:
+	clf.AuthToken, err = secrets.Resolve(clf.AuthToken)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if clf.AuthToken != "" && fileConf != nil && fileConf.AuthToken != "" && clf.AuthToken != fileConf.AuthToken {
+		// tokens are secrets, never log their values
+		log.Debugf("flag --token overrode config field teleport.auth_token (was %v, now %v)",
+			service.Redacted, service.Redacted)
+	}
 	cfg.ApplyToken(clf.AuthToken)
 
+	// apply --diag-addr flag:
+	if clf.DiagnosticAddr != "" {
+		addr, err := parseAddr("--diag-addr", clf.DiagnosticAddr, int(defaults.DiagnosticListenPort))
+		if err != nil {
+			return cfg, trace.Wrap(err)
+		}
+		logOverride("--diag-addr", "teleport.diag_addr", cfg.DiagnosticAddr.Addr, addr.Addr)
+		cfg.DiagnosticAddr = *addr
+	}
+
 	// apply --listen-ip flag:
 	if clf.ListenIP != nil {
+		was := *cfg
 		applyListenIP(clf.ListenIP, cfg)
+		logOverride("--listen-ip", "auth_service.listen_addr", was.Auth.SSHAddr.Addr, cfg.Auth.SSHAddr.Addr)
+		logOverride("--listen-ip", "auth_service.http_listen_addr", was.Auth.HTTPAddr.Addr, cfg.Auth.HTTPAddr.Addr)
+		logOverride("--listen-ip", "proxy_service.listen_addr", was.Proxy.SSHAddr.Addr, cfg.Proxy.SSHAddr.Addr)
+		logOverride("--listen-ip", "proxy_service.web_listen_addr", was.Proxy.WebAddr.Addr, cfg.Proxy.WebAddr.Addr)
+		logOverride("--listen-ip", "proxy_service.tunnel_listen_addr", was.Proxy.ReverseTunnelListenAddr.Addr, cfg.Proxy.ReverseTunnelListenAddr.Addr)
+		logOverride("--listen-ip", "ssh_service.listen_addr", was.SSH.Addr.Addr, cfg.SSH.Addr.Addr)
 	}
 
 	// --advertise-ip flag
 	if clf.AdvertiseIP != nil {
-		if err := validateAdvertiseIP(clf.AdvertiseIP); err != nil {
+		requireLocal := fileConf != nil && fileConf.RequireLocalAdvertiseIP()
+		if err := validateAdvertiseIP(clf.AdvertiseIP, requireLocal); err != nil {
 			return nil, trace.Wrap(err)
 		}
+		logOverride("--advertise-ip", "teleport.advertise_ip", cfg.AdvertiseIP, clf.AdvertiseIP)
 		cfg.AdvertiseIP = clf.AdvertiseIP
 	}
 
 	// apply --labels flag
+	wasLabels, wasCmdLabels := cfg.SSH.Labels, cfg.SSH.CmdLabels
 	if err = parseLabels(clf.Labels, &cfg.SSH); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	logOverride("--labels", "ssh_service.labels", wasLabels, cfg.SSH.Labels)
+	logOverride("--labels", "ssh_service.commands", wasCmdLabels, cfg.SSH.CmdLabels)
 
-	// locate web assets if web proxy is enabled
+	// label templates are expanded on start once the host UUID is known,
+	// catch errors in them early
+	if _, err = service.ExpandLabels(cfg.SSH.Labels, service.HostFacts{}); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// check the final list of auth servers from the file and the flags
+	if err = checkAuthServers(cfg); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// locate web assets if web proxy is enabled, in best-effort mode
+	// the proxy fails to start without them but the other roles don't
 	if cfg.Proxy.Enabled {
 		cfg.Proxy.AssetsDir, err = locateWebAssets()
 		if err != nil {
-			return nil, trace.Wrap(err)
+			if cfg.StartMode != service.StartBestEffort {
+				return nil, trace.Wrap(err)
+			}
+			log.Warningf("proxy won't start: %v", err)
 		}
 	}
 
+	// addresses come from the file, the flags and the defaults, bring
+	// them to one form before they are compared or used
+	if err = cfg.CanonicalizeAddrs(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// flags are applied on top of the file, make sure the result of
+	// the merge is consistent
+	if err = checkDisabledAuth(fileConf, authDisabledByFlag); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// remember where the config came from and its hash for the audit log
+	cfg.ConfigSource = configSource(clf)
+	if cfg.ConfigSHA256, err = config.ConfigHash(cfg); err != nil {
+		log.Warningf("failed to hash the configuration: %v", err)
+	}
+
 	return cfg, nil
 }
 
+// configSource describes where configure read the configuration from
+func configSource(clf *CommandLineFlags) string {
+	if clf.ConfigDir != "" {
+		return clf.ConfigDir
+	}
+	if clf.ConfigFile != "" {
+		return clf.ConfigFile
+	}
+	if fileExists(defaults.ConfigFilePath) {
+		return defaults.ConfigFilePath
+	}
+	return "defaults"
+}
+
+// logOverride logs a debug message if a command line flag has changed
+// a value that came from the config file or from defaults, so it's easy
+// to tell where the effective value came from
+func logOverride(flag, field string, was, now interface{}) {
+	wasValue, nowValue := fmt.Sprintf("%v", was), fmt.Sprintf("%v", now)
+	if wasValue != nowValue {
+		log.Debugf("flag %v overrode config field %v (was %v, now %v)", flag, field, wasValue, nowValue)
+	}
+}
+
+// addrList formats addresses for logging
+func addrList(addrs []utils.NetAddr) []string {
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		out[i] = addr.Addr
+	}
+	return out
+}
+
+// checkAuthServers makes sure the number of auth servers is within
+// the configured limit
+func checkAuthServers(cfg *service.Config) error {
+	if cfg.MaxAuthServers > 0 && len(cfg.AuthServers) > cfg.MaxAuthServers {
+		return trace.Wrap(teleport.BadParameter("auth_servers",
+			fmt.Sprintf("%v auth servers are configured, the maximum is %v, set teleport.max_auth_servers to allow more",
+				len(cfg.AuthServers), cfg.MaxAuthServers)))
+	}
+	return nil
+}
+
+// checkJoinToken makes sure a node or a proxy that has to register with
+// a remote auth server has a token, or has joined the cluster before and
+// keeps its host keys in the data dir
+func checkJoinToken(cfg *service.Config) error {
+	if cfg.Auth.Enabled {
+		return nil
+	}
+	roles := map[teleport.Role]string{}
+	if cfg.SSH.Enabled {
+		roles[teleport.RoleNode] = cfg.SSH.Token
+	}
+	if cfg.Proxy.Enabled {
+		roles[teleport.RoleProxy] = cfg.Proxy.Token
+	}
+	for role, token := range roles {
+		if token != "" {
+			continue
+		}
+		joined, err := haveJoined(cfg.DataDir, role)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if !joined {
+			return trace.Wrap(teleport.BadParameter("auth_token",
+				fmt.Sprintf("%v needs a token to join the cluster, pass it with --token or set teleport.auth_token in the config file", role)))
+		}
+	}
+	return nil
+}
+
+// haveJoined returns true if the data dir has host keys of the role,
+// it does not create the host UUID file if it's missing
+func haveJoined(dataDir string, role teleport.Role) (bool, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dataDir, utils.HostUUIDFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, trace.Wrap(err)
+	}
+	hostUUID := strings.TrimSpace(string(bytes))
+	return auth.HaveHostKeys(dataDir, auth.IdentityID{HostUUID: hostUUID, Role: role})
+}
+
+// orphanedSettings returns settings of the config file sections of roles
+// that are disabled, e.g. "proxy_service.https_cert_file"
+func orphanedSettings(fc *config.FileConfig, cfg *service.Config) []string {
+	if fc == nil {
+		return nil
+	}
+	var out []string
+	if !cfg.Auth.Enabled {
+		out = append(out, setFields("auth_service", reflect.ValueOf(fc.Auth))...)
+	}
+	if !cfg.SSH.Enabled {
+		out = append(out, setFields("ssh_service", reflect.ValueOf(fc.SSH))...)
+	}
+	if !cfg.Proxy.Enabled {
+		out = append(out, setFields("proxy_service", reflect.ValueOf(fc.Proxy))...)
+	}
+	return out
+}
+
+// checkDisabledAuth fails if the config file sets up the local auth
+// service and --auth-server turned it off to use a remote one. Unlike
+// settings of a service disabled in the file, these are not leftovers
+func checkDisabledAuth(fc *config.FileConfig, disabledByFlag bool) error {
+	if fc == nil || !disabledByFlag {
+		return nil
+	}
+	settings := setFields("auth_service", reflect.ValueOf(fc.Auth))
+	if len(settings) == 0 {
+		return nil
+	}
+	return trace.Wrap(teleport.BadParameter("auth_service",
+		fmt.Sprintf("%v set in the config file, but --auth-server turns off the local auth service",
+			strings.Join(settings, ", "))))
+}
+
+// setFields returns YAML names of fields of the section that have non-zero
+// values, except for the "enabled" flag
+func setFields(prefix string, section reflect.Value) []string {
+	var out []string
+	for i := 0; i < section.NumField(); i++ {
+		field, value := section.Type().Field(i), section.Field(i)
+		if field.Anonymous {
+			out = append(out, setFields(prefix, value)...)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "enabled" {
+			continue
+		}
+		if reflect.DeepEqual(value.Interface(), reflect.Zero(field.Type).Interface()) {
+			continue
+		}
+		out = append(out, prefix+"."+name)
+	}
+	return out
+}
+
 // parseLabels takes the value of --labels flag and tries to correctly populate
 // sshConf.Labels and sshConf.CmdLabels
 func parseLabels(spec string, sshConf *service.SSHConfig) error {
@@ -382,7 +1130,7 @@ func parseLabels(spec string, sshConf *service.SSHConfig) error {
 			sshConf.Labels[key] = value
 		}
 	}
-	return nil
+	return trace.Wrap(sshConf.LabelPolicy.Check(sshConf.Labels, sshConf.CmdLabels))
 }
 
 // isCmdLabelSpec tries to interpret a given string as a "command label" spec.
@@ -424,18 +1172,55 @@ func isCmdLabelSpec(spec string) (*services.CommandLabel, error) {
 	return nil, nil
 }
 
+// applyConnectionLimits applies global connection limits to the limiters
+// of all roles, the limiters are updated in place so the limits reach
+// the service config
+func applyConnectionLimits(limits config.ConnectionLimits, cfg *service.Config) error {
+	limiters := []*limiter.LimiterConfig{
+		&cfg.SSH.Limiter,
+		&cfg.Auth.Limiter,
+		&cfg.Proxy.Limiter,
+	}
+	if limits.MaxHandshakes < 0 {
+		return trace.Wrap(teleport.BadParameter("max_handshakes",
+			fmt.Sprintf("max handshakes can't be negative: %v", limits.MaxHandshakes)))
+	}
+	for _, l := range limiters {
+		if limits.MaxHandshakes > 0 {
+			l.MaxHandshakes = limits.MaxHandshakes
+		}
+		if limits.MaxConnections > 0 {
+			l.MaxConnections = limits.MaxConnections
+		}
+		if limits.MaxUsers > 0 {
+			l.MaxNumberOfUsers = limits.MaxUsers
+		}
+		for _, rate := range limits.Rates {
+			l.Rates = append(l.Rates, limiter.Rate{
+				Period:  rate.Period,
+				Average: rate.Average,
+				Burst:   rate.Burst,
+			})
+		}
+	}
+	return nil
+}
+
 // applyListenIP replaces all 'listen addr' settings for all services with
-// a given IP
+// a given IP, listeners that are not set stay disabled
 func applyListenIP(ip net.IP, cfg *service.Config) {
 	listeningAddresses := []*utils.NetAddr{
 		&cfg.Auth.SSHAddr,
-		&cfg.Auth.SSHAddr,
+		&cfg.Auth.HTTPAddr,
 		&cfg.Proxy.SSHAddr,
 		&cfg.Proxy.WebAddr,
 		&cfg.SSH.Addr,
 		&cfg.Proxy.ReverseTunnelListenAddr,
 	}
 	for _, addr := range listeningAddresses {
+		if addr.IsEmpty() {
+			continue
+		}
 		replaceHost(addr, ip.String())
 	}
 }
@@ -450,6 +1235,22 @@ func replaceHost(addr *utils.NetAddr, newHost string) {
 	addr.Addr = net.JoinHostPort(newHost, port)
 }
 
+// parseAddr parses host:port address set by the given config field
+// or flag, the error names the field so it's clear what to fix
+func parseAddr(field, value string, defaultPort int) (*utils.NetAddr, error) {
+	addr, err := utils.ParseHostPortAddr(value, defaultPort)
+	if err != nil {
+		return nil, trace.Wrap(invalidAddr(field, value))
+	}
+	return addr, nil
+}
+
+// invalidAddr returns an error about an invalid address in the given field
+func invalidAddr(field, value string) error {
+	return teleport.BadParameterWithCode(teleport.CodeInvalidListenAddr, field,
+		fmt.Sprintf("invalid address '%v', expected host:port, IPv6 hosts should be enclosed in brackets, e.g. [::1]:3022", value))
+}
+
 func fileExists(fp string) bool {
 	_, err := os.Stat(fp)
 	if err != nil && os.IsNotExist(err) {
@@ -473,11 +1274,29 @@ func validateRoles(roles string) error {
 	return nil
 }
 
-func validateAdvertiseIP(advertiseIP net.IP) error {
+// interfaceAddrs returns addresses of local network interfaces
+var interfaceAddrs = net.InterfaceAddrs
+
+// validateAdvertiseIP checks that the advertise IP is reachable, with
+// requireLocal set it also has to be assigned to a local interface
+func validateAdvertiseIP(advertiseIP net.IP, requireLocal bool) error {
 	if advertiseIP.IsLoopback() || advertiseIP.IsUnspecified() || advertiseIP.IsMulticast() {
 		return teleport.BadParameter("advertise-ip", fmt.Sprintf("unreachable advertise IP: %v", advertiseIP))
 	}
-	return nil
+	if !requireLocal {
+		return nil
+	}
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(advertiseIP) {
+			return nil
+		}
+	}
+	return teleport.BadParameter("advertise-ip",
+		fmt.Sprintf("advertise IP %v is not assigned to any local interface, set advertise_ip_behind_nat if the host is behind NAT", advertiseIP))
 }
 
 // DirsToLookForWebAssets defines the locations where teleport proxy looks for
@@ -522,3 +1341,16 @@ func locateWebAssets() (string, error) {
 	return "",
 		trace.Errorf("Cannot find web assets. Unable to locate %v", filepath.Join(exeDir, assetsToCheck[0]))
 }
+
+// readTextOrFile returns the contents of the file if value is an absolute
+// path, otherwise value itself is returned as inline text
+func readTextOrFile(value string) (string, error) {
+	if !filepath.IsAbs(value) {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return "", trace.Wrap(teleport.ConvertSystemError(err))
+	}
+	return string(data), nil
+}
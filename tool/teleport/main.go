@@ -17,11 +17,17 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gravitational/teleport/lib/config"
 	"github.com/gravitational/teleport/lib/defaults"
@@ -54,7 +60,7 @@ func run(cmdlineArgs []string, testRun bool) (executedCommand string, appliedCon
 
 	// define commands:
 	start := app.Command("start", "Starts the Teleport service.")
-	status := app.Command("status", "Print the status of the current SSH session.")
+	status := app.Command("status", "Print the status of the current SSH session or of a running teleport process.")
 	dump := app.Command("configure", "Print the sample config file into stdout.")
 	ver := app.Command("version", "Print the version.")
 	app.HelpFlag.Short('h')
@@ -83,10 +89,21 @@ func run(cmdlineArgs []string, testRun bool) (executedCommand string, appliedCon
 	start.Flag("config",
 		fmt.Sprintf("Path to a configuration file [%v]", defaults.ConfigFilePath)).
 		Short('c').ExistingFileVar(&ccf.ConfigFile)
+	start.Flag("config-dir",
+		"Directory with configuration fragments merged in lexical order under the configuration file").
+		ExistingDirVar(&ccf.ConfigDir)
 	start.Flag("labels", "List of labels for this node").StringVar(&ccf.Labels)
+	start.Flag("diag-addr",
+		"Start diagnostic endpoint serving metrics on this address [disabled]").
+		StringVar(&ccf.DiagnosticAddr)
 	start.Flag("httpprofile",
 		"Start profiling endpoint on localhost:6060").Hidden().BoolVar(&ccf.HTTPProfileEndpoint)
 
+	// define status flags:
+	status.Flag("diag-addr",
+		"Diagnostic address of a running teleport process to query").
+		StringVar(&ccf.DiagnosticAddr)
+
 	// define start's usage info (we use kingpin's "alias" field for this)
 	start.Alias(usageNotes + usageExamples)
 
@@ -116,7 +133,7 @@ func run(cmdlineArgs []string, testRun bool) (executedCommand string, appliedCon
 			}
 			err = onStart(config)
 		case status.FullCommand():
-			err = onStatus(config)
+			err = onStatus(config, ccf.DiagnosticAddr != "")
 		case dump.FullCommand():
 			onConfigDump()
 		case ver.FullCommand():
@@ -132,6 +149,14 @@ func run(cmdlineArgs []string, testRun bool) (executedCommand string, appliedCon
 
 // onStart is the handler for "start" CLI command
 func onStart(config *service.Config) error {
+	// nodes and proxies without an auth server in the same process can't
+	// join the cluster without a token, say so before they try
+	if err := checkJoinToken(config); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := writeSecretFiles(config); err != nil {
+		return trace.Wrap(err)
+	}
 	srv, err := service.NewTeleport(config)
 	if err != nil {
 		return trace.Wrap(err, "initializing teleport")
@@ -139,12 +164,54 @@ func onStart(config *service.Config) error {
 	if err := srv.Start(); err != nil {
 		return trace.Wrap(err, "starting teleport")
 	}
+	if process, ok := srv.(*service.TeleportProcess); ok {
+		go handleSignals(process)
+	}
 	srv.Wait()
 	return nil
 }
 
-// onStatus is the handler for "status" CLI command
-func onStatus(config *service.Config) error {
+// handleSignals reloads the proxy TLS certificate every time teleport
+// receives SIGHUP, e.g. after the certificate has been renewed, and
+// shuts the process down on SIGTERM and SIGINT
+func handleSignals(process *service.TeleportProcess) {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range sigC {
+		if sig != syscall.SIGHUP {
+			shutdown(process, sig)
+			continue
+		}
+		log.Infof("received SIGHUP, reloading TLS certificates")
+		if err := process.ReloadTLS(); err != nil {
+			log.Errorf("failed to reload TLS certificates: %v", err)
+		}
+	}
+}
+
+// shutdown waits for active sessions to end, but no longer than the
+// configured shutdown timeout, and exits
+func shutdown(process *service.TeleportProcess, sig os.Signal) {
+	timeout := process.Config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaults.ShutdownTimeout
+	}
+	log.Infof("received %v, shutting down in at most %v", sig, timeout)
+	if err := process.Shutdown(timeout); err != nil {
+		log.Warningf("forcing exit: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("teleport: clean exit")
+	os.Exit(0)
+}
+
+// onStatus is the handler for "status" CLI command, the running process
+// is queried only if --diag-addr is passed, diag_addr from the config file
+// alone does not hide the session info
+func onStatus(config *service.Config, queryDiag bool) error {
+	if queryDiag {
+		return printProcessStatus(os.Stdout, config.DiagnosticAddr.Addr)
+	}
 	sid := os.Getenv("SSH_SESSION_ID")
 	proxyHost := os.Getenv("SSH_SESSION_WEBPROXY_ADDR")
 	tuser := os.Getenv("SSH_TELEPORT_USER")
@@ -157,6 +224,79 @@ func onStatus(config *service.Config) error {
 	return nil
 }
 
+// printProcessStatus fetches the status of a running teleport process
+// from its diagnostic endpoint and renders it
+func printProcessStatus(w io.Writer, diagAddr string) error {
+	clt := http.Client{Timeout: defaults.DiagnosticRequestTimeout}
+	re, err := clt.Get(fmt.Sprintf("http://%v/status", diagAddr))
+	if err != nil {
+		return trace.Wrap(err, "failed to query teleport at %v", diagAddr)
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return trace.Errorf("unexpected response from %v: %v", diagAddr, re.Status)
+	}
+	var status service.Status
+	if err := json.NewDecoder(re.Body).Decode(&status); err != nil {
+		return trace.Wrap(err)
+	}
+	fmt.Fprintf(w, "Host UUID  : %v\n", status.HostUUID)
+	fmt.Fprintf(w, "Hostname   : %v\n", status.Hostname)
+	fmt.Fprintf(w, "Roles      : %v\n", strings.Join(status.Roles, ","))
+	fmt.Fprintf(w, "Started at : %v\n", status.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Uptime     : %v\n", time.Duration(status.Uptime)*time.Second)
+	if status.Backend != nil {
+		health := "healthy"
+		if !status.Backend.Healthy {
+			health = fmt.Sprintf("unhealthy: %v", status.Backend.Error)
+		}
+		fmt.Fprintf(w, "Backend    : %v (%v)\n", status.Backend.Type, health)
+	}
+	if len(status.AuthServers) != 0 {
+		roles := make([]string, 0, len(status.AuthServers))
+		for role := range status.AuthServers {
+			roles = append(roles, role)
+		}
+		sort.Strings(roles)
+		fmt.Fprintf(w, "Auth servers:\n")
+		for _, role := range roles {
+			fmt.Fprintf(w, "  %v: %v\n", role, status.AuthServers[role])
+		}
+	}
+	names := make([]string, 0, len(status.Connections))
+	for name := range status.Connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "Connections:\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %v: %v\n", name, status.Connections[name])
+	}
+	if len(status.DataDirUsage) != 0 {
+		files := make([]string, 0, len(status.DataDirUsage))
+		for file := range status.DataDirUsage {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		fmt.Fprintf(w, "Data dir usage (bytes):\n")
+		for _, file := range files {
+			fmt.Fprintf(w, "  %v: %v\n", file, status.DataDirUsage[file])
+		}
+	}
+	if len(status.CommandLabels) != 0 {
+		fmt.Fprintf(w, "Command labels:\n")
+		for _, label := range status.CommandLabels {
+			nextRun := "not scheduled"
+			if !label.NextRun.IsZero() {
+				nextRun = label.NextRun.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "  %v: %q every %v, next run: %v\n",
+				label.Name, label.Result, label.Period, nextRun)
+		}
+	}
+	return nil
+}
+
 // onConfigDump is the handler for "configure" CLI command
 func onConfigDump() {
 	sfc := config.MakeSampleFileConfig()
@@ -16,17 +16,36 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/backend/etcdbk"
+	"github.com/gravitational/teleport/lib/config"
 	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/events/webhook"
+	"github.com/gravitational/teleport/lib/httplib"
+	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/secrets"
 	"github.com/gravitational/teleport/lib/service"
 	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/srv"
+	"github.com/gravitational/teleport/lib/utils"
 
 	"gopkg.in/check.v1"
 )
@@ -82,12 +101,12 @@ func (s *MainTestSuite) TestDefault(c *check.C) {
 }
 
 func (s *MainTestSuite) TestRolesFlag(c *check.C) {
-	cmd, conf := run([]string{"start", "--roles=node"}, true)
+	cmd, conf := run([]string{"start", "--roles=node", "--token=token"}, true)
 	c.Assert(conf.SSH.Enabled, check.Equals, true)
 	c.Assert(conf.Auth.Enabled, check.Equals, false)
 	c.Assert(conf.Proxy.Enabled, check.Equals, false)
 
-	cmd, conf = run([]string{"start", "--roles=proxy"}, true)
+	cmd, conf = run([]string{"start", "--roles=proxy", "--token=token"}, true)
 	c.Assert(conf.SSH.Enabled, check.Equals, false)
 	c.Assert(conf.Auth.Enabled, check.Equals, false)
 	c.Assert(conf.Proxy.Enabled, check.Equals, true)
@@ -112,6 +131,1889 @@ func (s *MainTestSuite) TestConfigFile(c *check.C) {
 	c.Assert(conf.SSH.Labels, check.DeepEquals, map[string]string{"a": "a1", "b": "b1"})
 }
 
+func (s *MainTestSuite) TestProxyTLSConfig(c *check.C) {
+	// defaults
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.Proxy.TLSMinVersion, check.Equals, uint16(tls.VersionTLS12))
+	c.Assert(conf.Proxy.TLSCipherSuites, check.DeepEquals, utils.DefaultCipherSuites())
+
+	// valid version and cipher names
+	fc := &config.FileConfig{}
+	fc.Proxy.TLSMinVersion = "tls1.1"
+	fc.Proxy.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Proxy.TLSMinVersion, check.Equals, uint16(tls.VersionTLS11))
+	c.Assert(conf.Proxy.TLSCipherSuites, check.DeepEquals, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384})
+
+	// invalid version
+	fc = &config.FileConfig{}
+	fc.Proxy.TLSMinVersion = "ssl3"
+	c.Assert(applyFileConfig(fc, service.MakeDefaultConfig()), check.NotNil)
+
+	// invalid cipher suite
+	fc = &config.FileConfig{}
+	fc.Proxy.TLSCipherSuites = []string{"TLS_RSA_WITH_NOTHING"}
+	c.Assert(applyFileConfig(fc, service.MakeDefaultConfig()), check.NotNil)
+}
+
+func (s *MainTestSuite) TestSecurityHeadersConfig(c *check.C) {
+	// defaults are on
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(&config.FileConfig{}, conf), check.IsNil)
+	c.Assert(conf.Proxy.SecurityHeaders, check.DeepEquals, httplib.DefaultSecurityHeaders())
+
+	// overrides
+	fc := &config.FileConfig{}
+	fc.Proxy.SecurityHeaders.HSTSMaxAge = time.Hour
+	fc.Proxy.SecurityHeaders.FrameOptions = "SAMEORIGIN"
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Proxy.SecurityHeaders.Enabled, check.Equals, true)
+	c.Assert(conf.Proxy.SecurityHeaders.HSTSMaxAge, check.Equals, time.Hour)
+	c.Assert(conf.Proxy.SecurityHeaders.FrameOptions, check.Equals, "SAMEORIGIN")
+
+	// turned off
+	fc = &config.FileConfig{}
+	fc.Proxy.SecurityHeaders.EnabledFlag = "no"
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Proxy.SecurityHeaders.Enabled, check.Equals, false)
+}
+
+func (s *MainTestSuite) TestCanonicalAddrs(c *check.C) {
+	dir := c.MkDir()
+	for _, name := range []string{"auth.crt", "auth.key", "clients.crt"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), nil, 0600), check.IsNil)
+	}
+	path := filepath.Join(dir, "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`
+teleport:
+  auth_servers: ["tcp://Auth.Example.COM", "[0:0:0:0:0:0:0:1]:3025"]
+  diag_addr: "Diag.Example.COM"
+auth_service:
+  listen_addr: "[0:0:0:0:0:0:0:1]:3025"
+  http_listen_addr: "::1"
+  https_cert_file: `+filepath.Join(dir, "auth.crt")+`
+  https_key_file: `+filepath.Join(dir, "auth.key")+`
+  https_client_ca_file: `+filepath.Join(dir, "clients.crt")+`
+ssh_service:
+  listen_addr: "Node.Example.COM."
+`), 0644), check.IsNil)
+	_, conf := run([]string{"start", "--roles=node,auth", "--config=" + path}, true)
+
+	addrs := map[string]utils.NetAddr{
+		"auth_service.listen_addr":      conf.Auth.SSHAddr,
+		"auth_service.http_listen_addr": conf.Auth.HTTPAddr,
+		"ssh_service.listen_addr":       conf.SSH.Addr,
+		"teleport.diag_addr":            conf.DiagnosticAddr,
+		"teleport.auth_servers[0]":      conf.AuthServers[0],
+		"teleport.auth_servers[1]":      conf.AuthServers[1],
+	}
+	for field, addr := range addrs {
+		c.Assert(addr.AddrNetwork, check.Equals, "tcp", check.Commentf(field))
+		canonical, err := addr.Canonical(0)
+		c.Assert(err, check.IsNil, check.Commentf(field))
+		c.Assert(*canonical, check.DeepEquals, addr, check.Commentf(field))
+	}
+	c.Assert(conf.Auth.SSHAddr.Addr, check.Equals, "[::1]:3025")
+	c.Assert(conf.Auth.HTTPAddr.Addr, check.Equals, "[::1]:3026")
+	c.Assert(conf.SSH.Addr.Addr, check.Equals, "node.example.com:3022")
+	c.Assert(conf.DiagnosticAddr.Addr, check.Equals, "diag.example.com:3434")
+	c.Assert(conf.AuthServers[0].Addr, check.Equals, "auth.example.com:3025")
+	c.Assert(conf.AuthServers[1].Addr, check.Equals, "[::1]:3025")
+}
+
+func (s *MainTestSuite) TestCanonicalAddrsMissing(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.CanonicalizeAddrs(), check.IsNil)
+
+	// listeners of enabled roles have to be set
+	conf.Proxy.WebAddr = utils.NetAddr{}
+	c.Assert(teleport.IsBadParameter(conf.CanonicalizeAddrs()), check.Equals, true)
+	conf.Proxy.Enabled = false
+	c.Assert(conf.CanonicalizeAddrs(), check.IsNil)
+
+	// auth servers are dialed and need a host
+	conf.AuthServers = service.NetAddrSlice{{Addr: ":3025", AddrNetwork: "tcp"}}
+	c.Assert(teleport.IsBadParameter(conf.CanonicalizeAddrs()), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestBindIP(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.BindIP = net.ParseIP("10.1.1.1")
+	fc.AdvertiseIP = net.ParseIP("10.5.5.5")
+	fc.SSH.ListenAddress = "0.0.0.0:4022"
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+
+	c.Assert(conf.Auth.SSHAddr.Addr, check.Equals, "10.1.1.1:3025")
+	c.Assert(conf.SSH.Addr.Addr, check.Equals, "10.1.1.1:4022")
+	c.Assert(conf.Proxy.SSHAddr.Addr, check.Equals, "10.1.1.1:3023")
+	c.Assert(conf.Proxy.WebAddr.Addr, check.Equals, "10.1.1.1:3080")
+	c.Assert(conf.Proxy.ReverseTunnelListenAddr.Addr, check.Equals, "10.1.1.1:3024")
+	// advertise IP stays separate
+	c.Assert(conf.AdvertiseIP, check.DeepEquals, net.ParseIP("10.5.5.5"))
+	// auth HTTPS listener is off unless configured
+	c.Assert(conf.Auth.HTTPAddr.IsEmpty(), check.Equals, true)
+
+	// and binds to the IP when it's on
+	fc.Auth.HTTPListenAddress = "0.0.0.0:3026"
+	conf = service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.HTTPAddr.Addr, check.Equals, "10.1.1.1:3026")
+}
+
+func (s *MainTestSuite) TestStrictAdvertiseIP(c *check.C) {
+	defer func(orig func() ([]net.Addr, error)) { interfaceAddrs = orig }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		_, local, err := net.ParseCIDR("10.1.1.1/24")
+		c.Assert(err, check.IsNil)
+		local.IP = net.ParseIP("10.1.1.1")
+		return []net.Addr{local}, nil
+	}
+
+	// local IP passes the strict check
+	fc := &config.FileConfig{}
+	fc.StrictAdvertiseIP = true
+	fc.AdvertiseIP = net.ParseIP("10.1.1.1")
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.AdvertiseIP, check.DeepEquals, net.ParseIP("10.1.1.1"))
+
+	// non-local IP fails it
+	fc.AdvertiseIP = net.ParseIP("10.5.5.5")
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*10.5.5.5 is not assigned to any local interface.*")
+
+	// unless the host is behind NAT
+	fc.AdvertiseIPBehindNAT = true
+	c.Assert(applyFileConfig(fc, service.MakeDefaultConfig()), check.IsNil)
+
+	// non-strict mode does not check interfaces
+	fc = &config.FileConfig{}
+	fc.AdvertiseIP = net.ParseIP("10.5.5.5")
+	c.Assert(applyFileConfig(fc, service.MakeDefaultConfig()), check.IsNil)
+}
+
+func (s *MainTestSuite) TestToFileConfig(c *check.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+teleport:
+  nodename: node1
+  advertise_ip: 10.5.5.5
+  auth_token: xxxyyy
+  auth_servers: ["auth1:3025", "tcp://auth2:3025"]
+  auth_server_strategy: round-robin
+  heartbeat_ttl: 1m
+  clock_skew: 0s
+  reuse_port: true
+  audit_config_load: true
+  host_cert_check: off
+  min_key_size: 2048
+  register_retries: 10
+  diag_addr: 127.0.0.1:3434
+  connection_limits:
+    max_connections: 90
+    max_handshakes: 20
+    max_users: 91
+    rates:
+    - period: 1m
+      average: 70
+      burst: 71
+  storage:
+    type: bolt
+    data_dir: `+dir+`
+    check_timeout: 10s
+auth_service:
+  enabled: no
+  allowed_source_cidrs: [10.0.0.0/8]
+ssh_service:
+  listen_addr: 10.1.1.1:4022
+  labels: {role: db}
+  commands:
+  - name: hostname
+    command: [/bin/hostname]
+    period: 10s
+    exit_codes: {0: ok}
+    capture_stderr: true
+    stable_runs: 2
+  keepalive_interval: 0s
+  use_login_shell: false
+  label_jitter: 1s
+  label_policy:
+    key_pattern: "[a-z]+"
+proxy_service:
+  enable_reverse_tunnel: false
+  require_provided_tls: true
+  tls_min_version: tls1.1
+  tls_cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]
+  security_headers:
+    frame_options: SAMEORIGIN
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.CmdLabels["hostname"].CaptureStderr, check.Equals, true)
+
+	// runtime -> file -> runtime reproduces the config
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	reapplied := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(exported, reapplied), check.IsNil)
+	c.Assert(service.ConfigDiff(conf, reapplied), check.HasLen, 0)
+
+	// exported config survives marshaling and is stable
+	c.Assert(ioutil.WriteFile(path, []byte(exported.DebugDumpToYAML()), 0644), check.IsNil)
+	fc, err = config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	reapplied = service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, reapplied), check.IsNil)
+	c.Assert(service.ConfigDiff(conf, reapplied), check.HasLen, 0)
+	again, err := config.ToFileConfig(reapplied)
+	c.Assert(err, check.IsNil)
+	c.Assert(again, check.DeepEquals, exported)
+
+	// different tokens per role can't be expressed in the file
+	conf.SSH.Token = "other"
+	_, err = config.ToFileConfig(conf)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestStatus(c *check.C) {
+	startedAt := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, check.Equals, "/status")
+		json.NewEncoder(w).Encode(service.Status{
+			HostUUID:  "host-uuid",
+			Hostname:  "luna",
+			Roles:     []string{"auth", "node"},
+			StartedAt: startedAt,
+			Uptime:    3723,
+			Connections: map[string]int64{
+				"teleport_ssh_sessions_active":     2,
+				"teleport_auth_requests_in_flight": 1,
+			},
+			Backend:     &service.BackendStatus{Type: "bolt", Healthy: true},
+			AuthServers: map[string]string{"node": "10.0.0.2:3025"},
+			DataDirUsage: map[string]int64{
+				"keys.db": 32768,
+				"total":   40000,
+			},
+			CommandLabels: []srv.CommandLabelStatus{
+				{Name: "arch", Period: "1h0m0s", Result: "x86_64", NextRun: startedAt.Add(time.Hour)},
+				{Name: "uptime", Period: "1m0s", Result: "up"},
+			},
+		})
+	}))
+	defer fake.Close()
+	addr := strings.TrimPrefix(fake.URL, "http://")
+
+	cmd, conf := run([]string{"status", "--diag-addr=" + addr}, true)
+	c.Assert(cmd, check.Equals, "status")
+	c.Assert(conf.DiagnosticAddr.Addr, check.Equals, addr)
+
+	buf := &bytes.Buffer{}
+	c.Assert(printProcessStatus(buf, addr), check.IsNil)
+	c.Assert(buf.String(), check.Equals, `Host UUID  : host-uuid
+Hostname   : luna
+Roles      : auth,node
+Started at : 2016-05-01T10:00:00Z
+Uptime     : 1h2m3s
+Backend    : bolt (healthy)
+Auth servers:
+  node: 10.0.0.2:3025
+Connections:
+  teleport_auth_requests_in_flight: 1
+  teleport_ssh_sessions_active: 2
+Data dir usage (bytes):
+  keys.db: 32768
+  total: 40000
+Command labels:
+  arch: "x86_64" every 1h0m0s, next run: 2016-05-01T11:00:00Z
+  uptime: "up" every 1m0s, next run: not scheduled
+`)
+
+	// nothing is listening
+	fake.Close()
+	c.Assert(printProcessStatus(buf, addr), check.NotNil)
+
+	// diag_addr from the config file alone is not queried, so status
+	// inside of an SSH session keeps printing the session info
+	c.Assert(onStatus(conf, false), check.IsNil)
+	c.Assert(onStatus(conf, true), check.NotNil)
+}
+
+func (s *MainTestSuite) TestDisabledLimits(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Auth.Limits.Disabled = true
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+
+	c.Assert(conf.Auth.Limiter.Disabled, check.Equals, true)
+	c.Assert(conf.SSH.Limiter.Disabled, check.Equals, false)
+	c.Assert(conf.Proxy.Limiter.Disabled, check.Equals, false)
+}
+
+func (s *MainTestSuite) TestGlobalLimits(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Limits.MaxConnections = 50
+	fc.Limits.MaxUsers = 10
+	fc.Limits.Rates = []config.ConnectionRate{{Period: time.Minute, Average: 5, Burst: 10}}
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+
+	// global limits end up in the limiter of every role
+	for _, l := range []limiter.LimiterConfig{conf.SSH.Limiter, conf.Auth.Limiter, conf.Proxy.Limiter} {
+		c.Assert(l.MaxConnections, check.Equals, int64(50))
+		c.Assert(l.MaxNumberOfUsers, check.Equals, 10)
+		c.Assert(l.Rates, check.DeepEquals, []limiter.Rate{{Period: time.Minute, Average: 5, Burst: 10}})
+	}
+
+	// and the limiters built from the config enforce them
+	fc = &config.FileConfig{}
+	fc.Limits.MaxConnections = 1
+	conf = service.MakeDefaultConfig()
+	c.Assert(applyConnectionLimits(fc.Limits, conf), check.IsNil)
+	for _, l := range []limiter.LimiterConfig{conf.SSH.Limiter, conf.Auth.Limiter, conf.Proxy.Limiter} {
+		lim, err := limiter.NewLimiter(l)
+		c.Assert(err, check.IsNil)
+		c.Assert(lim.AcquireConnection("10.0.0.1"), check.IsNil)
+		c.Assert(lim.AcquireConnection("10.0.0.1"), check.NotNil)
+		lim.ReleaseConnection("10.0.0.1")
+		c.Assert(lim.AcquireConnection("10.0.0.1"), check.IsNil)
+	}
+}
+
+func (s *MainTestSuite) TestMaxHandshakes(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Limits.MaxHandshakes = 20
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.Limiter.MaxHandshakes, check.Equals, 20)
+	c.Assert(conf.Auth.Limiter.MaxHandshakes, check.Equals, 20)
+	c.Assert(conf.Proxy.Limiter.MaxHandshakes, check.Equals, 20)
+
+	fc.Limits.MaxHandshakes = -1
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestStorageCheckTimeout(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.Auth.BackendCheckTimeout, check.Equals, defaults.BackendCheckTimeout)
+
+	fc := &config.FileConfig{}
+	fc.Storage.CheckTimeout = 5 * time.Second
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.BackendCheckTimeout, check.Equals, 5*time.Second)
+
+	fc.Storage.CheckTimeout = -time.Second
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestAuthServerStrategy(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.AuthServerStrategy, check.Equals, auth.StrategyOrdered)
+
+	fc := &config.FileConfig{}
+	fc.AuthServerStrategy = "round-robin"
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.AuthServerStrategy, check.Equals, auth.StrategyRoundRobin)
+
+	fc.AuthServerStrategy = "fastest"
+	c.Assert(applyFileConfig(fc, conf), check.NotNil)
+}
+
+func (s *MainTestSuite) TestSSHVersionString(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	fc := &config.FileConfig{}
+	fc.SSH.VersionString = "SSH-2.0-Masked"
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.VersionString, check.Equals, "SSH-2.0-Masked")
+
+	fc.SSH.VersionString = "Masked"
+	c.Assert(applyFileConfig(fc, conf), check.NotNil)
+}
+
+func (s *MainTestSuite) TestMOTD(c *check.C) {
+	path := filepath.Join(c.MkDir(), "motd")
+	text := "Welcome to {{.Hostname}}, {{.Username}}\n"
+	c.Assert(ioutil.WriteFile(path, []byte(text), 0644), check.IsNil)
+
+	conf := service.MakeDefaultConfig()
+	fc := &config.FileConfig{}
+	fc.SSH.MOTD = path
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.MOTD, check.Equals, text)
+}
+
+func (s *MainTestSuite) TestKeepAlive(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.SSH.KeepAliveInterval, check.Equals, defaults.KeepAliveInterval)
+	c.Assert(conf.SSH.KeepAliveCountMax, check.Equals, defaults.KeepAliveCountMax)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  keepalive_interval: 30s
+  keepalive_count_max: 5
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.KeepAliveInterval, check.Equals, 30*time.Second)
+	c.Assert(conf.SSH.KeepAliveCountMax, check.Equals, 5)
+
+	// zero interval disables keepalives
+	interval := time.Duration(0)
+	fc = &config.FileConfig{}
+	fc.SSH.KeepAliveInterval = &interval
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.KeepAliveInterval, check.Equals, time.Duration(0))
+
+	fc.SSH.KeepAliveCountMax = -1
+	c.Assert(applyFileConfig(fc, conf), check.NotNil)
+}
+
+func (s *MainTestSuite) TestUseLoginShell(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.SSH.UseLoginShell, check.Equals, true)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  use_login_shell: false
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.UseLoginShell, check.Equals, false)
+
+	// not set in the file config keeps the current value
+	c.Assert(applyFileConfig(&config.FileConfig{}, conf), check.IsNil)
+	c.Assert(conf.SSH.UseLoginShell, check.Equals, false)
+}
+
+func (s *MainTestSuite) TestRecordSessions(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.SSH.RecordSessions, check.Equals, true)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  record_sessions: false
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.RecordSessions, check.Equals, false)
+}
+
+func (s *MainTestSuite) TestCommandLabelUser(c *check.C) {
+	current, err := user.Current()
+	c.Assert(err, check.IsNil)
+	fc := &config.FileConfig{}
+	fc.SSH.Commands = []config.CommandLabel{
+		{Name: "uid", Command: []string{"id", "-u"}, Period: time.Minute, User: current.Username},
+	}
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.CmdLabels["uid"].User, check.Equals, current.Username)
+
+	// user is validated on load
+	fc.SSH.Commands[0].User = "no-such-user-xyz"
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, `.*label "uid": unknown user "no-such-user-xyz".*`)
+}
+
+func (s *MainTestSuite) TestCommandLabelExitCodes(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  commands:
+  - name: health
+    command: [/usr/bin/check-health]
+    period: 1m
+    exit_codes: {0: healthy, "*": unhealthy}
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.CmdLabels["health"].ExitCodes, check.DeepEquals,
+		map[string]string{"0": "healthy", "*": "unhealthy"})
+
+	fc.SSH.Commands[0].ExitCodes = map[string]string{"zero": "healthy"}
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, `.*label "health".*"zero".*`)
+}
+
+func (s *MainTestSuite) TestCommandLabelStableRuns(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  commands:
+  - name: health
+    command: [/usr/bin/check-health]
+    period: 1m
+    stable_runs: 3
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.CmdLabels["health"].StableRuns, check.Equals, 3)
+
+	fc.SSH.Commands[0].StableRuns = -1
+	c.Assert(teleport.IsBadParameter(applyFileConfig(fc, service.MakeDefaultConfig())), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestLabelJitter(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.SSH.LabelJitter, check.Equals, defaults.CommandLabelJitter)
+
+	jitter := 30 * time.Second
+	fc := &config.FileConfig{}
+	fc.SSH.LabelJitter = &jitter
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.LabelJitter, check.Equals, jitter)
+
+	// zero disables the jitter
+	jitter = 0
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.LabelJitter, check.Equals, time.Duration(0))
+
+	jitter = -time.Second
+	c.Assert(teleport.IsBadParameter(applyFileConfig(fc, conf)), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestLabelPolicy(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	writeConfig := func(labels string) *config.FileConfig {
+		err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  label_policy:
+    key_pattern: "[a-z][a-z0-9_]*"
+    value_pattern: "[a-z0-9.-]+"
+  labels: `+labels+`
+  commands:
+  - name: arch
+    command: [uname, -m]
+    period: 1h
+`), 0644)
+		c.Assert(err, check.IsNil)
+		fc, err := config.ReadFromFile(path)
+		c.Assert(err, check.IsNil)
+		return fc
+	}
+
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(writeConfig(`{env: prod, db_role: "pg-9.5"}`), conf), check.IsNil)
+	c.Assert(conf.SSH.LabelPolicy, check.DeepEquals, service.LabelPolicy{
+		KeyPattern: "[a-z][a-z0-9_]*", ValuePattern: "[a-z0-9.-]+",
+		MaxCount: defaults.MaxLabels, MaxSize: defaults.MaxLabelsSize})
+
+	// patterns have to match the whole key or value
+	for _, labels := range []string{`{Env: prod}`, `{env: Prod}`, `{env: "prod us"}`, `{1env: prod}`} {
+		err := applyFileConfig(writeConfig(labels), service.MakeDefaultConfig())
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf(labels))
+	}
+
+	// labels from the flag are checked against the policy from the file
+	c.Assert(parseLabels(`env=staging,arch=[1h:/bin/uname -m]`, &conf.SSH), check.IsNil)
+	c.Assert(teleport.IsBadParameter(parseLabels(`env=Staging`, &conf.SSH)), check.Equals, true)
+	c.Assert(teleport.IsBadParameter(parseLabels(`Arch=[1h:/bin/uname -m]`, &conf.SSH)), check.Equals, true)
+
+	// invalid patterns are rejected
+	fc := &config.FileConfig{}
+	fc.SSH.LabelPolicy = &config.LabelPolicy{KeyPattern: "[a-z"}
+	c.Assert(teleport.IsBadParameter(applyFileConfig(fc, service.MakeDefaultConfig())), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestLabelBudget(c *check.C) {
+	read := func(yaml string) *config.FileConfig {
+		path := filepath.Join(c.MkDir(), "teleport.yaml")
+		c.Assert(ioutil.WriteFile(path, []byte(yaml), 0644), check.IsNil)
+		fc, err := config.ReadFromFile(path)
+		c.Assert(err, check.IsNil)
+		return fc
+	}
+
+	// the default budget fits common label sets
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.SSH.LabelPolicy.MaxCount, check.Equals, defaults.MaxLabels)
+	c.Assert(conf.SSH.LabelPolicy.MaxSize, check.Equals, defaults.MaxLabelsSize)
+	c.Assert(applyFileConfig(read("ssh_service:\n  labels: {env: prod, role: db}\n"), conf), check.IsNil)
+
+	// within the budget: 3 labels, 17 bytes
+	budget := "ssh_service:\n  label_policy:\n    max_count: 3\n    max_size: 17\n"
+	conf = service.MakeDefaultConfig()
+	fc := read(budget + "  labels: {env: prod, role: db}\n  commands:\n  - name: arch\n    command: [uname, -m]\n    period: 1h\n")
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.LabelPolicy.MaxCount, check.Equals, 3)
+	c.Assert(conf.SSH.LabelPolicy.MaxSize, check.Equals, 17)
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(*exported.SSH.LabelPolicy.MaxCount, check.Equals, 3)
+	c.Assert(*exported.SSH.LabelPolicy.MaxSize, check.Equals, 17)
+
+	// over the budget
+	for _, labels := range []string{
+		"  labels: {a: b, c: d, e: f, g: h}\n",
+		"  labels: {env: production, role: db}\n",
+	} {
+		err := applyFileConfig(read(budget+labels), service.MakeDefaultConfig())
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf(labels))
+	}
+
+	// labels from the flag are checked against the budget from the file
+	c.Assert(parseLabels("a=1,b=2,c=3", &conf.SSH), check.IsNil)
+	c.Assert(teleport.IsBadParameter(parseLabels("a=1,b=2,c=3,d=4", &conf.SSH)), check.Equals, true)
+
+	err = applyFileConfig(read("ssh_service:\n  label_policy:\n    max_count: -1\n"), service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestLabelCollisions(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`
+ssh_service:
+  labels: {env: prod, arch: x86_64}
+  commands:
+  - name: arch
+    command: [uname, -m]
+    period: 1h
+`), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err.Error(), check.Matches, `.*"arch".*`)
+
+	delete(fc.SSH.Labels, "arch")
+	c.Assert(applyFileConfig(fc, service.MakeDefaultConfig()), check.IsNil)
+}
+
+func (s *MainTestSuite) TestRequireProvidedTLS(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.Proxy.RequireProvidedTLS, check.Equals, false)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("proxy_service:\n  require_provided_tls: yes\n"), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Proxy.RequireProvidedTLS, check.Equals, true)
+}
+
+func (s *MainTestSuite) TestEnableReverseTunnel(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.Proxy.ReverseTunnelEnabled, check.Equals, true)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+proxy_service:
+  enable_reverse_tunnel: false
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Proxy.Enabled, check.Equals, true)
+	c.Assert(conf.Proxy.ReverseTunnelEnabled, check.Equals, false)
+
+	// not set in the file config keeps the current value
+	c.Assert(applyFileConfig(&config.FileConfig{}, conf), check.IsNil)
+	c.Assert(conf.Proxy.ReverseTunnelEnabled, check.Equals, false)
+}
+
+func (s *MainTestSuite) TestHeartbeatConfig(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.HeartbeatTTL, check.Equals, defaults.ServerHeartbeatTTL)
+	c.Assert(conf.AuthServersRefreshPeriod, check.Equals, defaults.AuthServersRefreshPeriod)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+teleport:
+  heartbeat_ttl: 1m
+  auth_servers_refresh_period: 20s
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.HeartbeatTTL, check.Equals, time.Minute)
+	c.Assert(conf.AuthServersRefreshPeriod, check.Equals, 20*time.Second)
+
+	// negative values are rejected
+	fc = &config.FileConfig{}
+	fc.HeartbeatTTL = -time.Second
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	fc = &config.FileConfig{}
+	fc.AuthServersRefreshPeriod = -time.Second
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	// refresh period should be smaller than the TTL
+	fc = &config.FileConfig{}
+	fc.HeartbeatTTL = time.Minute
+	fc.AuthServersRefreshPeriod = time.Minute
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	// TTL smaller than the default refresh period
+	fc = &config.FileConfig{}
+	fc.HeartbeatTTL = time.Second
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestHandshakeTimeout(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.SSH.HandshakeTimeout, check.Equals, defaults.HandshakeTimeout)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  handshake_timeout: 15s
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.HandshakeTimeout, check.Equals, 15*time.Second)
+
+	fc = &config.FileConfig{}
+	fc.SSH.HandshakeTimeout = -time.Second
+	err = applyFileConfig(fc, conf)
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestAddrErrors(c *check.C) {
+	testCases := []struct {
+		field string
+		set   func(fc *config.FileConfig)
+	}{
+		{"teleport.auth_servers", func(fc *config.FileConfig) { fc.AuthServers = []string{"[::1"} }},
+		{"teleport.diag_addr", func(fc *config.FileConfig) { fc.DiagAddr = "host:port:port" }},
+		{"proxy_service.listen_addr", func(fc *config.FileConfig) { fc.Proxy.ListenAddress = "proxy:3023:" }},
+		{"proxy_service.web_listen_addr", func(fc *config.FileConfig) { fc.Proxy.WebAddr = "[::1:3080" }},
+		{"auth_service.listen_addr", func(fc *config.FileConfig) { fc.Auth.ListenAddress = "a:b:c" }},
+		{"ssh_service.listen_addr", func(fc *config.FileConfig) { fc.SSH.ListenAddress = "[::1]]:3022" }},
+	}
+	for _, testCase := range testCases {
+		fc := &config.FileConfig{}
+		testCase.set(fc)
+		err := applyFileConfig(fc, service.MakeDefaultConfig())
+		c.Assert(err, check.NotNil, check.Commentf(testCase.field))
+		c.Assert(teleport.ErrorCode(err), check.Equals, teleport.CodeInvalidListenAddr, check.Commentf(testCase.field))
+		c.Assert(err.Error(), check.Matches, fmt.Sprintf("bad parameter '%v', invalid address .*", regexp.QuoteMeta(testCase.field)))
+	}
+
+	_, err := configure(&CommandLineFlags{AuthServerAddr: "a:b:c"})
+	c.Assert(err, check.ErrorMatches, "bad parameter '--auth-server', invalid address .*")
+}
+
+func (s *MainTestSuite) TestIPv6ListenAddr(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+ssh_service:
+  listen_addr: "[::1]:3022"
+proxy_service:
+  listen_addr: "::"
+  web_listen_addr: "[fe80::1]:443"
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.Addr.Addr, check.Equals, "[::1]:3022")
+	c.Assert(conf.Proxy.SSHAddr.Addr, check.Equals, fmt.Sprintf("[::]:%v", defaults.SSHProxyListenPort))
+	c.Assert(conf.Proxy.WebAddr.Addr, check.Equals, "[fe80::1]:443")
+}
+
+func (s *MainTestSuite) TestStartMode(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.StartMode, check.Equals, service.StartAllOrNothing)
+
+	fc := &config.FileConfig{}
+	fc.StartMode = "best-effort"
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.StartMode, check.Equals, service.StartBestEffort)
+
+	fc.StartMode = "whatever"
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	// missing web assets fail the proxy only in best-effort mode
+	defer func(dirs []string) { DirsToLookForWebAssets = dirs }(DirsToLookForWebAssets)
+	DirsToLookForWebAssets = []string{c.MkDir()}
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  start_mode: best-effort\n"), 0644), check.IsNil)
+	conf, err = configure(&CommandLineFlags{ConfigFile: path, Roles: "node,proxy", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.Proxy.Enabled, check.Equals, true)
+	c.Assert(conf.Proxy.AssetsDir, check.Equals, "")
+
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  start_mode: all-or-nothing\n"), 0644), check.IsNil)
+	_, err = configure(&CommandLineFlags{ConfigFile: path, Roles: "node,proxy", AuthToken: "token"})
+	c.Assert(err, check.ErrorMatches, ".*Cannot find web assets.*")
+}
+
+func (s *MainTestSuite) TestHostCertCheck(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.HostCertCheck, check.Equals, service.HostCertCheckWarn)
+
+	fc := &config.FileConfig{}
+	fc.HostCertCheck = "off"
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.HostCertCheck, check.Equals, service.HostCertCheckOff)
+
+	// removing the certificate would lock the host out of the cluster
+	for _, value := range []string{"regenerate", "whatever"} {
+		fc.HostCertCheck = value
+		err := applyFileConfig(fc, service.MakeDefaultConfig())
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	}
+}
+
+func (s *MainTestSuite) TestMinKeySize(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.MinKeySize, check.Equals, 0)
+
+	fc := &config.FileConfig{}
+	fc.MinKeySize = 2048
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.MinKeySize, check.Equals, 2048)
+
+	fc.MinKeySize = -1
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestRegisterRetries(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.RegisterRetries, check.Equals, 0)
+
+	fc := &config.FileConfig{}
+	fc.RegisterRetries = 5
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.RegisterRetries, check.Equals, 5)
+
+	fc.RegisterRetries = -1
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestAuthHTTPListener(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.Auth.TunnelEnabled, check.Equals, true)
+	c.Assert(conf.Auth.HTTPAddr.IsEmpty(), check.Equals, true)
+
+	dir := c.MkDir()
+	for _, name := range []string{"auth.crt", "auth.key", "clients.crt"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), nil, 0600), check.IsNil)
+	}
+	path := filepath.Join(dir, "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`auth_service:
+  enable_ssh_tunnel: no
+  http_listen_addr: 127.0.0.1
+  https_cert_file: `+filepath.Join(dir, "auth.crt")+`
+  https_key_file: `+filepath.Join(dir, "auth.key")+`
+  https_client_ca_file: `+filepath.Join(dir, "clients.crt")+`
+`), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.TunnelEnabled, check.Equals, false)
+	c.Assert(conf.Auth.HTTPAddr.Addr, check.Equals, "127.0.0.1:3026")
+	c.Assert(conf.Auth.HTTPClientCAFile, check.Equals, filepath.Join(dir, "clients.crt"))
+	c.Assert(conf.Auth.CheckListeners(), check.IsNil)
+
+	// the role comes from client certificates
+	c.Assert(ioutil.WriteFile(path, []byte(`auth_service:
+  http_listen_addr: 127.0.0.1
+  http_role: Admin
+`), 0644), check.IsNil)
+	_, err = config.ReadFromFile(path)
+	c.Assert(err, check.NotNil)
+
+	// the API is not served over plain HTTP
+	plain := service.MakeDefaultConfig()
+	plain.Auth.HTTPAddr = conf.Auth.HTTPAddr
+	c.Assert(teleport.IsBadParameter(plain.Auth.CheckListeners()), check.Equals, true)
+
+	// the API has to be served somewhere
+	fc.Auth.HTTPListenAddress = ""
+	conf = service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(teleport.IsBadParameter(conf.Validate()), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestMaxSessionSize(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`auth_service:
+  max_session_size: 1048576
+`), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.Auth.MaxSessionSize, check.Equals, int64(0))
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.MaxSessionSize, check.Equals, int64(1048576))
+
+	fc.Auth.MaxSessionSize = -1
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestEventWebhook(c *check.C) {
+	c.Assert(secrets.Register("stub", stubSecrets{"webhook": "Bearer xxx"}), check.IsNil)
+	defer secrets.Unregister("stub")
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`auth_service:
+  event_webhook:
+    url: https://events.example.com/teleport
+    auth_header: secret://stub/webhook
+    queue_size: 100
+    retries: 0
+    retry_period: 2s
+    on_full: block
+`), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.Auth.EventWebhook.Enabled(), check.Equals, false)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.EventWebhook, check.DeepEquals, webhook.Config{
+		URL:         "https://events.example.com/teleport",
+		AuthHeader:  "Bearer xxx",
+		QueueSize:   100,
+		Retries:     0,
+		RetryPeriod: 2 * time.Second,
+		OnFull:      webhook.BlockPolicy,
+	})
+
+	// retries are on by default
+	fc.Auth.EventWebhook.Retries = nil
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.EventWebhook.Retries, check.Equals, defaults.EventWebhookRetries)
+
+	// the exported config applies to the same settings
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	applied := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(exported, applied), check.IsNil)
+	c.Assert(applied.Auth.EventWebhook, check.DeepEquals, conf.Auth.EventWebhook)
+
+	fc.Auth.EventWebhook.OnFull = "wait"
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	fc.Auth.EventWebhook.OnFull = ""
+	fc.Auth.EventWebhook.URL = "events.example.com"
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestHostKeyRotationPeriod(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`ssh_service:
+  host_key_rotation_period: 720h
+`), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.SSH.HostKeyRotationPeriod, check.Equals, time.Duration(0))
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.HostKeyRotationPeriod, check.Equals, 720*time.Hour)
+
+	fc.SSH.HostKeyRotationPeriod = -time.Hour
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestPostStartCommand(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`teleport:
+  post_start_command: [/usr/local/bin/register, --service, teleport]
+  post_start_timeout: 5s
+  post_start_abort_on_error: true
+`), 0644), check.IsNil)
+	cfg, err := configure(&CommandLineFlags{ConfigFile: path, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.PostStart, check.DeepEquals, service.PostStartConfig{
+		Command:      []string{"/usr/local/bin/register", "--service", "teleport"},
+		Timeout:      5 * time.Second,
+		AbortOnError: true,
+	})
+
+	// hook is disabled by default
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(&config.FileConfig{}, conf), check.IsNil)
+	c.Assert(conf.PostStart.Command, check.HasLen, 0)
+}
+
+func (s *MainTestSuite) TestValidateMergedConfig(c *check.C) {
+	dir := c.MkDir()
+
+	// the file runs auth only, --auth-server turns it off
+	authOnly := filepath.Join(dir, "auth.yaml")
+	c.Assert(ioutil.WriteFile(authOnly, []byte(`ssh_service:
+  enabled: no
+proxy_service:
+  enabled: no
+`), 0644), check.IsNil)
+	_, err := configure(&CommandLineFlags{ConfigFile: authOnly})
+	c.Assert(err, check.IsNil)
+	_, err = configure(&CommandLineFlags{ConfigFile: authOnly, AuthServerAddr: "10.0.0.1:3025"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+
+	// the file sets up the local auth service, --auth-server points the
+	// node to a remote one
+	localAuth := filepath.Join(dir, "local-auth.yaml")
+	c.Assert(ioutil.WriteFile(localAuth, []byte(`auth_service:
+  domain_name: example.com
+`), 0644), check.IsNil)
+	_, err = configure(&CommandLineFlags{ConfigFile: localAuth, AuthServerAddr: "10.0.0.1:3025", AuthToken: "token"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+	c.Assert(err, check.ErrorMatches, "(?s).*auth_service.domain_name set in the config file, but --auth-server.*")
+
+	// settings of auth disabled in the file are only leftovers
+	c.Assert(ioutil.WriteFile(localAuth, []byte(`auth_service:
+  enabled: no
+  domain_name: example.com
+`), 0644), check.IsNil)
+	_, err = configure(&CommandLineFlags{ConfigFile: localAuth, AuthServerAddr: "10.0.0.1:3025", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+
+	// the file requires provided certificates, --roles turns the proxy on
+	requireTLS := filepath.Join(dir, "proxy.yaml")
+	c.Assert(ioutil.WriteFile(requireTLS, []byte(`proxy_service:
+  enabled: no
+  require_provided_tls: yes
+`), 0644), check.IsNil)
+	_, err = configure(&CommandLineFlags{ConfigFile: requireTLS, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	_, err = configure(&CommandLineFlags{ConfigFile: requireTLS, Roles: "node,proxy", AuthToken: "token"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+}
+
+func (s *MainTestSuite) TestOrphanedSettings(c *check.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "teleport.yaml")
+	for _, name := range []string{"proxy.crt", "proxy.key"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte("pem"), 0600), check.IsNil)
+	}
+	c.Assert(ioutil.WriteFile(path, []byte(`
+auth_service:
+  domain_name: example.com
+ssh_service:
+  enabled: yes
+  labels: {env: prod}
+proxy_service:
+  enabled: no
+  https_cert_file: `+filepath.Join(dir, "proxy.crt")+`
+  https_key_file: `+filepath.Join(dir, "proxy.key")+`
+  tls_min_version: tls1.2
+`), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(orphanedSettings(fc, conf), check.DeepEquals, []string{
+		"proxy_service.https_key_file",
+		"proxy_service.https_cert_file",
+		"proxy_service.tls_min_version",
+	})
+
+	// roles disabled by the flag orphan their settings too
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	cfg, err := configure(&CommandLineFlags{ConfigFile: path, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(orphanedSettings(fc, cfg), check.DeepEquals, []string{
+		"auth_service.domain_name",
+		"proxy_service.https_key_file",
+		"proxy_service.https_cert_file",
+		"proxy_service.tls_min_version",
+	})
+	c.Assert(buf.String(), check.Matches, `(?s).*auth_service.domain_name is set but the service is disabled.*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*proxy_service.https_cert_file is set but the service is disabled.*`)
+
+	// nothing is orphaned when all roles are enabled
+	conf.Proxy.Enabled = true
+	c.Assert(orphanedSettings(fc, conf), check.HasLen, 0)
+}
+
+func (s *MainTestSuite) TestConfigDir(c *check.C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "labels.yaml"),
+		[]byte("ssh_service:\n  labels: {env: prod, role: db}\n"), 0644), check.IsNil)
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("ssh_service:\n  labels: {env: staging}\n"), 0644), check.IsNil)
+
+	cfg, err := configure(&CommandLineFlags{ConfigFile: path, ConfigDir: dir, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Labels, check.DeepEquals, map[string]string{"env": "staging", "role": "db"})
+
+	// fragments are used without the main config file too
+	cfg, err = configure(&CommandLineFlags{ConfigDir: dir, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Labels, check.DeepEquals, map[string]string{"env": "prod", "role": "db"})
+
+	_, err = configure(&CommandLineFlags{ConfigDir: filepath.Join(dir, "missing"), Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *MainTestSuite) TestConfigHash(c *check.C) {
+	dir := c.MkDir()
+	writeConfig := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+		return path
+	}
+	path := writeConfig("teleport.yaml", `
+# node config
+teleport:
+  nodename: node
+  audit_config_load: yes
+ssh_service:
+  labels:
+    env: prod
+    role: db
+`)
+	cfg, err := configure(&CommandLineFlags{ConfigFile: path, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.AuditConfigLoad, check.Equals, true)
+	c.Assert(cfg.ConfigSource, check.Equals, path)
+	c.Assert(cfg.ConfigSHA256, check.HasLen, 64)
+
+	// the hash is stable across loads
+	again, err := configure(&CommandLineFlags{ConfigFile: path, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(again.ConfigSHA256, check.Equals, cfg.ConfigSHA256)
+
+	// secrets are not hashed
+	again, err = configure(&CommandLineFlags{ConfigFile: path, Roles: "node", AuthToken: "rotated-token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(again.ConfigSHA256, check.Equals, cfg.ConfigSHA256)
+
+	// comments and ordering don't change the canonical config
+	reordered := writeConfig("reordered.yaml", `
+ssh_service:
+  labels:
+    role: db
+    env: prod
+teleport:
+  audit_config_load: yes
+  nodename: node
+`)
+	other, err := configure(&CommandLineFlags{ConfigFile: reordered, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(other.ConfigSHA256, check.Equals, cfg.ConfigSHA256)
+
+	changed := writeConfig("changed.yaml", `
+teleport:
+  nodename: node
+  audit_config_load: yes
+ssh_service:
+  labels:
+    env: staging
+    role: db
+`)
+	other, err = configure(&CommandLineFlags{ConfigFile: changed, Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(other.ConfigSHA256, check.Not(check.Equals), cfg.ConfigSHA256)
+}
+
+func (s *MainTestSuite) TestReusePort(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.ReusePort, check.Equals, false)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  reuse_port: yes\n"), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	err = applyFileConfig(fc, conf)
+	if !utils.ReusePortSupported {
+		c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+		return
+	}
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.ReusePort, check.Equals, true)
+}
+
+func (s *MainTestSuite) TestShell(c *check.C) {
+	dir := c.MkDir()
+	shell := filepath.Join(dir, "zsh")
+	c.Assert(ioutil.WriteFile(shell, []byte("#!/bin/sh\n"), 0755), check.IsNil)
+
+	fc := &config.FileConfig{}
+	fc.SSH.Shell = shell
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.Shell, check.Equals, shell)
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.SSH.Shell, check.Equals, shell)
+
+	// the shell is validated on start, where a bad one is only fatal
+	// if the SSH service uses it
+	fc.SSH.Shell = filepath.Join(dir, "missing")
+	conf = service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.Shell, check.Equals, fc.SSH.Shell)
+}
+
+func (s *MainTestSuite) TestConnectionLogging(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.ConnectionLogging, check.Equals, false)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  connection_logging: yes\n"), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.ConnectionLogging, check.Equals, true)
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.ConnectionLogging, check.Equals, true)
+}
+
+func (s *MainTestSuite) TestAdvertiseIPCheck(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.AdvertiseIPCheck, check.Equals, false)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  advertise_ip: 10.10.10.1\n  advertise_ip_check: yes\n"), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.AdvertiseIPCheck, check.Equals, true)
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.AdvertiseIPCheck, check.Equals, true)
+}
+
+func (s *MainTestSuite) TestWarnThreshold(c *check.C) {
+	read := func(yaml string) *config.FileConfig {
+		path := filepath.Join(c.MkDir(), "teleport.yaml")
+		c.Assert(ioutil.WriteFile(path, []byte(yaml), 0644), check.IsNil)
+		fc, err := config.ReadFromFile(path)
+		c.Assert(err, check.IsNil)
+		return fc
+	}
+
+	conf := service.MakeDefaultConfig()
+	fc := read("teleport:\n  connection_limits:\n    max_connections: 10\nssh_service:\n  limits:\n    warn_threshold: 8\n")
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.SSH.Limiter.WarnThreshold, check.Equals, int64(8))
+	c.Assert(conf.Proxy.Limiter.WarnThreshold, check.Equals, int64(0))
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.SSH.Limits.WarnThreshold, check.Equals, int64(8))
+
+	// the warn threshold has to be below the hard limit
+	fc = read("teleport:\n  connection_limits:\n    max_connections: 10\nproxy_service:\n  limits:\n    warn_threshold: 10\n")
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true, check.Commentf("%v", err))
+}
+
+func (s *MainTestSuite) TestPanicRecovery(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.PanicRecovery, check.Equals, true)
+
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  panic_recovery: no\n"), 0644), check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.PanicRecovery, check.Equals, false)
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(*exported.PanicRecovery, check.Equals, false)
+}
+
+func (s *MainTestSuite) TestShutdownTimeout(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.ShutdownTimeout, check.Equals, defaults.ShutdownTimeout)
+
+	fc := &config.FileConfig{}
+	fc.ShutdownTimeout = time.Minute
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.ShutdownTimeout, check.Equals, time.Minute)
+
+	fc.ShutdownTimeout = -time.Second
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestLabelTemplates(c *check.C) {
+	writeConfig := func(value string) string {
+		path := filepath.Join(c.MkDir(), "teleport.yaml")
+		content := fmt.Sprintf("ssh_service:\n  labels:\n    host: '%v'\n", value)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+		return path
+	}
+
+	// templates are kept until the host facts are known on start
+	cfg, err := configure(&CommandLineFlags{ConfigFile: writeConfig("{{.Hostname}}"), Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Labels["host"], check.Equals, "{{.Hostname}}")
+
+	_, err = configure(&CommandLineFlags{ConfigFile: writeConfig("{{.Bogus}}"), Roles: "node", AuthToken: "token"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	_, err = configure(&CommandLineFlags{Labels: "host={{.Bogus}}", Roles: "node", AuthToken: "token"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestAuthCacheTTL(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.AuthCacheTTL, check.Equals, time.Duration(0))
+
+	fc := &config.FileConfig{}
+	fc.AuthCacheTTL = 10 * time.Second
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.AuthCacheTTL, check.Equals, 10*time.Second)
+
+	fc.AuthCacheTTL = -time.Second
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestAuthServerHostKey(c *check.C) {
+	pin := "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"
+	fc := &config.FileConfig{}
+	fc.AuthServerHostKey = pin
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.AuthServerHostKey, check.Equals, pin)
+
+	fc.AuthServerHostKey = "not-a-key"
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestDefaultRoles(c *check.C) {
+	writeConfig := func(content string) string {
+		path := filepath.Join(c.MkDir(), "teleport.yaml")
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+		return path
+	}
+	path := writeConfig("teleport:\n  auth_token: token\n  default_roles: [node, proxy]\n")
+
+	// config default is applied when --roles is absent
+	cfg, err := configure(&CommandLineFlags{ConfigFile: path})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Enabled, check.Equals, true)
+	c.Assert(cfg.Proxy.Enabled, check.Equals, true)
+	c.Assert(cfg.Auth.Enabled, check.Equals, false)
+
+	// --roles takes precedence
+	cfg, err = configure(&CommandLineFlags{ConfigFile: path, Roles: "auth"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Enabled, check.Equals, false)
+	c.Assert(cfg.Proxy.Enabled, check.Equals, false)
+	c.Assert(cfg.Auth.Enabled, check.Equals, true)
+
+	// so do the "enabled" flags of the services
+	cfg, err = configure(&CommandLineFlags{ConfigFile: writeConfig(
+		"teleport:\n  default_roles: [node, proxy]\nproxy_service:\n  enabled: no\nauth_service:\n  enabled: yes\n")})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Enabled, check.Equals, true)
+	c.Assert(cfg.Proxy.Enabled, check.Equals, false)
+	c.Assert(cfg.Auth.Enabled, check.Equals, true)
+
+	_, err = configure(&CommandLineFlags{ConfigFile: writeConfig("teleport:\n  default_roles: [node, bogus]\n")})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *MainTestSuite) TestMissingToken(c *check.C) {
+	dataDir := c.MkDir()
+	defer func(was string) { defaults.DataDir = was }(defaults.DataDir)
+	defaults.DataDir = dataDir
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  nodename: node\n"), 0644), check.IsNil)
+
+	// the token is checked on start only
+	start := func(clf *CommandLineFlags) error {
+		cfg, err := configure(clf)
+		if err != nil {
+			return err
+		}
+		return checkJoinToken(cfg)
+	}
+
+	// other commands work on a node that has never joined the cluster
+	_, err := configure(&CommandLineFlags{ConfigFile: path, Roles: "node"})
+	c.Assert(err, check.IsNil)
+
+	// it needs a token to start
+	err = start(&CommandLineFlags{ConfigFile: path, Roles: "node"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, "(?s).*--token.*auth_token.*")
+	err = start(&CommandLineFlags{ConfigFile: path, Roles: "proxy"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(start(&CommandLineFlags{ConfigFile: path, Roles: "node", AuthToken: "token"}), check.IsNil)
+
+	// the auth server in the same process registers the roles locally
+	c.Assert(start(&CommandLineFlags{ConfigFile: path, Roles: "auth"}), check.IsNil)
+	c.Assert(start(&CommandLineFlags{ConfigFile: path, Roles: "auth,node,proxy"}), check.IsNil)
+
+	// a node that has joined before uses its host keys
+	c.Assert(ioutil.WriteFile(filepath.Join(dataDir, utils.HostUUIDFile), []byte("uuid"), 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dataDir, "host.uuid.Node.key"), []byte("key"), 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dataDir, "host.uuid.Node.cert"), []byte("cert"), 0600), check.IsNil)
+	c.Assert(start(&CommandLineFlags{ConfigFile: path, Roles: "node"}), check.IsNil)
+}
+
+func (s *MainTestSuite) TestAllowedSourceCIDRs(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Auth.AllowedSourceCIDRs = []string{"10.0.0.0/8", "fd00::/8"}
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.AllowedSourceCIDRs, check.HasLen, 2)
+	c.Assert(conf.Auth.AllowedSourceCIDRs[1].String(), check.Equals, "fd00::/8")
+
+	fc.Auth.AllowedSourceCIDRs = []string{"10.0.0.0/33"}
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestAllowedTokens(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+auth_service:
+  domain_name: example.com
+  tokens:
+  - token: n-rack1
+    sources: [10.1.0.0/16, 'fd00::/8']
+  - token: a-anywhere
+`), 0644)
+	c.Assert(err, check.IsNil)
+	fc, err := config.ReadFromFile(path)
+	c.Assert(err, check.IsNil)
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.AllowedTokens, check.DeepEquals, service.KeyVal{
+		"n-rack1":    "example.com",
+		"a-anywhere": "example.com",
+	})
+	c.Assert(conf.Auth.AllowedTokenSources, check.HasLen, 1)
+	c.Assert(conf.Auth.AllowedTokenSources["n-rack1"], check.HasLen, 2)
+	c.Assert(conf.Auth.AllowedTokenSources["n-rack1"][0].String(), check.Equals, "10.1.0.0/16")
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.Auth.Tokens, check.DeepEquals, []config.AllowedToken{
+		{Token: "a-anywhere"},
+		{Token: "n-rack1", Sources: []string{"10.1.0.0/16", "fd00::/8"}},
+	})
+
+	fc = &config.FileConfig{}
+	fc.Auth.Tokens = []config.AllowedToken{{Token: "n-rack1", Sources: []string{"10.1.0.0/33"}}}
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	fc.Auth.Tokens = []config.AllowedToken{{Sources: []string{"10.1.0.0/16"}}}
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestClockSkew(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.ClockSkew, check.Equals, defaults.ClockSkew)
+
+	skew := 2 * time.Minute
+	fc := &config.FileConfig{}
+	fc.ClockSkew = &skew
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.ClockSkew, check.Equals, skew)
+
+	// zero turns the tolerance off
+	skew = 0
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.ClockSkew, check.Equals, time.Duration(0))
+
+	skew = -time.Second
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestMaxAuthServers(c *check.C) {
+	writeConfig := func(count, max int) string {
+		servers := make([]string, count)
+		for i := range servers {
+			servers[i] = fmt.Sprintf("    - auth%v.example.com:3025", i)
+		}
+		path := filepath.Join(c.MkDir(), "teleport.yaml")
+		content := "teleport:\n  auth_servers:\n" + strings.Join(servers, "\n") + "\n"
+		if max != 0 {
+			content += fmt.Sprintf("  max_auth_servers: %v\n", max)
+		}
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+		return path
+	}
+
+	// within the default bound
+	cfg, err := configure(&CommandLineFlags{ConfigFile: writeConfig(defaults.MaxAuthServers, 0), Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.AuthServers, check.HasLen, defaults.MaxAuthServers)
+
+	// over the default bound
+	_, err = configure(&CommandLineFlags{ConfigFile: writeConfig(defaults.MaxAuthServers+1, 0), Roles: "node", AuthToken: "token"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*21 auth servers are configured, the maximum is 20.*")
+
+	// the bound is configurable
+	cfg, err = configure(&CommandLineFlags{ConfigFile: writeConfig(30, 50), Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.AuthServers, check.HasLen, 30)
+
+	_, err = configure(&CommandLineFlags{ConfigFile: writeConfig(3, 2), Roles: "node", AuthToken: "token"})
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	// --auth-server flag replaces the list from the file
+	cfg, err = configure(&CommandLineFlags{ConfigFile: writeConfig(3, 2), Roles: "node", AuthToken: "token", AuthServerAddr: "auth.example.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.AuthServers, check.HasLen, 1)
+}
+
+func (s *MainTestSuite) TestLogTag(c *check.C) {
+	buf := &bytes.Buffer{}
+	logger := log.StandardLogger()
+	out, level, formatter := logger.Out, logger.Level, logger.Formatter
+	log.SetOutput(buf)
+	log.SetLevel(log.InfoLevel)
+	defer func() {
+		utils.SetLogTag("")
+		log.SetOutput(out)
+		log.SetLevel(level)
+		log.SetFormatter(formatter)
+	}()
+
+	// explicit tag prefixes text log lines
+	fc := &config.FileConfig{}
+	fc.Logger.Tag = "prod-eu"
+	applyLogTag(fc, service.MakeDefaultConfig())
+	log.Info("hello")
+	c.Assert(buf.String(), check.Matches, `(?s).*\[prod-eu\] hello.*`)
+
+	// the tag is replaced, not added to, and defaults to the node name
+	buf.Reset()
+	fc = &config.FileConfig{}
+	fc.NodeName = "luna"
+	cfg := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, cfg), check.IsNil)
+	applyLogTag(fc, cfg)
+	log.Info("hello")
+	c.Assert(strings.Contains(buf.String(), "[luna] hello"), check.Equals, true, check.Commentf(buf.String()))
+	c.Assert(strings.Contains(buf.String(), "prod-eu"), check.Equals, false)
+
+	// JSON entries get a field
+	buf.Reset()
+	log.SetFormatter(&log.JSONFormatter{})
+	log.Info("hello")
+	var entry map[string]interface{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &entry), check.IsNil)
+	c.Assert(entry["tag"], check.Equals, "luna")
+	c.Assert(entry["msg"], check.Equals, "hello")
+
+	// --name overrides the node name the tag defaults to
+	buf.Reset()
+	log.SetFormatter(formatter)
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("teleport:\n  nodename: luna\n"), 0600), check.IsNil)
+	_, err := configure(&CommandLineFlags{ConfigFile: path, NodeName: "sol", Roles: "auth"})
+	c.Assert(err, check.IsNil)
+	log.Info("hello")
+	c.Assert(strings.Contains(buf.String(), "[sol] hello"), check.Equals, true, check.Commentf(buf.String()))
+}
+
+func (s *MainTestSuite) TestLogOverrides(c *check.C) {
+	path := filepath.Join(c.MkDir(), "teleport.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+teleport:
+  nodename: file-node
+  auth_token: file-token
+`), 0644)
+	c.Assert(err, check.IsNil)
+
+	buf := &bytes.Buffer{}
+	logger := log.StandardLogger()
+	out, level := logger.Out, logger.Level
+	log.SetOutput(buf)
+	log.SetLevel(log.DebugLevel)
+	defer func() {
+		log.SetOutput(out)
+		log.SetLevel(level)
+	}()
+
+	cfg, err := configure(&CommandLineFlags{
+		ConfigFile: path,
+		Roles:      "node",
+		NodeName:   "flag-node",
+		AuthToken:  "flag-token",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.Hostname, check.Equals, "flag-node")
+
+	logs := buf.String()
+	c.Assert(strings.Contains(logs, "flag --name overrode config field teleport.nodename (was file-node, now flag-node)"),
+		check.Equals, true, check.Commentf(logs))
+	c.Assert(strings.Contains(logs, "flag --roles overrode config field proxy_service.enabled (was true, now false)"),
+		check.Equals, true, check.Commentf(logs))
+	c.Assert(strings.Contains(logs, "flag --token overrode config field teleport.auth_token"), check.Equals, true)
+	for _, token := range []string{"file-token", "flag-token"} {
+		c.Assert(strings.Contains(logs, token), check.Equals, false, check.Commentf("token leaked: %v", logs))
+	}
+
+	// flags that don't change anything are not logged
+	err = ioutil.WriteFile(path, []byte(`
+teleport:
+  nodename: file-node
+auth_service:
+  enabled: no
+proxy_service:
+  enabled: no
+`), 0644)
+	c.Assert(err, check.IsNil)
+	buf.Reset()
+	_, err = configure(&CommandLineFlags{ConfigFile: path, Roles: "node", AuthToken: "token", NodeName: "file-node"})
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(buf.String(), "overrode"), check.Equals, false, check.Commentf(buf.String()))
+
+	// --token without a config file has nothing to override
+	cfg, err = configure(&CommandLineFlags{Roles: "node", AuthToken: "flag-token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Token, check.Equals, "flag-token")
+}
+
+func (s *MainTestSuite) TestETCDForceClusterName(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Storage.Type = teleport.ETCDBackendType
+	fc.Storage.Peers = []string{"http://localhost:4001"}
+	fc.Storage.Prefix = "/teleport"
+	fc.Storage.ForceClusterName = true
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+
+	etcdCfg, err := etcdbk.ParseConfig(conf.Auth.KeysBackend.Params)
+	c.Assert(err, check.IsNil)
+	c.Assert(etcdCfg.ForceClusterName, check.Equals, true)
+	c.Assert(etcdCfg.Key, check.Equals, "/teleport")
+}
+
+func (s *MainTestSuite) TestDomainNameCase(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Auth.DomainName = "Example.COM."
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.DomainName, check.Equals, "example.com")
+
+	fc.Auth.DomainName = " . "
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestETCDQuorumCheckPeriod(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Storage.Type = teleport.ETCDBackendType
+	fc.Storage.Peers = []string{"http://localhost:4001"}
+	fc.Storage.Prefix = "/teleport"
+	fc.Storage.QuorumCheckPeriod = 10 * time.Second
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+
+	etcdCfg, err := etcdbk.ParseConfig(conf.Auth.KeysBackend.Params)
+	c.Assert(err, check.IsNil)
+	c.Assert(etcdCfg.QuorumCheckPeriod, check.Equals, 10*time.Second)
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.Storage.QuorumCheckPeriod, check.Equals, 10*time.Second)
+
+	fc.Storage.QuorumCheckPeriod = -time.Second
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+}
+
+func (s *MainTestSuite) TestETCDPeersFile(c *check.C) {
+	fc := &config.FileConfig{}
+	fc.Storage.Type = teleport.ETCDBackendType
+	fc.Storage.PeersFile = "/var/lib/discovery/etcd-peers"
+	fc.Storage.Prefix = "/teleport"
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+
+	etcdCfg, err := etcdbk.ParseConfig(conf.Auth.KeysBackend.Params)
+	c.Assert(err, check.IsNil)
+	c.Assert(etcdCfg.NodesFile, check.Equals, "/var/lib/discovery/etcd-peers")
+	c.Assert(etcdCfg.Nodes, check.HasLen, 0)
+
+	exported, err := config.ToFileConfig(conf)
+	c.Assert(err, check.IsNil)
+	c.Assert(exported.Storage.PeersFile, check.Equals, "/var/lib/discovery/etcd-peers")
+}
+
+func (s *MainTestSuite) TestRequireExistingDataDir(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.RequireExistingDataDir, check.Equals, false)
+
+	fc := &config.FileConfig{}
+	fc.Storage.RequireExistingDataDir = true
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.RequireExistingDataDir, check.Equals, true)
+}
+
+func (s *MainTestSuite) TestRequirePersistentDataDir(c *check.C) {
+	conf := service.MakeDefaultConfig()
+	c.Assert(conf.RequirePersistentDataDir, check.Equals, false)
+
+	fc := &config.FileConfig{}
+	fc.Storage.RequirePersistentDataDir = true
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.RequirePersistentDataDir, check.Equals, true)
+}
+
+func (s *MainTestSuite) TestDataDirFallback(c *check.C) {
+	dir := c.MkDir()
+	// a data dir under a regular file can't be created by anyone
+	file := filepath.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(file, nil, 0644), check.IsNil)
+	xdgDataHome := os.Getenv("XDG_DATA_HOME")
+	defer os.Setenv("XDG_DATA_HOME", xdgDataHome)
+	c.Assert(os.Setenv("XDG_DATA_HOME", dir), check.IsNil)
+
+	newConfig := func() *service.Config {
+		conf := service.MakeDefaultConfig()
+		conf.DataDir = filepath.Join(file, "teleport")
+		return conf
+	}
+
+	// root keeps the default data dir
+	conf := newConfig()
+	c.Assert(applyDataDirFallback(nil, conf, 0), check.IsNil)
+	c.Assert(conf.DataDir, check.Equals, filepath.Join(file, "teleport"))
+
+	// non-root user falls back to the user data dir
+	conf = newConfig()
+	c.Assert(applyDataDirFallback(nil, conf, 1000), check.IsNil)
+	c.Assert(conf.DataDir, check.Equals, filepath.Join(dir, "teleport"))
+	c.Assert(conf.Auth.KeysBackend.Params, check.Equals,
+		fmt.Sprintf(`{"path": "%v"}`, filepath.Join(dir, "teleport", defaults.KeysBoltFile)))
+
+	// bolt storage without data_dir keeps its files in the fallback dir
+	fc := &config.FileConfig{}
+	fc.Storage.Type = teleport.BoltBackendType
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.KeysBackend.Params, check.Equals,
+		fmt.Sprintf(`{"path": "%v"}`, filepath.Join(dir, "teleport", defaults.KeysBoltFile)))
+
+	// explicitly configured data dir is never replaced
+	conf = newConfig()
+	fc = &config.FileConfig{}
+	fc.Storage.DirName = filepath.Join(file, "teleport")
+	c.Assert(applyDataDirFallback(fc, conf, 1000), check.IsNil)
+	c.Assert(conf.DataDir, check.Equals, filepath.Join(file, "teleport"))
+}
+
+func (s *MainTestSuite) TestKeyPassphrase(c *check.C) {
+	path := filepath.Join(c.MkDir(), "passphrase")
+	c.Assert(ioutil.WriteFile(path, []byte("secret\n"), 0600), check.IsNil)
+
+	fc := &config.FileConfig{}
+	fc.KeyPassphraseFile = path
+	conf := service.MakeDefaultConfig()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.KeyPassphrase, check.Equals, "secret")
+
+	c.Assert(ioutil.WriteFile(path, []byte("\n"), 0600), check.IsNil)
+	err := applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsBadParameter(err), check.Equals, true)
+
+	// environment takes precedence over the config file
+	os.Setenv(teleport.KeyPassphraseEnvVar, "from-env")
+	defer os.Unsetenv(teleport.KeyPassphraseEnvVar)
+	cfg, err := configure(&CommandLineFlags{Roles: "node", AuthToken: "token"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.KeyPassphrase, check.Equals, "from-env")
+}
+
+type stubSecrets map[string]string
+
+func (p stubSecrets) GetSecret(path string) ([]byte, error) {
+	value, ok := p[path]
+	if !ok {
+		return nil, teleport.NotFound(path)
+	}
+	return []byte(value), nil
+}
+
+func (s *MainTestSuite) TestSecretReferences(c *check.C) {
+	c.Assert(secrets.Register("stub", stubSecrets{
+		"token":     "xxx-token",
+		"proxy/key": "key-data",
+	}), check.IsNil)
+	defer secrets.Unregister("stub")
+
+	fc := &config.FileConfig{}
+	fc.AuthToken = "secret://stub/token"
+	fc.Proxy.KeyFile = "secret://stub/proxy/key"
+	conf := service.MakeDefaultConfig()
+	conf.DataDir = c.MkDir()
+	c.Assert(applyFileConfig(fc, conf), check.IsNil)
+	c.Assert(conf.Auth.Token, check.Equals, "xxx-token")
+	c.Assert(conf.SSH.Token, check.Equals, "xxx-token")
+
+	// file secrets are not fetched while the config is parsed
+	c.Assert(conf.Proxy.TLSKey, check.Equals, "secret://stub/proxy/key")
+	files, err := ioutil.ReadDir(conf.DataDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 0)
+
+	// they are saved in the data dir on start
+	c.Assert(writeSecretFiles(conf), check.IsNil)
+	c.Assert(filepath.Dir(conf.Proxy.TLSKey), check.Equals, conf.DataDir)
+	data, err := ioutil.ReadFile(conf.Proxy.TLSKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "key-data")
+	c.Assert(conf.Proxy.TLSCert, check.Equals, "")
+
+	fc = &config.FileConfig{}
+	fc.AuthToken = "secret://stub/missing"
+	err = applyFileConfig(fc, service.MakeDefaultConfig())
+	c.Assert(teleport.IsNotFound(err), check.Equals, true)
+
+	// --token flag is resolved too
+	cfg, err := configure(&CommandLineFlags{AuthToken: "secret://stub/token", Roles: "node"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cfg.SSH.Token, check.Equals, "xxx-token")
+}
+
 func (s *MainTestSuite) TestLabelParsing(c *check.C) {
 	var conf service.SSHConfig
 	var err error
@@ -184,11 +2086,11 @@ teleport:
 
 auth_service:
   enabled: yes
-  listen_addr: tcp://auth
+  listen_addr: auth
 
 ssh_service:
   enabled: no
-  listen_addr: tcp://ssh
+  listen_addr: ssh
   labels:
     name: mondoserver
     role: slave